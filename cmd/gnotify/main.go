@@ -4,10 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	// embed tz database since runtime image lacks it
+	_ "time/tzdata"
 
 	"github.com/go-chi/chi"
 	"github.com/jessevdk/go-flags"
@@ -15,9 +21,17 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/vliubezny/gnotify/internal/auth"
+	"github.com/vliubezny/gnotify/internal/dispatch"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/render"
+	"github.com/vliubezny/gnotify/internal/sender"
 	"github.com/vliubezny/gnotify/internal/server/graphql"
 	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/storage"
+	"github.com/vliubezny/gnotify/internal/storage/boltdb"
+	"github.com/vliubezny/gnotify/internal/storage/memory"
 	"github.com/vliubezny/gnotify/internal/storage/mongodb"
+	"github.com/vliubezny/gnotify/internal/storage/postgres"
 )
 
 var errTerminated = errors.New("terminated")
@@ -30,8 +44,54 @@ var opts = struct {
 
 	SignKey string `long:"auth.signkey" env:"AUTH_SIGN_KEY" default:"changeme" description:"sign key for JWT"`
 
+	Storage     string `long:"storage" env:"STORAGE" default:"mongodb" description:"storage backend" choice:"mongodb" choice:"postgres" choice:"bolt" choice:"memory"`
+	StoragePath string `long:"storage.path" env:"STORAGE_PATH" default:"gnotify.db" description:"database file of bolt storage"`
+
 	MongoDBURI  string `long:"mongodb.uri" env:"MONGODB_URI" default:"mongodb://localhost:27017"`
 	MongoDBName string `long:"mongodb.name" env:"MONGODB_NAME" default:"gnotify"`
+
+	PostgresDSN string `long:"postgres.dsn" env:"POSTGRES_DSN" default:"postgres://localhost:5432/gnotify?sslmode=disable"`
+
+	DigestInterval  time.Duration `long:"digest.interval" env:"DIGEST_INTERVAL" default:"1m" description:"how often pending digests are checked"`
+	EventKeyTTL     time.Duration `long:"events.keyttl" env:"EVENTS_KEY_TTL" default:"24h" description:"how long event idempotency keys are kept, retries within it are not dispatched again"`
+	EventPoll       time.Duration `long:"events.poll" env:"EVENTS_POLL" default:"1s" description:"how often idle queue checks storage for accepted events"`
+	EventVisibility time.Duration `long:"events.visibility" env:"EVENTS_VISIBILITY" default:"5m" description:"max duration of event dispatch, event of crashed instance is dispatched after it"`
+
+	NotificationTemplates string `long:"notification.templates" env:"NOTIFICATION_TEMPLATES" default:"static/templates/notifications" description:"directory with notification templates named after languages"`
+	NotificationFallback  string `long:"notification.fallback" env:"NOTIFICATION_FALLBACK" default:"en" description:"language of notifications missing for user language"`
+	NotificationCurrency  string `long:"notification.currency" env:"NOTIFICATION_CURRENCY" default:"USD" description:"ISO 4217 currency code of event prices"`
+
+	OutboxWorkers    int           `long:"outbox.workers" env:"OUTBOX_WORKERS" default:"4" description:"number of deliveries sent concurrently"`
+	OutboxPoll       time.Duration `long:"outbox.poll" env:"OUTBOX_POLL" default:"1s" description:"how often idle workers check outbox for due deliveries"`
+	OutboxVisibility time.Duration `long:"outbox.visibility" env:"OUTBOX_VISIBILITY" default:"5m" description:"max duration of delivery attempt, delivery of crashed worker is retried after it"`
+	OutboxAttempts   int           `long:"outbox.attempts" env:"OUTBOX_ATTEMPTS" default:"8" description:"max number of delivery attempts before delivery is dead"`
+	OutboxBackoff    time.Duration `long:"outbox.backoff" env:"OUTBOX_BACKOFF" default:"30s" description:"delay before the first delivery retry, doubled on every next retry"`
+	OutboxMaxBackoff time.Duration `long:"outbox.maxbackoff" env:"OUTBOX_MAX_BACKOFF" default:"1h" description:"max delay between delivery retries"`
+
+	VAPIDPrivateKey string        `long:"webpush.vapid.privatekey" env:"WEBPUSH_VAPID_PRIVATE_KEY" description:"base64url encoded VAPID private key, web push is disabled if empty"`
+	VAPIDSubject    string        `long:"webpush.vapid.subject" env:"WEBPUSH_VAPID_SUBJECT" default:"mailto:admin@localhost" description:"mailto: or https: contact URI sent to push services"`
+	WebPushTTL      time.Duration `long:"webpush.ttl" env:"WEBPUSH_TTL" default:"24h" description:"how long push services keep undelivered messages"`
+
+	SMTPAddr       string        `long:"email.smtp.addr" env:"EMAIL_SMTP_ADDR" description:"host:port of SMTP relay, email is disabled if empty"`
+	SMTPUsername   string        `long:"email.smtp.username" env:"EMAIL_SMTP_USERNAME" description:"SMTP username, authentication is skipped if empty"`
+	SMTPPassword   string        `long:"email.smtp.password" env:"EMAIL_SMTP_PASSWORD" description:"SMTP password"`
+	SMTPAllowPlain bool          `long:"email.smtp.allowplain" env:"EMAIL_SMTP_ALLOW_PLAIN" description:"allow relays without STARTTLS"`
+	SMTPTimeout    time.Duration `long:"email.smtp.timeout" env:"EMAIL_SMTP_TIMEOUT" default:"30s" description:"max duration of SMTP session"`
+	EmailFrom      string        `long:"email.from" env:"EMAIL_FROM" default:"gnotify <noreply@localhost>" description:"sender address of emails"`
+	EmailTemplates string        `long:"email.templates" env:"EMAIL_TEMPLATES" default:"static/templates" description:"directory with email templates"`
+
+	FCMCredentials string `long:"fcm.credentials" env:"FCM_CREDENTIALS" description:"service account JSON key file, FCM is disabled if empty"`
+	FCMBaseURL     string `long:"fcm.baseurl" env:"FCM_BASE_URL" default:"https://fcm.googleapis.com" description:"FCM API URL"`
+
+	APNsKey     string `long:"apns.key" env:"APNS_KEY" description:"APNs authentication key file (.p8), APNs is disabled if empty"`
+	APNsKeyID   string `long:"apns.keyid" env:"APNS_KEY_ID" description:"ID of APNs authentication key"`
+	APNsTeamID  string `long:"apns.teamid" env:"APNS_TEAM_ID" description:"Apple developer team ID"`
+	APNsTopic   string `long:"apns.topic" env:"APNS_TOPIC" description:"bundle ID of the app"`
+	APNsBaseURL string `long:"apns.baseurl" env:"APNS_BASE_URL" default:"https://api.push.apple.com" description:"APNs URL, use https://api.sandbox.push.apple.com for development builds"`
+
+	WebhookTimeout time.Duration `long:"webhook.timeout" env:"WEBHOOK_TIMEOUT" default:"10s" description:"timeout of a single webhook request"`
+
+	LogSender bool `long:"sender.log" env:"SENDER_LOG" description:"log messages to devices without configured sender instead of failing their deliveries, e.g. for local runs"`
 }{}
 
 func main() {
@@ -42,6 +102,11 @@ func main() {
 	parser := flags.NewParser(&opts, flags.Default)
 	parser.Name = "gnotify"
 	parser.LongDescription = "Starts gnotify server."
+	parser.SubcommandsOptional = true
+
+	if err := addMigrateCommands(parser); err != nil {
+		logrus.WithError(err).Fatal("failed to setup commands")
+	}
 
 	if _, err := parser.Parse(); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
@@ -53,20 +118,56 @@ func main() {
 	lvl, _ := logrus.ParseLevel(opts.LogLevel)
 	logrus.SetLevel(lvl)
 
+	if cmd := parser.Active; cmd != nil && cmd.Name == "migrate" {
+		if err := runMigrate(cmd.Active.Name); err != nil {
+			logrus.WithError(err).Fatalf("failed to migrate %s", cmd.Active.Name)
+		}
+		return
+	}
+
 	logrus.Info("starting service")
-	logrus.Infof("%+v", opts) // can print secrets!
+	logrus.Infof("%+v", redactedOpts())
 
-	stg, err := mongodb.New(opts.MongoDBURI, opts.MongoDBName)
+	stg, err := newStorage()
 	if err != nil {
 		logrus.WithError(err).Fatal("failed to setup storage")
 	}
 
 	svc := service.New(stg)
+	snd, err := newSender()
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to setup sender")
+	}
+	workers := dispatch.NewWorkers(svc, snd, dispatch.WorkerConfig{
+		Workers:           opts.OutboxWorkers,
+		PollInterval:      opts.OutboxPoll,
+		VisibilityTimeout: opts.OutboxVisibility,
+		MaxAttempts:       opts.OutboxAttempts,
+		Backoff:           opts.OutboxBackoff,
+		MaxBackoff:        opts.OutboxMaxBackoff,
+	})
+
+	rnd, err := render.New(render.Config{
+		Dir:      opts.NotificationTemplates,
+		Fallback: opts.NotificationFallback,
+		Currency: opts.NotificationCurrency,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to setup renderer")
+	}
+
+	// messages are persisted to outbox and sent by workers
+	outbox := dispatch.NewOutbox(svc)
+	scheduler := dispatch.NewScheduler(svc, outbox, rnd)
+	queue := dispatch.NewQueue(svc, dispatch.New(svc, outbox, rnd), dispatch.QueueConfig{
+		PollInterval:      opts.EventPoll,
+		VisibilityTimeout: opts.EventVisibility,
+	})
 
 	r := chi.NewMux()
 	a := auth.New(opts.SignKey)
 
-	if err := graphql.SetupRouter(r, a, svc); err != nil {
+	if err := graphql.SetupRouter(r, a, svc, opts.EventKeyTTL); err != nil {
 		logrus.WithError(err).Fatal("failed to setup graphql")
 	}
 
@@ -75,9 +176,24 @@ func main() {
 		Handler: r,
 	}
 
-	gr, _ := errgroup.WithContext(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gr, _ := errgroup.WithContext(ctx)
 	gr.Go(srv.ListenAndServe)
 
+	gr.Go(func() error {
+		return scheduler.Run(ctx, opts.DigestInterval)
+	})
+
+	gr.Go(func() error {
+		return queue.Run(ctx)
+	})
+
+	gr.Go(func() error {
+		return workers.Run(ctx)
+	})
+
 	gr.Go(func() error {
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -85,10 +201,13 @@ func main() {
 		s := <-sigs
 		logrus.Infof("terminating by %s signal", s)
 
+		// server is stopped first, so in-flight requests finish saving their events
 		if err := srv.Shutdown(context.Background()); err != nil {
 			logrus.WithError(err).Error("failed to gracefully shutdown server")
 		}
 
+		cancel()
+
 		return errTerminated
 	})
 
@@ -98,3 +217,133 @@ func main() {
 		logrus.WithError(err).Fatal("service unexpectedly stopped")
 	}
 }
+
+func newStorage() (storage.Storage, error) {
+	switch opts.Storage {
+	case "postgres":
+		return postgres.New(opts.PostgresDSN)
+	case "bolt":
+		return boltdb.New(opts.StoragePath)
+	case "memory":
+		logrus.Warn("using in-memory storage, data will be lost on restart")
+		return memory.New(), nil
+	default:
+		return mongodb.New(opts.MongoDBURI, opts.MongoDBName)
+	}
+}
+
+// redactedOpts returns copy of options with secrets masked, so it can be logged.
+func redactedOpts() interface{} {
+	o := opts
+
+	for _, secret := range []*string{&o.SignKey, &o.SMTPPassword, &o.VAPIDPrivateKey} {
+		if *secret != "" {
+			*secret = "xxxxx"
+		}
+	}
+
+	for _, uri := range []*string{&o.MongoDBURI, &o.PostgresDSN} {
+		if u, err := url.Parse(*uri); err == nil {
+			*uri = u.Redacted()
+		}
+	}
+
+	return o
+}
+
+// newSender creates sender for configured device types.
+// Messages to devices of other types are logged if log sender is enabled, otherwise they fail permanently.
+func newSender() (sender.Sender, error) {
+	senders := make(map[string]sender.Sender)
+
+	if opts.VAPIDPrivateKey != "" {
+		webPush, err := sender.NewWebPush(sender.WebPushConfig{
+			PrivateKey: opts.VAPIDPrivateKey,
+			Subject:    opts.VAPIDSubject,
+			TTL:        opts.WebPushTTL,
+			Client:     &http.Client{Timeout: 30 * time.Second},
+		})
+		if err != nil {
+			return nil, err
+		}
+		senders[model.DeviceWebPush] = webPush
+
+		publicKey, _ := sender.VAPIDPublicKey(opts.VAPIDPrivateKey)
+		logrus.Infof("web push is enabled, VAPID public key %s", publicKey)
+	}
+
+	if opts.SMTPAddr != "" {
+		email, err := sender.NewEmail(sender.EmailConfig{
+			Addr:        opts.SMTPAddr,
+			Username:    opts.SMTPUsername,
+			Password:    opts.SMTPPassword,
+			From:        opts.EmailFrom,
+			TemplateDir: opts.EmailTemplates,
+			AllowPlain:  opts.SMTPAllowPlain,
+			Timeout:     opts.SMTPTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		senders[model.DeviceEmail] = email
+
+		logrus.Infof("email is enabled, relay %s", opts.SMTPAddr)
+	}
+
+	if opts.FCMCredentials != "" {
+		credentials, err := ioutil.ReadFile(opts.FCMCredentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+		}
+
+		fcm, err := sender.NewFCM(sender.FCMConfig{
+			Credentials: credentials,
+			BaseURL:     opts.FCMBaseURL,
+			Client:      &http.Client{Timeout: 30 * time.Second},
+		})
+		if err != nil {
+			return nil, err
+		}
+		senders[model.DeviceFCM] = fcm
+
+		logrus.Info("FCM is enabled")
+	}
+
+	if opts.APNsKey != "" {
+		key, err := ioutil.ReadFile(opts.APNsKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read APNs key: %w", err)
+		}
+
+		apns, err := sender.NewAPNs(sender.APNsConfig{
+			KeyID:      opts.APNsKeyID,
+			TeamID:     opts.APNsTeamID,
+			PrivateKey: key,
+			Topic:      opts.APNsTopic,
+			BaseURL:    opts.APNsBaseURL,
+			Client:     &http.Client{Timeout: 30 * time.Second},
+		})
+		if err != nil {
+			return nil, err
+		}
+		senders[model.DeviceAPNs] = apns
+
+		logrus.Infof("APNs is enabled, topic %s", opts.APNsTopic)
+	}
+
+	// failed requests are retried by outbox workers with delivery backoff,
+	// retries inside sender would hold delivery lease and multiply attempts
+	senders[model.DeviceWebhook] = sender.NewWebhook(sender.WebhookConfig{
+		Timeout:     opts.WebhookTimeout,
+		MaxAttempts: 1,
+	})
+
+	var fallback sender.Sender
+	if opts.LogSender {
+		fallback = sender.NewLog(logrus.StandardLogger())
+
+		logrus.Warn("messages to devices without configured sender are logged instead of delivered")
+	}
+
+	return sender.NewRouter(senders, fallback), nil
+}
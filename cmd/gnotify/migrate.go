@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/storage/mongodb"
+)
+
+// migrateTimeout limits time of single migrate command.
+const migrateTimeout = 10 * time.Minute
+
+func addMigrateCommands(parser *flags.Parser) error {
+	migrate, err := parser.AddCommand("migrate", "Manage mongodb schema",
+		"Applies, reverts or shows mongodb schema migrations.", &struct{}{})
+	if err != nil {
+		return err
+	}
+
+	commands := []struct {
+		name, description string
+	}{
+		{"up", "Apply pending migrations"},
+		{"down", "Revert the last applied migration"},
+		{"status", "Show migrations status"},
+	}
+
+	for _, c := range commands {
+		if _, err := migrate.AddCommand(c.name, c.description, c.description+".", &struct{}{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runMigrate(command string) error {
+	if opts.Storage != "mongodb" {
+		return fmt.Errorf("migrate command is not supported by %s storage", opts.Storage)
+	}
+
+	m, err := mongodb.NewMigrator(opts.MongoDBURI, opts.MongoDBName)
+	if err != nil {
+		return fmt.Errorf("failed to connect to mongodb: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	defer m.Close(ctx)
+
+	switch command {
+	case "up":
+		return m.Up(ctx)
+	case "down":
+		return m.Down(ctx)
+	default:
+		ss, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		printStatus(ss)
+		return nil
+	}
+}
+
+func printStatus(ss []mongodb.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT")
+
+	for _, s := range ss {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Description, applied)
+	}
+
+	if err := w.Flush(); err != nil {
+		logrus.WithError(err).Error("failed to print status")
+	}
+}
@@ -0,0 +1,209 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/render"
+	"github.com/vliubezny/gnotify/internal/sender"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+// Scheduler flushes buffered digests on device cadence.
+type Scheduler struct {
+	svc      service.Service
+	sender   sender.Sender
+	renderer render.Renderer
+	now      func() time.Time
+}
+
+// NewScheduler creates digest scheduler. Digests are rendered in recipient language.
+func NewScheduler(svc service.Service, s sender.Sender, r render.Renderer) *Scheduler {
+	return &Scheduler{
+		svc:      svc,
+		sender:   s,
+		renderer: r,
+		now:      time.Now,
+	}
+}
+
+// Run flushes due digests every interval until context is canceled.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := s.Flush(ctx); err != nil {
+			logrus.WithError(err).Error("failed to flush digests")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// Flush sends every digest whose delivery time has come and which is outside of user quiet hours.
+// Events of digests failed to send are put back unless the failure is permanent.
+func (s *Scheduler) Flush(ctx context.Context) error {
+	digests, err := s.svc.GetDigests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to flush digests: %w", err)
+	}
+
+	now := s.now()
+	users := make(map[int64]model.User)
+
+	for _, dg := range digests {
+		u, ok := users[dg.UserID]
+		if !ok {
+			u, err = s.svc.GetUser(ctx, dg.UserID)
+			if err != nil && !errors.Is(err, service.ErrNotFound) {
+				return fmt.Errorf("failed to flush digests: %w", err)
+			}
+			users[dg.UserID] = u
+		}
+
+		dev, ok := findDevice(u, dg.DeviceID)
+		ok = ok && !dev.Disabled
+		frequency, events := pending(dev.Settings, dg.Events)
+		// cadence follows user time zone, deliveries are deferred till quiet hours end
+		if ok && len(events) > 0 && (!due(dg.CreatedAt.In(location(u)), frequency, now) || inQuietHours(u, now)) {
+			continue
+		}
+
+		dg, err := s.svc.PopDigest(ctx, dg.UserID, dg.DeviceID)
+		if err != nil {
+			if errors.Is(err, service.ErrNotFound) {
+				continue
+			}
+			return fmt.Errorf("failed to flush digests: %w", err)
+		}
+
+		// digests of removed or disabled devices and events devices opted out of are dropped
+		_, events = pending(dev.Settings, dg.Events)
+		if !ok || len(events) == 0 {
+			continue
+		}
+
+		title, body := s.renderer.RenderDigest(u.Language, events)
+		msg := model.Message{
+			UserID: dg.UserID,
+			Device: dev,
+			Title:  title,
+			Body:   body,
+			Events: events,
+		}
+
+		if err := s.sender.Send(ctx, msg); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"userID":   dg.UserID,
+				"deviceID": dg.DeviceID,
+			}).Error("failed to send digest")
+			disableGone(ctx, s.svc, dg.UserID, dg.DeviceID, err)
+			s.restore(ctx, dg.UserID, dg.DeviceID, events, err)
+		}
+	}
+
+	return nil
+}
+
+// restore appends events of digest which failed to send back to the device digest,
+// so they are retried on the next flush. Events are dropped if retry can't succeed.
+func (s *Scheduler) restore(ctx context.Context, userID int64, deviceID string, events []model.Event, err error) {
+	if errors.Is(err, sender.ErrGone) || errors.Is(err, sender.ErrPermanent) {
+		return
+	}
+
+	for _, e := range events {
+		if err := s.svc.AddToDigest(ctx, userID, deviceID, e); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"userID":   userID,
+				"deviceID": deviceID,
+			}).Error("failed to restore digest")
+			return
+		}
+	}
+}
+
+func findDevice(u model.User, id string) (model.Device, bool) {
+	for _, d := range u.Devices {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return model.Device{}, false
+}
+
+// pending returns digest events device still wants and the most frequent cadence among their preferences.
+func pending(s model.NotificationSettings, events []model.Event) (frequency string, wanted []model.Event) {
+	for _, e := range events {
+		p := s.Preferences[e.Type]
+		if !s.Wants(e.Type) || p.Channel == model.ChannelInbox {
+			continue
+		}
+
+		if len(wanted) == 0 || cadence(p.Frequency) < cadence(frequency) {
+			frequency = p.Frequency
+		}
+		wanted = append(wanted, e)
+	}
+
+	return frequency, wanted
+}
+
+// cadence orders frequencies from the most to the least frequent.
+func cadence(frequency string) int {
+	switch frequency {
+	case model.Hourly:
+		return 1
+	case model.Daily:
+		return 2
+	case model.Weekly:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// due reports whether digest started at given time must be delivered now.
+// Digests are delivered at the start of the next hour, day or week (Monday).
+func due(createdAt time.Time, frequency string, now time.Time) bool {
+	return !now.Before(nextDelivery(createdAt, frequency))
+}
+
+func nextDelivery(t time.Time, frequency string) time.Time {
+	y, m, d := t.Date()
+
+	switch frequency {
+	case model.Hourly:
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+	case model.Daily:
+		return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	case model.Weekly:
+		days := (8 - int(t.Weekday())) % 7
+		if days == 0 {
+			days = 7
+		}
+		return time.Date(y, m, d+days, 0, 0, 0, 0, t.Location())
+	default:
+		return t
+	}
+}
+
+// isDigest reports whether devices with given frequency receive digests.
+func isDigest(frequency string) bool {
+	switch frequency {
+	case model.Hourly, model.Daily, model.Weekly:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,401 @@
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/sender"
+	senderMock "github.com/vliubezny/gnotify/internal/sender/mock"
+	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+func Test_nextDelivery(t *testing.T) {
+	// Wednesday
+	createdAt := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc      string
+		frequency string
+		createdAt time.Time
+		next      time.Time
+	}{
+		{
+			desc:      "hourly",
+			frequency: model.Hourly,
+			createdAt: createdAt,
+			next:      time.Date(2021, time.April, 7, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "hourly at midnight",
+			frequency: model.Hourly,
+			createdAt: time.Date(2021, time.April, 7, 23, 59, 0, 0, time.UTC),
+			next:      time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "daily",
+			frequency: model.Daily,
+			createdAt: createdAt,
+			next:      time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "weekly",
+			frequency: model.Weekly,
+			createdAt: createdAt,
+			next:      time.Date(2021, time.April, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "weekly on Sunday",
+			frequency: model.Weekly,
+			createdAt: time.Date(2021, time.April, 11, 10, 0, 0, 0, time.UTC),
+			next:      time.Date(2021, time.April, 12, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			desc:      "weekly on Monday",
+			frequency: model.Weekly,
+			createdAt: time.Date(2021, time.April, 12, 0, 0, 0, 0, time.UTC),
+			next:      time.Date(2021, time.April, 19, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.next, nextDelivery(tc.createdAt, tc.frequency))
+		})
+	}
+}
+
+func TestScheduler_Flush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	hourly := model.Device{
+		ID:       "1",
+		Name:     "Chrome",
+		Settings: priceChanged(true, model.Hourly, model.ChannelDevice),
+	}
+	daily := model.Device{
+		ID:       "2",
+		Name:     "Firefox",
+		Settings: priceChanged(true, model.Daily, model.ChannelDevice),
+	}
+	never := model.Device{
+		ID:       "3",
+		Name:     "Edge",
+		Settings: priceChanged(true, model.Never, model.ChannelDevice),
+	}
+	disabled := model.Device{
+		ID:       "6",
+		Name:     "Opera",
+		Disabled: true,
+		Settings: priceChanged(true, model.Hourly, model.ChannelDevice),
+	}
+
+	events := []model.Event{
+		{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100, CreatedAt: now},
+		{Type: model.PriceChanged, ProductID: 2, OldPrice: 300, NewPrice: 250, CreatedAt: now},
+	}
+
+	digests := []model.Digest{
+		{UserID: 1, DeviceID: hourly.ID, Events: events, CreatedAt: now},
+		{UserID: 1, DeviceID: daily.ID, Events: events, CreatedAt: now},
+		{UserID: 1, DeviceID: never.ID, Events: events, CreatedAt: now},
+		{UserID: 1, DeviceID: "removed", Events: events, CreatedAt: now},
+		{UserID: 2, DeviceID: "5", Events: events, CreatedAt: now},
+		{UserID: 1, DeviceID: disabled.ID, Events: events, CreatedAt: now},
+	}
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().GetDigests(ctx).Return(digests, nil)
+	svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{hourly, daily, never, disabled}}, nil)
+	svc.EXPECT().GetUser(ctx, int64(2)).Return(model.User{}, service.ErrNotFound)
+	svc.EXPECT().PopDigest(ctx, int64(1), hourly.ID).Return(digests[0], nil)
+	svc.EXPECT().PopDigest(ctx, int64(1), never.ID).Return(digests[2], nil)
+	svc.EXPECT().PopDigest(ctx, int64(1), "removed").Return(digests[3], nil)
+	svc.EXPECT().PopDigest(ctx, int64(2), "5").Return(model.Digest{}, service.ErrNotFound)
+	svc.EXPECT().PopDigest(ctx, int64(1), disabled.ID).Return(digests[5], nil)
+
+	s := sender.NewMemory()
+	sch := NewScheduler(svc, s, newRenderer(t))
+	sch.now = func() time.Time { return now.Add(time.Hour) }
+
+	require.NoError(t, sch.Flush(ctx))
+
+	assert.Equal(t, []model.Message{
+		{
+			UserID: 1,
+			Device: hourly,
+			Title:  "2 updates",
+			Body:   "Product 1 price changed from $ 2.00 to $ 1.00\nProduct 2 price changed from $ 3.00 to $ 2.50",
+			Events: events,
+		},
+	}, s.Messages())
+}
+
+func TestScheduler_Flush_userTime(t *testing.T) {
+	daily := model.Device{
+		ID:       "1",
+		Name:     "Chrome",
+		Settings: priceChanged(true, model.Daily, model.ChannelDevice),
+	}
+
+	// Wednesday, 13:30 in Minsk
+	createdAt := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	events := []model.Event{{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100, CreatedAt: createdAt}}
+	digest := model.Digest{UserID: 1, DeviceID: daily.ID, Events: events, CreatedAt: createdAt}
+
+	// from 23:00 till 07:00
+	night := []model.QuietHours{{Start: 23 * 60, End: 7 * 60}}
+
+	testCases := []struct {
+		desc string
+		user model.User
+		now  time.Time
+		sent bool
+	}{
+		{
+			desc: "UTC before midnight",
+			user: model.User{ID: 1, Devices: []model.Device{daily}},
+			now:  time.Date(2021, time.April, 7, 21, 0, 0, 0, time.UTC),
+			sent: false,
+		},
+		{
+			desc: "UTC midnight",
+			user: model.User{ID: 1, Devices: []model.Device{daily}},
+			now:  time.Date(2021, time.April, 8, 0, 0, 0, 0, time.UTC),
+			sent: true,
+		},
+		{
+			desc: "user midnight",
+			user: model.User{ID: 1, TimeZone: "Europe/Minsk", Devices: []model.Device{daily}},
+			now:  time.Date(2021, time.April, 7, 21, 0, 0, 0, time.UTC),
+			sent: true,
+		},
+		{
+			desc: "deferred in quiet hours",
+			user: model.User{ID: 1, TimeZone: "Europe/Minsk", QuietHours: night, Devices: []model.Device{daily}},
+			now:  time.Date(2021, time.April, 7, 21, 0, 0, 0, time.UTC),
+			sent: false,
+		},
+		{
+			desc: "quiet hours end",
+			user: model.User{ID: 1, TimeZone: "Europe/Minsk", QuietHours: night, Devices: []model.Device{daily}},
+			now:  time.Date(2021, time.April, 8, 4, 0, 0, 0, time.UTC),
+			sent: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			svc.EXPECT().GetDigests(ctx).Return([]model.Digest{digest}, nil)
+			svc.EXPECT().GetUser(ctx, int64(1)).Return(tc.user, nil)
+			if tc.sent {
+				svc.EXPECT().PopDigest(ctx, int64(1), daily.ID).Return(digest, nil)
+			}
+
+			s := sender.NewMemory()
+			sch := NewScheduler(svc, s, newRenderer(t))
+			sch.now = func() time.Time { return tc.now }
+
+			require.NoError(t, sch.Flush(ctx))
+
+			assert.Equal(t, tc.sent, len(s.Messages()) == 1)
+		})
+	}
+}
+
+func TestScheduler_Flush_sendError(t *testing.T) {
+	hourly := model.Device{
+		ID:       "1",
+		Name:     "Chrome",
+		Settings: priceChanged(true, model.Hourly, model.ChannelDevice),
+	}
+
+	events := []model.Event{
+		{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100, CreatedAt: now},
+		{Type: model.PriceChanged, ProductID: 2, OldPrice: 300, NewPrice: 250, CreatedAt: now},
+	}
+	digest := model.Digest{UserID: 1, DeviceID: hourly.ID, Events: events, CreatedAt: now}
+
+	testCases := []struct {
+		desc     string
+		err      error
+		restored bool
+	}{
+		{
+			desc:     "temporary failure",
+			err:      assert.AnError,
+			restored: true,
+		},
+		{
+			desc:     "permanent failure",
+			err:      fmt.Errorf("%w: bad request", sender.ErrPermanent),
+			restored: false,
+		},
+		{
+			desc:     "gone",
+			err:      fmt.Errorf("%w: unsubscribed", sender.ErrGone),
+			restored: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			svc.EXPECT().GetDigests(ctx).Return([]model.Digest{digest}, nil)
+			svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{hourly}}, nil)
+			svc.EXPECT().PopDigest(ctx, int64(1), hourly.ID).Return(digest, nil)
+			if tc.restored {
+				gomock.InOrder(
+					svc.EXPECT().AddToDigest(ctx, int64(1), hourly.ID, events[0]).Return(nil),
+					svc.EXPECT().AddToDigest(ctx, int64(1), hourly.ID, events[1]).Return(nil),
+				)
+			}
+			if errors.Is(tc.err, sender.ErrGone) {
+				svc.EXPECT().DisableDevice(ctx, int64(1), hourly.ID).Return(nil)
+			}
+
+			s := senderMock.NewMockSender(ctrl)
+			s.EXPECT().Send(ctx, gomock.Any()).Return(tc.err)
+
+			sch := NewScheduler(svc, s, newRenderer(t))
+			sch.now = func() time.Time { return now.Add(time.Hour) }
+
+			require.NoError(t, sch.Flush(ctx))
+		})
+	}
+}
+
+func TestScheduler_Flush_error(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().GetDigests(ctx).Return(nil, assert.AnError)
+
+	err := NewScheduler(svc, sender.NewMemory(), newRenderer(t)).Flush(ctx)
+	assert.True(t, errors.Is(err, assert.AnError), fmt.Sprintf("wanted %s got %s", assert.AnError, err))
+}
+
+func Test_pending(t *testing.T) {
+	price := model.Event{Type: model.PriceChanged, ProductID: 1}
+	wishlist := model.Event{Type: model.Wishlist, ProductID: 2}
+	promotion := model.Event{Type: model.Promotion}
+
+	settings := model.NotificationSettings{Preferences: map[string]model.Preference{
+		model.PriceChanged: {Enabled: true, Frequency: model.Weekly, Channel: model.ChannelDevice},
+		model.Wishlist:     {Enabled: true, Frequency: model.Hourly, Channel: model.ChannelDevice},
+		model.Promotion:    {Enabled: false, Frequency: model.Hourly, Channel: model.ChannelDevice},
+		model.BackInStock:  {Enabled: true, Frequency: model.Hourly, Channel: model.ChannelInbox},
+	}}
+
+	testCases := []struct {
+		desc      string
+		events    []model.Event
+		frequency string
+		wanted    []model.Event
+	}{
+		{
+			desc:      "single type",
+			events:    []model.Event{price},
+			frequency: model.Weekly,
+			wanted:    []model.Event{price},
+		},
+		{
+			desc:      "most frequent cadence wins",
+			events:    []model.Event{price, wishlist},
+			frequency: model.Hourly,
+			wanted:    []model.Event{price, wishlist},
+		},
+		{
+			desc:      "drop opted out events",
+			events:    []model.Event{promotion, price, {Type: model.BackInStock}},
+			frequency: model.Weekly,
+			wanted:    []model.Event{price},
+		},
+		{
+			desc:   "nothing wanted",
+			events: []model.Event{promotion},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			frequency, wanted := pending(settings, tc.events)
+			assert.Equal(t, tc.frequency, frequency)
+			assert.Equal(t, tc.wanted, wanted)
+		})
+	}
+}
+
+func Test_inQuietHours(t *testing.T) {
+	minsk := model.User{
+		TimeZone:   "Europe/Minsk",
+		QuietHours: []model.QuietHours{{Start: 23 * 60, End: 7 * 60}, {Start: 13 * 60, End: 14 * 60}},
+	}
+
+	testCases := []struct {
+		desc  string
+		user  model.User
+		t     time.Time
+		quiet bool
+	}{
+		{
+			desc:  "no quiet hours",
+			user:  model.User{TimeZone: "Europe/Minsk"},
+			t:     time.Date(2021, time.April, 7, 21, 0, 0, 0, time.UTC),
+			quiet: false,
+		},
+		{
+			desc:  "before midnight period",
+			user:  minsk,
+			t:     time.Date(2021, time.April, 7, 19, 59, 0, 0, time.UTC),
+			quiet: false,
+		},
+		{
+			desc:  "period start",
+			user:  minsk,
+			t:     time.Date(2021, time.April, 7, 20, 0, 0, 0, time.UTC),
+			quiet: true,
+		},
+		{
+			desc:  "after midnight",
+			user:  minsk,
+			t:     time.Date(2021, time.April, 8, 2, 0, 0, 0, time.UTC),
+			quiet: true,
+		},
+		{
+			desc:  "period end",
+			user:  minsk,
+			t:     time.Date(2021, time.April, 8, 4, 0, 0, 0, time.UTC),
+			quiet: false,
+		},
+		{
+			desc:  "day period",
+			user:  minsk,
+			t:     time.Date(2021, time.April, 8, 10, 30, 0, 0, time.UTC),
+			quiet: true,
+		},
+		{
+			desc:  "UTC by default",
+			user:  model.User{QuietHours: minsk.QuietHours},
+			t:     time.Date(2021, time.April, 7, 20, 0, 0, 0, time.UTC),
+			quiet: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.quiet, inQuietHours(tc.user, tc.t))
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/render"
+	"github.com/vliubezny/gnotify/internal/sender"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+//go:generate mockgen -destination=./mock/mock.go -package=mock -source=dispatch.go
+
+// usersPageSize is number of users loaded at once for broadcast events.
+const usersPageSize = 100
+
+// ErrUnknownEvent states that event type is not supported.
+var ErrUnknownEvent = errors.New("unknown event")
+
+// Dispatcher delivers events to user devices according to their notification settings.
+type Dispatcher interface {
+	// Dispatch sends event to every device that opted into it.
+	Dispatch(ctx context.Context, e model.Event) error
+}
+
+type dispatcher struct {
+	svc      service.Service
+	sender   sender.Sender
+	renderer render.Renderer
+	now      func() time.Time
+}
+
+// New creates dispatcher. Messages are rendered in recipient language.
+func New(svc service.Service, s sender.Sender, r render.Renderer) Dispatcher {
+	return &dispatcher{
+		svc:      svc,
+		sender:   s,
+		renderer: r,
+		now:      time.Now,
+	}
+}
+
+func (d *dispatcher) Dispatch(ctx context.Context, e model.Event) error {
+	if !isEventType(e.Type) {
+		return fmt.Errorf("%w: %s", ErrUnknownEvent, e.Type)
+	}
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = d.now()
+	}
+
+	total, failed := 0, 0
+	err := d.eachRecipient(ctx, e, func(u model.User) {
+		t, f := d.notify(ctx, u, e)
+		total, failed = total+t, failed+f
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dispatch event: %w", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to deliver %d of %d messages", failed, total)
+	}
+
+	return nil
+}
+
+// notify delivers event to user devices and inbox and returns number of total and failed deliveries.
+func (d *dispatcher) notify(ctx context.Context, u model.User, e model.Event) (total, failed int) {
+	if !wants(u, e.Type) {
+		return 0, 0
+	}
+
+	title, body := d.renderer.Render(u.Language, e)
+
+	total, failed = d.deliver(ctx, u, e, title, body)
+
+	n := model.Notification{
+		UserID:    u.ID,
+		Type:      e.Type,
+		Title:     title,
+		Body:      body,
+		CreatedAt: e.CreatedAt,
+	}
+
+	if _, err := d.svc.AddNotification(ctx, n); err != nil {
+		failed++
+		logrus.WithError(err).WithField("userID", u.ID).Error("failed to add notification to inbox")
+	}
+
+	return total + 1, failed
+}
+
+// deliver sends event to user devices which opted into it and returns number of total and failed deliveries.
+func (d *dispatcher) deliver(ctx context.Context, u model.User, e model.Event, title, body string) (total, failed int) {
+	for _, dev := range u.Devices {
+		p := dev.Settings.Preferences[e.Type]
+		if dev.Disabled || !dev.Settings.Wants(e.Type) || p.Channel == model.ChannelInbox {
+			continue
+		}
+
+		total++
+		l := logrus.WithFields(logrus.Fields{
+			"userID":   u.ID,
+			"deviceID": dev.ID,
+		})
+
+		if isDigest(p.Frequency) {
+			if err := d.svc.AddToDigest(ctx, u.ID, dev.ID, e); err != nil {
+				failed++
+				l.WithError(err).Error("failed to add event to digest")
+			}
+			continue
+		}
+
+		msg := model.Message{
+			UserID: u.ID,
+			Device: dev,
+			Title:  title,
+			Body:   body,
+			Events: []model.Event{e},
+		}
+
+		if err := d.sender.Send(ctx, msg); err != nil {
+			failed++
+			l.WithError(err).Error("failed to send message")
+			disableGone(ctx, d.svc, u.ID, dev.ID, err)
+		}
+	}
+
+	return total, failed
+}
+
+// disableGone disables device if sender reported that device address expired.
+func disableGone(ctx context.Context, svc service.Service, userID int64, deviceID string, err error) {
+	if !errors.Is(err, sender.ErrGone) {
+		return
+	}
+
+	if err := svc.DisableDevice(ctx, userID, deviceID); err != nil && !errors.Is(err, service.ErrNotFound) {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"userID":   userID,
+			"deviceID": deviceID,
+		}).Error("failed to disable device")
+	}
+}
+
+// isEventType reports whether event type is supported.
+func isEventType(t string) bool {
+	for _, et := range model.EventTypes {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+// wants reports whether any user device opted into events of the given type.
+func wants(u model.User, eventType string) bool {
+	for _, dev := range u.Devices {
+		if dev.Settings.Wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// eachRecipient calls fn for every user the event is addressed to.
+// Users of broadcast events are loaded page by page.
+func (d *dispatcher) eachRecipient(ctx context.Context, e model.Event, fn func(model.User)) error {
+	if len(e.UserIDs) > 0 {
+		for _, id := range e.UserIDs {
+			u, err := d.svc.GetUser(ctx, id)
+			if err != nil {
+				if errors.Is(err, service.ErrNotFound) {
+					continue
+				}
+				return err
+			}
+			fn(u)
+		}
+		return nil
+	}
+
+	query := recipientsQuery(e)
+	for {
+		page, err := d.svc.GetUsers(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range page.Users {
+			fn(u)
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		query.After = page.NextCursor
+	}
+}
+
+// recipientsQuery selects users having devices opted into event.
+func recipientsQuery(e model.Event) model.UserQuery {
+	return model.UserQuery{
+		First:     usersPageSize,
+		EventType: e.Type,
+	}
+}
@@ -0,0 +1,365 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/render"
+	"github.com/vliubezny/gnotify/internal/sender"
+	senderMock "github.com/vliubezny/gnotify/internal/sender/mock"
+	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+var (
+	ctx    = context.Background()
+	errAny = errors.New("any error")
+
+	chrome = model.Device{
+		ID:       "1",
+		Name:     "Chrome",
+		Settings: priceChanged(true, model.Daily, model.ChannelDevice),
+	}
+	firefox = model.Device{
+		ID:       "2",
+		Name:     "Firefox",
+		Settings: priceChanged(false, model.Daily, model.ChannelDevice),
+	}
+	safari = model.Device{
+		ID:       "3",
+		Name:     "Safari",
+		Settings: priceChanged(true, "", model.ChannelDevice),
+	}
+	edge = model.Device{
+		ID:       "4",
+		Name:     "Edge",
+		Settings: priceChanged(true, model.Never, model.ChannelDevice),
+	}
+	opera = model.Device{
+		ID:       "5",
+		Name:     "Opera",
+		Settings: priceChanged(true, model.Daily, model.ChannelInbox),
+	}
+	now = time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+)
+
+// newRenderer creates renderer of shipped templates.
+func newRenderer(t *testing.T) render.Renderer {
+	r, err := render.New(render.Config{Dir: "../../static/templates/notifications"})
+	require.NoError(t, err)
+	return r
+}
+
+// priceChanged returns settings with single price changed preference.
+func priceChanged(enabled bool, frequency, channel string) model.NotificationSettings {
+	return model.NotificationSettings{Preferences: map[string]model.Preference{
+		model.PriceChanged: {Enabled: enabled, Frequency: frequency, Channel: channel},
+	}}
+}
+
+func TestDispatcher_Dispatch(t *testing.T) {
+	event := model.Event{
+		Type:      model.PriceChanged,
+		ProductID: 7,
+		OldPrice:  1099,
+		NewPrice:  999,
+		CreatedAt: now,
+	}
+
+	inboxNote := model.Notification{
+		UserID:    1,
+		Type:      model.PriceChanged,
+		Title:     "Price changed",
+		Body:      "Product 7 price changed from $ 10.99 to $ 9.99",
+		CreatedAt: now,
+	}
+
+	broadcast := model.UserQuery{First: usersPageSize, EventType: model.PriceChanged}
+
+	testCases := []struct {
+		desc     string
+		userIDs  []int64
+		prepare  func(svc *mock.MockService)
+		messages []model.Message
+		err      error
+	}{
+		{
+			desc: "broadcast to every user",
+			prepare: func(svc *mock.MockService) {
+				first := svc.EXPECT().GetUsers(ctx, broadcast).Return(model.UserPage{
+					Users:      []model.User{{ID: 1, Devices: []model.Device{chrome, firefox, safari, edge}}},
+					NextCursor: "1",
+				}, nil)
+				next := broadcast
+				next.After = "1"
+				svc.EXPECT().GetUsers(ctx, next).Return(model.UserPage{
+					Users: []model.User{{ID: 2, Devices: []model.Device{firefox}}},
+				}, nil).After(first)
+				svc.EXPECT().AddToDigest(ctx, int64(1), chrome.ID, gomock.Any()).Return(nil)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+			messages: []model.Message{
+				{
+					UserID: 1,
+					Device: safari,
+					Title:  "Price changed",
+					Body:   "Product 7 price changed from $ 10.99 to $ 9.99",
+				},
+			},
+		},
+		{
+			desc:    "send to watchers",
+			userIDs: []int64{1, 2},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{safari}}, nil)
+				svc.EXPECT().GetUser(ctx, int64(2)).Return(model.User{}, service.ErrNotFound)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+			messages: []model.Message{
+				{
+					UserID: 1,
+					Device: safari,
+					Title:  "Price changed",
+					Body:   "Product 7 price changed from $ 10.99 to $ 9.99",
+				},
+			},
+		},
+		{
+			desc:    "render in user language",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Language: "ru", Devices: []model.Device{safari}}, nil)
+				note := inboxNote
+				note.Title, note.Body = "Цена изменилась", "Цена товара 7 изменилась с $ 10,99 на $ 9,99"
+				svc.EXPECT().AddNotification(ctx, note).Return(model.Notification{}, nil)
+			},
+			messages: []model.Message{
+				{
+					UserID: 1,
+					Device: safari,
+					Title:  "Цена изменилась",
+					Body:   "Цена товара 7 изменилась с $ 10,99 на $ 9,99",
+				},
+			},
+		},
+		{
+			desc:    "skip disabled device",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				disabled := safari
+				disabled.Disabled = true
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{disabled}}, nil)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+			messages: nil,
+		},
+		{
+			desc:    "buffer digest",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{chrome}}, nil)
+				svc.EXPECT().AddToDigest(ctx, int64(1), chrome.ID, model.Event{
+					Type:      model.PriceChanged,
+					UserIDs:   []int64{1},
+					ProductID: 7,
+					OldPrice:  1099,
+					NewPrice:  999,
+					CreatedAt: now,
+				}).Return(nil)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+		},
+		{
+			desc:    "AddToDigest error",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{chrome}}, nil)
+				svc.EXPECT().AddToDigest(ctx, int64(1), chrome.ID, gomock.Any()).Return(assert.AnError)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+			err: errAny,
+		},
+		{
+			desc:    "AddNotification error",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{chrome}}, nil)
+				svc.EXPECT().AddToDigest(ctx, int64(1), chrome.ID, gomock.Any()).Return(nil)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, assert.AnError)
+			},
+			err: errAny,
+		},
+		{
+			desc:    "inbox only",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{firefox, opera}}, nil)
+				svc.EXPECT().AddNotification(ctx, inboxNote).Return(model.Notification{}, nil)
+			},
+		},
+		{
+			desc:    "skip inbox without deliveries",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{firefox, edge}}, nil)
+			},
+		},
+		{
+			desc: "GetUsers error",
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUsers(ctx, broadcast).Return(model.UserPage{}, assert.AnError)
+			},
+			err: assert.AnError,
+		},
+		{
+			desc:    "GetUser error",
+			userIDs: []int64{1},
+			prepare: func(svc *mock.MockService) {
+				svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{}, assert.AnError)
+			},
+			err: assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			tc.prepare(svc)
+
+			s := sender.NewMemory()
+			d := New(svc, s, newRenderer(t))
+
+			e := event
+			e.UserIDs = tc.userIDs
+
+			err := d.Dispatch(ctx, e)
+			if tc.err == errAny {
+				assert.Error(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			}
+
+			for i := range tc.messages {
+				tc.messages[i].Events = []model.Event{e}
+			}
+			assert.Equal(t, tc.messages, s.Messages())
+		})
+	}
+}
+
+func TestDispatcher_Dispatch_eventTypes(t *testing.T) {
+	testCases := []struct {
+		event model.Event
+		title string
+		body  string
+	}{
+		{
+			event: model.Event{Type: model.BackInStock, UserIDs: []int64{1}, ProductID: 7, CreatedAt: now},
+			title: "Back in stock",
+			body:  "Product 7 is back in stock",
+		},
+		{
+			event: model.Event{Type: model.OrderStatus, UserIDs: []int64{1}, OrderID: "A-1001", Status: model.OrderDelivered, CreatedAt: now},
+			title: "Order delivered",
+			body:  "Order A-1001 has been delivered",
+		},
+		{
+			event: model.Event{Type: model.Promotion, UserIDs: []int64{1}, ProductID: 7, Discount: 20, CreatedAt: now},
+			title: "Sale",
+			body:  "Product 7 is 20% off",
+		},
+		{
+			event: model.Event{Type: model.Wishlist, UserIDs: []int64{1}, ProductID: 7, Quantity: 2, CreatedAt: now},
+			title: "Running out of stock",
+			body:  "Only 2 items of product 7 from your wishlist are left",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.event.Type, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			dev := model.Device{ID: "1", Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+				tc.event.Type: {Enabled: true, Channel: model.ChannelDevice},
+			}}}
+
+			svc := mock.NewMockService(ctrl)
+			svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{dev}}, nil)
+			svc.EXPECT().AddNotification(ctx, model.Notification{
+				UserID:    1,
+				Type:      tc.event.Type,
+				Title:     tc.title,
+				Body:      tc.body,
+				CreatedAt: now,
+			}).Return(model.Notification{}, nil)
+
+			s := sender.NewMemory()
+			require.NoError(t, New(svc, s, newRenderer(t)).Dispatch(ctx, tc.event))
+
+			assert.Equal(t, []model.Message{{
+				UserID: 1,
+				Device: dev,
+				Title:  tc.title,
+				Body:   tc.body,
+				Events: []model.Event{tc.event},
+			}}, s.Messages())
+		})
+	}
+}
+
+func TestDispatcher_Dispatch_unknownEvent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := New(mock.NewMockService(ctrl), sender.NewMemory(), newRenderer(t))
+
+	err := d.Dispatch(ctx, model.Event{Type: "UNKNOWN"})
+	assert.True(t, errors.Is(err, ErrUnknownEvent), fmt.Sprintf("wanted %s got %s", ErrUnknownEvent, err))
+}
+
+func TestDispatcher_Dispatch_senderError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().GetUsers(ctx, gomock.Any()).Return(model.UserPage{
+		Users: []model.User{{ID: 1, Devices: []model.Device{safari, safari}}},
+	}, nil)
+
+	svc.EXPECT().AddNotification(ctx, gomock.Any()).Return(model.Notification{}, nil)
+
+	s := senderMock.NewMockSender(ctrl)
+	s.EXPECT().Send(ctx, gomock.Any()).Return(assert.AnError)
+	s.EXPECT().Send(ctx, gomock.Any()).Return(nil)
+
+	err := New(svc, s, newRenderer(t)).Dispatch(ctx, model.Event{Type: model.PriceChanged})
+	require.Error(t, err)
+	assert.Equal(t, "failed to deliver 1 of 3 messages", err.Error())
+}
+
+func TestDispatcher_Dispatch_gone(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().GetUser(ctx, int64(1)).Return(model.User{ID: 1, Devices: []model.Device{safari}}, nil)
+	svc.EXPECT().AddNotification(ctx, gomock.Any()).Return(model.Notification{}, nil)
+	svc.EXPECT().DisableDevice(ctx, int64(1), safari.ID).Return(nil)
+
+	s := senderMock.NewMockSender(ctrl)
+	s.EXPECT().Send(ctx, gomock.Any()).Return(fmt.Errorf("%w: push service responded 410 Gone", sender.ErrGone))
+
+	err := New(svc, s, newRenderer(t)).Dispatch(ctx, model.Event{Type: model.PriceChanged, UserIDs: []int64{1}})
+	require.Error(t, err)
+	assert.Equal(t, "failed to deliver 1 of 2 messages", err.Error())
+}
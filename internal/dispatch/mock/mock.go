@@ -0,0 +1,49 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: dispatch.go
+
+// Package mock is a generated GoMock package.
+package mock
+
+import (
+	context "context"
+	gomock "github.com/golang/mock/gomock"
+	model "github.com/vliubezny/gnotify/internal/model"
+	reflect "reflect"
+)
+
+// MockDispatcher is a mock of Dispatcher interface
+type MockDispatcher struct {
+	ctrl     *gomock.Controller
+	recorder *MockDispatcherMockRecorder
+}
+
+// MockDispatcherMockRecorder is the mock recorder for MockDispatcher
+type MockDispatcherMockRecorder struct {
+	mock *MockDispatcher
+}
+
+// NewMockDispatcher creates a new mock instance
+func NewMockDispatcher(ctrl *gomock.Controller) *MockDispatcher {
+	mock := &MockDispatcher{ctrl: ctrl}
+	mock.recorder = &MockDispatcherMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockDispatcher) EXPECT() *MockDispatcherMockRecorder {
+	return m.recorder
+}
+
+// Dispatch mocks base method
+func (m *MockDispatcher) Dispatch(ctx context.Context, e model.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Dispatch", ctx, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Dispatch indicates an expected call of Dispatch
+func (mr *MockDispatcherMockRecorder) Dispatch(ctx, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dispatch", reflect.TypeOf((*MockDispatcher)(nil).Dispatch), ctx, e)
+}
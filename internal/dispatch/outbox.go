@@ -0,0 +1,245 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/sender"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+type outbox struct {
+	svc service.Service
+	now func() time.Time
+}
+
+// NewOutbox creates sender that persists messages as pending deliveries.
+// Deliveries are sent by Workers, so messages survive restarts and failed sends are retried.
+func NewOutbox(svc service.Service) sender.Sender {
+	return &outbox{
+		svc: svc,
+		now: time.Now,
+	}
+}
+
+func (o *outbox) Send(ctx context.Context, msg model.Message) error {
+	now := o.now()
+
+	_, err := o.svc.AddDelivery(ctx, model.Delivery{
+		UserID:        msg.UserID,
+		DeviceID:      msg.Device.ID,
+		Title:         msg.Title,
+		Body:          msg.Body,
+		Events:        msg.Events,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue delivery: %w", err)
+	}
+
+	return nil
+}
+
+// WorkerConfig configures outbox workers.
+type WorkerConfig struct {
+	// Workers is number of deliveries processed concurrently.
+	Workers int
+	// PollInterval is delay before idle worker looks for due deliveries again.
+	PollInterval time.Duration
+	// VisibilityTimeout limits duration of an attempt, delivery is leased again after it
+	// if worker crashed.
+	VisibilityTimeout time.Duration
+	// MaxAttempts limits number of attempts before delivery is dead.
+	MaxAttempts int
+	// Backoff is delay before the first retry, it doubles on every next retry up to MaxBackoff.
+	// Actual delay is randomized between half and full backoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Workers send outbox deliveries.
+type Workers struct {
+	svc    service.Service
+	sender sender.Sender
+	cfg    WorkerConfig
+	now    func() time.Time
+	jitter func(d time.Duration) time.Duration
+}
+
+// NewWorkers creates pool of outbox workers which send deliveries with s.
+func NewWorkers(svc service.Service, s sender.Sender, cfg WorkerConfig) *Workers {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+
+	return &Workers{
+		svc:    svc,
+		sender: s,
+		cfg:    cfg,
+		now:    time.Now,
+		jitter: equalJitter,
+	}
+}
+
+// Run processes due deliveries until context is canceled.
+func (w *Workers) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	for i := 0; i < w.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// work processes deliveries one by one and polls for new ones when outbox is drained.
+func (w *Workers) work(ctx context.Context) {
+	for {
+		ok, err := w.ProcessNext(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("failed to process delivery")
+		}
+
+		if ok && err == nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.cfg.PollInterval):
+		}
+	}
+}
+
+// ProcessNext leases single due delivery and sends it.
+// It reports whether there was a due delivery.
+func (w *Workers) ProcessNext(ctx context.Context) (bool, error) {
+	ds, err := w.svc.LeaseDeliveries(ctx, w.now(), w.cfg.VisibilityTimeout, 1)
+	if err != nil {
+		return false, fmt.Errorf("failed to lease delivery: %w", err)
+	}
+
+	if len(ds) == 0 {
+		return false, nil
+	}
+
+	d := w.attempt(ctx, ds[0])
+
+	if err := w.svc.UpdateDelivery(ctx, d); err != nil {
+		if errors.Is(err, service.ErrConflict) {
+			// lease expired during attempt and delivery belongs to another worker now
+			logrus.WithField("deliveryID", d.ID).Warn("delivery lease expired")
+			return true, nil
+		}
+		return true, fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	return true, nil
+}
+
+// attempt sends leased delivery and returns it with the next state.
+func (w *Workers) attempt(ctx context.Context, d model.Delivery) model.Delivery {
+	l := logrus.WithFields(logrus.Fields{
+		"deliveryID": d.ID,
+		"userID":     d.UserID,
+		"deviceID":   d.DeviceID,
+		"attempt":    d.Attempts,
+	})
+
+	err := w.send(ctx, d)
+
+	now := w.now()
+	d.UpdatedAt = now
+	d.NextAttemptAt = now
+	d.LastError = ""
+
+	switch {
+	case err == nil:
+		d.State = model.DeliverySucceeded
+		return d
+	case errors.Is(err, sender.ErrPermanent), errors.Is(err, sender.ErrGone):
+		d.State = model.DeliveryDead
+	case d.Attempts >= w.cfg.MaxAttempts:
+		d.State = model.DeliveryDead
+	default:
+		d.State = model.DeliveryFailed
+		d.NextAttemptAt = now.Add(w.jitter(w.backoff(d.Attempts)))
+	}
+
+	d.LastError = err.Error()
+	l.WithError(err).WithField("state", d.State).Error("failed to send delivery")
+	disableGone(ctx, w.svc, d.UserID, d.DeviceID, err)
+
+	return d
+}
+
+// send delivers message to the device of delivery.
+func (w *Workers) send(ctx context.Context, d model.Delivery) error {
+	dev, err := w.svc.GetDevice(ctx, d.UserID, d.DeviceID)
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			return fmt.Errorf("%w: device not found", sender.ErrPermanent)
+		}
+		return fmt.Errorf("failed to get device: %w", err)
+	}
+
+	if dev.Disabled {
+		return fmt.Errorf("%w: device is disabled", sender.ErrPermanent)
+	}
+
+	// attempt must end before lease expires, otherwise delivery may be sent twice concurrently
+	if w.cfg.VisibilityTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.cfg.VisibilityTimeout)
+		defer cancel()
+	}
+
+	return w.sender.Send(ctx, model.Message{
+		UserID: d.UserID,
+		Device: dev,
+		Title:  d.Title,
+		Body:   d.Body,
+		Events: d.Events,
+	})
+}
+
+// backoff returns delay before retry of failed attempt.
+func (w *Workers) backoff(attempt int) time.Duration {
+	b := w.cfg.Backoff
+	for i := 1; i < attempt; i++ {
+		if b *= 2; w.cfg.MaxBackoff > 0 && b >= w.cfg.MaxBackoff {
+			return w.cfg.MaxBackoff
+		}
+	}
+	return b
+}
+
+// equalJitter returns random duration between d/2 and d so retries of many deliveries spread out.
+func equalJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
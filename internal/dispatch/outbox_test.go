@@ -0,0 +1,246 @@
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/sender"
+	senderMock "github.com/vliubezny/gnotify/internal/sender/mock"
+	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+func TestOutbox_Send(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	e := model.Event{Type: model.PriceChanged, ProductID: 7, OldPrice: 1099, NewPrice: 999, CreatedAt: now}
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().AddDelivery(ctx, model.Delivery{
+		UserID:        1,
+		DeviceID:      chrome.ID,
+		Title:         "Price changed",
+		Body:          "Product 7 price changed from 10.99 to 9.99",
+		Events:        []model.Event{e},
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}).Return(model.Delivery{ID: "12345"}, nil)
+	svc.EXPECT().AddDelivery(ctx, gomock.Any()).Return(model.Delivery{}, errAny)
+
+	o := NewOutbox(svc)
+	o.(*outbox).now = func() time.Time { return now }
+
+	msg := model.Message{
+		UserID: 1,
+		Device: chrome,
+		Title:  "Price changed",
+		Body:   "Product 7 price changed from 10.99 to 9.99",
+		Events: []model.Event{e},
+	}
+
+	require.NoError(t, o.Send(ctx, msg))
+
+	err := o.Send(ctx, msg)
+	assert.True(t, errors.Is(err, errAny), fmt.Sprintf("wanted %s got %s", errAny, err))
+}
+
+func TestWorkers_ProcessNext(t *testing.T) {
+	const timeout = time.Minute
+
+	leased := model.Delivery{
+		ID:            "12345",
+		UserID:        1,
+		DeviceID:      chrome.ID,
+		Title:         "Price changed",
+		Body:          "Product 7 price changed from 10.99 to 9.99",
+		State:         model.DeliveryInFlight,
+		Attempts:      2,
+		NextAttemptAt: now.Add(timeout),
+	}
+	msg := model.Message{
+		UserID: 1,
+		Device: chrome,
+		Title:  "Price changed",
+		Body:   "Product 7 price changed from 10.99 to 9.99",
+	}
+
+	// result returns leased delivery updated after attempt
+	result := func(state, lastError string, next time.Time) model.Delivery {
+		d := leased
+		d.State = state
+		d.LastError = lastError
+		d.NextAttemptAt = next
+		d.UpdatedAt = now
+		return d
+	}
+
+	testCases := []struct {
+		desc       string
+		attempts   int
+		rDevice    model.Device
+		rDeviceErr error
+		send       bool
+		rSendErr   error
+		disable    bool
+		delivery   model.Delivery
+		rUpdateErr error
+		err        error
+	}{
+		{
+			desc:     "succeeded",
+			rDevice:  chrome,
+			send:     true,
+			delivery: result(model.DeliverySucceeded, "", now),
+		},
+		{
+			desc:     "failed with backoff",
+			rDevice:  chrome,
+			send:     true,
+			rSendErr: errAny,
+			delivery: result(model.DeliveryFailed, errAny.Error(), now.Add(20*time.Second)),
+		},
+		{
+			desc:     "backoff is limited",
+			attempts: 5,
+			rDevice:  chrome,
+			send:     true,
+			rSendErr: errAny,
+			delivery: func() model.Delivery {
+				d := result(model.DeliveryFailed, errAny.Error(), now.Add(time.Minute))
+				d.Attempts = 5
+				return d
+			}(),
+		},
+		{
+			desc:     "attempts exhausted",
+			attempts: 10,
+			rDevice:  chrome,
+			send:     true,
+			rSendErr: errAny,
+			delivery: func() model.Delivery {
+				d := result(model.DeliveryDead, errAny.Error(), now)
+				d.Attempts = 10
+				return d
+			}(),
+		},
+		{
+			desc:     "device gone",
+			rDevice:  chrome,
+			send:     true,
+			rSendErr: sender.ErrGone,
+			disable:  true,
+			delivery: result(model.DeliveryDead, sender.ErrGone.Error(), now),
+		},
+		{
+			desc:     "no sender for device type",
+			rDevice:  chrome,
+			send:     true,
+			rSendErr: fmt.Errorf("%w: no sender for device type \"SMS\"", sender.ErrPermanent),
+			delivery: result(model.DeliveryDead, `permanent failure: no sender for device type "SMS"`, now),
+		},
+		{
+			desc:       "device not found",
+			rDeviceErr: service.ErrNotFound,
+			delivery:   result(model.DeliveryDead, "permanent failure: device not found", now),
+		},
+		{
+			desc:     "device disabled",
+			rDevice:  model.Device{ID: chrome.ID, Disabled: true},
+			delivery: result(model.DeliveryDead, "permanent failure: device is disabled", now),
+		},
+		{
+			desc:       "device lookup failed",
+			rDeviceErr: errAny,
+			delivery:   result(model.DeliveryFailed, "failed to get device: any error", now.Add(20*time.Second)),
+		},
+		{
+			desc:       "lease expired",
+			rDevice:    chrome,
+			send:       true,
+			delivery:   result(model.DeliverySucceeded, "", now),
+			rUpdateErr: service.ErrConflict,
+		},
+		{
+			desc:       "update failed",
+			rDevice:    chrome,
+			send:       true,
+			delivery:   result(model.DeliverySucceeded, "", now),
+			rUpdateErr: errAny,
+			err:        errAny,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			d := leased
+			if tc.attempts > 0 {
+				d.Attempts = tc.attempts
+			}
+
+			svc := mock.NewMockService(ctrl)
+			s := senderMock.NewMockSender(ctrl)
+
+			svc.EXPECT().LeaseDeliveries(ctx, now, timeout, 1).Return([]model.Delivery{d}, nil)
+			svc.EXPECT().GetDevice(ctx, int64(1), chrome.ID).Return(tc.rDevice, tc.rDeviceErr)
+			if tc.send {
+				s.EXPECT().Send(gomock.Any(), msg).Return(tc.rSendErr)
+			}
+			if tc.disable {
+				svc.EXPECT().DisableDevice(ctx, int64(1), chrome.ID).Return(nil)
+			}
+			svc.EXPECT().UpdateDelivery(ctx, tc.delivery).Return(tc.rUpdateErr)
+
+			w := NewWorkers(svc, s, WorkerConfig{
+				VisibilityTimeout: timeout,
+				MaxAttempts:       10,
+				Backoff:           10 * time.Second,
+				MaxBackoff:        time.Minute,
+			})
+			w.now = func() time.Time { return now }
+			w.jitter = func(d time.Duration) time.Duration { return d }
+
+			ok, err := w.ProcessNext(ctx)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestWorkers_ProcessNext_empty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().LeaseDeliveries(ctx, now, time.Minute, 1).Return([]model.Delivery{}, nil)
+	svc.EXPECT().LeaseDeliveries(ctx, now, time.Minute, 1).Return(nil, errAny)
+
+	w := NewWorkers(svc, senderMock.NewMockSender(ctrl), WorkerConfig{VisibilityTimeout: time.Minute})
+	w.now = func() time.Time { return now }
+
+	ok, err := w.ProcessNext(ctx)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = w.ProcessNext(ctx)
+	assert.True(t, errors.Is(err, errAny), fmt.Sprintf("wanted %s got %s", errAny, err))
+	assert.False(t, ok)
+}
+
+func Test_equalJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := equalJitter(10 * time.Second)
+		assert.True(t, d >= 5*time.Second && d <= 10*time.Second, d.String())
+	}
+	assert.Equal(t, time.Duration(0), equalJitter(0))
+}
@@ -0,0 +1,111 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+// QueueConfig configures event queue.
+type QueueConfig struct {
+	// PollInterval is delay before idle queue looks for pending events again.
+	PollInterval time.Duration
+	// VisibilityTimeout limits duration of event dispatch, event is leased again after it
+	// if process crashed.
+	VisibilityTimeout time.Duration
+}
+
+// Queue dispatches events saved with idempotency keys.
+// Event is leased before dispatch, so concurrent instances never dispatch the same event
+// and event of crashed instance is dispatched again once its lease expires.
+type Queue struct {
+	svc service.Service
+	d   Dispatcher
+	cfg QueueConfig
+	now func() time.Time
+}
+
+// NewQueue creates queue which dispatches pending events with d.
+func NewQueue(svc service.Service, d Dispatcher, cfg QueueConfig) *Queue {
+	return &Queue{
+		svc: svc,
+		d:   d,
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// Run dispatches pending events until context is canceled.
+// Event dispatched at that moment is finished before Run returns.
+func (q *Queue) Run(ctx context.Context) error {
+	for {
+		// interrupted dispatch would notify users who already got the event again after lease expires
+		ok, err := q.ProcessNext(context.Background())
+		if err != nil {
+			logrus.WithError(err).Error("failed to process event")
+		}
+
+		if ok && err == nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(q.cfg.PollInterval):
+		}
+	}
+}
+
+// ProcessNext leases single pending event and dispatches it.
+// It reports whether there was a pending event.
+func (q *Queue) ProcessNext(ctx context.Context) (bool, error) {
+	ks, err := q.svc.LeaseEvents(ctx, q.now(), q.cfg.VisibilityTimeout, 1)
+	if err != nil {
+		return false, fmt.Errorf("failed to lease event: %w", err)
+	}
+
+	if len(ks) == 0 {
+		return false, nil
+	}
+	k := ks[0]
+
+	q.dispatch(ctx, k.EventID, k.Event)
+
+	if err := q.svc.MarkEventDispatched(ctx, k.Key); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			// key expired and was removed during dispatch
+			return true, nil
+		}
+		return true, fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+
+	return true, nil
+}
+
+// dispatch sends event to its recipients. Failed event is not dispatched again,
+// otherwise recipients notified before the failure would get it twice.
+func (q *Queue) dispatch(ctx context.Context, eventID string, e model.Event) {
+	// dispatch must end before lease expires, otherwise event may be dispatched twice concurrently
+	if q.cfg.VisibilityTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.cfg.VisibilityTimeout)
+		defer cancel()
+	}
+
+	if err := q.d.Dispatch(ctx, e); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"eventID": eventID,
+			"type":    e.Type,
+		}).Error("failed to dispatch event")
+	}
+}
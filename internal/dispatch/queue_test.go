@@ -0,0 +1,122 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dispatchMock "github.com/vliubezny/gnotify/internal/dispatch/mock"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+func TestQueue_ProcessNext(t *testing.T) {
+	const timeout = time.Minute
+
+	leased := model.IdempotencyKey{
+		Key:           "price-1-999",
+		EventID:       "12345",
+		Event:         model.Event{Type: model.PriceChanged, UserIDs: []int64{1}, ProductID: 1, OldPrice: 1099, NewPrice: 999, CreatedAt: now},
+		Pending:       true,
+		NextAttemptAt: now.Add(timeout),
+	}
+
+	testCases := []struct {
+		desc         string
+		rDispatchErr error
+		rMarkErr     error
+		err          error
+	}{
+		{
+			desc: "dispatched",
+		},
+		{
+			desc:         "dispatch failed",
+			rDispatchErr: errAny,
+		},
+		{
+			desc:     "key expired",
+			rMarkErr: service.ErrNotFound,
+		},
+		{
+			desc:     "mark failed",
+			rMarkErr: errAny,
+			err:      errAny,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			d := dispatchMock.NewMockDispatcher(ctrl)
+
+			gomock.InOrder(
+				svc.EXPECT().LeaseEvents(ctx, now, timeout, 1).Return([]model.IdempotencyKey{leased}, nil),
+				d.EXPECT().Dispatch(gomock.Any(), leased.Event).Return(tc.rDispatchErr),
+				svc.EXPECT().MarkEventDispatched(ctx, leased.Key).Return(tc.rMarkErr),
+			)
+
+			q := NewQueue(svc, d, QueueConfig{VisibilityTimeout: timeout})
+			q.now = func() time.Time { return now }
+
+			ok, err := q.ProcessNext(ctx)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestQueue_ProcessNext_empty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().LeaseEvents(ctx, now, time.Minute, 1).Return([]model.IdempotencyKey{}, nil)
+	svc.EXPECT().LeaseEvents(ctx, now, time.Minute, 1).Return(nil, errAny)
+
+	q := NewQueue(svc, dispatchMock.NewMockDispatcher(ctrl), QueueConfig{VisibilityTimeout: time.Minute})
+	q.now = func() time.Time { return now }
+
+	ok, err := q.ProcessNext(ctx)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = q.ProcessNext(ctx)
+	assert.True(t, errors.Is(err, errAny), fmt.Sprintf("wanted %s got %s", errAny, err))
+	assert.False(t, ok)
+}
+
+func TestQueue_Run(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	k := model.IdempotencyKey{Key: "price-1-999", Event: model.Event{Type: model.PriceChanged, ProductID: 1}}
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().LeaseEvents(gomock.Any(), gomock.Any(), time.Minute, 1).Return([]model.IdempotencyKey{k}, nil)
+	svc.EXPECT().MarkEventDispatched(gomock.Any(), k.Key).Return(nil)
+
+	// shutdown during dispatch doesn't interrupt it
+	d := dispatchMock.NewMockDispatcher(ctrl)
+	d.EXPECT().Dispatch(gomock.Any(), k.Event).DoAndReturn(func(dctx context.Context, _ model.Event) error {
+		cancel()
+		assert.NoError(t, dctx.Err())
+		return nil
+	})
+
+	q := NewQueue(svc, d, QueueConfig{PollInterval: time.Hour, VisibilityTimeout: time.Minute})
+
+	assert.NoError(t, q.Run(c))
+}
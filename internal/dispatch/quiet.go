@@ -0,0 +1,42 @@
+package dispatch
+
+import (
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// location returns user time zone, unknown or empty time zone stands for UTC.
+func location(u model.User) *time.Location {
+	if u.TimeZone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(u.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// inQuietHours reports whether t falls into any of user quiet hours in user time zone.
+func inQuietHours(u model.User, t time.Time) bool {
+	if len(u.QuietHours) == 0 {
+		return false
+	}
+
+	t = t.In(location(u))
+	m := t.Hour()*60 + t.Minute()
+
+	for _, q := range u.QuietHours {
+		if q.Start < q.End {
+			if m >= q.Start && m < q.End {
+				return true
+			}
+		} else if m >= q.Start || m < q.End {
+			return true
+		}
+	}
+
+	return false
+}
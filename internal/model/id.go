@@ -0,0 +1,73 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInvalidID states that identifier is malformed.
+var ErrInvalidID = errors.New("invalid id")
+
+// idLen is length of identifier in bytes.
+const idLen = 12
+
+var (
+	processID = newProcessID()
+	idCounter = newIDCounter()
+)
+
+// NewID generates identifier for storages which don't generate one natively.
+// Like ObjectID it consists of timestamp, process unique bytes and counter,
+// so identifiers created by one process grow monotonically.
+func NewID() string {
+	var id [idLen]byte
+
+	binary.BigEndian.PutUint32(id[0:4], uint32(time.Now().Unix()))
+	copy(id[4:9], processID[:])
+
+	c := atomic.AddUint32(&idCounter, 1)
+	id[9], id[10], id[11] = byte(c>>16), byte(c>>8), byte(c)
+
+	return FormatID(id)
+}
+
+func newProcessID() [5]byte {
+	var b [5]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("failed to generate process id: " + err.Error())
+	}
+	return b
+}
+
+func newIDCounter() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("failed to generate id counter: " + err.Error())
+	}
+	return binary.BigEndian.Uint32(b[:]) & 0xffffff
+}
+
+// FormatID encodes identifier as lowercase hex string. Identifiers share
+// the layout of MongoDB ObjectID so storages can use it natively.
+func FormatID(id [idLen]byte) string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseID decodes identifier produced by FormatID.
+func ParseID(s string) ([idLen]byte, error) {
+	var id [idLen]byte
+
+	if len(s) != 2*idLen {
+		return id, ErrInvalidID
+	}
+
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, ErrInvalidID
+	}
+
+	return id, nil
+}
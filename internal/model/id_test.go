@@ -0,0 +1,72 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseID(t *testing.T) {
+	testCases := []struct {
+		desc string
+		id   string
+		err  error
+	}{
+		{
+			desc: "success",
+			id:   "606d8e1b3a7c2f0001a1b2c3",
+			err:  nil,
+		},
+		{
+			desc: "short",
+			id:   "606d8e1b",
+			err:  ErrInvalidID,
+		},
+		{
+			desc: "not hex",
+			id:   "606d8e1b3a7c2f0001a1b2cz",
+			err:  ErrInvalidID,
+		},
+		{
+			desc: "mongo string representation",
+			id:   `ObjectID("606d8e1b3a7c2f0001a1b2c3")`,
+			err:  ErrInvalidID,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			id, err := ParseID(tc.id)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+
+			if tc.err == nil {
+				assert.Equal(t, tc.id, FormatID(id))
+			}
+		})
+	}
+}
+
+func TestFormatID(t *testing.T) {
+	id := [12]byte{0x60, 0x6d, 0x8e, 0x1b, 0x3a, 0x7c, 0x2f, 0x00, 0x01, 0xa1, 0xb2, 0xc3}
+
+	s := FormatID(id)
+	assert.Equal(t, "606d8e1b3a7c2f0001a1b2c3", s)
+
+	parsed, err := ParseID(s)
+	require.NoError(t, err)
+	assert.Equal(t, id, parsed)
+}
+
+func TestNewID(t *testing.T) {
+	a, b := NewID(), NewID()
+
+	_, err := ParseID(a)
+	require.NoError(t, err)
+
+	_, err = ParseID(b)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, a, b)
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // Frequency enum.
 const (
 	Hourly = "HOURLY"
@@ -8,21 +10,261 @@ const (
 	Never  = "NEVER"
 )
 
+// Event type enum.
+const (
+	PriceChanged = "PRICE_CHANGED"
+	BackInStock  = "BACK_IN_STOCK"
+	OrderStatus  = "ORDER_STATUS"
+	Promotion    = "PROMOTION"
+	Wishlist     = "WISHLIST"
+)
+
+// EventTypes lists supported event types.
+var EventTypes = []string{PriceChanged, BackInStock, OrderStatus, Promotion, Wishlist}
+
+// Order status enum.
+const (
+	OrderPlaced    = "PLACED"
+	OrderShipped   = "SHIPPED"
+	OrderDelivered = "DELIVERED"
+	OrderCanceled  = "CANCELED"
+)
+
+// OrderStatuses lists supported order statuses.
+var OrderStatuses = []string{OrderPlaced, OrderShipped, OrderDelivered, OrderCanceled}
+
+// Channel enum.
+const (
+	// ChannelDevice delivers events to the device and user inbox.
+	ChannelDevice = "DEVICE"
+	// ChannelInbox delivers events to user inbox only.
+	ChannelInbox = "INBOX"
+)
+
 // User represents user notifications preferences.
 type User struct {
 	ID       int64
 	Language string
-	Devices  []Device
+	// TimeZone is IANA time zone name, empty means UTC.
+	TimeZone string
+	// QuietHours are daily periods in user time zone when scheduled deliveries are deferred.
+	QuietHours []QuietHours
+	Devices    []Device
+	// Version is incremented on every change of user or its devices.
+	Version int64
+}
+
+// QuietHours represents daily period from Start till End, period spans midnight if End is before Start.
+// Bounds are minutes since midnight.
+type QuietHours struct {
+	Start int
+	End   int
 }
 
+// Device type enum.
+const (
+	// DeviceWebPush is browser reachable with Web Push protocol.
+	DeviceWebPush = "WEB_PUSH"
+	// DeviceEmail is email mailbox.
+	DeviceEmail = "EMAIL"
+	// DeviceSMS is mobile phone reachable with text messages.
+	DeviceSMS = "SMS"
+	// DeviceFCM is mobile app reachable with Firebase Cloud Messaging.
+	DeviceFCM = "FCM"
+	// DeviceAPNs is iOS app reachable with Apple Push Notification service.
+	DeviceAPNs = "APNS"
+	// DeviceWebhook is HTTP endpoint of a customer system.
+	DeviceWebhook = "WEBHOOK"
+)
+
 type Device struct {
-	ID       string
-	Name     string
+	ID   string
+	Name string
+	// Type defines how device is reached, it is empty for devices registered before device types.
+	Type    string
+	Address Address
+	// Disabled devices are skipped on delivery, device is disabled when its address expires.
+	Disabled bool
 	Settings NotificationSettings
 }
 
+// Address represents device type specific data required for delivery.
+type Address struct {
+	// Endpoint, P256dh and Auth form Web Push subscription, keys are base64url encoded.
+	Endpoint string
+	P256dh   string
+	Auth     string
+	Email    string
+	// Phone is in E.164 format.
+	Phone string
+	// Token is FCM registration token or APNs device token.
+	Token string
+	// URL is webhook endpoint.
+	URL string
+	// Secret signs webhook payloads, it is generated by the service.
+	Secret string
+}
+
 // NotificationSettings represents notification settings for the device.
 type NotificationSettings struct {
-	PriceChanged bool
-	Frequency    string
+	// Preferences maps event type to preference, events of missing types are not delivered.
+	Preferences map[string]Preference
+}
+
+// Preference represents device preference for events of a single type.
+type Preference struct {
+	Enabled   bool
+	Frequency string
+	Channel   string
+}
+
+// Wants reports whether device settings opt into events of the given type.
+func (s NotificationSettings) Wants(eventType string) bool {
+	p := s.Preferences[eventType]
+	return p.Enabled && p.Frequency != Never
+}
+
+// Event represents something that happened in the store and may be worth notifying about.
+type Event struct {
+	Type string
+	// UserIDs limits recipients of the event, empty means every user.
+	UserIDs   []int64
+	ProductID int64
+	// OldPrice and NewPrice are in minor currency units (cents).
+	OldPrice int64
+	NewPrice int64
+	// OrderID and Status describe order of OrderStatus event.
+	OrderID string
+	Status  string
+	// Discount is percentage off product price of Promotion event.
+	Discount int64
+	// Quantity is number of product items left in stock of Wishlist event.
+	Quantity  int64
+	CreatedAt time.Time
+}
+
+// Digest represents events buffered for a device until its next delivery.
+type Digest struct {
+	UserID    int64
+	DeviceID  string
+	Events    []Event
+	CreatedAt time.Time
+}
+
+// Notification represents notification record in user inbox.
+type Notification struct {
+	ID        string
+	UserID    int64
+	Type      string
+	Title     string
+	Body      string
+	Read      bool
+	CreatedAt time.Time
+}
+
+// NotificationQuery selects page of user notifications ordered from newest to oldest.
+type NotificationQuery struct {
+	// First limits page size.
+	First int
+	// After is ID of the last notification from the previous page.
+	After      string
+	UnreadOnly bool
+}
+
+// NotificationPage represents page of user notifications.
+type NotificationPage struct {
+	Notifications []Notification
+	HasNextPage   bool
+}
+
+// UserQuery selects page of users ordered by ID.
+// Empty filter fields match any value.
+type UserQuery struct {
+	Language string
+	// EventType and Frequency select users having device with enabled preference matching both.
+	EventType string
+	Frequency string
+	// First limits page size.
+	First int
+	// After is cursor returned with the previous page.
+	After string
+}
+
+// UserPage represents page of users.
+type UserPage struct {
+	Users []User
+	// NextCursor points after the last user of the page, empty if there are no more users.
+	NextCursor string
+}
+
+// Message represents notification addressed to a single user device.
+type Message struct {
+	UserID int64
+	Device Device
+	Title  string
+	Body   string
+	Events []Event
+}
+
+// Delivery state enum.
+const (
+	// DeliveryPending waits for the first attempt.
+	DeliveryPending = "PENDING"
+	// DeliveryInFlight is leased by a worker till NextAttemptAt.
+	DeliveryInFlight  = "IN_FLIGHT"
+	DeliverySucceeded = "SUCCEEDED"
+	// DeliveryFailed waits for retry at NextAttemptAt.
+	DeliveryFailed = "FAILED"
+	// DeliveryDead failed permanently or ran out of attempts, it is retried only if requeued.
+	DeliveryDead = "DEAD"
+)
+
+// Delivery represents message to a user device kept in outbox until it is delivered.
+type Delivery struct {
+	ID       string
+	UserID   int64
+	DeviceID string
+	Title    string
+	Body     string
+	Events   []Event
+	State    string
+	// Attempts counts leases of the delivery.
+	Attempts  int
+	LastError string
+	// NextAttemptAt is when delivery may be leased, lease of in-flight delivery expires then.
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// DeliveryQuery selects page of deliveries ordered from newest to oldest.
+type DeliveryQuery struct {
+	// State filter, empty matches any state.
+	State string
+	// First limits page size.
+	First int
+	// After is ID of the last delivery from the previous page.
+	After string
+}
+
+// DeliveryPage represents page of deliveries.
+type DeliveryPage struct {
+	Deliveries  []Delivery
+	HasNextPage bool
+}
+
+// IdempotencyKey records ingestion of event sent with the key so retries of the event are not dispatched again.
+// Event is saved with its key, so accepted event is dispatched even if process stops before dispatch.
+type IdempotencyKey struct {
+	Key string
+	// EventID identifies event accepted with the key.
+	EventID    string
+	Event      Event
+	AcceptedAt time.Time
+	// ExpiresAt is when key may be reused.
+	ExpiresAt time.Time
+	// Pending is set till event is dispatched.
+	Pending bool
+	// NextAttemptAt is when pending event may be leased for dispatch, lease of leased event expires then.
+	NextAttemptAt time.Time
 }
@@ -0,0 +1,64 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: render.go
+
+// Package mock is a generated GoMock package.
+package mock
+
+import (
+	gomock "github.com/golang/mock/gomock"
+	model "github.com/vliubezny/gnotify/internal/model"
+	reflect "reflect"
+)
+
+// MockRenderer is a mock of Renderer interface
+type MockRenderer struct {
+	ctrl     *gomock.Controller
+	recorder *MockRendererMockRecorder
+}
+
+// MockRendererMockRecorder is the mock recorder for MockRenderer
+type MockRendererMockRecorder struct {
+	mock *MockRenderer
+}
+
+// NewMockRenderer creates a new mock instance
+func NewMockRenderer(ctrl *gomock.Controller) *MockRenderer {
+	mock := &MockRenderer{ctrl: ctrl}
+	mock.recorder = &MockRendererMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockRenderer) EXPECT() *MockRendererMockRecorder {
+	return m.recorder
+}
+
+// Render mocks base method
+func (m *MockRenderer) Render(lang string, e model.Event) (string, string) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Render", lang, e)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(string)
+	return ret0, ret1
+}
+
+// Render indicates an expected call of Render
+func (mr *MockRendererMockRecorder) Render(lang, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Render", reflect.TypeOf((*MockRenderer)(nil).Render), lang, e)
+}
+
+// RenderDigest mocks base method
+func (m *MockRenderer) RenderDigest(lang string, events []model.Event) (string, string) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RenderDigest", lang, events)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(string)
+	return ret0, ret1
+}
+
+// RenderDigest indicates an expected call of RenderDigest
+func (mr *MockRendererMockRecorder) RenderDigest(lang, events interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenderDigest", reflect.TypeOf((*MockRenderer)(nil).RenderDigest), lang, events)
+}
@@ -0,0 +1,322 @@
+// Package render renders notification title and body in user language.
+//
+// Templates are loaded from JSON files named after BCP-47 language tags, e.g. pt-BR.json.
+// Every file maps event types and DIGEST to title and body messages:
+//
+//	{
+//	  "PRICE_CHANGED": {
+//	    "title": "Price changed",
+//	    "body": "Product %[1]s price changed from %[2]s to %[3]s"
+//	  },
+//	  "DIGEST": {
+//	    "title": {"arg": 1, "cases": {"one": "%d update", "other": "%d updates"}}
+//	  }
+//	}
+//
+// Messages are golang.org/x/text/message format strings, numbers are formatted according to language.
+// Message given as object selects case by plural form of the arg-th argument.
+// Arguments of PRICE_CHANGED are product ID, old price and new price with currency,
+// BACK_IN_STOCK has product ID, PROMOTION has product ID and discount percent,
+// WISHLIST has product ID and number of items left.
+// ORDER_STATUS event is rendered with ORDER_<status> messages, e.g. ORDER_SHIPPED, their argument is order ID.
+// The only argument of DIGEST title is number of events.
+//
+// Message missing for a language is looked up along its parent chain (pt-BR, pt)
+// and then in fallback language.
+package render
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+	"golang.org/x/text/number"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+//go:generate mockgen -destination=./mock/mock.go -package=mock -source=render.go
+
+// Template keys.
+const (
+	digest = "DIGEST"
+	title  = "title"
+	body   = "body"
+)
+
+// required lists messages fallback language must define.
+var required = func() []string {
+	names := []string{model.PriceChanged, model.BackInStock, model.Promotion, model.Wishlist}
+	for _, s := range model.OrderStatuses {
+		names = append(names, orderStatus(s))
+	}
+
+	keys := make([]string, 0, 2*len(names)+1)
+	for _, n := range names {
+		keys = append(keys, key(n, title), key(n, body))
+	}
+	return append(keys, key(digest, title))
+}()
+
+// Renderer renders notifications.
+type Renderer interface {
+	// Render builds message title and body for the event in the language.
+	Render(lang string, e model.Event) (title, body string)
+
+	// RenderDigest builds single message title and body for several events in the language.
+	RenderDigest(lang string, events []model.Event) (title, body string)
+}
+
+// Config configures renderer.
+type Config struct {
+	// Dir contains template files.
+	Dir string
+	// Fallback is language of messages missing for user language, English is used if empty.
+	Fallback string
+	// Currency is ISO 4217 code of event prices, USD is used if empty.
+	Currency string
+}
+
+type renderer struct {
+	cat      *catalog.Builder
+	keys     map[language.Tag]map[string]bool
+	fallback language.Tag
+	currency currency.Unit
+	// scale is number of minor currency units digits.
+	scale int
+}
+
+// New loads templates and creates renderer.
+func New(cfg Config) (Renderer, error) {
+	fallback := language.English
+	if cfg.Fallback != "" {
+		tag, err := language.Parse(cfg.Fallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback language: %w", err)
+		}
+		fallback = tag
+	}
+
+	unit := currency.USD
+	if cfg.Currency != "" {
+		u, err := currency.ParseISO(cfg.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid currency: %w", err)
+		}
+		unit = u
+	}
+	scale, _ := currency.Standard.Rounding(unit)
+
+	r := &renderer{
+		cat:      catalog.NewBuilder(),
+		keys:     make(map[language.Tag]map[string]bool),
+		fallback: fallback,
+		currency: unit,
+		scale:    scale,
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+
+	for _, f := range files {
+		if err := r.load(f); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", filepath.Base(f), err)
+		}
+	}
+
+	for _, k := range required {
+		if !r.keys[fallback][k] {
+			return nil, fmt.Errorf("fallback language %s has no %s message", fallback, k)
+		}
+	}
+
+	return r, nil
+}
+
+// load adds messages of the template file to catalog.
+func (r *renderer) load(file string) error {
+	tag, err := language.Parse(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+	if err != nil {
+		return fmt.Errorf("invalid language: %w", err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var templates map[string]map[string]template
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("failed to parse file: %w", err)
+	}
+
+	if r.keys[tag] == nil {
+		r.keys[tag] = make(map[string]bool)
+	}
+
+	for name, fields := range templates {
+		for field, t := range fields {
+			if field != title && field != body {
+				return fmt.Errorf("%s: unknown field %s", name, field)
+			}
+
+			k := key(name, field)
+			if err := r.cat.Set(tag, k, t.msg); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			r.keys[tag][k] = true
+		}
+	}
+
+	return nil
+}
+
+func (r *renderer) Render(lang string, e model.Event) (string, string) {
+	switch e.Type {
+	case model.PriceChanged:
+		p := r.printer(lang, key(e.Type, body))
+		return r.sprintf(lang, key(e.Type, title)),
+			p.Sprintf(key(e.Type, body), strconv.FormatInt(e.ProductID, 10), r.price(p, e.OldPrice), r.price(p, e.NewPrice))
+	case model.BackInStock:
+		return r.sprintf(lang, key(e.Type, title)),
+			r.sprintf(lang, key(e.Type, body), strconv.FormatInt(e.ProductID, 10))
+	case model.OrderStatus:
+		name := orderStatus(e.Status)
+		return r.sprintf(lang, key(name, title)),
+			r.sprintf(lang, key(name, body), e.OrderID)
+	case model.Promotion:
+		return r.sprintf(lang, key(e.Type, title)),
+			r.sprintf(lang, key(e.Type, body), strconv.FormatInt(e.ProductID, 10), e.Discount)
+	case model.Wishlist:
+		return r.sprintf(lang, key(e.Type, title)),
+			r.sprintf(lang, key(e.Type, body), strconv.FormatInt(e.ProductID, 10), e.Quantity)
+	default:
+		return e.Type, ""
+	}
+}
+
+func (r *renderer) RenderDigest(lang string, events []model.Event) (string, string) {
+	if len(events) == 1 {
+		return r.Render(lang, events[0])
+	}
+
+	lines := make([]string, len(events))
+	for i, e := range events {
+		_, lines[i] = r.Render(lang, e)
+	}
+
+	return r.sprintf(lang, key(digest, title), len(events)), strings.Join(lines, "\n")
+}
+
+func (r *renderer) sprintf(lang, key string, args ...interface{}) string {
+	return r.printer(lang, key).Sprintf(key, args...)
+}
+
+// printer returns printer of the language if the language or one of its parents has message,
+// otherwise printer of fallback language is returned.
+func (r *renderer) printer(lang, key string) *message.Printer {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return message.NewPrinter(r.fallback, message.Catalog(r.cat))
+	}
+
+	for t := tag; ; t = t.Parent() {
+		if r.keys[t][key] {
+			return message.NewPrinter(tag, message.Catalog(r.cat))
+		}
+
+		if t == language.Und {
+			return message.NewPrinter(r.fallback, message.Catalog(r.cat))
+		}
+	}
+}
+
+// price formats amount in minor currency units with currency symbol.
+func (r *renderer) price(p *message.Printer, amount int64) string {
+	v := float64(amount) / math.Pow10(r.scale)
+	return p.Sprintf("%v %v", currency.Symbol(r.currency), number.Decimal(v, number.Scale(r.scale)))
+}
+
+func key(name, field string) string {
+	return name + "." + field
+}
+
+// orderStatus returns template name of order status.
+func orderStatus(status string) string {
+	return "ORDER_" + status
+}
+
+// template is either plain message or plural selection.
+type template struct {
+	msg catalog.Message
+}
+
+// pluralForms orders plural selectors, "=x" and "<x" selectors go first.
+var pluralForms = map[string]int{
+	"zero":  1,
+	"one":   2,
+	"two":   3,
+	"few":   4,
+	"many":  5,
+	"other": 6,
+}
+
+func (t *template) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		t.msg = catalog.String(s)
+		return nil
+	}
+
+	var p struct {
+		Arg   int               `json:"arg"`
+		Cases map[string]string `json:"cases"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return errors.New("message must be string or plural selection")
+	}
+
+	if p.Arg < 1 {
+		return errors.New("plural arg must be positive")
+	}
+
+	if _, ok := p.Cases["other"]; !ok {
+		return errors.New("plural cases must include other")
+	}
+
+	selectors := make([]string, 0, len(p.Cases))
+	for s := range p.Cases {
+		if _, ok := pluralForms[s]; !ok && !strings.HasPrefix(s, "=") && !strings.HasPrefix(s, "<") {
+			return fmt.Errorf("unknown plural case %s", s)
+		}
+		selectors = append(selectors, s)
+	}
+	sort.Slice(selectors, func(i, j int) bool {
+		fi, fj := pluralForms[selectors[i]], pluralForms[selectors[j]]
+		if fi != fj {
+			return fi < fj
+		}
+		return selectors[i] < selectors[j]
+	})
+
+	cases := make([]interface{}, 0, 2*len(selectors))
+	for _, s := range selectors {
+		cases = append(cases, s, p.Cases[s])
+	}
+
+	t.msg = plural.Selectf(p.Arg, "", cases...)
+	return nil
+}
@@ -0,0 +1,281 @@
+package render
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const templatesDir = "../../static/templates/notifications"
+
+var priceChanged = model.Event{Type: model.PriceChanged, ProductID: 12345, OldPrice: 123450, NewPrice: 99}
+
+// events returns n price changed events.
+func events(n int) []model.Event {
+	events := make([]model.Event, n)
+	for i := range events {
+		events[i] = model.Event{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100}
+	}
+	return events
+}
+
+// writeTemplates creates template files named after languages.
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "templates")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for lang, data := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, lang+".json"), []byte(data), 0600))
+	}
+	return dir
+}
+
+const enTemplates = `{
+	"PRICE_CHANGED": {"title": "Price changed", "body": "Product %[1]s price changed from %[2]s to %[3]s"},
+	"BACK_IN_STOCK": {"title": "Back in stock", "body": "Product %[1]s is back in stock"},
+	"ORDER_PLACED": {"title": "Order placed", "body": "Order %[1]s has been placed"},
+	"ORDER_SHIPPED": {"title": "Order shipped", "body": "Order %[1]s has been shipped"},
+	"ORDER_DELIVERED": {"title": "Order delivered", "body": "Order %[1]s has been delivered"},
+	"ORDER_CANCELED": {"title": "Order canceled", "body": "Order %[1]s has been canceled"},
+	"PROMOTION": {"title": "Sale", "body": "Product %[1]s is %[2]d%% off"},
+	"WISHLIST": {"title": "Running out of stock", "body": "Only %[2]d of product %[1]s left"},
+	"DIGEST": {"title": {"arg": 1, "cases": {"one": "%d update", "=2": "two updates", "other": "%d updates"}}}
+}`
+
+func TestRenderer_Render(t *testing.T) {
+	r, err := New(Config{Dir: templatesDir})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		lang  string
+		event model.Event
+		title string
+		body  string
+	}{
+		{
+			lang:  "en",
+			event: priceChanged,
+			title: "Price changed",
+			body:  "Product 12345 price changed from $ 1,234.50 to $ 0.99",
+		},
+		{
+			lang:  "ru",
+			event: priceChanged,
+			title: "Цена изменилась",
+			body:  "Цена товара 12345 изменилась с $ 1\u00a0234,50 на $ 0,99",
+		},
+		{
+			lang:  "pt-BR",
+			event: priceChanged,
+			title: "Preço alterado",
+			body:  "O preço do produto 12345 mudou de US$ 1.234,50 para US$ 0,99",
+		},
+		{
+			lang:  "en-GB",
+			event: priceChanged,
+			title: "Price changed",
+			body:  "Product 12345 price changed from US$ 1,234.50 to US$ 0.99",
+		},
+		{
+			lang:  "ja",
+			event: priceChanged,
+			title: "Price changed",
+			body:  "Product 12345 price changed from $ 1,234.50 to $ 0.99",
+		},
+		{
+			lang:  "",
+			event: priceChanged,
+			title: "Price changed",
+			body:  "Product 12345 price changed from $ 1,234.50 to $ 0.99",
+		},
+		{
+			lang:  "en",
+			event: model.Event{Type: model.BackInStock, ProductID: 12345},
+			title: "Back in stock",
+			body:  "Product 12345 is back in stock",
+		},
+		{
+			lang:  "en",
+			event: model.Event{Type: model.OrderStatus, OrderID: "A-1001", Status: model.OrderShipped},
+			title: "Order shipped",
+			body:  "Order A-1001 has been shipped",
+		},
+		{
+			lang:  "ru",
+			event: model.Event{Type: model.OrderStatus, OrderID: "A-1001", Status: model.OrderCanceled},
+			title: "Заказ отменён",
+			body:  "Заказ A-1001 отменён",
+		},
+		{
+			lang:  "en",
+			event: model.Event{Type: model.Promotion, ProductID: 12345, Discount: 15},
+			title: "Sale",
+			body:  "Product 12345 is 15% off",
+		},
+		{
+			lang:  "en",
+			event: model.Event{Type: model.Wishlist, ProductID: 12345, Quantity: 1},
+			title: "Running out of stock",
+			body:  "Only 1 item of product 12345 from your wishlist is left",
+		},
+		{
+			lang:  "ru",
+			event: model.Event{Type: model.Wishlist, ProductID: 12345, Quantity: 3},
+			title: "Товар заканчивается",
+			body:  "Товара 12345 из вашего списка желаний осталось 3 штуки",
+		},
+		{
+			lang:  "en",
+			event: model.Event{Type: "UNKNOWN"},
+			title: "UNKNOWN",
+			body:  "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.lang+" "+tc.event.Type, func(t *testing.T) {
+			title, body := r.Render(tc.lang, tc.event)
+
+			assert.Equal(t, tc.title, title)
+			assert.Equal(t, tc.body, body)
+		})
+	}
+}
+
+func TestRenderer_RenderDigest(t *testing.T) {
+	r, err := New(Config{Dir: templatesDir})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		lang   string
+		events []model.Event
+		title  string
+	}{
+		{lang: "en", events: events(1), title: "Price changed"},
+		{lang: "en", events: events(2), title: "2 updates"},
+		{lang: "ru", events: events(2), title: "2 обновления"},
+		{lang: "ru", events: events(5), title: "5 обновлений"},
+		{lang: "ru", events: events(21), title: "21 обновление"},
+		{lang: "pl", events: events(22), title: "22 aktualizacje"},
+		{lang: "pt-BR", events: events(3), title: "3 atualizações"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.title, func(t *testing.T) {
+			title, _ := r.RenderDigest(tc.lang, tc.events)
+
+			assert.Equal(t, tc.title, title)
+		})
+	}
+
+	_, body := r.RenderDigest("en", events(2))
+	assert.Equal(t, "Product 1 price changed from $ 2.00 to $ 1.00\nProduct 1 price changed from $ 2.00 to $ 1.00", body)
+}
+
+func TestRenderer_fallback(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"en":    enTemplates,
+		"pt":    `{"PRICE_CHANGED": {"title": "Preço alterado", "body": "Produto %[1]s: %[2]s → %[3]s"}}`,
+		"pt-BR": `{"PRICE_CHANGED": {"title": "Preço mudou"}}`,
+	})
+
+	r, err := New(Config{Dir: dir, Currency: "EUR"})
+	require.NoError(t, err)
+
+	title, body := r.Render("pt-BR", priceChanged)
+	assert.Equal(t, "Preço mudou", title)
+	assert.Equal(t, "Produto 12345: € 1.234,50 → € 0,99", body)
+
+	title, body = r.Render("pt", priceChanged)
+	assert.Equal(t, "Preço alterado", title)
+	assert.Equal(t, "Produto 12345: € 1.234,50 → € 0,99", body)
+
+	title, _ = r.RenderDigest("pt-BR", events(2))
+	assert.Equal(t, "two updates", title)
+
+	title, _ = r.RenderDigest("pt-BR", events(3))
+	assert.Equal(t, "3 updates", title)
+}
+
+func TestRenderer_currency(t *testing.T) {
+	r, err := New(Config{Dir: writeTemplates(t, map[string]string{"en": enTemplates}), Currency: "JPY"})
+	require.NoError(t, err)
+
+	_, body := r.Render("en", priceChanged)
+	assert.Equal(t, "Product 12345 price changed from ¥ 123,450 to ¥ 99", body)
+}
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		files map[string]string
+		cfg   Config
+		err   string
+	}{
+		{
+			desc:  "invalid fallback",
+			files: map[string]string{"en": enTemplates},
+			cfg:   Config{Fallback: "!"},
+			err:   "invalid fallback language: language: tag is not well-formed",
+		},
+		{
+			desc:  "invalid currency",
+			files: map[string]string{"en": enTemplates},
+			cfg:   Config{Currency: "XYZ"},
+			err:   "invalid currency: currency: tag is not a recognized currency",
+		},
+		{
+			desc:  "no fallback templates",
+			files: map[string]string{"ru": enTemplates},
+			err:   "fallback language en has no PRICE_CHANGED.title message",
+		},
+		{
+			desc:  "missing fallback message",
+			files: map[string]string{"en": `{"PRICE_CHANGED": {"title": "Price changed"}}`},
+			err:   "fallback language en has no PRICE_CHANGED.body message",
+		},
+		{
+			desc:  "invalid language",
+			files: map[string]string{"english": enTemplates},
+			err:   "failed to load english.json: invalid language: language: tag is not well-formed",
+		},
+		{
+			desc:  "invalid json",
+			files: map[string]string{"en": `{`},
+			err:   "failed to load en.json: failed to parse file: unexpected end of JSON input",
+		},
+		{
+			desc:  "unknown field",
+			files: map[string]string{"en": `{"PRICE_CHANGED": {"subject": "Price changed"}}`},
+			err:   "failed to load en.json: PRICE_CHANGED: unknown field subject",
+		},
+		{
+			desc:  "no other case",
+			files: map[string]string{"en": `{"DIGEST": {"title": {"arg": 1, "cases": {"one": "%d update"}}}}`},
+			err:   "failed to load en.json: failed to parse file: plural cases must include other",
+		},
+		{
+			desc:  "unknown case",
+			files: map[string]string{"en": `{"DIGEST": {"title": {"arg": 1, "cases": {"single": "%d update", "other": "%d updates"}}}}`},
+			err:   "failed to load en.json: failed to parse file: unknown plural case single",
+		},
+		{
+			desc:  "no arg",
+			files: map[string]string{"en": `{"DIGEST": {"title": {"cases": {"other": "%d updates"}}}}`},
+			err:   "failed to load en.json: failed to parse file: plural arg must be positive",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tc.cfg.Dir = writeTemplates(t, tc.files)
+
+			_, err := New(tc.cfg)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const (
+	apnsBaseURL = "https://api.push.apple.com"
+
+	// apnsTokenRefresh is lifetime of provider token, APNs rejects tokens older than 1 hour
+	// and throttles tokens refreshed more often than every 20 minutes.
+	apnsTokenRefresh = 40 * time.Minute
+)
+
+// apnsGoneReasons are APNs rejection reasons that mean device token must not be used anymore.
+var apnsGoneReasons = map[string]bool{
+	"BadDeviceToken":         true,
+	"Unregistered":           true,
+	"DeviceTokenNotForTopic": true,
+}
+
+// APNsConfig configures APNs sender.
+type APNsConfig struct {
+	// KeyID is ID of APNs authentication key.
+	KeyID string
+	// TeamID is Apple developer team ID.
+	TeamID string
+	// PrivateKey is PEM encoded P-256 authentication key (.p8 file).
+	PrivateKey []byte
+	// Topic is bundle ID of the app.
+	Topic string
+	// BaseURL is APNs URL, https://api.push.apple.com is used if empty.
+	BaseURL string
+	// Client sends requests to APNs, it must support HTTP/2. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+type apnsSender struct {
+	keyID   string
+	teamID  string
+	key     *ecdsa.PrivateKey
+	topic   string
+	baseURL string
+	client  *http.Client
+	now     func() time.Time
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// NewAPNs creates sender that delivers messages to iOS apps with APNs HTTP/2 API.
+// Requests are authorized with ES256 provider tokens.
+// Sender fails with ErrGone if APNs reports that device token is no longer valid.
+func NewAPNs(cfg APNsConfig) (Sender, error) {
+	if cfg.KeyID == "" || cfg.TeamID == "" || cfg.Topic == "" {
+		return nil, errors.New("invalid APNs config: key ID, team ID and topic are required")
+	}
+
+	key, err := parseAPNsKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = apnsBaseURL
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &apnsSender{
+		keyID:   cfg.KeyID,
+		teamID:  cfg.TeamID,
+		key:     key,
+		topic:   cfg.Topic,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  client,
+		now:     time.Now,
+	}, nil
+}
+
+func parseAPNsKey(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("invalid APNs private key: PEM expected")
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs private key: %w", err)
+	}
+
+	key, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid APNs private key: ECDSA key expected")
+	}
+
+	return key, nil
+}
+
+type apnsAlert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type apnsPayload struct {
+	APS struct {
+		Alert apnsAlert `json:"alert"`
+	} `json:"aps"`
+}
+
+func (s *apnsSender) Send(ctx context.Context, msg model.Message) error {
+	var payload apnsPayload
+	payload.APS.Alert = apnsAlert{Title: msg.Title, Body: msg.Body}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	token, err := s.providerToken()
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+"/3/device/"+msg.Device.Address.Token, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	var e struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+
+	switch {
+	case resp.StatusCode == http.StatusGone || apnsGoneReasons[e.Reason]:
+		return fmt.Errorf("%w: APNs responded %s: %s", ErrGone, resp.Status, e.Reason)
+	case e.Reason == "ExpiredProviderToken" || e.Reason == "InvalidProviderToken":
+		s.resetToken()
+	}
+
+	return fmt.Errorf("failed to send notification: APNs responded %s: %s", resp.Status, e.Reason)
+}
+
+// providerToken returns cached provider token or signs new one if it is about to expire.
+func (s *apnsSender) providerToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Sub(s.issuedAt) < apnsTokenRefresh {
+		return s.token, nil
+	}
+
+	jt := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": s.teamID,
+		"iat": now.Unix(),
+	})
+	jt.Header["kid"] = s.keyID
+
+	token, err := jt.SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.issuedAt = now
+
+	return token, nil
+}
+
+func (s *apnsSender) resetToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+}
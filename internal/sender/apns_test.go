@@ -0,0 +1,186 @@
+package sender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// newAPNsKey creates authentication key in .p8 format.
+func newAPNsKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// newAPNsServer starts HTTP/2 server like APNs.
+func newAPNsServer(h http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+var apnsMsg = model.Message{
+	UserID: 1,
+	Device: model.Device{ID: "1", Name: "iPhone", Type: model.DeviceAPNs, Address: model.Address{Token: "a1b2c3"}},
+	Title:  "Price changed",
+	Body:   "Product 7 price changed from 10.99 to 9.99",
+}
+
+func TestAPNs_Send(t *testing.T) {
+	key, p8 := newAPNsKey(t)
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+
+	var (
+		reqs   []*http.Request
+		bodies []string
+	)
+	srv := newAPNsServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs = append(reqs, r)
+		bodies = append(bodies, string(body))
+		w.Header().Set("apns-id", "EC1BF194-B3B2-424A-89A9-5A918A6E6B5D")
+	})
+	defer srv.Close()
+
+	s, err := NewAPNs(APNsConfig{
+		KeyID:      "KEY1234567",
+		TeamID:     "TEAM123456",
+		PrivateKey: p8,
+		Topic:      "com.example.store",
+		BaseURL:    srv.URL,
+		Client:     srv.Client(),
+	})
+	require.NoError(t, err)
+	s.(*apnsSender).now = func() time.Time { return now }
+
+	require.NoError(t, s.Send(ctx, apnsMsg))
+	require.NoError(t, s.Send(ctx, apnsMsg))
+
+	require.Len(t, reqs, 2)
+	req := reqs[0]
+	assert.Equal(t, 2, req.ProtoMajor)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/3/device/a1b2c3", req.URL.Path)
+	assert.Equal(t, "com.example.store", req.Header.Get("apns-topic"))
+	assert.Equal(t, "alert", req.Header.Get("apns-push-type"))
+	assert.Equal(t, "10", req.Header.Get("apns-priority"))
+	assert.JSONEq(t, `{"aps": {"alert": {"title": "Price changed", "body": "Product 7 price changed from 10.99 to 9.99"}}}`, bodies[0])
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "bearer ")
+	assert.Equal(t, token, strings.TrimPrefix(reqs[1].Header.Get("Authorization"), "bearer "), "provider token must be reused")
+
+	claims := jwt.MapClaims{}
+	jt, err := (&jwt.Parser{SkipClaimsValidation: true}).ParseWithClaims(token, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, jwt.SigningMethodES256, token.Method)
+			return &key.PublicKey, nil
+		})
+	require.NoError(t, err)
+
+	assert.Equal(t, "KEY1234567", jt.Header["kid"])
+	assert.Equal(t, "TEAM123456", claims["iss"])
+	assert.Equal(t, float64(now.Unix()), claims["iat"])
+
+	// provider token is refreshed
+	now = now.Add(time.Hour)
+	require.NoError(t, s.Send(ctx, apnsMsg))
+	require.Len(t, reqs, 3)
+	assert.NotEqual(t, req.Header.Get("Authorization"), reqs[2].Header.Get("Authorization"))
+}
+
+func TestAPNs_Send_status(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		status int
+		body   string
+		err    error
+	}{
+		{
+			desc:   "unregistered",
+			status: http.StatusGone,
+			body:   `{"reason": "Unregistered", "timestamp": 1617791400000}`,
+			err:    ErrGone,
+		},
+		{
+			desc:   "bad device token",
+			status: http.StatusBadRequest,
+			body:   `{"reason": "BadDeviceToken"}`,
+			err:    ErrGone,
+		},
+		{
+			desc:   "payload too large",
+			status: http.StatusRequestEntityTooLarge,
+			body:   `{"reason": "PayloadTooLarge"}`,
+			err:    errors.New("failed to send notification: APNs responded 413 Request Entity Too Large: PayloadTooLarge"),
+		},
+		{
+			desc:   "expired provider token",
+			status: http.StatusForbidden,
+			body:   `{"reason": "ExpiredProviderToken"}`,
+			err:    errors.New("failed to send notification: APNs responded 403 Forbidden: ExpiredProviderToken"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := newAPNsServer(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			})
+			defer srv.Close()
+
+			_, p8 := newAPNsKey(t)
+			s, err := NewAPNs(APNsConfig{
+				KeyID:      "KEY1234567",
+				TeamID:     "TEAM123456",
+				PrivateKey: p8,
+				Topic:      "com.example.store",
+				BaseURL:    srv.URL,
+				Client:     srv.Client(),
+			})
+			require.NoError(t, err)
+
+			err = s.Send(ctx, apnsMsg)
+			if tc.err == ErrGone {
+				assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			} else {
+				assert.EqualError(t, err, tc.err.Error())
+				assert.False(t, errors.Is(err, ErrGone))
+			}
+		})
+	}
+}
+
+func TestNewAPNs_invalidConfig(t *testing.T) {
+	_, p8 := newAPNsKey(t)
+
+	_, err := NewAPNs(APNsConfig{TeamID: "TEAM123456", PrivateKey: p8, Topic: "com.example.store"})
+	assert.Error(t, err)
+
+	_, err = NewAPNs(APNsConfig{KeyID: "KEY1234567", TeamID: "TEAM123456", PrivateKey: []byte("key"), Topic: "com.example.store"})
+	assert.Error(t, err)
+
+	_, err = NewAPNs(APNsConfig{KeyID: "KEY1234567", TeamID: "TEAM123456", PrivateKey: p8, Topic: "com.example.store"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,340 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// Email template file names.
+const (
+	textTemplate = "email.txt.tmpl"
+	htmlTemplate = "email.html.tmpl"
+)
+
+// RecipientError states that relay rejected recipient of the email.
+type RecipientError struct {
+	Recipient string
+	// Code is SMTP reply code, 5xx codes are permanent failures.
+	Code int
+	// Status is enhanced status code (RFC 3463) of the reply, e.g. 5.1.1, it is empty if relay didn't send it.
+	Status string
+	Err    error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("recipient %s rejected: %s", e.Recipient, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether sending to the recipient will fail on retry too.
+func (e *RecipientError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// Gone reports whether mailbox doesn't exist, so sending to the address is pointless.
+// Only mailbox rejections (550, 551 and 553 replies) with addressing status 5.1.x prove that.
+func (e *RecipientError) Gone() bool {
+	switch e.Code {
+	case 550, 551, 553:
+		return strings.HasPrefix(e.Status, "5.1.")
+	default:
+		return false
+	}
+}
+
+// Is reports missing mailbox as ErrGone, so device with rejected address is disabled,
+// and every permanent rejection as ErrPermanent, so it is not retried.
+func (e *RecipientError) Is(target error) bool {
+	switch target {
+	case ErrGone:
+		return e.Gone()
+	case ErrPermanent:
+		return e.Permanent()
+	default:
+		return false
+	}
+}
+
+// enhancedStatus returns enhanced status code the reply message starts with.
+func enhancedStatus(msg string) string {
+	status := strings.SplitN(msg, " ", 2)[0]
+
+	parts := strings.Split(status, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	for _, p := range parts {
+		if _, err := strconv.Atoi(p); err != nil {
+			return ""
+		}
+	}
+
+	return status
+}
+
+// EmailConfig configures email sender.
+type EmailConfig struct {
+	// Addr is host:port of SMTP relay.
+	Addr string
+	// Username and Password authenticate with PLAIN mechanism, authentication is skipped if Username is empty.
+	Username string
+	Password string
+	// From is sender address of emails.
+	From string
+	// TemplateDir contains email.txt.tmpl and email.html.tmpl templates of email body.
+	TemplateDir string
+	// AllowPlain allows relays without STARTTLS support.
+	AllowPlain bool
+	// TLSConfig is used for STARTTLS, relay host is used as server name if it is nil.
+	TLSConfig *tls.Config
+	// Timeout limits duration of SMTP session.
+	Timeout time.Duration
+}
+
+type emailSender struct {
+	addr       string
+	host       string
+	auth       smtp.Auth
+	from       *mail.Address
+	text       *texttemplate.Template
+	html       *htmltemplate.Template
+	allowPlain bool
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	now        func() time.Time
+}
+
+// NewEmail creates sender that delivers messages as multipart text and HTML emails via SMTP relay.
+// STARTTLS is used whenever relay supports it.
+func NewEmail(cfg EmailConfig) (Sender, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay address: %w", err)
+	}
+
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+
+	text, err := texttemplate.ParseFiles(filepath.Join(cfg.TemplateDir, textTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse text template: %w", err)
+	}
+
+	html, err := htmltemplate.ParseFiles(filepath.Join(cfg.TemplateDir, htmlTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse html template: %w", err)
+	}
+
+	tlsConfig := cfg.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+
+	return &emailSender{
+		addr:       cfg.Addr,
+		host:       host,
+		auth:       auth,
+		from:       from,
+		text:       text,
+		html:       html,
+		allowPlain: cfg.AllowPlain,
+		tlsConfig:  tlsConfig,
+		timeout:    cfg.Timeout,
+		now:        time.Now,
+	}, nil
+}
+
+func (s *emailSender) Send(ctx context.Context, msg model.Message) error {
+	to := msg.Device.Address.Email
+
+	body, err := s.compose(to, msg)
+	if err != nil {
+		return fmt.Errorf("failed to compose email: %w", err)
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	if err := s.send(ctx, to, body); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+// send delivers email within single SMTP session.
+func (s *emailSender) send(ctx context.Context, to string, body []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	if d, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(d); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(s.tlsConfig); err != nil {
+			return err
+		}
+	} else if !s.allowPlain {
+		return errors.New("relay doesn't support STARTTLS")
+	}
+
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+
+	if err := c.Rcpt(to); err != nil {
+		re := &RecipientError{Recipient: to, Err: err}
+
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			re.Code = tpErr.Code
+			re.Status = enhancedStatus(tpErr.Msg)
+		}
+		return re
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+type emailData struct {
+	Title string
+	Body  string
+	// Lines are body lines, digests have line per event.
+	Lines []string
+}
+
+// compose renders email with alternative text and HTML parts.
+func (s *emailSender) compose(to string, msg model.Message) ([]byte, error) {
+	data := emailData{
+		Title: msg.Title,
+		Body:  msg.Body,
+		Lines: strings.Split(msg.Body, "\n"),
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	h := []struct{ key, value string }{
+		{"From", s.from.String()},
+		{"To", (&mail.Address{Address: to}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Title)},
+		{"Date", s.now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain(s.from.Address))},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, kv := range h {
+		fmt.Fprintf(&buf, "%s: %s\r\n", kv.key, kv.value)
+	}
+	buf.WriteString("\r\n")
+
+	if err := writePart(mw, "text/plain; charset=utf-8", func(w *quotedprintable.Writer) error {
+		return s.text.Execute(w, data)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to render text part: %w", err)
+	}
+
+	if err := writePart(mw, "text/html; charset=utf-8", func(w *quotedprintable.Writer) error {
+		return s.html.Execute(w, data)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to render html part: %w", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writePart writes quoted-printable encoded part rendered by render.
+func writePart(mw *multipart.Writer, contentType string, render func(w *quotedprintable.Writer) error) error {
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qw := quotedprintable.NewWriter(pw)
+	if err := render(qw); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+func domain(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
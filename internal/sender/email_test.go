@@ -0,0 +1,437 @@
+package sender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// smtpMessage is email accepted by fake SMTP server.
+type smtpMessage struct {
+	from string
+	to   []string
+	tls  bool
+	auth string
+	data []byte
+}
+
+// smtpServer is in-process fake SMTP relay.
+type smtpServer struct {
+	t         *testing.T
+	ln        net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+	users     map[string]string
+	rejected  map[string]bool
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newSMTPServer(t *testing.T, cert tls.Certificate) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &smtpServer{
+		t:         t,
+		ln:        ln,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		startTLS:  true,
+		users:     map[string]string{},
+		rejected:  map[string]bool{},
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *smtpServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smtpServer) Close() {
+	s.ln.Close()
+}
+
+func (s *smtpServer) Messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	var msg smtpMessage
+
+	_ = tp.PrintfLine("220 localhost fake SMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			ext := []string{"250-localhost", "250 AUTH PLAIN"}
+			if s.startTLS && !msg.tls {
+				ext = []string{"250-localhost", "250-STARTTLS", "250 AUTH PLAIN"}
+			}
+			for _, e := range ext {
+				_ = tp.PrintfLine(e)
+			}
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 ready to start TLS")
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			msg = smtpMessage{tls: true}
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			parts := strings.Split(string(creds), "\x00")
+			if len(parts) != 3 || s.users[parts[1]] != parts[2] {
+				_ = tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			msg.auth = parts[1]
+			_ = tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if s.rejected[to] {
+				_ = tp.PrintfLine("550 5.1.1 mailbox unavailable")
+				continue
+			}
+			msg.to = append(msg.to, to)
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := ioutil.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data = data
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+
+			msg = smtpMessage{tls: msg.tls, auth: msg.auth}
+			_ = tp.PrintfLine("250 queued")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// newCertificate creates self-signed certificate for localhost relay.
+func newCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+var emailMsg = model.Message{
+	UserID: 1,
+	Device: model.Device{ID: "1", Name: "Mailbox", Type: model.DeviceEmail, Address: model.Address{Email: "user@example.com"}},
+	Title:  "2 updates",
+	Body:   "Product 1 price changed from 2.00 to 1.00\nProduct <b>2</b> price changed from 3.00 to 2.50",
+}
+
+func TestEmail_Send(t *testing.T) {
+	cert, pool := newCertificate(t)
+
+	srv := newSMTPServer(t, cert)
+	defer srv.Close()
+	srv.users["gnotify"] = "secret"
+
+	s, err := NewEmail(EmailConfig{
+		Addr:        srv.Addr(),
+		Username:    "gnotify",
+		Password:    "secret",
+		From:        "Store <noreply@store.example.com>",
+		TemplateDir: "../../static/templates",
+		TLSConfig:   &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+		Timeout:     5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	s.(*emailSender).now = func() time.Time { return now }
+
+	require.NoError(t, s.Send(ctx, emailMsg))
+
+	msgs := srv.Messages()
+	require.Len(t, msgs, 1)
+	assert.True(t, msgs[0].tls)
+	assert.Equal(t, "gnotify", msgs[0].auth)
+	assert.Equal(t, "noreply@store.example.com", msgs[0].from)
+	assert.Equal(t, []string{"user@example.com"}, msgs[0].to)
+
+	m, err := mail.ReadMessage(strings.NewReader(string(msgs[0].data)))
+	require.NoError(t, err)
+
+	assert.Equal(t, `"Store" <noreply@store.example.com>`, m.Header.Get("From"))
+	assert.Equal(t, "<user@example.com>", m.Header.Get("To"))
+	assert.Equal(t, "2 updates", m.Header.Get("Subject"))
+	assert.Equal(t, "Wed, 07 Apr 2021 10:30:00 +0000", m.Header.Get("Date"))
+	assert.True(t, strings.HasSuffix(m.Header.Get("Message-ID"), "@store.example.com>"))
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		assert.Equal(t, "quoted-printable", p.Header.Get("Content-Transfer-Encoding"))
+
+		b, err := ioutil.ReadAll(quotedprintable.NewReader(p))
+		require.NoError(t, err)
+		parts[p.Header.Get("Content-Type")] = string(b)
+	}
+
+	text := parts["text/plain; charset=utf-8"]
+	assert.Contains(t, text, "2 updates\n\nProduct 1 price changed from 2.00 to 1.00\nProduct <b>2</b> price changed")
+
+	html := parts["text/html; charset=utf-8"]
+	assert.Contains(t, html, "<h1>2 updates</h1>")
+	assert.Contains(t, html, "<p>Product 1 price changed from 2.00 to 1.00</p>")
+	assert.Contains(t, html, "<p>Product &lt;b&gt;2&lt;/b&gt; price changed from 3.00 to 2.50</p>")
+}
+
+func TestEmail_Send_nonASCIISubject(t *testing.T) {
+	cert, pool := newCertificate(t)
+
+	srv := newSMTPServer(t, cert)
+	defer srv.Close()
+
+	s, err := NewEmail(EmailConfig{
+		Addr:        srv.Addr(),
+		From:        "noreply@store.example.com",
+		TemplateDir: "../../static/templates",
+		TLSConfig:   &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+	})
+	require.NoError(t, err)
+
+	msg := emailMsg
+	msg.Title = "Цена изменилась"
+	require.NoError(t, s.Send(ctx, msg))
+
+	msgs := srv.Messages()
+	require.Len(t, msgs, 1)
+
+	m, err := mail.ReadMessage(strings.NewReader(string(msgs[0].data)))
+	require.NoError(t, err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Цена изменилась", subject)
+}
+
+func TestEmail_Send_errors(t *testing.T) {
+	cert, pool := newCertificate(t)
+
+	testCases := []struct {
+		desc      string
+		startTLS  bool
+		allow     bool
+		password  string
+		rejected  bool
+		recipient bool
+		err       string
+	}{
+		{
+			desc:     "relay without STARTTLS",
+			startTLS: false,
+			password: "secret",
+			err:      "failed to send email: relay doesn't support STARTTLS",
+		},
+		{
+			desc:     "plain relay allowed",
+			startTLS: false,
+			allow:    true,
+			err:      "",
+		},
+		{
+			desc:     "authentication failed",
+			startTLS: true,
+			password: "wrong",
+			err:      "failed to send email: 535",
+		},
+		{
+			desc:      "recipient rejected",
+			startTLS:  true,
+			password:  "secret",
+			rejected:  true,
+			recipient: true,
+			err:       "failed to send email: recipient user@example.com rejected: 550",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := newSMTPServer(t, cert)
+			defer srv.Close()
+			srv.startTLS = tc.startTLS
+			srv.users["gnotify"] = "secret"
+			srv.rejected["user@example.com"] = tc.rejected
+
+			cfg := EmailConfig{
+				Addr:        srv.Addr(),
+				From:        "noreply@store.example.com",
+				TemplateDir: "../../static/templates",
+				AllowPlain:  tc.allow,
+				TLSConfig:   &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+			}
+			if tc.password != "" {
+				cfg.Username, cfg.Password = "gnotify", tc.password
+			}
+
+			s, err := NewEmail(cfg)
+			require.NoError(t, err)
+
+			err = s.Send(ctx, emailMsg)
+			if tc.err == "" {
+				require.NoError(t, err)
+				assert.Len(t, srv.Messages(), 1)
+				return
+			}
+
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Empty(t, srv.Messages())
+
+			var re *RecipientError
+			assert.Equal(t, tc.recipient, errors.As(err, &re), fmt.Sprintf("wanted recipient error got %s", err))
+			if tc.recipient {
+				assert.Equal(t, "user@example.com", re.Recipient)
+				assert.Equal(t, 550, re.Code)
+				assert.Equal(t, "5.1.1", re.Status)
+				assert.True(t, re.Permanent())
+				assert.True(t, errors.Is(err, ErrGone), fmt.Sprintf("wanted %s got %s", ErrGone, err))
+			}
+		})
+	}
+}
+
+func TestRecipientError_Is(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		code      int
+		status    string
+		gone      bool
+		permanent bool
+	}{
+		{desc: "mailbox unavailable", code: 550, status: "5.1.1", gone: true, permanent: true},
+		{desc: "user not local", code: 551, status: "5.1.6", gone: true, permanent: true},
+		{desc: "mailbox name not allowed", code: 553, status: "5.1.3", gone: true, permanent: true},
+		{desc: "policy rejection", code: 550, status: "5.7.1", permanent: true},
+		{desc: "no enhanced status", code: 550, permanent: true},
+		{desc: "message too big", code: 552, status: "5.3.4", permanent: true},
+		{desc: "transaction failed", code: 554, status: "5.1.1", permanent: true},
+		{desc: "temporary", code: 450, status: "4.2.1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := fmt.Errorf("failed to send email: %w", &RecipientError{Recipient: "user@example.com", Code: tc.code, Status: tc.status})
+
+			assert.Equal(t, tc.gone, errors.Is(err, ErrGone))
+			assert.Equal(t, tc.permanent, errors.Is(err, ErrPermanent))
+		})
+	}
+}
+
+func Test_enhancedStatus(t *testing.T) {
+	assert.Equal(t, "5.1.1", enhancedStatus("5.1.1 mailbox unavailable"))
+	assert.Equal(t, "5.7.1", enhancedStatus("5.7.1"))
+	assert.Equal(t, "", enhancedStatus("mailbox unavailable"))
+	assert.Equal(t, "", enhancedStatus("5.1 mailbox unavailable"))
+	assert.Equal(t, "", enhancedStatus("5.x.1 mailbox unavailable"))
+	assert.Equal(t, "", enhancedStatus(""))
+}
+
+func TestNewEmail_invalidConfig(t *testing.T) {
+	_, err := NewEmail(EmailConfig{Addr: "localhost", From: "noreply@example.com", TemplateDir: "../../static/templates"})
+	assert.Error(t, err)
+
+	_, err = NewEmail(EmailConfig{Addr: "localhost:25", From: "noreply", TemplateDir: "../../static/templates"})
+	assert.Error(t, err)
+
+	_, err = NewEmail(EmailConfig{Addr: "localhost:25", From: "noreply@example.com", TemplateDir: "missing"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,292 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const (
+	fcmBaseURL  = "https://fcm.googleapis.com"
+	fcmTokenURL = "https://oauth2.googleapis.com/token"
+	fcmScope    = "https://www.googleapis.com/auth/firebase.messaging"
+
+	// fcmAssertionExpiration is lifetime of service account assertion, Google accepts up to 1 hour.
+	fcmAssertionExpiration = time.Hour
+
+	// tokenExpiryDelta refreshes access tokens slightly before they expire.
+	tokenExpiryDelta = time.Minute
+)
+
+// FCMConfig configures FCM sender.
+type FCMConfig struct {
+	// Credentials is JSON key of Google service account allowed to send messages.
+	Credentials []byte
+	// BaseURL is FCM API URL, https://fcm.googleapis.com is used if empty.
+	BaseURL string
+	// TokenURL is OAuth2 token endpoint, token_uri of credentials is used if empty.
+	TokenURL string
+	// Client sends requests to FCM and token endpoint, http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// serviceAccount is Google service account JSON key.
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type fcmSender struct {
+	projectID string
+	email     string
+	keyID     string
+	key       *rsa.PrivateKey
+	baseURL   string
+	tokenURL  string
+	client    *http.Client
+	now       func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewFCM creates sender that delivers messages to mobile apps with FCM HTTP v1 API.
+// Access tokens are obtained with service account JWT assertion (RFC 7523).
+// Sender fails with ErrGone if FCM reports that registration token is no longer valid.
+func NewFCM(cfg FCMConfig) (Sender, error) {
+	var sa serviceAccount
+	if err := json.Unmarshal(cfg.Credentials, &sa); err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials: %w", err)
+	}
+
+	if sa.ProjectID == "" || sa.ClientEmail == "" {
+		return nil, errors.New("invalid FCM credentials: project_id and client_email are required")
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials private key: %w", err)
+	}
+
+	tokenURL := cfg.TokenURL
+	if tokenURL == "" {
+		tokenURL = sa.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = fcmTokenURL
+	}
+
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = fcmBaseURL
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &fcmSender{
+		projectID: sa.ProjectID,
+		email:     sa.ClientEmail,
+		keyID:     sa.PrivateKeyID,
+		key:       key,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		tokenURL:  tokenURL,
+		client:    client,
+		now:       time.Now,
+	}, nil
+}
+
+type fcmNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type fcmMessage struct {
+	Token        string          `json:"token"`
+	Notification fcmNotification `json:"notification"`
+}
+
+type fcmRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+// fcmError is error response of Google APIs.
+// Details hold FcmError error code and BadRequest field violations.
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode       string `json:"errorCode"`
+			FieldViolations []struct {
+				Field string `json:"field"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// gone reports whether error states that registration token is no longer valid:
+// the app was unregistered or the token is malformed.
+// Other errors, including bare 404 responses, don't prove that token expired.
+func (e fcmError) gone() bool {
+	invalidArgument, tokenViolated := false, false
+	for _, d := range e.Error.Details {
+		switch d.ErrorCode {
+		case "UNREGISTERED":
+			return true
+		case "INVALID_ARGUMENT":
+			invalidArgument = true
+		}
+
+		for _, v := range d.FieldViolations {
+			if v.Field == "message.token" {
+				tokenViolated = true
+			}
+		}
+	}
+
+	return invalidArgument && tokenViolated
+}
+
+func (s *fcmSender) Send(ctx context.Context, msg model.Message) error {
+	body, err := json.Marshal(fcmRequest{
+		Message: fcmMessage{
+			Token:        msg.Device.Address.Token,
+			Notification: fcmNotification{Title: msg.Title, Body: msg.Body},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to authorize: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/projects/%s/messages:send", s.baseURL, s.projectID), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	var e fcmError
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		s.resetToken()
+	}
+
+	if e.gone() {
+		return fmt.Errorf("%w: FCM responded %s", ErrGone, resp.Status)
+	}
+
+	return fmt.Errorf("failed to send message: FCM responded %s: %s", resp.Status, e.Error.Message)
+}
+
+// accessToken returns cached access token or exchanges new service account assertion for it.
+func (s *fcmSender) accessToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Before(s.expires) {
+		return s.token, nil
+	}
+
+	jt := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   s.email,
+		"scope": fcmScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(fcmAssertionExpiration).Unix(),
+	})
+	if s.keyID != "" {
+		jt.Header["kid"] = s.keyID
+	}
+
+	assertion, err := jt.SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("failed to request token: token endpoint responded %s", resp.Status)
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	if t.AccessToken == "" {
+		return "", errors.New("failed to request token: empty access token")
+	}
+
+	s.token = t.AccessToken
+	s.expires = now.Add(time.Duration(t.ExpiresIn)*time.Second - tokenExpiryDelta)
+
+	return s.token, nil
+}
+
+func (s *fcmSender) resetToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+}
@@ -0,0 +1,241 @@
+package sender
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// newServiceAccount creates service account key with token endpoint at tokenURL.
+func newServiceAccount(t *testing.T, tokenURL string) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	credentials, err := json.Marshal(serviceAccount{
+		ProjectID:    "gnotify-test",
+		PrivateKeyID: "key1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "gnotify@gnotify-test.iam.gserviceaccount.com",
+		TokenURI:     tokenURL,
+	})
+	require.NoError(t, err)
+
+	return key, credentials
+}
+
+// fakeFCM serves token endpoint and FCM messages API.
+type fakeFCM struct {
+	t      *testing.T
+	key    *rsa.PrivateKey
+	now    time.Time
+	status int
+	body   string
+
+	tokens   int
+	messages []json.RawMessage
+}
+
+func (f *fakeFCM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		require.NoError(f.t, r.ParseForm())
+		assert.Equal(f.t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		claims := jwt.MapClaims{}
+		token, err := (&jwt.Parser{SkipClaimsValidation: true}).ParseWithClaims(r.PostForm.Get("assertion"), claims,
+			func(token *jwt.Token) (interface{}, error) {
+				assert.Equal(f.t, jwt.SigningMethodRS256, token.Method)
+				return &f.key.PublicKey, nil
+			})
+		require.NoError(f.t, err)
+
+		assert.Equal(f.t, "key1", token.Header["kid"])
+		assert.Equal(f.t, "gnotify@gnotify-test.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(f.t, fcmScope, claims["scope"])
+		assert.Equal(f.t, "http://"+r.Host+"/token", claims["aud"])
+		assert.Equal(f.t, float64(f.now.Unix()), claims["iat"])
+		assert.Equal(f.t, float64(f.now.Add(time.Hour).Unix()), claims["exp"])
+
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 3600, "token_type": "Bearer"}`, f.tokens)
+	case "/v1/projects/gnotify-test/messages:send":
+		assert.Equal(f.t, fmt.Sprintf("Bearer token%d", f.tokens), r.Header.Get("Authorization"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		f.messages = append(f.messages, body)
+
+		w.WriteHeader(f.status)
+		_, _ = w.Write([]byte(f.body))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var fcmMsg = model.Message{
+	UserID: 1,
+	Device: model.Device{ID: "1", Name: "Pixel", Type: model.DeviceFCM, Address: model.Address{Token: "fcm-token"}},
+	Title:  "Price changed",
+	Body:   "Product 7 price changed from 10.99 to 9.99",
+}
+
+func TestFCM_Send(t *testing.T) {
+	f := &fakeFCM{t: t, now: time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC), status: http.StatusOK, body: `{"name": "projects/gnotify-test/messages/1"}`}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	var credentials []byte
+	f.key, credentials = newServiceAccount(t, srv.URL+"/token")
+
+	s, err := NewFCM(FCMConfig{Credentials: credentials, BaseURL: srv.URL, Client: srv.Client()})
+	require.NoError(t, err)
+	s.(*fcmSender).now = func() time.Time { return f.now }
+
+	require.NoError(t, s.Send(ctx, fcmMsg))
+	require.NoError(t, s.Send(ctx, fcmMsg))
+
+	assert.Equal(t, 1, f.tokens, "access token must be cached")
+	require.Len(t, f.messages, 2)
+	assert.JSONEq(t, `{
+		"message": {
+			"token": "fcm-token",
+			"notification": {"title": "Price changed", "body": "Product 7 price changed from 10.99 to 9.99"}
+		}
+	}`, string(f.messages[0]))
+
+	// token expired
+	f.now = f.now.Add(time.Hour)
+	require.NoError(t, s.Send(ctx, fcmMsg))
+	assert.Equal(t, 2, f.tokens)
+}
+
+func TestFCM_Send_status(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		status int
+		body   string
+		tokens int
+		err    error
+	}{
+		{
+			desc:   "unregistered",
+			status: http.StatusNotFound,
+			body:   `{"error": {"code": 404, "message": "Requested entity was not found.", "status": "NOT_FOUND", "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`,
+			tokens: 1,
+			err:    ErrGone,
+		},
+		{
+			desc:   "invalid token",
+			status: http.StatusBadRequest,
+			body:   `{"error": {"code": 400, "message": "The registration token is not a valid FCM registration token", "status": "INVALID_ARGUMENT", "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "INVALID_ARGUMENT"}, {"@type": "type.googleapis.com/google.rpc.BadRequest", "fieldViolations": [{"field": "message.token", "description": "Invalid registration token"}]}]}}`,
+			tokens: 1,
+			err:    ErrGone,
+		},
+		{
+			desc:   "invalid message",
+			status: http.StatusBadRequest,
+			body:   `{"error": {"code": 400, "message": "Invalid JSON payload received.", "status": "INVALID_ARGUMENT", "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "INVALID_ARGUMENT"}, {"@type": "type.googleapis.com/google.rpc.BadRequest", "fieldViolations": [{"field": "message.notification.title", "description": "Invalid value"}]}]}}`,
+			tokens: 1,
+			err:    errors.New("failed to send message: FCM responded 400 Bad Request: Invalid JSON payload received."),
+		},
+		{
+			desc:   "not found",
+			status: http.StatusNotFound,
+			body:   `{"error": {"code": 404, "message": "Requested entity was not found.", "status": "NOT_FOUND"}}`,
+			tokens: 1,
+			err:    errors.New("failed to send message: FCM responded 404 Not Found: Requested entity was not found."),
+		},
+		{
+			desc:   "not found without body",
+			status: http.StatusNotFound,
+			tokens: 1,
+			err:    errors.New("failed to send message: FCM responded 404 Not Found: "),
+		},
+		{
+			desc:   "unavailable",
+			status: http.StatusServiceUnavailable,
+			body:   `{"error": {"code": 503, "message": "The service is currently unavailable.", "status": "UNAVAILABLE"}}`,
+			tokens: 1,
+			err:    errors.New("failed to send message: FCM responded 503 Service Unavailable: The service is currently unavailable."),
+		},
+		{
+			desc:   "unauthenticated",
+			status: http.StatusUnauthorized,
+			body:   `{"error": {"code": 401, "message": "Request had invalid authentication credentials.", "status": "UNAUTHENTICATED"}}`,
+			tokens: 2,
+			err:    errors.New("failed to send message: FCM responded 401 Unauthorized: Request had invalid authentication credentials."),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &fakeFCM{t: t, now: time.Now(), status: tc.status, body: tc.body}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+
+			var credentials []byte
+			f.key, credentials = newServiceAccount(t, srv.URL+"/token")
+
+			s, err := NewFCM(FCMConfig{Credentials: credentials, BaseURL: srv.URL, Client: srv.Client()})
+			require.NoError(t, err)
+			s.(*fcmSender).now = func() time.Time { return f.now }
+
+			err = s.Send(ctx, fcmMsg)
+			if tc.err == ErrGone {
+				assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			} else {
+				assert.EqualError(t, err, tc.err.Error())
+				assert.False(t, errors.Is(err, ErrGone))
+			}
+
+			// unauthenticated response drops cached token
+			_ = s.Send(ctx, fcmMsg)
+			assert.Equal(t, tc.tokens, f.tokens)
+		})
+	}
+}
+
+func TestFCM_Send_tokenError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, credentials := newServiceAccount(t, srv.URL+"/token")
+
+	s, err := NewFCM(FCMConfig{Credentials: credentials, BaseURL: srv.URL, Client: srv.Client()})
+	require.NoError(t, err)
+
+	err = s.Send(ctx, fcmMsg)
+	assert.EqualError(t, err, "failed to authorize: failed to request token: token endpoint responded 400 Bad Request")
+}
+
+func TestNewFCM_invalidConfig(t *testing.T) {
+	_, err := NewFCM(FCMConfig{Credentials: []byte("{")})
+	assert.Error(t, err)
+
+	_, err = NewFCM(FCMConfig{Credentials: []byte(`{"project_id": "p", "client_email": "e", "private_key": "key"}`)})
+	assert.Error(t, err)
+
+	_, credentials := newServiceAccount(t, "")
+	credentials = []byte(strings.Replace(string(credentials), `"project_id":"gnotify-test"`, `"project_id":""`, 1))
+	_, err = NewFCM(FCMConfig{Credentials: credentials})
+	assert.Error(t, err)
+}
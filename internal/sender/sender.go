@@ -0,0 +1,104 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+//go:generate mockgen -destination=./mock/mock.go -package=mock -source=sender.go
+
+var (
+	// ErrGone states that device address expired and device must not be used anymore.
+	ErrGone = errors.New("device address is gone")
+
+	// ErrPermanent states that message can't be delivered if retried.
+	ErrPermanent = errors.New("permanent failure")
+)
+
+// Sender delivers messages to user devices.
+type Sender interface {
+	// Send delivers message to the device.
+	Send(ctx context.Context, msg model.Message) error
+}
+
+type logSender struct {
+	logger logrus.FieldLogger
+}
+
+// NewLog creates sender that writes messages to the log instead of delivering them.
+func NewLog(logger logrus.FieldLogger) Sender {
+	return &logSender{
+		logger: logger,
+	}
+}
+
+func (s *logSender) Send(ctx context.Context, msg model.Message) error {
+	s.logger.WithFields(logrus.Fields{
+		"userID":   msg.UserID,
+		"deviceID": msg.Device.ID,
+		"events":   len(msg.Events),
+	}).Infof("%s: %s", msg.Title, msg.Body)
+
+	return nil
+}
+
+type router struct {
+	senders  map[string]Sender
+	fallback Sender
+}
+
+// NewRouter creates sender that delivers messages with sender registered for device type.
+// Messages to devices of other types are delivered with fallback sender,
+// they fail with ErrPermanent if fallback is nil.
+func NewRouter(senders map[string]Sender, fallback Sender) Sender {
+	return &router{
+		senders:  senders,
+		fallback: fallback,
+	}
+}
+
+func (r *router) Send(ctx context.Context, msg model.Message) error {
+	if s, ok := r.senders[msg.Device.Type]; ok {
+		return s.Send(ctx, msg)
+	}
+
+	if r.fallback != nil {
+		return r.fallback.Send(ctx, msg)
+	}
+
+	return fmt.Errorf("%w: no sender for device type %q", ErrPermanent, msg.Device.Type)
+}
+
+// Memory is sender that keeps delivered messages in memory.
+type Memory struct {
+	mu       sync.Mutex
+	messages []model.Message
+}
+
+// NewMemory creates in-memory sender.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send saves message.
+func (s *Memory) Send(ctx context.Context, msg model.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages returns copy of delivered messages.
+func (s *Memory) Messages() []model.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]model.Message(nil), s.messages...)
+}
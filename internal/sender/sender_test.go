@@ -0,0 +1,84 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+var (
+	ctx = context.Background()
+	msg = model.Message{
+		UserID: 1,
+		Device: model.Device{ID: "1", Name: "Chrome"},
+		Title:  "Price changed",
+		Body:   "Product 7 price changed from 10.99 to 9.99",
+	}
+)
+
+func TestLogSender_Send(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+
+	require.NoError(t, NewLog(logger).Send(ctx, msg))
+
+	log := hook.LastEntry()
+	require.NotNil(t, log)
+	assert.Equal(t, "Price changed: Product 7 price changed from 10.99 to 9.99", log.Message)
+	assert.Equal(t, int64(1), log.Data["userID"])
+	assert.Equal(t, "1", log.Data["deviceID"])
+}
+
+func TestMemory_Send(t *testing.T) {
+	s := NewMemory()
+
+	require.NoError(t, s.Send(ctx, msg))
+	require.NoError(t, s.Send(ctx, msg))
+
+	assert.Equal(t, []model.Message{msg, msg}, s.Messages())
+}
+
+func TestRouter_Send(t *testing.T) {
+	webPush := NewMemory()
+
+	s := NewRouter(map[string]Sender{model.DeviceWebPush: webPush}, nil)
+
+	pushMsg := msg
+	pushMsg.Device.Type = model.DeviceWebPush
+
+	smsMsg := msg
+	smsMsg.Device.Type = model.DeviceSMS
+
+	require.NoError(t, s.Send(ctx, pushMsg))
+
+	err := s.Send(ctx, smsMsg)
+	assert.True(t, errors.Is(err, ErrPermanent), fmt.Sprintf("wanted %s got %s", ErrPermanent, err))
+	assert.EqualError(t, err, `permanent failure: no sender for device type "SMS"`)
+
+	err = s.Send(ctx, msg)
+	assert.True(t, errors.Is(err, ErrPermanent), fmt.Sprintf("wanted %s got %s", ErrPermanent, err))
+
+	assert.Equal(t, []model.Message{pushMsg}, webPush.Messages())
+}
+
+func TestRouter_Send_fallback(t *testing.T) {
+	webPush := NewMemory()
+	fallback := NewMemory()
+
+	s := NewRouter(map[string]Sender{model.DeviceWebPush: webPush}, fallback)
+
+	pushMsg := msg
+	pushMsg.Device.Type = model.DeviceWebPush
+
+	require.NoError(t, s.Send(ctx, pushMsg))
+	require.NoError(t, s.Send(ctx, msg))
+
+	assert.Equal(t, []model.Message{pushMsg}, webPush.Messages())
+	assert.Equal(t, []model.Message{msg}, fallback.Messages())
+}
@@ -0,0 +1,270 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// Webhook request headers.
+const (
+	// WebhookTimestampHeader is unix time of the request, receivers should reject old requests.
+	WebhookTimestampHeader = "X-Gnotify-Timestamp"
+	// WebhookSignatureHeader is "v1=" followed by hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+	WebhookSignatureHeader = "X-Gnotify-Signature"
+)
+
+// errPrivateAddress states that webhook resolves to address which is not publicly routable.
+var errPrivateAddress = errors.New("private address")
+
+// privateNets lists IPv4 and IPv6 private address ranges, see RFC 1918 and RFC 4193.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// PublicIP reports whether ip is publicly routable,
+// i.e. it is not loopback, link-local, private or unspecified address.
+func PublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewWebhookClient creates HTTP client which refuses to connect to addresses that are not publicly routable,
+// so customer webhooks can't reach internal services.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+				return fmt.Errorf("%w %s", errPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Transport: transport}
+}
+
+// WebhookConfig configures webhook sender.
+type WebhookConfig struct {
+	// Client sends requests to webhooks, NewWebhookClient is used if nil.
+	// Redirects are never followed.
+	Client *http.Client
+	// Timeout limits duration of a single attempt.
+	Timeout time.Duration
+	// MaxAttempts limits number of attempts, 1 disables retries.
+	MaxAttempts int
+	// Backoff is delay before the first retry, it doubles on every next retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type webhookSender struct {
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	now         func() time.Time
+}
+
+// NewWebhook creates sender that POSTs messages as JSON to customer endpoints.
+// Requests are signed with device secret, failed requests are retried with exponential backoff
+// on network errors, timeouts and 5xx responses.
+// Sender fails with ErrGone if endpoint responds 410 Gone
+// and with ErrPermanent if endpoint resolves to address which is not publicly routable.
+func NewWebhook(cfg WebhookConfig) Sender {
+	client := NewWebhookClient()
+	if cfg.Client != nil {
+		c := *cfg.Client
+		client = &c
+	}
+	// redirect responses fail the request, otherwise webhook could point requests to another host
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &webhookSender{
+		client:      client,
+		timeout:     cfg.Timeout,
+		maxAttempts: maxAttempts,
+		backoff:     cfg.Backoff,
+		maxBackoff:  cfg.MaxBackoff,
+		now:         time.Now,
+	}
+}
+
+type webhookEvent struct {
+	Type      string    `json:"type"`
+	ProductID int64     `json:"productId,omitempty"`
+	OldPrice  int64     `json:"oldPrice,omitempty"`
+	NewPrice  int64     `json:"newPrice,omitempty"`
+	OrderID   string    `json:"orderId,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Discount  int64     `json:"discount,omitempty"`
+	Quantity  int64     `json:"quantity,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type webhookPayload struct {
+	UserID   int64          `json:"userId"`
+	DeviceID string         `json:"deviceId"`
+	Title    string         `json:"title"`
+	Body     string         `json:"body"`
+	Events   []webhookEvent `json:"events"`
+}
+
+// retryableError states that attempt may succeed if retried.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func (s *webhookSender) Send(ctx context.Context, msg model.Message) error {
+	p := webhookPayload{
+		UserID:   msg.UserID,
+		DeviceID: msg.Device.ID,
+		Title:    msg.Title,
+		Body:     msg.Body,
+		Events:   make([]webhookEvent, len(msg.Events)),
+	}
+	for i, e := range msg.Events {
+		p.Events[i] = webhookEvent{
+			Type:      e.Type,
+			ProductID: e.ProductID,
+			OldPrice:  e.OldPrice,
+			NewPrice:  e.NewPrice,
+			OrderID:   e.OrderID,
+			Status:    e.Status,
+			Discount:  e.Discount,
+			Quantity:  e.Quantity,
+			CreatedAt: e.CreatedAt,
+		}
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err = s.post(ctx, msg.Device.Address, body)
+		if _, ok := err.(retryableError); !ok || attempt >= s.maxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to call webhook: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; s.maxBackoff > 0 && backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+	return nil
+}
+
+// post makes single signed request.
+func (s *webhookSender) post(ctx context.Context, address model.Address, body []byte) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, address.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	ts := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, ts)
+	req.Header.Set(WebhookSignatureHeader, "v1="+SignWebhook(address.Secret, ts, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return fmt.Errorf("%w: %v", ErrPermanent, err)
+		}
+		return retryableError{err}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: webhook responded %s", ErrGone, resp.Status)
+	case resp.StatusCode >= 500:
+		return retryableError{fmt.Errorf("webhook responded %s", resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SignWebhook returns hex encoded HMAC-SHA256 signature of webhook request body sent at timestamp.
+// Receivers compute it to verify requests.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,220 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+func TestSignWebhook(t *testing.T) {
+	assert.Equal(t, "262a97269b78a4b0a7914837f6f29dcef2a79e67b047e162439bb1d0f9c21b9f",
+		SignWebhook("secret", "1617791400", []byte(`{}`)))
+}
+
+// fakeWebhook responds with statuses in order, the last status is repeated.
+type fakeWebhook struct {
+	mu       sync.Mutex
+	statuses []int
+	delay    time.Duration
+	reqs     []*http.Request
+	bodies   [][]byte
+}
+
+func (f *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mu.Lock()
+	n := len(f.reqs)
+	f.reqs = append(f.reqs, r)
+	f.bodies = append(f.bodies, body)
+	status := f.statuses[len(f.statuses)-1]
+	if n < len(f.statuses) {
+		status = f.statuses[n]
+	}
+	f.mu.Unlock()
+
+	if n == 0 && f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+
+	w.WriteHeader(status)
+}
+
+func (f *fakeWebhook) attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.reqs)
+}
+
+func webhookMsg(url string) model.Message {
+	return model.Message{
+		UserID: 1,
+		Device: model.Device{ID: "1", Name: "CRM", Type: model.DeviceWebhook, Address: model.Address{URL: url, Secret: "secret"}},
+		Title:  "Price changed",
+		Body:   "Product 7 price changed from 10.99 to 9.99",
+		Events: []model.Event{
+			{Type: model.PriceChanged, ProductID: 7, OldPrice: 1099, NewPrice: 999, CreatedAt: time.Date(2021, time.April, 7, 10, 0, 0, 0, time.UTC)},
+		},
+	}
+}
+
+func TestWebhook_Send(t *testing.T) {
+	f := &fakeWebhook{statuses: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	s := NewWebhook(WebhookConfig{Client: srv.Client(), MaxAttempts: 3})
+	s.(*webhookSender).now = func() time.Time { return time.Unix(1617791400, 0) }
+
+	require.NoError(t, s.Send(ctx, webhookMsg(srv.URL+"/hooks/gnotify")))
+
+	require.Equal(t, 1, f.attempts())
+	req, body := f.reqs[0], f.bodies[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/hooks/gnotify", req.URL.Path)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "1617791400", req.Header.Get(WebhookTimestampHeader))
+	assert.Equal(t, "v1="+SignWebhook("secret", "1617791400", body), req.Header.Get(WebhookSignatureHeader))
+	assert.JSONEq(t, `{
+		"userId": 1,
+		"deviceId": "1",
+		"title": "Price changed",
+		"body": "Product 7 price changed from 10.99 to 9.99",
+		"events": [
+			{"type": "PRICE_CHANGED", "productId": 7, "oldPrice": 1099, "newPrice": 999, "createdAt": "2021-04-07T10:00:00Z"}
+		]
+	}`, string(body))
+}
+
+func TestWebhook_Send_retry(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		statuses []int
+		delay    time.Duration
+		attempts int
+		err      error
+	}{
+		{
+			desc:     "retry server error",
+			statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK},
+			attempts: 3,
+		},
+		{
+			desc:     "retry timeout",
+			statuses: []int{http.StatusOK},
+			delay:    200 * time.Millisecond,
+			attempts: 2,
+		},
+		{
+			desc:     "attempts exhausted",
+			statuses: []int{http.StatusServiceUnavailable},
+			attempts: 3,
+			err:      errors.New("failed to call webhook: webhook responded 503 Service Unavailable"),
+		},
+		{
+			desc:     "client error is not retried",
+			statuses: []int{http.StatusBadRequest},
+			attempts: 1,
+			err:      errors.New("failed to call webhook: webhook responded 400 Bad Request"),
+		},
+		{
+			desc:     "gone",
+			statuses: []int{http.StatusGone},
+			attempts: 1,
+			err:      ErrGone,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &fakeWebhook{statuses: tc.statuses, delay: tc.delay}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+
+			s := NewWebhook(WebhookConfig{
+				Client:      srv.Client(),
+				Timeout:     50 * time.Millisecond,
+				MaxAttempts: 3,
+				Backoff:     time.Millisecond,
+				MaxBackoff:  2 * time.Millisecond,
+			})
+
+			err := s.Send(ctx, webhookMsg(srv.URL))
+			switch {
+			case tc.err == nil:
+				assert.NoError(t, err)
+			case tc.err == ErrGone:
+				assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			default:
+				assert.EqualError(t, err, tc.err.Error())
+			}
+
+			assert.Equal(t, tc.attempts, f.attempts())
+		})
+	}
+}
+
+func TestWebhook_Send_redirect(t *testing.T) {
+	f := &fakeWebhook{statuses: []int{http.StatusOK}}
+	mux := http.NewServeMux()
+	mux.Handle("/moved", f)
+	mux.Handle("/", http.RedirectHandler("/moved", http.StatusTemporaryRedirect))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := NewWebhook(WebhookConfig{Client: srv.Client(), MaxAttempts: 3})
+
+	err := s.Send(ctx, webhookMsg(srv.URL))
+	assert.EqualError(t, err, "failed to call webhook: webhook responded 307 Temporary Redirect")
+	assert.Equal(t, 0, f.attempts())
+}
+
+func TestWebhook_Send_privateAddress(t *testing.T) {
+	f := &fakeWebhook{statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	// default client refuses to connect to loopback test server
+	s := NewWebhook(WebhookConfig{MaxAttempts: 3})
+
+	err := s.Send(ctx, webhookMsg(srv.URL))
+	assert.True(t, errors.Is(err, ErrPermanent), fmt.Sprintf("wanted %s got %s", ErrPermanent, err))
+	assert.Equal(t, 0, f.attempts())
+}
+
+func TestPublicIP(t *testing.T) {
+	testCases := []struct {
+		ip     string
+		public bool
+	}{
+		{ip: "93.184.216.34", public: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", public: true},
+		{ip: "127.0.0.1", public: false},
+		{ip: "::1", public: false},
+		{ip: "10.1.2.3", public: false},
+		{ip: "172.16.0.1", public: false},
+		{ip: "172.32.0.1", public: true},
+		{ip: "192.168.1.1", public: false},
+		{ip: "169.254.169.254", public: false},
+		{ip: "fe80::1", public: false},
+		{ip: "fd00::1", public: false},
+		{ip: "0.0.0.0", public: false},
+		{ip: "::ffff:127.0.0.1", public: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			assert.Equal(t, tc.public, PublicIP(net.ParseIP(tc.ip)))
+		})
+	}
+}
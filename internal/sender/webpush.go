@@ -0,0 +1,298 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const (
+	// recordSize is the only aes128gcm record, push services accept up to 4096 bytes of body.
+	recordSize = 4096
+
+	// headerSize is aes128gcm header with 65 bytes of sender public key as key ID.
+	headerSize = 16 + 4 + 1 + 65
+
+	// maxPayloadSize leaves room for header, padding delimiter and GCM tag.
+	maxPayloadSize = recordSize - headerSize - 1 - 16
+
+	// vapidExpiration is lifetime of VAPID token, RFC 8292 limits it to 24 hours.
+	vapidExpiration = 12 * time.Hour
+)
+
+// ErrPayloadTooLarge states that message doesn't fit into single push message.
+// It is permanent failure, the same message never fits.
+var ErrPayloadTooLarge = fmt.Errorf("%w: payload too large", ErrPermanent)
+
+// WebPushConfig configures Web Push sender.
+type WebPushConfig struct {
+	// PrivateKey is VAPID private key, base64url encoded P-256 scalar.
+	PrivateKey string
+	// Subject is mailto: or https: contact URI of the application server.
+	Subject string
+	// TTL limits how long push service keeps undelivered message.
+	TTL time.Duration
+	// Client sends requests to push services, http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+type webPushSender struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+	ttl       time.Duration
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewWebPush creates sender that delivers messages to browsers with Web Push protocol (RFC 8030).
+// Payload is encrypted as described in RFC 8291 and requests are signed with VAPID (RFC 8292).
+// Sender fails with ErrGone if push service reports that subscription expired
+// and with ErrPermanent if push service rejects the request, e.g. responds 400 or 413.
+func NewWebPush(cfg WebPushConfig) (Sender, error) {
+	key, err := parseVAPIDKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(cfg.Subject, "mailto:") && !strings.HasPrefix(cfg.Subject, "https:") {
+		return nil, fmt.Errorf("invalid VAPID subject %q: mailto: or https: URI expected", cfg.Subject)
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &webPushSender{
+		key:       key,
+		publicKey: encodePublicKey(key),
+		subject:   cfg.Subject,
+		ttl:       cfg.TTL,
+		client:    client,
+		now:       time.Now,
+	}, nil
+}
+
+// VAPIDPublicKey returns base64url encoded public key of VAPID private key.
+// Browsers need it as applicationServerKey to subscribe.
+func VAPIDPublicKey(privateKey string) (string, error) {
+	key, err := parseVAPIDKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return encodePublicKey(key), nil
+}
+
+func parseVAPIDKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeKey(privateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid VAPID private key: base64url encoded 32 bytes expected")
+	}
+
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d)
+
+	return key, nil
+}
+
+func encodePublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// decodeKey decodes base64url key tolerating padding.
+func decodeKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type webPushPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+func (s *webPushSender) Send(ctx context.Context, msg model.Message) error {
+	payload, err := json.Marshal(webPushPayload{Title: msg.Title, Body: msg.Body})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	body, err := encrypt(msg.Device.Address, payload)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt payload: %w", err)
+	}
+
+	token, err := s.vapidToken(msg.Device.Address.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, msg.Device.Address.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(s.ttl.Seconds())))
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, s.publicKey))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push message: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: push service responded %s", ErrGone, resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: push service responded %s", ErrPermanent, resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("failed to push message: push service responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// vapidToken signs JWT for origin of push service endpoint.
+func (s *webPushSender) vapidToken(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": s.now().Add(vapidExpiration).Unix(),
+		"sub": s.subject,
+	})
+
+	return token.SignedString(s.key)
+}
+
+// encrypt encrypts payload for subscription as single aes128gcm record (RFC 8188, RFC 8291).
+func encrypt(sub model.Address, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeKey(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh: %w", err)
+	}
+
+	authSecret, err := decodeKey(sub.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth: %w", err)
+	}
+
+	// ephemeral application server key
+	asPrivate, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	return encryptRecord(uaPublic, authSecret, asPrivate, salt, payload)
+}
+
+func encryptRecord(uaPublic, authSecret, asPrivate, salt, payload []byte) ([]byte, error) {
+	if len(payload) > maxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh: not a P-256 point")
+	}
+
+	asX, asY := curve.ScalarBaseMult(asPrivate)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := sx.FillBytes(make([]byte, 32))
+
+	cek, nonce, err := deriveKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	// 0x02 delimits padding of the last record
+	plaintext := append(append(make([]byte, 0, len(payload)+1), payload...), 2)
+
+	header := make([]byte, headerSize)
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], recordSize)
+	header[20] = byte(len(asPublic))
+	copy(header[21:], asPublic)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// deriveKeys derives content encryption key and nonce as described in RFC 8291 section 3.4.
+func deriveKeys(ecdhSecret, authSecret, uaPublic, asPublic, salt []byte) (cek, nonce []byte, err error) {
+	info := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+
+	ikm, err := derive(authSecret, ecdhSecret, info, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cek, err = derive(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16); err != nil {
+		return nil, nil, err
+	}
+
+	if nonce, err = derive(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12); err != nil {
+		return nil, nil, err
+	}
+
+	return cek, nonce, nil
+}
+
+func derive(salt, secret, info []byte, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), b); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return b, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,255 @@
+package sender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+func b64(s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Test vector from RFC 8291 Appendix A.
+func Test_encryptRecord(t *testing.T) {
+	body, err := encryptRecord(
+		b64("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		b64("BTBZMqHH6r4Tts7J_aSIgg"),
+		b64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"),
+		b64("DGv6ra1nlYgDCS1FRnbzlw"),
+		[]byte("When I grow up, I want to be a watermelon"),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN",
+		base64.RawURLEncoding.EncodeToString(body))
+}
+
+func Test_encryptRecord_tooLarge(t *testing.T) {
+	_, err := encryptRecord(nil, nil, nil, nil, make([]byte, maxPayloadSize+1))
+	assert.True(t, errors.Is(err, ErrPayloadTooLarge), fmt.Sprintf("wanted %s got %s", ErrPayloadTooLarge, err))
+	assert.True(t, errors.Is(err, ErrPermanent), fmt.Sprintf("wanted %s got %s", ErrPermanent, err))
+}
+
+// subscription is browser side of push subscription.
+type subscription struct {
+	key  *ecdsa.PrivateKey
+	auth []byte
+}
+
+func newSubscription(t *testing.T) subscription {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	auth := make([]byte, 16)
+	_, err = rand.Read(auth)
+	require.NoError(t, err)
+
+	return subscription{key: key, auth: auth}
+}
+
+func (s subscription) address(endpoint string) model.Address {
+	return model.Address{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(elliptic.Marshal(s.key.Curve, s.key.X, s.key.Y)),
+		Auth:     base64.RawURLEncoding.EncodeToString(s.auth),
+	}
+}
+
+// decrypt decrypts push message body like browser does.
+func (s subscription) decrypt(t *testing.T, body []byte) []byte {
+	require.True(t, len(body) > headerSize)
+
+	salt := body[:16]
+	assert.Equal(t, uint32(recordSize), binary.BigEndian.Uint32(body[16:20]))
+	require.Equal(t, byte(65), body[20])
+	asPublic := body[21:headerSize]
+
+	curve := elliptic.P256()
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	require.NotNil(t, asX)
+
+	sx, _ := curve.ScalarMult(asX, asY, s.key.D.Bytes())
+	uaPublic := elliptic.Marshal(curve, s.key.X, s.key.Y)
+
+	cek, nonce, err := deriveKeys(sx.FillBytes(make([]byte, 32)), s.auth, uaPublic, asPublic, salt)
+	require.NoError(t, err)
+
+	gcm, err := newGCM(cek)
+	require.NoError(t, err)
+
+	plaintext, err := gcm.Open(nil, nonce, body[headerSize:], nil)
+	require.NoError(t, err)
+
+	require.Equal(t, byte(2), plaintext[len(plaintext)-1])
+	return plaintext[:len(plaintext)-1]
+}
+
+func newVAPIDKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+}
+
+func TestWebPush_Send(t *testing.T) {
+	sub := newSubscription(t)
+	vapidKey := newVAPIDKey(t)
+	publicKey, err := VAPIDPublicKey(vapidKey)
+	require.NoError(t, err)
+
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+
+	var (
+		req  *http.Request
+		body []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	s, err := NewWebPush(WebPushConfig{
+		PrivateKey: vapidKey,
+		Subject:    "mailto:admin@example.com",
+		TTL:        time.Hour,
+		Client:     srv.Client(),
+	})
+	require.NoError(t, err)
+	s.(*webPushSender).now = func() time.Time { return now }
+
+	err = s.Send(ctx, model.Message{
+		UserID: 1,
+		Device: model.Device{ID: "1", Name: "Chrome", Type: model.DeviceWebPush, Address: sub.address(srv.URL + "/push/abc")},
+		Title:  "Price changed",
+		Body:   "Product 7 price changed from 10.99 to 9.99",
+	})
+	require.NoError(t, err)
+
+	require.NotNil(t, req)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/push/abc", req.URL.Path)
+	assert.Equal(t, "aes128gcm", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "3600", req.Header.Get("TTL"))
+
+	assert.JSONEq(t, `{"title": "Price changed", "body": "Product 7 price changed from 10.99 to 9.99"}`,
+		string(sub.decrypt(t, body)))
+
+	// Authorization: vapid t=<JWT>, k=<public key>
+	auth := strings.TrimPrefix(req.Header.Get("Authorization"), "vapid ")
+	parts := strings.Split(auth, ", ")
+	require.Len(t, parts, 2)
+	assert.Equal(t, "k="+publicKey, parts[1])
+
+	claims := jwt.MapClaims{}
+	_, err = (&jwt.Parser{SkipClaimsValidation: true}).ParseWithClaims(strings.TrimPrefix(parts[0], "t="), claims,
+		func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, jwt.SigningMethodES256, token.Method)
+			x, y := elliptic.Unmarshal(elliptic.P256(), b64(publicKey))
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+		})
+	require.NoError(t, err)
+
+	assert.Equal(t, srv.URL, claims["aud"])
+	assert.Equal(t, "mailto:admin@example.com", claims["sub"])
+	assert.Equal(t, float64(now.Add(12*time.Hour).Unix()), claims["exp"])
+}
+
+func TestWebPush_Send_status(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		status int
+		err    error
+	}{
+		{
+			desc:   "created",
+			status: http.StatusCreated,
+			err:    nil,
+		},
+		{
+			desc:   "not found",
+			status: http.StatusNotFound,
+			err:    ErrGone,
+		},
+		{
+			desc:   "gone",
+			status: http.StatusGone,
+			err:    ErrGone,
+		},
+		{
+			desc:   "bad request",
+			status: http.StatusBadRequest,
+			err:    ErrPermanent,
+		},
+		{
+			desc:   "payload too large",
+			status: http.StatusRequestEntityTooLarge,
+			err:    ErrPermanent,
+		},
+		{
+			desc:   "too many requests",
+			status: http.StatusTooManyRequests,
+			err:    errors.New("failed to push message: push service responded 429 Too Many Requests"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			s, err := NewWebPush(WebPushConfig{
+				PrivateKey: newVAPIDKey(t),
+				Subject:    "https://example.com",
+				Client:     srv.Client(),
+			})
+			require.NoError(t, err)
+
+			err = s.Send(ctx, model.Message{
+				Device: model.Device{Type: model.DeviceWebPush, Address: newSubscription(t).address(srv.URL)},
+			})
+
+			switch {
+			case tc.err == nil:
+				assert.NoError(t, err)
+			case tc.err == ErrGone || tc.err == ErrPermanent:
+				assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			default:
+				assert.EqualError(t, err, tc.err.Error())
+				assert.False(t, errors.Is(err, ErrGone))
+				assert.False(t, errors.Is(err, ErrPermanent))
+			}
+		})
+	}
+}
+
+func TestNewWebPush_invalidConfig(t *testing.T) {
+	_, err := NewWebPush(WebPushConfig{PrivateKey: "abc", Subject: "mailto:admin@example.com"})
+	assert.Error(t, err)
+
+	_, err = NewWebPush(WebPushConfig{PrivateKey: newVAPIDKey(t), Subject: "admin@example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,315 @@
+package graphql
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+
+	"github.com/vliubezny/gnotify/internal/auth"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+// requireAdmin returns error unless current principal is admin.
+func requireAdmin(ctx context.Context) error {
+	if !auth.FromContext(ctx).IsAdmin {
+		return errForbidden
+	}
+	return nil
+}
+
+type userFilter struct {
+	Language  *string
+	EventType *string
+	Frequency *string
+}
+
+func (f *userFilter) apply(q *model.UserQuery) {
+	if f == nil {
+		return
+	}
+
+	if f.Language != nil {
+		q.Language = *f.Language
+	}
+	if f.EventType != nil {
+		q.EventType = *f.EventType
+	}
+	if f.Frequency != nil {
+		q.Frequency = *f.Frequency
+	}
+}
+
+type usersArgs struct {
+	Filter *userFilter
+	First  int32
+	After  *string
+}
+
+// Users resolves page of users matching filter. Admin only.
+func (r *RootResolver) Users(ctx context.Context, args usersArgs) (*userConnectionResolver, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	q := model.UserQuery{First: int(args.First)}
+	if args.After != nil {
+		q.After = *args.After
+	}
+	args.Filter.apply(&q)
+
+	page, err := r.svc.GetUsers(ctx, q)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve users")
+	}
+
+	return &userConnectionResolver{page: page, svc: r.svc}, nil
+}
+
+// User resolves user by ID. Admin only.
+func (r *RootResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := parseUserID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := r.svc.GetUser(ctx, id)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve user")
+	}
+
+	return &userResolver{user: u, svc: r.svc}, nil
+}
+
+type userInput struct {
+	ID         graphql.ID
+	Language   string
+	TimeZone   *string
+	QuietHours *[]quietHoursInput
+	Version    *int32
+}
+
+// UpsertUser creates user or updates settings of existing one. Admin only.
+func (r *RootResolver) UpsertUser(ctx context.Context, args struct{ User userInput }) (*userResolver, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := parseUserID(args.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := settingsUser(ctx, r.svc, id, args.User.Language, args.User.TimeZone, args.User.QuietHours, args.User.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.svc.UpsertUser(ctx, u); err != nil {
+		return nil, wrapError(err, "failed to upsert user")
+	}
+
+	u, err = r.svc.GetUser(ctx, id)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve user")
+	}
+
+	return &userResolver{user: u, svc: r.svc}, nil
+}
+
+// DeleteUser deletes user by ID. Admin only.
+func (r *RootResolver) DeleteUser(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return false, err
+	}
+
+	id, err := parseUserID(args.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.svc.DeleteUser(ctx, id); err != nil {
+		return false, wrapError(err, "failed to delete user")
+	}
+
+	return true, nil
+}
+
+type userConnectionResolver struct {
+	page model.UserPage
+	svc  service.Service
+}
+
+func (r *userConnectionResolver) Edges() []userEdgeResolver {
+	er := make([]userEdgeResolver, len(r.page.Users))
+
+	for i, u := range r.page.Users {
+		er[i] = userEdgeResolver{user: u, svc: r.svc}
+	}
+
+	return er
+}
+
+func (r *userConnectionResolver) PageInfo() pageInfoResolver {
+	pi := pageInfoResolver{HasNextPage: r.page.NextCursor != ""}
+
+	if l := len(r.page.Users); l > 0 {
+		c := strconv.FormatInt(r.page.Users[l-1].ID, 10)
+		pi.EndCursor = &c
+	}
+
+	return pi
+}
+
+type userEdgeResolver struct {
+	user model.User
+	svc  service.Service
+}
+
+func (r userEdgeResolver) Cursor() string {
+	return strconv.FormatInt(r.user.ID, 10)
+}
+
+func (r userEdgeResolver) Node() *userResolver {
+	return &userResolver{user: r.user, svc: r.svc}
+}
+
+type deliveriesArgs struct {
+	State *string
+	First int32
+	After *string
+}
+
+// Deliveries resolves page of outbox deliveries. Admin only.
+func (r *RootResolver) Deliveries(ctx context.Context, args deliveriesArgs) (*deliveryConnectionResolver, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	q := model.DeliveryQuery{First: int(args.First)}
+	if args.State != nil {
+		q.State = *args.State
+	}
+	if args.After != nil {
+		q.After = *args.After
+	}
+
+	page, err := r.svc.GetDeliveries(ctx, q)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve deliveries")
+	}
+
+	return &deliveryConnectionResolver{page: page}, nil
+}
+
+// RequeueDelivery makes dead delivery pending again. Admin only.
+func (r *RootResolver) RequeueDelivery(ctx context.Context, args struct{ ID graphql.ID }) (*deliveryResolver, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := parseDeliveryID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := r.svc.RequeueDelivery(ctx, id, time.Now())
+	if err != nil {
+		return nil, wrapError(err, "failed to requeue delivery")
+	}
+
+	return &deliveryResolver{d}, nil
+}
+
+type deliveryResolver struct {
+	d model.Delivery
+}
+
+func (r deliveryResolver) ID() graphql.ID {
+	return graphql.ID(r.d.ID)
+}
+
+func (r deliveryResolver) UserID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(r.d.UserID, 10))
+}
+
+func (r deliveryResolver) DeviceID() graphql.ID {
+	return graphql.ID(r.d.DeviceID)
+}
+
+func (r deliveryResolver) Title() string {
+	return r.d.Title
+}
+
+func (r deliveryResolver) Body() string {
+	return r.d.Body
+}
+
+func (r deliveryResolver) State() string {
+	return r.d.State
+}
+
+func (r deliveryResolver) Attempts() int32 {
+	return int32(r.d.Attempts)
+}
+
+func (r deliveryResolver) LastError() *string {
+	if r.d.LastError == "" {
+		return nil
+	}
+	return &r.d.LastError
+}
+
+func (r deliveryResolver) NextAttemptAt() graphql.Time {
+	return graphql.Time{Time: r.d.NextAttemptAt}
+}
+
+func (r deliveryResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.d.CreatedAt}
+}
+
+func (r deliveryResolver) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: r.d.UpdatedAt}
+}
+
+type deliveryConnectionResolver struct {
+	page model.DeliveryPage
+}
+
+func (r *deliveryConnectionResolver) Edges() []deliveryEdgeResolver {
+	er := make([]deliveryEdgeResolver, len(r.page.Deliveries))
+
+	for i, d := range r.page.Deliveries {
+		er[i] = deliveryEdgeResolver{d}
+	}
+
+	return er
+}
+
+func (r *deliveryConnectionResolver) PageInfo() pageInfoResolver {
+	pi := pageInfoResolver{HasNextPage: r.page.HasNextPage}
+
+	if l := len(r.page.Deliveries); l > 0 {
+		pi.EndCursor = &r.page.Deliveries[l-1].ID
+	}
+
+	return pi
+}
+
+type deliveryEdgeResolver struct {
+	d model.Delivery
+}
+
+func (r deliveryEdgeResolver) Cursor() string {
+	return r.d.ID
+}
+
+func (r deliveryEdgeResolver) Node() deliveryResolver {
+	return deliveryResolver{r.d}
+}
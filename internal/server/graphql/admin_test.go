@@ -0,0 +1,536 @@
+package graphql
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vliubezny/gnotify/internal/auth"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+func TestSchema_adminForbidden(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		query string
+		field string
+	}{
+		{
+			desc:  "users",
+			query: `{ users { edges { cursor } } }`,
+			field: "users",
+		},
+		{
+			desc:  "user",
+			query: `{ user(id: "1") { id } }`,
+			field: "user",
+		},
+		{
+			desc:  "upsertUser",
+			query: `mutation { upsertUser(user: {id: "1", language: "en"}) { id } }`,
+			field: "upsertUser",
+		},
+		{
+			desc:  "deleteUser",
+			query: `mutation { deleteUser(id: "1") }`,
+			field: "deleteUser",
+		},
+		{
+			desc:  "deliveries",
+			query: `{ deliveries { edges { cursor } } }`,
+			field: "deliveries",
+		},
+		{
+			desc:  "requeueDelivery",
+			query: `mutation { requeueDelivery(id: "6070a5d8e4b0c1a2b3c4d5e6") { id } }`,
+			field: "requeueDelivery",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			result := s.Exec(auth.Principal{UserID: 1}.Propagate(ctx), tc.query, "", nil)
+			require.Len(t, result.Errors, 1)
+
+			assert.Equal(t, "forbidden", result.Errors[0].Message)
+			assert.Equal(t, []interface{}{tc.field}, result.Errors[0].Path)
+			assert.Equal(t, map[string]interface{}{"code": "FORBIDDEN"}, result.Errors[0].Extensions)
+		})
+	}
+}
+
+func TestSchema_users(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		query string
+		q     model.UserQuery
+		rPage model.UserPage
+		rErr  error
+		data  string
+	}{
+		{
+			desc:  "first page",
+			query: `{ users(first: 2) { edges { cursor node { id } } pageInfo { hasNextPage endCursor } } }`,
+			q:     model.UserQuery{First: 2},
+			rPage: model.UserPage{
+				Users:      []model.User{{ID: 1, Language: "en"}, {ID: 2, Language: "ru"}},
+				NextCursor: "2",
+			},
+			data: `{
+				"data": {
+					"users": {
+						"edges": [
+							{"cursor": "1", "node": {"id": "1"}},
+							{"cursor": "2", "node": {"id": "2"}}
+						],
+						"pageInfo": {"hasNextPage": true, "endCursor": "2"}
+					}
+				}
+			}`,
+		},
+		{
+			desc:  "last page",
+			query: `{ users(first: 2, after: "2") { edges { cursor } pageInfo { hasNextPage endCursor } } }`,
+			q:     model.UserQuery{First: 2, After: "2"},
+			rPage: model.UserPage{
+				Users: []model.User{{ID: 3}, {ID: 4}},
+			},
+			data: `{
+				"data": {
+					"users": {
+						"edges": [{"cursor": "3"}, {"cursor": "4"}],
+						"pageInfo": {"hasNextPage": false, "endCursor": "4"}
+					}
+				}
+			}`,
+		},
+		{
+			desc:  "filter",
+			query: `{ users(filter: {language: "ru", eventType: WISHLIST, frequency: DAILY}) { edges { cursor } } }`,
+			q:     model.UserQuery{First: 20, Language: "ru", EventType: model.Wishlist, Frequency: model.Daily},
+			rPage: model.UserPage{
+				Users: []model.User{{ID: 2}},
+			},
+			data: `{"data": {"users": {"edges": [{"cursor": "2"}]}}}`,
+		},
+		{
+			desc:  "empty page",
+			query: `{ users(after: "4") { edges { cursor } pageInfo { hasNextPage endCursor } } }`,
+			q:     model.UserQuery{First: 20, After: "4"},
+			data:  `{"data": {"users": {"edges": [], "pageInfo": {"hasNextPage": false, "endCursor": null}}}}`,
+		},
+		{
+			desc:  "invalid cursor",
+			query: `{ users(after: "abc") { edges { cursor } } }`,
+			q:     model.UserQuery{First: 20, After: "abc"},
+			rErr:  service.ErrInvalidCursor,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to resolve users: invalid cursor",
+						"path": ["users"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+		{
+			desc:  "unexpected error",
+			query: `{ users { edges { cursor } } }`,
+			q:     model.UserQuery{First: 20},
+			rErr:  assert.AnError,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to resolve users: assert.AnError general error for testing",
+						"path": ["users"]
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			svc.EXPECT().GetUsers(gomock.Any(), tc.q).Return(tc.rPage, tc.rErr)
+
+			result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), tc.query, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_user(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		id      string
+		getUser bool
+		rErr    error
+		data    string
+	}{
+		{
+			desc:    "user",
+			id:      "7",
+			getUser: true,
+			data:    `{"data": {"user": {"id": "7", "settings": {"language": {"code": "de"}}}}}`,
+		},
+		{
+			desc:    "user not found",
+			id:      "7",
+			getUser: true,
+			rErr:    service.ErrNotFound,
+			data: `{
+				"data": {"user": null},
+				"errors": [
+					{
+						"message": "failed to resolve user: not found",
+						"path": ["user"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "invalid id",
+			id:   "x7",
+			data: `{
+				"data": {"user": null},
+				"errors": [
+					{
+						"message": "invalid user id",
+						"path": ["user"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			if tc.getUser {
+				svc.EXPECT().GetUser(gomock.Any(), int64(7)).Return(model.User{ID: 7, Language: "de"}, tc.rErr)
+			}
+
+			result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), `query ($id: ID!) {
+				user(id: $id) {
+					id
+					settings { language { code } }
+				}
+			}`, "", map[string]interface{}{"id": tc.id})
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_upsertUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	s, err := NewSchema(svc)
+	require.NoError(t, err)
+
+	// omitted time zone and quiet hours keep stored values
+	stored := model.User{ID: 7, Language: "en", TimeZone: "Europe/Warsaw", QuietHours: []model.QuietHours{{Start: 0, End: 360}}, Version: 2}
+
+	gomock.InOrder(
+		svc.EXPECT().GetUser(gomock.Any(), int64(7)).Return(stored, nil),
+		svc.EXPECT().UpsertUser(gomock.Any(), model.User{ID: 7, Language: "PL", TimeZone: "Europe/Warsaw", QuietHours: stored.QuietHours, Version: 2}).Return(nil),
+		svc.EXPECT().GetUser(gomock.Any(), int64(7)).Return(model.User{ID: 7, Language: "pl"}, nil),
+	)
+
+	result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), `mutation {
+		upsertUser(user: {id: "7", language: "PL"}) {
+			id
+			settings { language { code } }
+		}
+	}`, "", nil)
+
+	json, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"data": {"upsertUser": {"id": "7", "settings": {"language": {"code": "pl"}}}}}`, string(json))
+}
+
+func TestSchema_deleteUser(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rErr error
+		data string
+	}{
+		{
+			desc: "deleteUser",
+			data: `{"data": {"deleteUser": true}}`,
+		},
+		{
+			desc: "deleteUser not found",
+			rErr: service.ErrNotFound,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to delete user: not found",
+						"path": ["deleteUser"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			svc.EXPECT().DeleteUser(gomock.Any(), int64(7)).Return(tc.rErr)
+
+			result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), `mutation {
+				deleteUser(id: "7")
+			}`, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+var deadDelivery = model.Delivery{
+	ID:            "6070a5d8e4b0c1a2b3c4d5e6",
+	UserID:        7,
+	DeviceID:      "6070a5d8e4b0c1a2b3c4d5e7",
+	Title:         "Price changed",
+	Body:          "Product 7 price changed from 10.99 to 9.99",
+	State:         model.DeliveryDead,
+	Attempts:      5,
+	LastError:     "webhook responded 503 Service Unavailable",
+	NextAttemptAt: time.Date(2021, time.April, 7, 11, 0, 0, 0, time.UTC),
+	CreatedAt:     time.Date(2021, time.April, 7, 10, 0, 0, 0, time.UTC),
+	UpdatedAt:     time.Date(2021, time.April, 7, 11, 0, 0, 0, time.UTC),
+}
+
+func TestSchema_deliveries(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		query  string
+		sQuery model.DeliveryQuery
+		rPage  model.DeliveryPage
+		rErr   error
+		data   string
+	}{
+		{
+			desc: "dead deliveries",
+			query: `{
+				deliveries(state: DEAD, first: 1, after: "6070a5d8e4b0c1a2b3c4d5ff") {
+					edges {
+						cursor
+						node { id userId deviceId title body state attempts lastError nextAttemptAt createdAt updatedAt }
+					}
+					pageInfo { hasNextPage endCursor }
+				}
+			}`,
+			sQuery: model.DeliveryQuery{State: model.DeliveryDead, First: 1, After: "6070a5d8e4b0c1a2b3c4d5ff"},
+			rPage:  model.DeliveryPage{Deliveries: []model.Delivery{deadDelivery}, HasNextPage: true},
+			data: `{
+				"data": {
+					"deliveries": {
+						"edges": [
+							{
+								"cursor": "6070a5d8e4b0c1a2b3c4d5e6",
+								"node": {
+									"id": "6070a5d8e4b0c1a2b3c4d5e6",
+									"userId": "7",
+									"deviceId": "6070a5d8e4b0c1a2b3c4d5e7",
+									"title": "Price changed",
+									"body": "Product 7 price changed from 10.99 to 9.99",
+									"state": "DEAD",
+									"attempts": 5,
+									"lastError": "webhook responded 503 Service Unavailable",
+									"nextAttemptAt": "2021-04-07T11:00:00Z",
+									"createdAt": "2021-04-07T10:00:00Z",
+									"updatedAt": "2021-04-07T11:00:00Z"
+								}
+							}
+						],
+						"pageInfo": {"hasNextPage": true, "endCursor": "6070a5d8e4b0c1a2b3c4d5e6"}
+					}
+				}
+			}`,
+		},
+		{
+			desc:   "default page",
+			query:  `{ deliveries { edges { cursor } pageInfo { hasNextPage endCursor } } }`,
+			sQuery: model.DeliveryQuery{First: 20},
+			rPage:  model.DeliveryPage{Deliveries: []model.Delivery{}},
+			data:   `{"data": {"deliveries": {"edges": [], "pageInfo": {"hasNextPage": false, "endCursor": null}}}}`,
+		},
+		{
+			desc:   "invalid cursor",
+			query:  `{ deliveries(after: "x") { edges { cursor } } }`,
+			sQuery: model.DeliveryQuery{First: 20, After: "x"},
+			rErr:   service.ErrInvalidCursor,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to resolve deliveries: invalid cursor",
+						"path": ["deliveries"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			svc.EXPECT().GetDeliveries(gomock.Any(), tc.sQuery).Return(tc.rPage, tc.rErr)
+
+			result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), tc.query, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_requeueDelivery(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		id        string
+		requeue   bool
+		rDelivery model.Delivery
+		rErr      error
+		data      string
+	}{
+		{
+			desc:    "requeued",
+			id:      deadDelivery.ID,
+			requeue: true,
+			rDelivery: func() model.Delivery {
+				d := deadDelivery
+				d.State = model.DeliveryPending
+				d.Attempts = 0
+				d.LastError = ""
+				return d
+			}(),
+			data: `{"data": {"requeueDelivery": {"id": "6070a5d8e4b0c1a2b3c4d5e6", "state": "PENDING", "attempts": 0, "lastError": null}}}`,
+		},
+		{
+			desc:    "not dead",
+			id:      deadDelivery.ID,
+			requeue: true,
+			rErr:    service.ErrConflict,
+			data: `{
+				"data": {"requeueDelivery": null},
+				"errors": [
+					{
+						"message": "failed to requeue delivery: conflict",
+						"path": ["requeueDelivery"],
+						"extensions": {"code": "CONFLICT"}
+					}
+				]
+			}`,
+		},
+		{
+			desc:    "not found",
+			id:      deadDelivery.ID,
+			requeue: true,
+			rErr:    service.ErrNotFound,
+			data: `{
+				"data": {"requeueDelivery": null},
+				"errors": [
+					{
+						"message": "failed to requeue delivery: not found",
+						"path": ["requeueDelivery"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "invalid id",
+			id:   "x",
+			data: `{
+				"data": {"requeueDelivery": null},
+				"errors": [
+					{
+						"message": "invalid delivery id",
+						"path": ["requeueDelivery"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			if tc.requeue {
+				svc.EXPECT().RequeueDelivery(gomock.Any(), tc.id, gomock.Any()).Return(tc.rDelivery, tc.rErr)
+			}
+
+			result := s.Exec(auth.Principal{UserID: 100, IsAdmin: true}.Propagate(ctx), `mutation ($id: ID!) {
+				requeueDelivery(id: $id) { id state attempts lastError }
+			}`, "", map[string]interface{}{"id": tc.id})
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
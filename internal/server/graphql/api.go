@@ -1,6 +1,342 @@
 package graphql
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const (
+	// maxEvents limits number of events in a single ingestion request.
+	maxEvents = 100
+	// maxIdempotencyKeyLen limits length of event idempotency key.
+	maxIdempotencyKeyLen = 255
+	// maxOrderIDLen limits length of order ID.
+	maxOrderIDLen = 64
+)
+
 // errorResponse represents error response
 type errorResponse struct {
 	Error string `json:"error"`
 }
+
+// Message types of graphql-ws protocol.
+const (
+	wsConnectionInit      = "connection_init"
+	wsConnectionAck       = "connection_ack"
+	wsConnectionError     = "connection_error"
+	wsConnectionKeepAlive = "ka"
+	wsConnectionTerminate = "connection_terminate"
+	wsStart               = "start"
+	wsStop                = "stop"
+	wsData                = "data"
+	wsError               = "error"
+	wsComplete            = "complete"
+)
+
+// wsMessage represents graphql-ws protocol message.
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsInitPayload represents connection_init payload.
+type wsInitPayload struct {
+	Authorization string `json:"authorization"`
+}
+
+// wsStartPayload represents start payload.
+type wsStartPayload struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// wsErrorPayload represents connection_error and error payloads.
+type wsErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// eventsRequest represents batch of ingested events.
+type eventsRequest struct {
+	Events []event `json:"events"`
+}
+
+// event represents ingested event. Exactly one event field must be set.
+// Producers must send the same idempotency key when they retry event, so it is dispatched once.
+type event struct {
+	IdempotencyKey string             `json:"idempotencyKey"`
+	PriceChanged   *priceChangedEvent `json:"priceChanged"`
+	BackInStock    *backInStockEvent  `json:"backInStock"`
+	OrderStatus    *orderStatusEvent  `json:"orderStatus"`
+	Promotion      *promotionEvent    `json:"promotion"`
+	Wishlist       *wishlistEvent     `json:"wishlist"`
+}
+
+// priceChangedEvent represents product price change. Prices are in cents.
+// Only watchers of the product are notified.
+type priceChangedEvent struct {
+	ProductID int64   `json:"productId"`
+	OldPrice  int64   `json:"oldPrice"`
+	NewPrice  int64   `json:"newPrice"`
+	Watchers  []int64 `json:"watchers"`
+}
+
+// backInStockEvent represents product return to stock.
+// Only watchers of the product are notified.
+type backInStockEvent struct {
+	ProductID int64   `json:"productId"`
+	Watchers  []int64 `json:"watchers"`
+}
+
+// orderStatusEvent represents status change of user order.
+type orderStatusEvent struct {
+	OrderID string `json:"orderId"`
+	UserID  int64  `json:"userId"`
+	Status  string `json:"status"`
+}
+
+// promotionEvent represents product discount in percent.
+// Every user is notified if users are not set.
+type promotionEvent struct {
+	ProductID int64   `json:"productId"`
+	Discount  int64   `json:"discount"`
+	Users     []int64 `json:"users"`
+}
+
+// wishlistEvent represents product from wishlists running out of stock.
+// Only users having the product in wishlist are notified.
+type wishlistEvent struct {
+	ProductID int64   `json:"productId"`
+	Quantity  int64   `json:"quantity"`
+	Users     []int64 `json:"users"`
+}
+
+// eventsResponse represents ingestion result.
+type eventsResponse struct {
+	// Accepted is number of events accepted for dispatch, duplicates are not counted.
+	Accepted int           `json:"accepted"`
+	Events   []eventResult `json:"events"`
+}
+
+// eventResult represents ingestion result of single event.
+// Duplicate event gets result of the original one.
+type eventResult struct {
+	IdempotencyKey string    `json:"idempotencyKey"`
+	EventID        string    `json:"eventId"`
+	AcceptedAt     time.Time `json:"acceptedAt"`
+	Duplicate      bool      `json:"duplicate"`
+}
+
+// toModel validates events and returns them with their idempotency keys.
+func (r eventsRequest) toModel() ([]model.Event, []string, error) {
+	if len(r.Events) == 0 {
+		return nil, nil, errors.New("events are required")
+	}
+
+	if len(r.Events) > maxEvents {
+		return nil, nil, fmt.Errorf("too many events: max %d", maxEvents)
+	}
+
+	events := make([]model.Event, len(r.Events))
+	keys := make([]string, len(r.Events))
+	seen := make(map[string]bool, len(r.Events))
+	for i, e := range r.Events {
+		me, err := e.toModel()
+		if err != nil {
+			return nil, nil, fmt.Errorf("events[%d]: %w", i, err)
+		}
+
+		if seen[e.IdempotencyKey] {
+			return nil, nil, fmt.Errorf("events[%d]: duplicate idempotencyKey", i)
+		}
+		seen[e.IdempotencyKey] = true
+
+		events[i], keys[i] = me, e.IdempotencyKey
+	}
+
+	return events, keys, nil
+}
+
+func (e event) toModel() (model.Event, error) {
+	if e.IdempotencyKey == "" {
+		return model.Event{}, errors.New("idempotencyKey is required")
+	}
+
+	if len(e.IdempotencyKey) > maxIdempotencyKeyLen {
+		return model.Event{}, fmt.Errorf("idempotencyKey is too long: max %d", maxIdempotencyKeyLen)
+	}
+
+	var (
+		me  model.Event
+		err error
+		set int
+	)
+	if e.PriceChanged != nil {
+		me, err = e.PriceChanged.toModel()
+		set++
+	}
+	if e.BackInStock != nil {
+		me, err = e.BackInStock.toModel()
+		set++
+	}
+	if e.OrderStatus != nil {
+		me, err = e.OrderStatus.toModel()
+		set++
+	}
+	if e.Promotion != nil {
+		me, err = e.Promotion.toModel()
+		set++
+	}
+	if e.Wishlist != nil {
+		me, err = e.Wishlist.toModel()
+		set++
+	}
+
+	switch {
+	case set == 0:
+		return model.Event{}, errors.New("unknown event type")
+	case set > 1:
+		return model.Event{}, errors.New("only one event type must be set")
+	}
+
+	return me, err
+}
+
+func (e priceChangedEvent) toModel() (model.Event, error) {
+	if e.ProductID <= 0 {
+		return model.Event{}, errors.New("productId must be positive")
+	}
+
+	if e.OldPrice < 0 || e.NewPrice < 0 {
+		return model.Event{}, errors.New("prices must not be negative")
+	}
+
+	if e.OldPrice == e.NewPrice {
+		return model.Event{}, errors.New("price did not change")
+	}
+
+	if err := validateUsers("watchers", e.Watchers, true); err != nil {
+		return model.Event{}, err
+	}
+
+	return model.Event{
+		Type:      model.PriceChanged,
+		UserIDs:   e.Watchers,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+	}, nil
+}
+
+func (e backInStockEvent) toModel() (model.Event, error) {
+	if e.ProductID <= 0 {
+		return model.Event{}, errors.New("productId must be positive")
+	}
+
+	if err := validateUsers("watchers", e.Watchers, true); err != nil {
+		return model.Event{}, err
+	}
+
+	return model.Event{
+		Type:      model.BackInStock,
+		UserIDs:   e.Watchers,
+		ProductID: e.ProductID,
+	}, nil
+}
+
+func (e orderStatusEvent) toModel() (model.Event, error) {
+	if e.OrderID == "" {
+		return model.Event{}, errors.New("orderId is required")
+	}
+
+	if len(e.OrderID) > maxOrderIDLen {
+		return model.Event{}, fmt.Errorf("orderId is too long: max %d", maxOrderIDLen)
+	}
+
+	if e.UserID <= 0 {
+		return model.Event{}, errors.New("userId must be positive")
+	}
+
+	if !contains(model.OrderStatuses, e.Status) {
+		return model.Event{}, fmt.Errorf("status must be one of %s", strings.Join(model.OrderStatuses, ", "))
+	}
+
+	return model.Event{
+		Type:    model.OrderStatus,
+		UserIDs: []int64{e.UserID},
+		OrderID: e.OrderID,
+		Status:  e.Status,
+	}, nil
+}
+
+func (e promotionEvent) toModel() (model.Event, error) {
+	if e.ProductID <= 0 {
+		return model.Event{}, errors.New("productId must be positive")
+	}
+
+	if e.Discount <= 0 || e.Discount >= 100 {
+		return model.Event{}, errors.New("discount must be between 1 and 99")
+	}
+
+	if err := validateUsers("users", e.Users, false); err != nil {
+		return model.Event{}, err
+	}
+
+	return model.Event{
+		Type:      model.Promotion,
+		UserIDs:   e.Users,
+		ProductID: e.ProductID,
+		Discount:  e.Discount,
+	}, nil
+}
+
+func (e wishlistEvent) toModel() (model.Event, error) {
+	if e.ProductID <= 0 {
+		return model.Event{}, errors.New("productId must be positive")
+	}
+
+	if e.Quantity <= 0 {
+		return model.Event{}, errors.New("quantity must be positive")
+	}
+
+	if err := validateUsers("users", e.Users, true); err != nil {
+		return model.Event{}, err
+	}
+
+	return model.Event{
+		Type:      model.Wishlist,
+		UserIDs:   e.Users,
+		ProductID: e.ProductID,
+		Quantity:  e.Quantity,
+	}, nil
+}
+
+// validateUsers checks that recipients of the event are valid user IDs.
+func validateUsers(field string, ids []int64, required bool) error {
+	if len(ids) == 0 && required {
+		return fmt.Errorf("%s are required", field)
+	}
+
+	for _, id := range ids {
+		if id <= 0 {
+			return fmt.Errorf("%s must be positive user IDs", field)
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package graphql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	graphql "github.com/graph-gophers/graphql-go"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+)
+
+// Error codes exposed in graphql error extensions.
+const (
+	codeNotFound        = "NOT_FOUND"
+	codeInvalidArgument = "INVALID_ARGUMENT"
+	codeForbidden       = "FORBIDDEN"
+	codeConflict        = "CONFLICT"
+)
+
+// gqlError represents graphql error with code extension.
+type gqlError struct {
+	code string
+	err  error
+}
+
+func (e *gqlError) Error() string {
+	return e.err.Error()
+}
+
+func (e *gqlError) Unwrap() error {
+	return e.err
+}
+
+// Extensions returns additional error fields.
+func (e *gqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{
+		"code": e.code,
+	}
+}
+
+var (
+	// errInvalidDeviceID is returned when device ID argument is malformed.
+	errInvalidDeviceID = &gqlError{code: codeInvalidArgument, err: errors.New("invalid device id")}
+
+	// errInvalidUserID is returned when user ID argument is malformed.
+	errInvalidUserID = &gqlError{code: codeInvalidArgument, err: errors.New("invalid user id")}
+
+	// errInvalidDeliveryID is returned when delivery ID argument is malformed.
+	errInvalidDeliveryID = &gqlError{code: codeInvalidArgument, err: errors.New("invalid delivery id")}
+
+	// errInvalidQuietHours is returned when quiet hours bound is not in HH:MM format.
+	errInvalidQuietHours = &gqlError{code: codeInvalidArgument, err: errors.New("invalid quiet hours")}
+
+	// errForbidden is returned when principal lacks required role.
+	errForbidden = &gqlError{code: codeForbidden, err: errors.New("forbidden")}
+)
+
+// parseDeviceID validates device ID argument.
+func parseDeviceID(id graphql.ID) (string, error) {
+	if _, err := model.ParseID(string(id)); err != nil {
+		return "", errInvalidDeviceID
+	}
+	return string(id), nil
+}
+
+// parseDeliveryID validates delivery ID argument.
+func parseDeliveryID(id graphql.ID) (string, error) {
+	if _, err := model.ParseID(string(id)); err != nil {
+		return "", errInvalidDeliveryID
+	}
+	return string(id), nil
+}
+
+// parseUserID validates user ID argument.
+func parseUserID(id graphql.ID) (int64, error) {
+	v, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, errInvalidUserID
+	}
+	return v, nil
+}
+
+// wrapError adds message to service error and assigns code to known errors.
+func wrapError(err error, message string) error {
+	err = fmt.Errorf("%s: %w", message, err)
+
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		return &gqlError{code: codeNotFound, err: err}
+	case errors.Is(err, service.ErrConflict):
+		return &gqlError{code: codeConflict, err: err}
+	case errors.Is(err, service.ErrInvalidCursor), errors.Is(err, service.ErrInvalidLanguage),
+		errors.Is(err, service.ErrInvalidTimeZone), errors.Is(err, service.ErrInvalidQuietHours),
+		errors.Is(err, service.ErrInvalidDevice):
+		return &gqlError{code: codeInvalidArgument, err: err}
+	default:
+		return err
+	}
+}
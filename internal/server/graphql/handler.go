@@ -2,7 +2,11 @@ package graphql
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
 )
 
 // graphqlHandler handles graphql requests.
@@ -27,3 +31,77 @@ func (s *server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseJSON)
 }
+
+// eventsHandler accepts batch of events for dispatch.
+func (s *server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	l := getLogger(r)
+
+	var req eventsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(l.WithError(err), w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	events, keys, err := req.toModel()
+	if err != nil {
+		writeError(l, w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	now := s.now()
+
+	// event is saved with its key and dispatched from storage,
+	// so concurrent retries find the key and accepted event survives restarts
+	accepted := 0
+	results := make([]eventResult, len(events))
+	for i, e := range events {
+		e.CreatedAt = now
+
+		k, ok, err := s.svc.AddIdempotencyKey(ctx, model.IdempotencyKey{
+			Key:        keys[i],
+			EventID:    model.NewID(),
+			Event:      e,
+			AcceptedAt: now,
+			ExpiresAt:  now.Add(s.keyTTL),
+		})
+		if err != nil {
+			// events saved before are accepted, retry of the batch gets them as duplicates
+			writeInternalError(l.WithError(err), w, "failed to save idempotency key")
+			return
+		}
+
+		results[i] = eventResult{
+			IdempotencyKey: k.Key,
+			EventID:        k.EventID,
+			AcceptedAt:     k.AcceptedAt,
+			Duplicate:      !ok,
+		}
+
+		if ok {
+			accepted++
+		}
+	}
+
+	writeJSON(l, w, http.StatusAccepted, eventsResponse{Accepted: accepted, Events: results})
+}
+
+// backupHandler streams storage snapshot.
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	l := getLogger(r)
+
+	// headers are sent with the first chunk of snapshot, so errors can still be reported until then
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="gnotify.db"`)
+
+	if err := s.svc.Backup(r.Context(), w); err != nil {
+		if errors.Is(err, service.ErrBackupNotSupported) {
+			w.Header().Del("Content-Disposition")
+			w.Header().Set("Content-Type", "application/json")
+			writeError(l, w, http.StatusNotImplemented, err.Error())
+			return
+		}
+
+		l.WithError(err).Error("failed to backup storage")
+	}
+}
@@ -1,15 +1,27 @@
 package graphql
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
 	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
+	serviceMock "github.com/vliubezny/gnotify/internal/service/mock"
+	"github.com/vliubezny/gnotify/internal/storage/memory"
 )
 
 type resolver struct{}
@@ -47,3 +59,384 @@ func TestServer_graphqlHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Result().StatusCode)
 	assert.JSONEq(t, `{"data":{"hello":"world"}}`, string(body))
 }
+
+func TestServer_eventsHandler(t *testing.T) {
+	now := time.Date(2021, time.April, 7, 10, 0, 0, 0, time.UTC)
+	seen := model.IdempotencyKey{
+		Key:        "k1",
+		EventID:    "original",
+		AcceptedAt: now.Add(-time.Minute),
+		ExpiresAt:  now.Add(59 * time.Minute),
+	}
+
+	testCases := []struct {
+		desc   string
+		body   string
+		seen   []model.IdempotencyKey
+		kErr   error
+		keys   int
+		events []model.Event
+		rcode  int
+		rdata  string
+	}{
+		{
+			desc: "success",
+			body: `{"events":[
+				{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1,2]}},
+				{"idempotencyKey":"k2","priceChanged":{"productId":2,"oldPrice":100,"newPrice":200,"watchers":[1]}}
+			]}`,
+			keys: 2,
+			events: []model.Event{
+				{Type: model.PriceChanged, UserIDs: []int64{1, 2}, ProductID: 1, OldPrice: 1099, NewPrice: 999, CreatedAt: now},
+				{Type: model.PriceChanged, UserIDs: []int64{1}, ProductID: 2, OldPrice: 100, NewPrice: 200, CreatedAt: now},
+			},
+			rcode: http.StatusAccepted,
+			rdata: `{"accepted":2,"events":[
+				{"idempotencyKey":"k1","eventId":"event-k1","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false},
+				{"idempotencyKey":"k2","eventId":"event-k2","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false}
+			]}`,
+		},
+		{
+			desc: "all event types",
+			body: `{"events":[
+				{"idempotencyKey":"k1","backInStock":{"productId":1,"watchers":[1,2]}},
+				{"idempotencyKey":"k2","orderStatus":{"orderId":"A-1001","userId":1,"status":"SHIPPED"}},
+				{"idempotencyKey":"k3","promotion":{"productId":2,"discount":15}},
+				{"idempotencyKey":"k4","wishlist":{"productId":3,"quantity":2,"users":[2]}}
+			]}`,
+			keys: 4,
+			events: []model.Event{
+				{Type: model.BackInStock, UserIDs: []int64{1, 2}, ProductID: 1, CreatedAt: now},
+				{Type: model.OrderStatus, UserIDs: []int64{1}, OrderID: "A-1001", Status: model.OrderShipped, CreatedAt: now},
+				{Type: model.Promotion, ProductID: 2, Discount: 15, CreatedAt: now},
+				{Type: model.Wishlist, UserIDs: []int64{2}, ProductID: 3, Quantity: 2, CreatedAt: now},
+			},
+			rcode: http.StatusAccepted,
+			rdata: `{"accepted":4,"events":[
+				{"idempotencyKey":"k1","eventId":"event-k1","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false},
+				{"idempotencyKey":"k2","eventId":"event-k2","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false},
+				{"idempotencyKey":"k3","eventId":"event-k3","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false},
+				{"idempotencyKey":"k4","eventId":"event-k4","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false}
+			]}`,
+		},
+		{
+			desc: "duplicate event",
+			body: `{"events":[
+				{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}},
+				{"idempotencyKey":"k2","priceChanged":{"productId":2,"oldPrice":100,"newPrice":200,"watchers":[1]}}
+			]}`,
+			seen: []model.IdempotencyKey{seen},
+			keys: 2,
+			events: []model.Event{
+				{Type: model.PriceChanged, UserIDs: []int64{1}, ProductID: 2, OldPrice: 100, NewPrice: 200, CreatedAt: now},
+			},
+			rcode: http.StatusAccepted,
+			rdata: `{"accepted":1,"events":[
+				{"idempotencyKey":"k1","eventId":"original","acceptedAt":"2021-04-07T09:59:00Z","duplicate":true},
+				{"idempotencyKey":"k2","eventId":"event-k2","acceptedAt":"2021-04-07T10:00:00Z","duplicate":false}
+			]}`,
+		},
+		{
+			desc:  "all events are duplicates",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`,
+			seen:  []model.IdempotencyKey{seen},
+			keys:  1,
+			rcode: http.StatusAccepted,
+			rdata: `{"accepted":0,"events":[
+				{"idempotencyKey":"k1","eventId":"original","acceptedAt":"2021-04-07T09:59:00Z","duplicate":true}
+			]}`,
+		},
+		{
+			desc:  "invalid body",
+			body:  `{"events":`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"invalid request body"}`,
+		},
+		{
+			desc:  "no events",
+			body:  `{"events":[]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events are required"}`,
+		},
+		{
+			desc:  "no idempotency key",
+			body:  `{"events":[{"priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: idempotencyKey is required"}`,
+		},
+		{
+			desc:  "long idempotency key",
+			body:  `{"events":[{"idempotencyKey":"` + strings.Repeat("k", maxIdempotencyKeyLen+1) + `","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: idempotencyKey is too long: max 255"}`,
+		},
+		{
+			desc: "repeated idempotency key",
+			body: `{"events":[
+				{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}},
+				{"idempotencyKey":"k1","priceChanged":{"productId":2,"oldPrice":100,"newPrice":200,"watchers":[1]}}
+			]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[1]: duplicate idempotencyKey"}`,
+		},
+		{
+			desc:  "unknown event",
+			body:  `{"events":[{"idempotencyKey":"k1","orderShipped":{}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: unknown event type"}`,
+		},
+		{
+			desc:  "several event types",
+			body:  `{"events":[{"idempotencyKey":"k1","backInStock":{"productId":1,"watchers":[1]},"wishlist":{"productId":1,"quantity":1,"users":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: only one event type must be set"}`,
+		},
+		{
+			desc:  "invalid product",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: productId must be positive"}`,
+		},
+		{
+			desc:  "negative price",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":-1,"newPrice":999,"watchers":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: prices must not be negative"}`,
+		},
+		{
+			desc:  "same price",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":999,"newPrice":999,"watchers":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: price did not change"}`,
+		},
+		{
+			desc:  "no watchers",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: watchers are required"}`,
+		},
+		{
+			desc:  "invalid watcher",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[0]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: watchers must be positive user IDs"}`,
+		},
+		{
+			desc:  "back in stock without watchers",
+			body:  `{"events":[{"idempotencyKey":"k1","backInStock":{"productId":1}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: watchers are required"}`,
+		},
+		{
+			desc:  "no order",
+			body:  `{"events":[{"idempotencyKey":"k1","orderStatus":{"userId":1,"status":"SHIPPED"}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: orderId is required"}`,
+		},
+		{
+			desc:  "long order",
+			body:  `{"events":[{"idempotencyKey":"k1","orderStatus":{"orderId":"` + strings.Repeat("1", maxOrderIDLen+1) + `","userId":1,"status":"SHIPPED"}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: orderId is too long: max 64"}`,
+		},
+		{
+			desc:  "invalid order user",
+			body:  `{"events":[{"idempotencyKey":"k1","orderStatus":{"orderId":"A-1001","status":"SHIPPED"}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: userId must be positive"}`,
+		},
+		{
+			desc:  "unknown order status",
+			body:  `{"events":[{"idempotencyKey":"k1","orderStatus":{"orderId":"A-1001","userId":1,"status":"LOST"}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: status must be one of PLACED, SHIPPED, DELIVERED, CANCELED"}`,
+		},
+		{
+			desc:  "invalid discount",
+			body:  `{"events":[{"idempotencyKey":"k1","promotion":{"productId":1,"discount":100}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: discount must be between 1 and 99"}`,
+		},
+		{
+			desc:  "invalid promotion user",
+			body:  `{"events":[{"idempotencyKey":"k1","promotion":{"productId":1,"discount":10,"users":[-1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: users must be positive user IDs"}`,
+		},
+		{
+			desc:  "invalid quantity",
+			body:  `{"events":[{"idempotencyKey":"k1","wishlist":{"productId":1,"quantity":0,"users":[1]}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: quantity must be positive"}`,
+		},
+		{
+			desc:  "wishlist without users",
+			body:  `{"events":[{"idempotencyKey":"k1","wishlist":{"productId":1,"quantity":1}}]}`,
+			rcode: http.StatusBadRequest,
+			rdata: `{"error":"events[0]: users are required"}`,
+		},
+		{
+			desc:  "idempotency key error",
+			body:  `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`,
+			kErr:  assert.AnError,
+			keys:  1,
+			rcode: http.StatusInternalServerError,
+			rdata: `{"error":"internal error"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var saved []model.Event
+			svc := serviceMock.NewMockService(ctrl)
+			svc.EXPECT().AddIdempotencyKey(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+				if tc.kErr != nil {
+					return model.IdempotencyKey{}, false, tc.kErr
+				}
+
+				for _, s := range tc.seen {
+					if s.Key == k.Key {
+						return s, false, nil
+					}
+				}
+
+				assert.Equal(t, now, k.AcceptedAt)
+				assert.Equal(t, now.Add(time.Hour), k.ExpiresAt)
+				saved = append(saved, k.Event)
+				k.EventID = "event-" + k.Key
+				return k, true, nil
+			}).Times(tc.keys)
+
+			srv := &server{
+				svc:    svc,
+				keyTTL: time.Hour,
+				now:    func() time.Time { return now },
+			}
+
+			logger, _ := test.NewNullLogger()
+			ctx := context.WithValue(context.Background(), loggerKey{}, logger)
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(tc.body)).WithContext(ctx)
+
+			srv.eventsHandler(rec, r)
+
+			body, _ := ioutil.ReadAll(rec.Result().Body)
+
+			assert.Equal(t, tc.rcode, rec.Result().StatusCode)
+			assert.JSONEq(t, tc.rdata, string(body))
+			assert.Equal(t, tc.events, saved)
+		})
+	}
+}
+
+func TestServer_eventsHandler_concurrentRetries(t *testing.T) {
+	const n = 50
+
+	svc := service.New(memory.New())
+	srv := &server{
+		svc:    svc,
+		keyTTL: time.Hour,
+		now:    time.Now,
+	}
+
+	logger, _ := test.NewNullLogger()
+	ctx := context.WithValue(context.Background(), loggerKey{}, logger)
+	body := `{"events":[{"idempotencyKey":"k1","priceChanged":{"productId":1,"oldPrice":1099,"newPrice":999,"watchers":[1]}}]}`
+
+	start := make(chan struct{})
+	results := make([]eventsResponse, n)
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)).WithContext(ctx)
+			srv.eventsHandler(rec, r)
+
+			codes[i] = rec.Result().StatusCode
+			_ = json.NewDecoder(rec.Result().Body).Decode(&results[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	pending, err := svc.LeaseEvents(ctx, time.Now(), time.Minute, n)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1, "event must be saved for dispatch once")
+
+	accepted := 0
+	for i := 0; i < n; i++ {
+		require.Equal(t, http.StatusAccepted, codes[i])
+		require.Len(t, results[i].Events, 1)
+		accepted += results[i].Accepted
+
+		assert.Equal(t, results[0].Events[0].EventID, results[i].Events[0].EventID)
+		assert.True(t, results[0].Events[0].AcceptedAt.Equal(results[i].Events[0].AcceptedAt))
+		assert.Equal(t, results[i].Accepted == 0, results[i].Events[0].Duplicate)
+	}
+	assert.Equal(t, 1, accepted)
+}
+
+func TestServer_backupHandler(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		data  string
+		err   error
+		rcode int
+		rtype string
+		rdata string
+	}{
+		{
+			desc:  "success",
+			data:  "snapshot",
+			rcode: http.StatusOK,
+			rtype: "application/octet-stream",
+			rdata: "snapshot",
+		},
+		{
+			desc:  "not supported",
+			err:   service.ErrBackupNotSupported,
+			rcode: http.StatusNotImplemented,
+			rtype: "application/json",
+			rdata: `{"error":"backup is not supported by storage"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := serviceMock.NewMockService(ctrl)
+			svc.EXPECT().Backup(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, w io.Writer) error {
+				if tc.err != nil {
+					return tc.err
+				}
+				_, err := io.WriteString(w, tc.data)
+				return err
+			})
+
+			srv := &server{
+				svc: svc,
+			}
+
+			logger, _ := test.NewNullLogger()
+			ctx := context.WithValue(context.Background(), loggerKey{}, logger)
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/backup", nil).WithContext(ctx)
+
+			srv.backupHandler(rec, r)
+
+			body, _ := ioutil.ReadAll(rec.Result().Body)
+
+			assert.Equal(t, tc.rcode, rec.Result().StatusCode)
+			assert.Equal(t, tc.rtype, rec.Result().Header.Get("Content-Type"))
+			assert.Equal(t, tc.rdata, string(body))
+		})
+	}
+}
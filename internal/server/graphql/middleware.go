@@ -69,3 +69,15 @@ func jwtAuthMiddleware(authenticator auth.Authenticator) func(http.Handler) http
 		})
 	}
 }
+
+// adminMiddleware allows only administrators to proceed.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.FromContext(r.Context()).IsAdmin {
+			writeError(getLogger(r), w, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
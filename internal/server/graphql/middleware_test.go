@@ -140,3 +140,46 @@ func Test_jwtAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func Test_adminMiddleware(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		principal auth.Principal
+		rcode     int
+		rdata     string
+	}{
+		{
+			desc:      "allow admin",
+			principal: auth.Principal{UserID: 1, IsAdmin: true},
+			rcode:     http.StatusOK,
+			rdata:     `{"result":"OK"}`,
+		},
+		{
+			desc:      "forbid user",
+			principal: auth.Principal{UserID: 1},
+			rcode:     http.StatusForbidden,
+			rdata:     `{"error":"forbidden"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			ctx := context.WithValue(context.Background(), loggerKey{}, logger)
+			ctx = tc.principal.Propagate(ctx)
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"result":"OK"}`))
+			})
+
+			adminMiddleware(h).ServeHTTP(rec, req)
+
+			body, _ := ioutil.ReadAll(rec.Result().Body)
+
+			assert.Equal(t, tc.rcode, rec.Result().StatusCode)
+			assert.JSONEq(t, tc.rdata, string(body))
+		})
+	}
+}
@@ -2,9 +2,11 @@ package graphql
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"time"
 
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/vliubezny/gnotify/internal/auth"
@@ -16,15 +18,33 @@ import (
 
 type userResolver struct {
 	user model.User
+	svc  service.Service
 }
 
 func (r *userResolver) ID() graphql.ID {
 	return graphql.ID(strconv.FormatInt(r.user.ID, 10))
 }
 
+// Version resolves user version which clients pass back to detect concurrent changes.
+func (r *userResolver) Version() int32 {
+	return int32(r.user.Version)
+}
+
 func (r *userResolver) Settings() settingsResolver {
+	qr := make([]quietHoursResolver, len(r.user.QuietHours))
+	for i, q := range r.user.QuietHours {
+		qr[i] = quietHoursResolver{Start: formatClock(q.Start), End: formatClock(q.End)}
+	}
+
+	tz := r.user.TimeZone
+	if tz == "" {
+		tz = "UTC"
+	}
+
 	return settingsResolver{
-		Language: languageResolver{Code: r.user.Language},
+		Language:   languageResolver{Code: r.user.Language},
+		TimeZone:   tz,
+		QuietHours: qr,
 	}
 }
 
@@ -38,8 +58,136 @@ func (r *userResolver) Devices() []deviceResolver {
 	return dr
 }
 
+type notificationsArgs struct {
+	First      int32
+	After      *string
+	UnreadOnly bool
+}
+
+func (r *userResolver) Notifications(ctx context.Context, args notificationsArgs) (*notificationConnectionResolver, error) {
+	q := model.NotificationQuery{
+		First:      int(args.First),
+		UnreadOnly: args.UnreadOnly,
+	}
+	if args.After != nil {
+		q.After = *args.After
+	}
+
+	page, err := r.svc.GetNotifications(ctx, r.user.ID, q)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve notifications")
+	}
+
+	return &notificationConnectionResolver{page: page}, nil
+}
+
 type settingsResolver struct {
-	Language languageResolver
+	Language   languageResolver
+	TimeZone   string
+	QuietHours []quietHoursResolver
+}
+
+type quietHoursResolver struct {
+	Start string
+	End   string
+}
+
+// formatClock formats minutes since midnight as HH:MM.
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// parseClock parses HH:MM into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errInvalidQuietHours
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type quietHoursInput struct {
+	Start string
+	End   string
+}
+
+// parseQuietHours converts quiet hours argument, empty list clears quiet hours.
+func parseQuietHours(in []quietHoursInput) ([]model.QuietHours, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+
+	qs := make([]model.QuietHours, len(in))
+	for i, q := range in {
+		start, err := parseClock(q.Start)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseClock(q.End)
+		if err != nil {
+			return nil, err
+		}
+
+		qs[i] = model.QuietHours{Start: start, End: end}
+	}
+
+	return qs, nil
+}
+
+// timeZone converts time zone argument, UTC is stored as empty time zone.
+func timeZone(tz string) string {
+	if tz == "UTC" {
+		return ""
+	}
+	return tz
+}
+
+// settingsUser returns user with settings arguments applied.
+// Omitted time zone and quiet hours keep stored values, so stored user is expected unchanged
+// unless version argument is given.
+func settingsUser(ctx context.Context, svc service.Service, id int64, language string, tz *string, qh *[]quietHoursInput, version *int32) (model.User, error) {
+	var qs []model.QuietHours
+	if qh != nil {
+		var err error
+		if qs, err = parseQuietHours(*qh); err != nil {
+			return model.User{}, err
+		}
+	}
+
+	u := model.User{
+		ID:         id,
+		Language:   language,
+		QuietHours: qs,
+		Version:    expectedVersion(version),
+	}
+	if tz != nil {
+		u.TimeZone = timeZone(*tz)
+	}
+
+	if tz != nil && qh != nil {
+		return u, nil
+	}
+
+	stored, err := svc.GetUser(ctx, id)
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			return u, nil
+		}
+		return model.User{}, wrapError(err, "failed to get user")
+	}
+
+	if tz == nil {
+		u.TimeZone = stored.TimeZone
+	}
+	if qh == nil {
+		u.QuietHours = stored.QuietHours
+	}
+	if version == nil {
+		u.Version = stored.Version
+	}
+
+	return u, nil
 }
 
 type languageResolver struct {
@@ -64,20 +212,172 @@ func (r deviceResolver) Name() string {
 	return r.device.Name
 }
 
+// Type resolves device type, it is null for devices registered before device types.
+func (r deviceResolver) Type() *string {
+	return optional(r.device.Type)
+}
+
+func (r deviceResolver) Address() addressResolver {
+	return addressResolver{r.device.Address}
+}
+
+func (r deviceResolver) Disabled() bool {
+	return r.device.Disabled
+}
+
 func (r deviceResolver) Settings() notificationSettingsResolver {
 	return notificationSettingsResolver{settings: r.device.Settings}
 }
 
+type addressResolver struct {
+	address model.Address
+}
+
+func (r addressResolver) Endpoint() *string {
+	return optional(r.address.Endpoint)
+}
+
+func (r addressResolver) P256dh() *string {
+	return optional(r.address.P256dh)
+}
+
+func (r addressResolver) Auth() *string {
+	return optional(r.address.Auth)
+}
+
+func (r addressResolver) Email() *string {
+	return optional(r.address.Email)
+}
+
+func (r addressResolver) Phone() *string {
+	return optional(r.address.Phone)
+}
+
+func (r addressResolver) Token() *string {
+	return optional(r.address.Token)
+}
+
+func (r addressResolver) URL() *string {
+	return optional(r.address.URL)
+}
+
+func (r addressResolver) Secret() *string {
+	return optional(r.address.Secret)
+}
+
+// optional converts empty string into null.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
 type notificationSettingsResolver struct {
 	settings model.NotificationSettings
 }
 
-func (r notificationSettingsResolver) PriceChanged() bool {
-	return r.settings.PriceChanged
+// Preferences resolves preferences ordered as event types in schema.
+func (r notificationSettingsResolver) Preferences() []eventPreferenceResolver {
+	pr := make([]eventPreferenceResolver, 0, len(r.settings.Preferences))
+
+	for _, t := range model.EventTypes {
+		if p, ok := r.settings.Preferences[t]; ok {
+			pr = append(pr, eventPreferenceResolver{eventType: t, p: p})
+		}
+	}
+
+	return pr
+}
+
+type eventPreferenceResolver struct {
+	eventType string
+	p         model.Preference
+}
+
+func (r eventPreferenceResolver) EventType() string {
+	return r.eventType
 }
 
-func (r notificationSettingsResolver) Frequency() string {
-	return r.settings.Frequency
+func (r eventPreferenceResolver) Enabled() bool {
+	return r.p.Enabled
+}
+
+func (r eventPreferenceResolver) Frequency() string {
+	return r.p.Frequency
+}
+
+func (r eventPreferenceResolver) Channel() string {
+	return r.p.Channel
+}
+
+type notificationResolver struct {
+	n model.Notification
+}
+
+func (r notificationResolver) ID() graphql.ID {
+	return graphql.ID(r.n.ID)
+}
+
+func (r notificationResolver) Type() string {
+	return r.n.Type
+}
+
+func (r notificationResolver) Title() string {
+	return r.n.Title
+}
+
+func (r notificationResolver) Body() string {
+	return r.n.Body
+}
+
+func (r notificationResolver) Read() bool {
+	return r.n.Read
+}
+
+func (r notificationResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.n.CreatedAt}
+}
+
+type notificationConnectionResolver struct {
+	page model.NotificationPage
+}
+
+func (r *notificationConnectionResolver) Edges() []notificationEdgeResolver {
+	er := make([]notificationEdgeResolver, len(r.page.Notifications))
+
+	for i, n := range r.page.Notifications {
+		er[i] = notificationEdgeResolver{n}
+	}
+
+	return er
+}
+
+func (r *notificationConnectionResolver) PageInfo() pageInfoResolver {
+	pi := pageInfoResolver{HasNextPage: r.page.HasNextPage}
+
+	if l := len(r.page.Notifications); l > 0 {
+		pi.EndCursor = &r.page.Notifications[l-1].ID
+	}
+
+	return pi
+}
+
+type notificationEdgeResolver struct {
+	n model.Notification
+}
+
+func (r notificationEdgeResolver) Cursor() string {
+	return r.n.ID
+}
+
+func (r notificationEdgeResolver) Node() notificationResolver {
+	return notificationResolver{r.n}
+}
+
+type pageInfoResolver struct {
+	HasNextPage bool
+	EndCursor   *string
 }
 
 // RootResolver defines root resolvers.
@@ -90,40 +390,272 @@ func (r *RootResolver) CurrentUser(ctx context.Context) (*userResolver, error) {
 	p := auth.FromContext(ctx)
 	u, err := r.svc.GetUser(ctx, p.UserID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve current user: %w", err)
+		return nil, wrapError(err, "failed to resolve current user")
 	}
 
-	return &userResolver{user: u}, nil
+	return &userResolver{user: u, svc: r.svc}, nil
+}
+
+// Device resolves current user device by ID.
+func (r *RootResolver) Device(ctx context.Context, args struct{ ID graphql.ID }) (*deviceResolver, error) {
+	p := auth.FromContext(ctx)
+
+	id, err := parseDeviceID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := r.svc.GetDevice(ctx, p.UserID, id)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve device")
+	}
+
+	return &deviceResolver{device}, nil
+}
+
+// SupportedLanguages resolves languages users may choose.
+func (r *RootResolver) SupportedLanguages() []languageResolver {
+	codes := r.svc.SupportedLanguages()
+
+	lr := make([]languageResolver, len(codes))
+	for i, c := range codes {
+		lr[i] = languageResolver{Code: c}
+	}
+
+	return lr
+}
+
+type settingsInput struct {
+	Language   string
+	TimeZone   *string
+	QuietHours *[]quietHoursInput
+	Version    *int32
+}
+
+// expectedVersion converts optional version argument, zero skips version check.
+func expectedVersion(v *int32) int64 {
+	if v == nil {
+		return 0
+	}
+	return int64(*v)
+}
+
+// UpdateSettingsForCurrentUser updates current user settings creating user if needed.
+func (r *RootResolver) UpdateSettingsForCurrentUser(
+	ctx context.Context,
+	args struct{ Input settingsInput },
+) (*userResolver, error) {
+	p := auth.FromContext(ctx)
+
+	u, err := settingsUser(ctx, r.svc, p.UserID, args.Input.Language, args.Input.TimeZone, args.Input.QuietHours, args.Input.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.svc.UpsertUser(ctx, u); err != nil {
+		return nil, wrapError(err, "failed to update settings of current user")
+	}
+
+	u, err = r.svc.GetUser(ctx, p.UserID)
+	if err != nil {
+		return nil, wrapError(err, "failed to resolve current user")
+	}
+
+	return &userResolver{user: u, svc: r.svc}, nil
+}
+
+type eventPreferenceInput struct {
+	EventType string
+	Enabled   bool
+	Frequency string
+	Channel   string
+}
+
+type addressInput struct {
+	Endpoint *string
+	P256dh   *string
+	Auth     *string
+	Email    *string
+	Phone    *string
+	Token    *string
+	URL      *string
+}
+
+func (i addressInput) toModel() model.Address {
+	value := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+
+	return model.Address{
+		Endpoint: value(i.Endpoint),
+		P256dh:   value(i.P256dh),
+		Auth:     value(i.Auth),
+		Email:    value(i.Email),
+		Phone:    value(i.Phone),
+		Token:    value(i.Token),
+		URL:      value(i.URL),
+	}
 }
 
 type deviceInput struct {
-	Name         string
-	PriceChanged bool
-	Frequency    string
+	Name        string
+	Type        string
+	Address     addressInput
+	Preferences []eventPreferenceInput
+}
+
+func (i deviceInput) toModel() model.Device {
+	d := model.Device{
+		Name:    i.Name,
+		Type:    i.Type,
+		Address: i.Address.toModel(),
+	}
+
+	if len(i.Preferences) > 0 {
+		d.Settings.Preferences = make(map[string]model.Preference, len(i.Preferences))
+
+		for _, p := range i.Preferences {
+			d.Settings.Preferences[p.EventType] = model.Preference{
+				Enabled:   p.Enabled,
+				Frequency: p.Frequency,
+				Channel:   p.Channel,
+			}
+		}
+	}
+
+	return d
 }
 
 func (r *RootResolver) AddDeviceForCurrentUser(
 	ctx context.Context,
-	args struct{ Device deviceInput },
+	args struct {
+		Device  deviceInput
+		Version *int32
+	},
 ) (*deviceResolver, error) {
 	p := auth.FromContext(ctx)
 
-	input := model.Device{
-		Name: args.Device.Name,
-		Settings: model.NotificationSettings{
-			PriceChanged: args.Device.PriceChanged,
-			Frequency:    args.Device.Frequency,
-		},
+	device, err := r.svc.AddDevice(ctx, p.UserID, expectedVersion(args.Version), args.Device.toModel())
+	if err != nil {
+		return nil, wrapError(err, "failed to add device to current user")
 	}
 
-	device, err := r.svc.AddDevice(ctx, p.UserID, input)
+	return &deviceResolver{device}, nil
+}
+
+// UpdateDeviceForCurrentUser updates current user device enabling it if it was disabled.
+func (r *RootResolver) UpdateDeviceForCurrentUser(
+	ctx context.Context,
+	args struct {
+		ID      graphql.ID
+		Device  deviceInput
+		Version *int32
+	},
+) (*deviceResolver, error) {
+	p := auth.FromContext(ctx)
+
+	id, err := parseDeviceID(args.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to add device to current user: %w", err)
+		return nil, err
+	}
+
+	input := args.Device.toModel()
+	input.ID = id
+
+	device, err := r.svc.UpdateDevice(ctx, p.UserID, expectedVersion(args.Version), input)
+	if err != nil {
+		return nil, wrapError(err, "failed to update device of current user")
 	}
 
 	return &deviceResolver{device}, nil
 }
 
+// RemoveDeviceForCurrentUser removes current user device.
+func (r *RootResolver) RemoveDeviceForCurrentUser(
+	ctx context.Context,
+	args struct {
+		ID      graphql.ID
+		Version *int32
+	},
+) (bool, error) {
+	p := auth.FromContext(ctx)
+
+	id, err := parseDeviceID(args.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.svc.RemoveDevice(ctx, p.UserID, expectedVersion(args.Version), id); err != nil {
+		return false, wrapError(err, "failed to remove device of current user")
+	}
+
+	return true, nil
+}
+
+// RotateDeviceSecretForCurrentUser replaces secret of current user webhook.
+func (r *RootResolver) RotateDeviceSecretForCurrentUser(
+	ctx context.Context,
+	args struct {
+		ID      graphql.ID
+		Version *int32
+	},
+) (*deviceResolver, error) {
+	p := auth.FromContext(ctx)
+
+	id, err := parseDeviceID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := r.svc.RotateDeviceSecret(ctx, p.UserID, expectedVersion(args.Version), id)
+	if err != nil {
+		return nil, wrapError(err, "failed to rotate device secret of current user")
+	}
+
+	return &deviceResolver{device}, nil
+}
+
+// MarkNotificationsRead marks current user notifications as read.
+func (r *RootResolver) MarkNotificationsRead(ctx context.Context, args struct{ IDs []graphql.ID }) (int32, error) {
+	p := auth.FromContext(ctx)
+
+	ids := make([]string, len(args.IDs))
+	for i, id := range args.IDs {
+		ids[i] = string(id)
+	}
+
+	n, err := r.svc.MarkNotificationsRead(ctx, p.UserID, ids)
+	if err != nil {
+		return 0, wrapError(err, "failed to mark notifications read")
+	}
+
+	return int32(n), nil
+}
+
+// NotificationReceived streams new notifications of current user.
+func (r *RootResolver) NotificationReceived(ctx context.Context) <-chan notificationResolver {
+	p := auth.FromContext(ctx)
+	ns := r.svc.SubscribeNotifications(ctx, p.UserID)
+
+	c := make(chan notificationResolver)
+	go func() {
+		defer close(c)
+
+		for n := range ns {
+			select {
+			case c <- notificationResolver{n}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
 // NewSchema parses and creates new graphql schema.
 func NewSchema(svc service.Service) (*graphql.Schema, error) {
 	schema, err := ioutil.ReadFile("../../../static/schema.graphql")
@@ -3,13 +3,16 @@ package graphql
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vliubezny/gnotify/internal/auth"
 	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service"
 	"github.com/vliubezny/gnotify/internal/service/mock"
 )
 
@@ -23,10 +26,9 @@ func TestSchema_currentUser(t *testing.T) {
 			{
 				ID:   "132323",
 				Name: "Chrome",
-				Settings: model.NotificationSettings{
-					Frequency:    model.Daily,
-					PriceChanged: true,
-				},
+				Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+					model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+				}},
 			},
 		},
 	}
@@ -55,8 +57,12 @@ func TestSchema_currentUser(t *testing.T) {
 						id
 						name
 						settings {
-							frequency
-							priceChanged
+							preferences {
+								eventType
+								enabled
+								frequency
+								channel
+							}
 						}
 					}
 				}
@@ -75,8 +81,14 @@ func TestSchema_currentUser(t *testing.T) {
 								"id": "132323",
 								"name": "Chrome",
 								"settings": {
-									"frequency": "DAILY",
-									"priceChanged": true
+									"preferences": [
+										{
+											"eventType": "PRICE_CHANGED",
+											"enabled": true,
+											"frequency": "DAILY",
+											"channel": "DEVICE"
+										}
+									]
 								}
 							}
 						]
@@ -134,12 +146,13 @@ func TestSchema_currentUser(t *testing.T) {
 
 func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 	device := model.Device{
-		ID:   "132323",
-		Name: "Chrome",
-		Settings: model.NotificationSettings{
-			Frequency:    model.Daily,
-			PriceChanged: true,
-		},
+		ID:      "132323",
+		Name:    "Chrome",
+		Type:    model.DeviceEmail,
+		Address: model.Address{Email: "user@example.com"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
 	}
 
 	testCases := []struct {
@@ -156,9 +169,16 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 			principal: auth.Principal{UserID: 1},
 			vars: map[string]interface{}{
 				"device": map[string]interface{}{
-					"name":         "Chrome",
-					"priceChanged": true,
-					"frequency":    "DAILY",
+					"name":    "Chrome",
+					"type":    "EMAIL",
+					"address": map[string]interface{}{"email": "user@example.com"},
+					"preferences": []interface{}{
+						map[string]interface{}{
+							"eventType": "PRICE_CHANGED",
+							"enabled":   true,
+							"frequency": "DAILY",
+						},
+					},
 				},
 			},
 			rDevice: device,
@@ -166,9 +186,16 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 				addDeviceForCurrentUser(device: $device) {
 					id
 					name
+					type
+					address { email phone }
+					disabled
 					settings {
-						frequency
-						priceChanged
+						preferences {
+							eventType
+							enabled
+							frequency
+							channel
+						}
 					}
 				}
 			}`,
@@ -177,22 +204,67 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 					"addDeviceForCurrentUser": {
 						"id": "132323",
 						"name": "Chrome",
+						"type": "EMAIL",
+						"address": {"email": "user@example.com", "phone": null},
+						"disabled": false,
 						"settings": {
-							"frequency": "DAILY",
-							"priceChanged": true
+							"preferences": [
+								{
+									"eventType": "PRICE_CHANGED",
+									"enabled": true,
+									"frequency": "DAILY",
+									"channel": "DEVICE"
+								}
+							]
 						}
 					}
 				}
 			}`,
 		},
+		{
+			desc:      "addDeviceForCurrentUser invalid device",
+			principal: auth.Principal{UserID: 1},
+			vars: map[string]interface{}{
+				"device": map[string]interface{}{
+					"name":        "Chrome",
+					"type":        "EMAIL",
+					"address":     map[string]interface{}{"phone": "+375291234567"},
+					"preferences": []interface{}{},
+				},
+			},
+			rDevice: model.Device{Name: "Chrome", Type: model.DeviceEmail, Address: model.Address{Phone: "+375291234567"}},
+			rErr:    fmt.Errorf("%w: malformed email", service.ErrInvalidDevice),
+			query: `mutation ($device: DeviceInput!) {
+				addDeviceForCurrentUser(device: $device) { id }
+			}`,
+			data: `{
+				"data": {
+					"addDeviceForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to add device to current user: invalid device: malformed email",
+						"path": ["addDeviceForCurrentUser"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
 		{
 			desc:      "addDeviceForCurrentUser error",
 			principal: auth.Principal{UserID: 1},
 			vars: map[string]interface{}{
 				"device": map[string]interface{}{
-					"name":         "Chrome",
-					"priceChanged": true,
-					"frequency":    "DAILY",
+					"name":    "Chrome",
+					"type":    "EMAIL",
+					"address": map[string]interface{}{"email": "user@example.com"},
+					"preferences": []interface{}{
+						map[string]interface{}{
+							"eventType": "PRICE_CHANGED",
+							"enabled":   true,
+							"frequency": "DAILY",
+						},
+					},
 				},
 			},
 			rDevice: device,
@@ -202,8 +274,12 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 					id
 					name
 					settings {
-						frequency
-						priceChanged
+						preferences {
+							eventType
+							enabled
+							frequency
+							channel
+						}
 					}
 				}
 			}`,
@@ -231,8 +307,8 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 
 			c := tc.principal.Propagate(ctx)
 
-			svc.EXPECT().AddDevice(gomock.Any(), tc.principal.UserID, gomock.Any()).
-				DoAndReturn(func(ctx context.Context, id int64, device model.Device) (model.Device, error) {
+			svc.EXPECT().AddDevice(gomock.Any(), tc.principal.UserID, int64(0), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, id, version int64, device model.Device) (model.Device, error) {
 					assert.Empty(t, device.ID)
 					device.ID = tc.rDevice.ID
 					assert.Equal(t, tc.rDevice, device)
@@ -249,3 +325,924 @@ func TestSchema_addDeviceForCurrentUser(t *testing.T) {
 		})
 	}
 }
+
+func TestSchema_notifications(t *testing.T) {
+	page := model.NotificationPage{
+		Notifications: []model.Notification{
+			{
+				ID:        "2",
+				UserID:    1,
+				Type:      model.PriceChanged,
+				Title:     "Price changed",
+				Body:      "Product 7 price changed from 10.99 to 9.99",
+				CreatedAt: time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC),
+			},
+		},
+		HasNextPage: true,
+	}
+
+	testCases := []struct {
+		desc  string
+		query string
+		q     model.NotificationQuery
+		rPage model.NotificationPage
+		rErr  error
+		data  string
+	}{
+		{
+			desc: "query notifications",
+			query: `{
+				currentUser {
+					notifications(first: 1, after: "3", unreadOnly: true) {
+						edges {
+							cursor
+							node {
+								id
+								type
+								title
+								body
+								read
+								createdAt
+							}
+						}
+						pageInfo {
+							hasNextPage
+							endCursor
+						}
+					}
+				}
+			}`,
+			q:     model.NotificationQuery{First: 1, After: "3", UnreadOnly: true},
+			rPage: page,
+			data: `{
+				"data": {
+					"currentUser": {
+						"notifications": {
+							"edges": [
+								{
+									"cursor": "2",
+									"node": {
+										"id": "2",
+										"type": "PRICE_CHANGED",
+										"title": "Price changed",
+										"body": "Product 7 price changed from 10.99 to 9.99",
+										"read": false,
+										"createdAt": "2021-04-07T10:30:00Z"
+									}
+								}
+							],
+							"pageInfo": {
+								"hasNextPage": true,
+								"endCursor": "2"
+							}
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "query empty notifications with defaults",
+			query: `{
+				currentUser {
+					notifications {
+						edges {
+							cursor
+						}
+						pageInfo {
+							hasNextPage
+							endCursor
+						}
+					}
+				}
+			}`,
+			q:     model.NotificationQuery{First: 20},
+			rPage: model.NotificationPage{},
+			data: `{
+				"data": {
+					"currentUser": {
+						"notifications": {
+							"edges": [],
+							"pageInfo": {
+								"hasNextPage": false,
+								"endCursor": null
+							}
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "query notifications error",
+			query: `{
+				currentUser {
+					notifications {
+						edges {
+							cursor
+						}
+					}
+				}
+			}`,
+			q:    model.NotificationQuery{First: 20},
+			rErr: assert.AnError,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to resolve notifications: assert.AnError general error for testing",
+						"path": ["currentUser", "notifications"]
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			svc.EXPECT().GetUser(gomock.Any(), principal.UserID).Return(model.User{ID: 1}, nil)
+			svc.EXPECT().GetNotifications(gomock.Any(), principal.UserID, tc.q).Return(tc.rPage, tc.rErr)
+
+			result := s.Exec(c, tc.query, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_markNotificationsRead(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rN   int
+		rErr error
+		data string
+	}{
+		{
+			desc: "markNotificationsRead",
+			rN:   2,
+			data: `{
+				"data": {
+					"markNotificationsRead": 2
+				}
+			}`,
+		},
+		{
+			desc: "markNotificationsRead error",
+			rErr: assert.AnError,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to mark notifications read: assert.AnError general error for testing",
+						"path": ["markNotificationsRead"]
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			svc.EXPECT().MarkNotificationsRead(gomock.Any(), principal.UserID, []string{"1", "2"}).Return(tc.rN, tc.rErr)
+
+			result := s.Exec(c, `mutation {
+				markNotificationsRead(ids: ["1", "2"])
+			}`, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_updateDeviceForCurrentUser(t *testing.T) {
+	device := model.Device{
+		ID:      "606d8e1b3a7c2f0001a1b2c3",
+		Name:    "Chrome",
+		Type:    model.DeviceSMS,
+		Address: model.Address{Phone: "+375291234567"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: false, Frequency: model.Weekly, Channel: model.ChannelDevice},
+		}},
+	}
+
+	query := `mutation ($id: ID!, $device: DeviceInput!) {
+		updateDeviceForCurrentUser(id: $id, device: $device) {
+			id
+			name
+			settings {
+				preferences {
+					eventType
+					enabled
+					frequency
+					channel
+				}
+			}
+		}
+	}`
+
+	vars := map[string]interface{}{
+		"id": "606d8e1b3a7c2f0001a1b2c3",
+		"device": map[string]interface{}{
+			"name":    "Chrome",
+			"type":    "SMS",
+			"address": map[string]interface{}{"phone": "+375291234567"},
+			"preferences": []interface{}{
+				map[string]interface{}{
+					"eventType": "PRICE_CHANGED",
+					"enabled":   false,
+					"frequency": "WEEKLY",
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		desc    string
+		rDevice model.Device
+		rErr    error
+		data    string
+	}{
+		{
+			desc:    "updateDeviceForCurrentUser",
+			rDevice: device,
+			data: `{
+				"data": {
+					"updateDeviceForCurrentUser": {
+						"id": "606d8e1b3a7c2f0001a1b2c3",
+						"name": "Chrome",
+						"settings": {
+							"preferences": [
+								{
+									"eventType": "PRICE_CHANGED",
+									"enabled": false,
+									"frequency": "WEEKLY",
+									"channel": "DEVICE"
+								}
+							]
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "updateDeviceForCurrentUser not found",
+			rErr: service.ErrNotFound,
+			data: `{
+				"data": {
+					"updateDeviceForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to update device of current user: not found",
+						"path": ["updateDeviceForCurrentUser"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "updateDeviceForCurrentUser error",
+			rErr: assert.AnError,
+			data: `{
+				"data": {
+					"updateDeviceForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to update device of current user: assert.AnError general error for testing",
+						"path": ["updateDeviceForCurrentUser"]
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			svc.EXPECT().UpdateDevice(gomock.Any(), principal.UserID, int64(0), device).Return(tc.rDevice, tc.rErr)
+
+			result := s.Exec(c, query, "", vars)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_removeDeviceForCurrentUser(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rErr error
+		data string
+	}{
+		{
+			desc: "removeDeviceForCurrentUser",
+			data: `{
+				"data": {
+					"removeDeviceForCurrentUser": true
+				}
+			}`,
+		},
+		{
+			desc: "removeDeviceForCurrentUser not found",
+			rErr: service.ErrNotFound,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to remove device of current user: not found",
+						"path": ["removeDeviceForCurrentUser"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "removeDeviceForCurrentUser conflict",
+			rErr: service.ErrConflict,
+			data: `{
+				"data": null,
+				"errors": [
+					{
+						"message": "failed to remove device of current user: conflict",
+						"path": ["removeDeviceForCurrentUser"],
+						"extensions": {"code": "CONFLICT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			svc.EXPECT().RemoveDevice(gomock.Any(), principal.UserID, int64(5), "606d8e1b3a7c2f0001a1b2c3").Return(tc.rErr)
+
+			result := s.Exec(c, `mutation {
+				removeDeviceForCurrentUser(id: "606d8e1b3a7c2f0001a1b2c3", version: 5)
+			}`, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_rotateDeviceSecretForCurrentUser(t *testing.T) {
+	webhook := model.Device{
+		ID:      "606d8e1b3a7c2f0001a1b2c3",
+		Name:    "CRM",
+		Type:    model.DeviceWebhook,
+		Address: model.Address{URL: "https://example.com/hooks/gnotify", Secret: "bmV3IHNlY3JldA"},
+	}
+
+	testCases := []struct {
+		desc    string
+		rDevice model.Device
+		rErr    error
+		data    string
+	}{
+		{
+			desc:    "rotateDeviceSecretForCurrentUser",
+			rDevice: webhook,
+			data: `{
+				"data": {
+					"rotateDeviceSecretForCurrentUser": {
+						"id": "606d8e1b3a7c2f0001a1b2c3",
+						"type": "WEBHOOK",
+						"address": {"url": "https://example.com/hooks/gnotify", "secret": "bmV3IHNlY3JldA", "email": null}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "rotateDeviceSecretForCurrentUser not webhook",
+			rErr: fmt.Errorf("%w: only webhooks have secret", service.ErrInvalidDevice),
+			data: `{
+				"data": {"rotateDeviceSecretForCurrentUser": null},
+				"errors": [
+					{
+						"message": "failed to rotate device secret of current user: invalid device: only webhooks have secret",
+						"path": ["rotateDeviceSecretForCurrentUser"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "rotateDeviceSecretForCurrentUser conflict",
+			rErr: service.ErrConflict,
+			data: `{
+				"data": {"rotateDeviceSecretForCurrentUser": null},
+				"errors": [
+					{
+						"message": "failed to rotate device secret of current user: conflict",
+						"path": ["rotateDeviceSecretForCurrentUser"],
+						"extensions": {"code": "CONFLICT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			svc.EXPECT().RotateDeviceSecret(gomock.Any(), principal.UserID, int64(5), "606d8e1b3a7c2f0001a1b2c3").Return(tc.rDevice, tc.rErr)
+
+			result := s.Exec(c, `mutation {
+				rotateDeviceSecretForCurrentUser(id: "606d8e1b3a7c2f0001a1b2c3", version: 5) {
+					id
+					type
+					address { url secret email }
+				}
+			}`, "", nil)
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_device(t *testing.T) {
+	device := model.Device{
+		ID:      "606d8e1b3a7c2f0001a1b2c3",
+		Name:    "Chrome",
+		Type:    model.DeviceSMS,
+		Address: model.Address{Phone: "+375291234567"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
+	}
+
+	testCases := []struct {
+		desc    string
+		id      string
+		call    bool
+		rDevice model.Device
+		rErr    error
+		data    string
+	}{
+		{
+			desc:    "query device",
+			id:      device.ID,
+			call:    true,
+			rDevice: device,
+			data: `{
+				"data": {
+					"device": {
+						"id": "606d8e1b3a7c2f0001a1b2c3",
+						"name": "Chrome"
+					}
+				}
+			}`,
+		},
+		{
+			desc: "device not found",
+			id:   device.ID,
+			call: true,
+			rErr: service.ErrNotFound,
+			data: `{
+				"data": {
+					"device": null
+				},
+				"errors": [
+					{
+						"message": "failed to resolve device: not found",
+						"path": ["device"],
+						"extensions": {"code": "NOT_FOUND"}
+					}
+				]
+			}`,
+		},
+		{
+			desc: "invalid device id",
+			id:   "132323",
+			data: `{
+				"data": {
+					"device": null
+				},
+				"errors": [
+					{
+						"message": "invalid device id",
+						"path": ["device"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			if tc.call {
+				svc.EXPECT().GetDevice(gomock.Any(), principal.UserID, tc.id).Return(tc.rDevice, tc.rErr)
+			}
+
+			result := s.Exec(c, `query ($id: ID!) {
+				device(id: $id) {
+					id
+					name
+				}
+			}`, "", map[string]interface{}{"id": tc.id})
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_supportedLanguages(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	svc := mock.NewMockService(ctrl)
+	s, err := NewSchema(svc)
+	require.NoError(t, err)
+
+	svc.EXPECT().SupportedLanguages().Return([]string{"en", "pt-BR"})
+
+	result := s.Exec(auth.Principal{UserID: 1}.Propagate(ctx), `{
+		supportedLanguages {
+			code
+			name
+		}
+	}`, "", nil)
+
+	json, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"data": {
+			"supportedLanguages": [
+				{"code": "en", "name": "English"},
+				{"code": "pt-BR", "name": "Brazilian Portuguese"}
+			]
+		}
+	}`, string(json))
+}
+
+func TestSchema_updateSettingsForCurrentUser(t *testing.T) {
+	query := `mutation ($input: SettingsInput!) {
+		updateSettingsForCurrentUser(input: $input) {
+			id
+			settings {
+				language {
+					code
+					name
+				}
+			}
+		}
+	}`
+
+	// omitted time zone and quiet hours keep stored values
+	stored := model.User{
+		ID:         1,
+		Language:   "en",
+		TimeZone:   "Europe/Minsk",
+		QuietHours: []model.QuietHours{{Start: 1350, End: 420}},
+		Version:    3,
+	}
+
+	testCases := []struct {
+		desc     string
+		language string
+		rErr     error
+		getUser  bool
+		data     string
+	}{
+		{
+			desc:     "updateSettingsForCurrentUser",
+			language: "be",
+			getUser:  true,
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": {
+						"id": "1",
+						"settings": {
+							"language": {
+								"code": "be",
+								"name": "Belarusian"
+							}
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc:     "updateSettingsForCurrentUser invalid language",
+			language: "xx-invalid-tag",
+			rErr:     fmt.Errorf("%w: xx-invalid-tag", service.ErrInvalidLanguage),
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to update settings of current user: invalid language: xx-invalid-tag",
+						"path": ["updateSettingsForCurrentUser"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+		{
+			desc:     "updateSettingsForCurrentUser error",
+			language: "be",
+			rErr:     assert.AnError,
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to update settings of current user: assert.AnError general error for testing",
+						"path": ["updateSettingsForCurrentUser"]
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			principal := auth.Principal{UserID: 1}
+			c := principal.Propagate(ctx)
+
+			u := stored
+			u.Language = tc.language
+
+			svc.EXPECT().GetUser(gomock.Any(), principal.UserID).Return(stored, nil)
+			upsert := svc.EXPECT().UpsertUser(gomock.Any(), u).Return(tc.rErr)
+			if tc.getUser {
+				svc.EXPECT().GetUser(gomock.Any(), principal.UserID).Return(u, nil).After(upsert)
+			}
+
+			result := s.Exec(c, query, "", map[string]interface{}{
+				"input": map[string]interface{}{"language": tc.language},
+			})
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
+
+func TestSchema_updateSettingsForCurrentUser_quietHours(t *testing.T) {
+	query := `mutation ($input: SettingsInput!) {
+		updateSettingsForCurrentUser(input: $input) {
+			settings {
+				timeZone
+				quietHours { start end }
+			}
+		}
+	}`
+
+	stored := model.User{
+		ID:         1,
+		Language:   "en",
+		TimeZone:   "Europe/Minsk",
+		QuietHours: []model.QuietHours{{Start: 1350, End: 420}},
+		Version:    3,
+	}
+
+	testCases := []struct {
+		desc    string
+		input   map[string]interface{}
+		stored  *model.User
+		rGetErr error
+		upsert  bool
+		user    model.User
+		data    string
+	}{
+		{
+			desc: "quiet hours",
+			input: map[string]interface{}{
+				"timeZone":   "Europe/Minsk",
+				"quietHours": []interface{}{map[string]interface{}{"start": "22:30", "end": "07:00"}},
+			},
+			upsert: true,
+			user: model.User{
+				ID:         1,
+				Language:   "en",
+				TimeZone:   "Europe/Minsk",
+				QuietHours: []model.QuietHours{{Start: 1350, End: 420}},
+			},
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": {
+						"settings": {
+							"timeZone": "Europe/Minsk",
+							"quietHours": [{"start": "22:30", "end": "07:00"}]
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "empty quiet hours clear stored ones",
+			input: map[string]interface{}{
+				"quietHours": []interface{}{},
+			},
+			stored: &stored,
+			upsert: true,
+			user:   model.User{ID: 1, Language: "en", TimeZone: "Europe/Minsk", Version: 3},
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": {
+						"settings": {
+							"timeZone": "Europe/Minsk",
+							"quietHours": []
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc: "omitted quiet hours keep stored ones",
+			input: map[string]interface{}{
+				"timeZone": "UTC",
+				"version":  5,
+			},
+			stored: &stored,
+			upsert: true,
+			user: model.User{
+				ID:         1,
+				Language:   "en",
+				QuietHours: []model.QuietHours{{Start: 1350, End: 420}},
+				Version:    5,
+			},
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": {
+						"settings": {
+							"timeZone": "UTC",
+							"quietHours": [{"start": "22:30", "end": "07:00"}]
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc:    "new user",
+			input:   map[string]interface{}{},
+			stored:  &model.User{},
+			rGetErr: service.ErrNotFound,
+			upsert:  true,
+			user:    model.User{ID: 1, Language: "en"},
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": {
+						"settings": {
+							"timeZone": "UTC",
+							"quietHours": []
+						}
+					}
+				}
+			}`,
+		},
+		{
+			desc:    "get user error",
+			input:   map[string]interface{}{},
+			stored:  &model.User{},
+			rGetErr: assert.AnError,
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "failed to get user: assert.AnError general error for testing",
+						"path": ["updateSettingsForCurrentUser"]
+					}
+				]
+			}`,
+		},
+		{
+			desc: "invalid quiet hours",
+			input: map[string]interface{}{
+				"quietHours": []interface{}{map[string]interface{}{"start": "24:00", "end": "07:00"}},
+			},
+			data: `{
+				"data": {
+					"updateSettingsForCurrentUser": null
+				},
+				"errors": [
+					{
+						"message": "invalid quiet hours",
+						"path": ["updateSettingsForCurrentUser"],
+						"extensions": {"code": "INVALID_ARGUMENT"}
+					}
+				]
+			}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			svc := mock.NewMockService(ctrl)
+			s, err := NewSchema(svc)
+			require.NoError(t, err)
+
+			var calls []*gomock.Call
+			if tc.stored != nil {
+				calls = append(calls, svc.EXPECT().GetUser(gomock.Any(), int64(1)).Return(*tc.stored, tc.rGetErr))
+			}
+			if tc.upsert {
+				calls = append(calls,
+					svc.EXPECT().UpsertUser(gomock.Any(), tc.user).Return(nil),
+					svc.EXPECT().GetUser(gomock.Any(), int64(1)).Return(tc.user, nil),
+				)
+			}
+			gomock.InOrder(calls...)
+
+			input := map[string]interface{}{"language": "en"}
+			for k, v := range tc.input {
+				input[k] = v
+			}
+
+			result := s.Exec(auth.Principal{UserID: 1}.Propagate(ctx), query, "", map[string]interface{}{
+				"input": input,
+			})
+
+			json, err := json.Marshal(result)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.data, string(json))
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	graphql "github.com/graph-gophers/graphql-go"
@@ -14,27 +15,45 @@ import (
 )
 
 type server struct {
-	schema *graphql.Schema
+	svc           service.Service
+	schema        *graphql.Schema
+	authenticator auth.Authenticator
+	// keyTTL is how long idempotency keys of ingested events are kept.
+	keyTTL time.Duration
+	now    func() time.Time
 }
 
 // SetupRouter setups routes and handlers.
-func SetupRouter(r chi.Router, authenticator auth.Authenticator, svc service.Service) error {
+// Ingested events are saved for dispatch, their retries are detected for keyTTL.
+func SetupRouter(r chi.Router, authenticator auth.Authenticator, svc service.Service, keyTTL time.Duration) error {
 	s, err := NewSchema(svc)
 	if err != nil {
 		return err
 	}
 
 	srv := &server{
-		schema: s,
+		svc:           svc,
+		schema:        s,
+		authenticator: authenticator,
+		keyTTL:        keyTTL,
+		now:           time.Now,
 	}
 
 	r.Use(
 		loggerMiddleware,
 		recoveryMiddleware,
-		jwtAuthMiddleware(authenticator),
 	)
 
-	r.Post("/graphql", srv.graphqlHandler)
+	// WebSocket clients authenticate inside the connection
+	r.Get("/graphql", srv.subscriptionHandler)
+
+	r.Group(func(r chi.Router) {
+		r.Use(jwtAuthMiddleware(authenticator))
+
+		r.Post("/graphql", srv.graphqlHandler)
+		r.With(adminMiddleware).Post("/events", srv.eventsHandler)
+		r.With(adminMiddleware).Get("/backup", srv.backupHandler)
+	})
 
 	return nil
 }
@@ -44,7 +63,10 @@ func getLogger(r *http.Request) logrus.FieldLogger {
 }
 
 func extractBearer(r *http.Request) string {
-	auth := r.Header.Get("Authorization")
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+func parseBearer(auth string) string {
 	if len(auth) > 7 && strings.ToUpper(auth[0:7]) == "BEARER " {
 		return auth[7:]
 	}
@@ -74,12 +96,16 @@ func writeInternalError(l logrus.FieldLogger, w http.ResponseWriter, message str
 }
 
 func writeOK(l logrus.FieldLogger, w http.ResponseWriter, payload interface{}) {
+	writeJSON(l, w, http.StatusOK, payload)
+}
+
+func writeJSON(l logrus.FieldLogger, w http.ResponseWriter, code int, payload interface{}) {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		writeInternalError(l.WithError(err), w, "fail to serialize payload")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 	w.Write(body)
 }
@@ -0,0 +1,228 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	wsProtocol          = "graphql-ws"
+	wsInitTimeout       = 10 * time.Second
+	wsKeepAliveInterval = 20 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{wsProtocol},
+	// clients authenticate with bearer token, so cross-origin requests are safe
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// subscriptionHandler serves graphql operations over WebSocket using graphql-ws protocol.
+// Clients authenticate with bearer token passed in connection_init payload or Authorization header.
+func (s *server) subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	l := getLogger(r)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.WithError(err).Error("failed to upgrade connection")
+		return
+	}
+	defer conn.Close()
+
+	c := &wsConnection{
+		conn:   conn,
+		logger: l,
+		server: s,
+		ops:    make(map[string]context.CancelFunc),
+	}
+
+	c.serve(r.Context(), extractBearer(r))
+}
+
+// wsConnection represents single graphql-ws connection.
+type wsConnection struct {
+	conn   *websocket.Conn
+	logger logrus.FieldLogger
+	server *server
+
+	writeMu sync.Mutex
+	opsMu   sync.Mutex
+	ops     map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (c *wsConnection) serve(ctx context.Context, token string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.wg.Wait()
+	}()
+
+	ctx, err := c.init(ctx, token)
+	if err != nil {
+		c.logger.WithError(err).Error("failed to init connection")
+		return
+	}
+
+	c.wg.Add(1)
+	go c.keepAlive(ctx)
+
+	for {
+		var msg wsMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.WithError(err).Error("failed to read message")
+			}
+			return
+		}
+
+		switch msg.Type {
+		case wsStart:
+			c.start(ctx, msg)
+		case wsStop:
+			c.stop(msg.ID)
+		case wsConnectionTerminate:
+			return
+		default:
+			c.write(wsMessage{ID: msg.ID, Type: wsError, Payload: errorPayload("unknown message type")})
+		}
+	}
+}
+
+// init waits for connection_init message and authenticates user.
+func (c *wsConnection) init(ctx context.Context, token string) (context.Context, error) {
+	c.conn.SetReadDeadline(time.Now().Add(wsInitTimeout))
+
+	var msg wsMessage
+	if err := c.conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+
+	if msg.Type != wsConnectionInit {
+		c.write(wsMessage{Type: wsConnectionError, Payload: errorPayload("connection is not initialized")})
+		return nil, errors.New("unexpected message " + msg.Type)
+	}
+
+	var payload wsInitPayload
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			c.write(wsMessage{Type: wsConnectionError, Payload: errorPayload("invalid payload")})
+			return nil, err
+		}
+	}
+
+	if t := parseBearer(payload.Authorization); t != "" {
+		token = t
+	}
+
+	if token == "" {
+		c.write(wsMessage{Type: wsConnectionError, Payload: errorPayload("missing token")})
+		return nil, errors.New("missing token")
+	}
+
+	principal, err := c.server.authenticator.Authenthicate(token)
+	if err != nil {
+		c.write(wsMessage{Type: wsConnectionError, Payload: errorPayload("invalid access token")})
+		return nil, err
+	}
+
+	c.logger = c.logger.WithField("userID", principal.UserID)
+	c.write(wsMessage{Type: wsConnectionAck})
+
+	return principal.Propagate(ctx), nil
+}
+
+func (c *wsConnection) keepAlive(ctx context.Context) {
+	defer c.wg.Done()
+
+	t := time.NewTicker(wsKeepAliveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			c.write(wsMessage{Type: wsConnectionKeepAlive})
+		}
+	}
+}
+
+// start executes operation and streams its results until operation is stopped.
+func (c *wsConnection) start(ctx context.Context, msg wsMessage) {
+	var payload wsStartPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.write(wsMessage{ID: msg.ID, Type: wsError, Payload: errorPayload("invalid payload")})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	c.opsMu.Lock()
+	if _, ok := c.ops[msg.ID]; ok || msg.ID == "" {
+		c.opsMu.Unlock()
+		cancel()
+		c.write(wsMessage{ID: msg.ID, Type: wsError, Payload: errorPayload("invalid operation id")})
+		return
+	}
+	c.ops[msg.ID] = cancel
+	c.opsMu.Unlock()
+
+	responses, err := c.server.schema.Subscribe(ctx, payload.Query, payload.OperationName, payload.Variables)
+	if err != nil {
+		c.stop(msg.ID)
+		c.write(wsMessage{ID: msg.ID, Type: wsError, Payload: errorPayload(err.Error())})
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for r := range responses {
+			data, err := json.Marshal(r)
+			if err != nil {
+				c.logger.WithError(err).Error("failed to serialize response")
+				continue
+			}
+			c.write(wsMessage{ID: msg.ID, Type: wsData, Payload: data})
+		}
+
+		c.stop(msg.ID)
+		c.write(wsMessage{ID: msg.ID, Type: wsComplete})
+	}()
+}
+
+// stop cancels running operation.
+func (c *wsConnection) stop(id string) {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+
+	if cancel, ok := c.ops[id]; ok {
+		cancel()
+		delete(c.ops, id)
+	}
+}
+
+func (c *wsConnection) write(msg wsMessage) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.logger.WithError(err).Debug("failed to write message")
+	}
+}
+
+func errorPayload(message string) json.RawMessage {
+	p, _ := json.Marshal(wsErrorPayload{Message: message})
+	return p
+}
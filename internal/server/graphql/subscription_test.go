@@ -0,0 +1,166 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/auth"
+	authMock "github.com/vliubezny/gnotify/internal/auth/mock"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/service/mock"
+)
+
+func setupWebSocket(t *testing.T, a auth.Authenticator, svc *mock.MockService, header http.Header) *websocket.Conn {
+	r := chi.NewMux()
+	require.NoError(t, SetupRouter(r, a, svc, time.Hour))
+
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	d := websocket.Dialer{Subprotocols: []string{wsProtocol}}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/graphql", header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) wsMessage {
+	var msg wsMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	return msg
+}
+
+func TestServer_subscriptionHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	principal := auth.Principal{UserID: 1}
+	notifications := make(chan model.Notification)
+
+	a := authMock.NewMockAuthenticator(ctrl)
+	a.EXPECT().Authenthicate("testtoken").Return(principal, nil)
+
+	svc := mock.NewMockService(ctrl)
+	svc.EXPECT().SubscribeNotifications(gomock.Any(), principal.UserID).
+		DoAndReturn(func(ctx context.Context, userID int64) <-chan model.Notification {
+			assert.Equal(t, principal, auth.FromContext(ctx))
+			return notifications
+		})
+	svc.EXPECT().GetUser(gomock.Any(), principal.UserID).Return(model.User{ID: 1, Language: "en"}, nil)
+
+	conn := setupWebSocket(t, a, svc, nil)
+
+	require.NoError(t, conn.WriteJSON(wsMessage{
+		Type:    wsConnectionInit,
+		Payload: json.RawMessage(`{"authorization":"Bearer testtoken"}`),
+	}))
+	assert.Equal(t, wsMessage{Type: wsConnectionAck}, readMessage(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsMessage{
+		ID:      "1",
+		Type:    wsStart,
+		Payload: json.RawMessage(`{"query":"subscription { notificationReceived { id title } }"}`),
+	}))
+
+	notifications <- model.Notification{ID: "10", UserID: 1, Title: "Price changed"}
+
+	msg := readMessage(t, conn)
+	assert.Equal(t, "1", msg.ID)
+	assert.Equal(t, wsData, msg.Type)
+	assert.JSONEq(t, `{"data":{"notificationReceived":{"id":"10","title":"Price changed"}}}`, string(msg.Payload))
+
+	require.NoError(t, conn.WriteJSON(wsMessage{
+		ID:      "2",
+		Type:    wsStart,
+		Payload: json.RawMessage(`{"query":"{ currentUser { id } }"}`),
+	}))
+
+	msg = readMessage(t, conn)
+	assert.Equal(t, "2", msg.ID)
+	assert.Equal(t, wsData, msg.Type)
+	assert.JSONEq(t, `{"data":{"currentUser":{"id":"1"}}}`, string(msg.Payload))
+	assert.Equal(t, wsMessage{ID: "2", Type: wsComplete}, readMessage(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsMessage{ID: "1", Type: wsStop}))
+	assert.Equal(t, wsMessage{ID: "1", Type: wsComplete}, readMessage(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsMessage{Type: wsConnectionTerminate}))
+}
+
+func TestServer_subscriptionHandler_headerToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	a := authMock.NewMockAuthenticator(ctrl)
+	a.EXPECT().Authenthicate("testtoken").Return(auth.Principal{UserID: 1}, nil)
+
+	conn := setupWebSocket(t, a, mock.NewMockService(ctrl), http.Header{"Authorization": {"Bearer testtoken"}})
+
+	require.NoError(t, conn.WriteJSON(wsMessage{Type: wsConnectionInit}))
+	assert.Equal(t, wsMessage{Type: wsConnectionAck}, readMessage(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsMessage{ID: "1", Type: "unknown"}))
+
+	msg := readMessage(t, conn)
+	assert.Equal(t, wsError, msg.Type)
+	assert.JSONEq(t, `{"message":"unknown message type"}`, string(msg.Payload))
+}
+
+func TestServer_subscriptionHandler_initError(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		msg     wsMessage
+		authErr error
+		payload string
+	}{
+		{
+			desc:    "missing token",
+			msg:     wsMessage{Type: wsConnectionInit},
+			payload: `{"message":"missing token"}`,
+		},
+		{
+			desc:    "invalid token",
+			msg:     wsMessage{Type: wsConnectionInit, Payload: json.RawMessage(`{"authorization":"Bearer testtoken"}`)},
+			authErr: auth.ErrInvalidToken,
+			payload: `{"message":"invalid access token"}`,
+		},
+		{
+			desc:    "not initialized",
+			msg:     wsMessage{ID: "1", Type: wsStart},
+			payload: `{"message":"connection is not initialized"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			a := authMock.NewMockAuthenticator(ctrl)
+			if tc.authErr != nil {
+				a.EXPECT().Authenthicate("testtoken").Return(auth.Principal{}, tc.authErr)
+			}
+
+			conn := setupWebSocket(t, a, mock.NewMockService(ctrl), nil)
+
+			require.NoError(t, conn.WriteJSON(tc.msg))
+
+			msg := readMessage(t, conn)
+			assert.Equal(t, wsConnectionError, msg.Type)
+			assert.JSONEq(t, tc.payload, string(msg.Payload))
+		})
+	}
+}
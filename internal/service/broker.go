@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// subscriptionBuffer limits number of notifications waiting for slow subscriber.
+const subscriptionBuffer = 16
+
+// broker fans out new notifications to subscribers of the same user.
+type broker struct {
+	mu   sync.RWMutex
+	subs map[int64]map[chan model.Notification]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{
+		subs: make(map[int64]map[chan model.Notification]struct{}),
+	}
+}
+
+// subscribe returns channel of user notifications which is closed when context is done.
+func (b *broker) subscribe(ctx context.Context, userID int64) <-chan model.Notification {
+	ch := make(chan model.Notification, subscriptionBuffer)
+
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan model.Notification]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		delete(b.subs[userID], ch)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+		b.mu.Unlock()
+
+		close(ch)
+	}()
+
+	return ch
+}
+
+// publish sends notification to user subscribers. Notifications are dropped for subscribers that fall behind.
+func (b *broker) publish(n model.Notification) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs[n.UserID] {
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+}
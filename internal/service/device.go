@@ -0,0 +1,102 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/sender"
+)
+
+var phoneRe = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// validateDevice checks that device address has data required by device type.
+func validateDevice(d model.Device) error {
+	a := d.Address
+
+	switch d.Type {
+	case model.DeviceWebPush:
+		return validateWebPush(a)
+	case model.DeviceEmail:
+		if m, err := mail.ParseAddress(a.Email); err != nil || m.Address != a.Email {
+			return fmt.Errorf("%w: malformed email", ErrInvalidDevice)
+		}
+	case model.DeviceSMS:
+		if !phoneRe.MatchString(a.Phone) {
+			return fmt.Errorf("%w: phone is not in E.164 format", ErrInvalidDevice)
+		}
+	case model.DeviceFCM:
+		if a.Token == "" || strings.ContainsAny(a.Token, " \t\r\n") {
+			return fmt.Errorf("%w: malformed token", ErrInvalidDevice)
+		}
+	case model.DeviceAPNs:
+		if b, err := hex.DecodeString(a.Token); err != nil || len(b) == 0 {
+			return fmt.Errorf("%w: token is not hex encoded", ErrInvalidDevice)
+		}
+	case model.DeviceWebhook:
+		u, err := url.Parse(a.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%w: webhook URL must be https URL", ErrInvalidDevice)
+		}
+		if !publicHost(u.Hostname()) {
+			return fmt.Errorf("%w: webhook host must be public", ErrInvalidDevice)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidDevice, d.Type)
+	}
+
+	return nil
+}
+
+// publicHost reports whether host may be public. Host names are resolved when webhook is called,
+// so only localhost and IP addresses are checked.
+func publicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return sender.PublicIP(ip)
+	}
+	return true
+}
+
+// validateWebPush checks Web Push subscription, see RFC 8291 for key sizes.
+func validateWebPush(a model.Address) error {
+	u, err := url.Parse(a.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%w: endpoint must be https URL", ErrInvalidDevice)
+	}
+
+	if k, err := decodeKey(a.P256dh); err != nil || len(k) != 65 || k[0] != 4 {
+		return fmt.Errorf("%w: p256dh must be uncompressed P-256 point", ErrInvalidDevice)
+	}
+
+	if k, err := decodeKey(a.Auth); err != nil || len(k) != 16 {
+		return fmt.Errorf("%w: auth must be 16 bytes", ErrInvalidDevice)
+	}
+
+	return nil
+}
+
+// decodeKey decodes base64url key tolerating padding.
+func decodeKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newSecret generates random webhook signing secret.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+func Test_validateDevice(t *testing.T) {
+	webPush := model.Address{
+		Endpoint: "https://fcm.googleapis.com/fcm/send/abc",
+		P256dh:   "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM",
+		Auth:     "tBHItJI5svbpez7KI4CCXg",
+	}
+
+	testCases := []struct {
+		desc   string
+		device model.Device
+		err    error
+	}{
+		{
+			desc:   "web push",
+			device: model.Device{Type: model.DeviceWebPush, Address: webPush},
+		},
+		{
+			desc: "web push padded keys",
+			device: model.Device{Type: model.DeviceWebPush, Address: model.Address{
+				Endpoint: webPush.Endpoint,
+				P256dh:   webPush.P256dh + "=",
+				Auth:     webPush.Auth + "==",
+			}},
+		},
+		{
+			desc: "web push plain http",
+			device: model.Device{Type: model.DeviceWebPush, Address: model.Address{
+				Endpoint: "http://push.example.com/abc",
+				P256dh:   webPush.P256dh,
+				Auth:     webPush.Auth,
+			}},
+			err: ErrInvalidDevice,
+		},
+		{
+			desc: "web push short key",
+			device: model.Device{Type: model.DeviceWebPush, Address: model.Address{
+				Endpoint: webPush.Endpoint,
+				P256dh:   webPush.Auth,
+				Auth:     webPush.Auth,
+			}},
+			err: ErrInvalidDevice,
+		},
+		{
+			desc: "web push missing auth",
+			device: model.Device{Type: model.DeviceWebPush, Address: model.Address{
+				Endpoint: webPush.Endpoint,
+				P256dh:   webPush.P256dh,
+			}},
+			err: ErrInvalidDevice,
+		},
+		{
+			desc:   "email",
+			device: model.Device{Type: model.DeviceEmail, Address: model.Address{Email: "user@example.com"}},
+		},
+		{
+			desc:   "email with name",
+			device: model.Device{Type: model.DeviceEmail, Address: model.Address{Email: "User <user@example.com>"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "malformed email",
+			device: model.Device{Type: model.DeviceEmail, Address: model.Address{Email: "user"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "sms",
+			device: model.Device{Type: model.DeviceSMS, Address: model.Address{Phone: "+375291234567"}},
+		},
+		{
+			desc:   "sms without country code",
+			device: model.Device{Type: model.DeviceSMS, Address: model.Address{Phone: "291234567"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "fcm",
+			device: model.Device{Type: model.DeviceFCM, Address: model.Address{Token: "bk3RNwTe3H0:CI2k_HHwgIpoDKCIZvvDMExUdFQ3P1"}},
+		},
+		{
+			desc:   "fcm missing token",
+			device: model.Device{Type: model.DeviceFCM},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "apns",
+			device: model.Device{Type: model.DeviceAPNs, Address: model.Address{Token: "740f4707bebcf74f9b7c25d48e3358945f6aa01da5ddb387462c7eaf61bb78ad"}},
+		},
+		{
+			desc:   "apns not hex",
+			device: model.Device{Type: model.DeviceAPNs, Address: model.Address{Token: "token"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "https://example.com/hooks/gnotify"}},
+		},
+		{
+			desc:   "webhook plain http",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "http://example.com/hooks/gnotify"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook loopback",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "https://127.0.0.1:8080/hooks"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook localhost",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "https://localhost/hooks"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook link-local",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "https://169.254.169.254/latest/meta-data"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook private",
+			device: model.Device{Type: model.DeviceWebhook, Address: model.Address{URL: "https://[fd00::1]/hooks"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "webhook missing URL",
+			device: model.Device{Type: model.DeviceWebhook},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "unknown type",
+			device: model.Device{Type: "PIGEON", Address: model.Address{Email: "user@example.com"}},
+			err:    ErrInvalidDevice,
+		},
+		{
+			desc:   "missing type",
+			device: model.Device{Address: model.Address{Email: "user@example.com"}},
+			err:    ErrInvalidDevice,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := validateDevice(tc.device)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
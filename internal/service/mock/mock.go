@@ -8,7 +8,9 @@ import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
 	model "github.com/vliubezny/gnotify/internal/model"
+	io "io"
 	reflect "reflect"
+	time "time"
 )
 
 // MockService is a mock of Service interface
@@ -50,18 +52,18 @@ func (mr *MockServiceMockRecorder) GetUser(ctx, id interface{}) *gomock.Call {
 }
 
 // GetUsers mocks base method
-func (m *MockService) GetUsers(ctx context.Context) ([]model.User, error) {
+func (m *MockService) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUsers", ctx)
-	ret0, _ := ret[0].([]model.User)
+	ret := m.ctrl.Call(m, "GetUsers", ctx, query)
+	ret0, _ := ret[0].(model.UserPage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetUsers indicates an expected call of GetUsers
-func (mr *MockServiceMockRecorder) GetUsers(ctx interface{}) *gomock.Call {
+func (mr *MockServiceMockRecorder) GetUsers(ctx, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsers", reflect.TypeOf((*MockService)(nil).GetUsers), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsers", reflect.TypeOf((*MockService)(nil).GetUsers), ctx, query)
 }
 
 // UpsertUser mocks base method
@@ -93,16 +95,339 @@ func (mr *MockServiceMockRecorder) DeleteUser(ctx, id interface{}) *gomock.Call
 }
 
 // AddDevice mocks base method
-func (m *MockService) AddDevice(ctx context.Context, userID int64, device model.Device) (model.Device, error) {
+func (m *MockService) AddDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddDevice", ctx, userID, device)
+	ret := m.ctrl.Call(m, "AddDevice", ctx, userID, version, device)
 	ret0, _ := ret[0].(model.Device)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddDevice indicates an expected call of AddDevice
-func (mr *MockServiceMockRecorder) AddDevice(ctx, userID, device interface{}) *gomock.Call {
+func (mr *MockServiceMockRecorder) AddDevice(ctx, userID, version, device interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDevice", reflect.TypeOf((*MockService)(nil).AddDevice), ctx, userID, device)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDevice", reflect.TypeOf((*MockService)(nil).AddDevice), ctx, userID, version, device)
+}
+
+// GetDevice mocks base method
+func (m *MockService) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDevice", ctx, userID, deviceID)
+	ret0, _ := ret[0].(model.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDevice indicates an expected call of GetDevice
+func (mr *MockServiceMockRecorder) GetDevice(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDevice", reflect.TypeOf((*MockService)(nil).GetDevice), ctx, userID, deviceID)
+}
+
+// UpdateDevice mocks base method
+func (m *MockService) UpdateDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDevice", ctx, userID, version, device)
+	ret0, _ := ret[0].(model.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateDevice indicates an expected call of UpdateDevice
+func (mr *MockServiceMockRecorder) UpdateDevice(ctx, userID, version, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDevice", reflect.TypeOf((*MockService)(nil).UpdateDevice), ctx, userID, version, device)
+}
+
+// RotateDeviceSecret mocks base method
+func (m *MockService) RotateDeviceSecret(ctx context.Context, userID, version int64, deviceID string) (model.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateDeviceSecret", ctx, userID, version, deviceID)
+	ret0, _ := ret[0].(model.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateDeviceSecret indicates an expected call of RotateDeviceSecret
+func (mr *MockServiceMockRecorder) RotateDeviceSecret(ctx, userID, version, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateDeviceSecret", reflect.TypeOf((*MockService)(nil).RotateDeviceSecret), ctx, userID, version, deviceID)
+}
+
+// RemoveDevice mocks base method
+func (m *MockService) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveDevice", ctx, userID, version, deviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveDevice indicates an expected call of RemoveDevice
+func (mr *MockServiceMockRecorder) RemoveDevice(ctx, userID, version, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveDevice", reflect.TypeOf((*MockService)(nil).RemoveDevice), ctx, userID, version, deviceID)
+}
+
+// DisableDevice mocks base method
+func (m *MockService) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisableDevice", ctx, userID, deviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DisableDevice indicates an expected call of DisableDevice
+func (mr *MockServiceMockRecorder) DisableDevice(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisableDevice", reflect.TypeOf((*MockService)(nil).DisableDevice), ctx, userID, deviceID)
+}
+
+// AddToDigest mocks base method
+func (m *MockService) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddToDigest", ctx, userID, deviceID, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddToDigest indicates an expected call of AddToDigest
+func (mr *MockServiceMockRecorder) AddToDigest(ctx, userID, deviceID, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddToDigest", reflect.TypeOf((*MockService)(nil).AddToDigest), ctx, userID, deviceID, e)
+}
+
+// GetDigests mocks base method
+func (m *MockService) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDigests", ctx)
+	ret0, _ := ret[0].([]model.Digest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDigests indicates an expected call of GetDigests
+func (mr *MockServiceMockRecorder) GetDigests(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDigests", reflect.TypeOf((*MockService)(nil).GetDigests), ctx)
+}
+
+// PopDigest mocks base method
+func (m *MockService) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PopDigest", ctx, userID, deviceID)
+	ret0, _ := ret[0].(model.Digest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PopDigest indicates an expected call of PopDigest
+func (mr *MockServiceMockRecorder) PopDigest(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PopDigest", reflect.TypeOf((*MockService)(nil).PopDigest), ctx, userID, deviceID)
+}
+
+// AddNotification mocks base method
+func (m *MockService) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddNotification", ctx, n)
+	ret0, _ := ret[0].(model.Notification)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddNotification indicates an expected call of AddNotification
+func (mr *MockServiceMockRecorder) AddNotification(ctx, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddNotification", reflect.TypeOf((*MockService)(nil).AddNotification), ctx, n)
+}
+
+// GetNotifications mocks base method
+func (m *MockService) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNotifications", ctx, userID, query)
+	ret0, _ := ret[0].(model.NotificationPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNotifications indicates an expected call of GetNotifications
+func (mr *MockServiceMockRecorder) GetNotifications(ctx, userID, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNotifications", reflect.TypeOf((*MockService)(nil).GetNotifications), ctx, userID, query)
+}
+
+// MarkNotificationsRead mocks base method
+func (m *MockService) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkNotificationsRead", ctx, userID, ids)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MarkNotificationsRead indicates an expected call of MarkNotificationsRead
+func (mr *MockServiceMockRecorder) MarkNotificationsRead(ctx, userID, ids interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkNotificationsRead", reflect.TypeOf((*MockService)(nil).MarkNotificationsRead), ctx, userID, ids)
+}
+
+// AddDelivery mocks base method
+func (m *MockService) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddDelivery", ctx, d)
+	ret0, _ := ret[0].(model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddDelivery indicates an expected call of AddDelivery
+func (mr *MockServiceMockRecorder) AddDelivery(ctx, d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDelivery", reflect.TypeOf((*MockService)(nil).AddDelivery), ctx, d)
+}
+
+// LeaseDeliveries mocks base method
+func (m *MockService) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaseDeliveries", ctx, now, timeout, limit)
+	ret0, _ := ret[0].([]model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LeaseDeliveries indicates an expected call of LeaseDeliveries
+func (mr *MockServiceMockRecorder) LeaseDeliveries(ctx, now, timeout, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaseDeliveries", reflect.TypeOf((*MockService)(nil).LeaseDeliveries), ctx, now, timeout, limit)
+}
+
+// UpdateDelivery mocks base method
+func (m *MockService) UpdateDelivery(ctx context.Context, d model.Delivery) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDelivery", ctx, d)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateDelivery indicates an expected call of UpdateDelivery
+func (mr *MockServiceMockRecorder) UpdateDelivery(ctx, d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDelivery", reflect.TypeOf((*MockService)(nil).UpdateDelivery), ctx, d)
+}
+
+// GetDeliveries mocks base method
+func (m *MockService) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeliveries", ctx, query)
+	ret0, _ := ret[0].(model.DeliveryPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeliveries indicates an expected call of GetDeliveries
+func (mr *MockServiceMockRecorder) GetDeliveries(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeliveries", reflect.TypeOf((*MockService)(nil).GetDeliveries), ctx, query)
+}
+
+// RequeueDelivery mocks base method
+func (m *MockService) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueDelivery", ctx, id, now)
+	ret0, _ := ret[0].(model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueDelivery indicates an expected call of RequeueDelivery
+func (mr *MockServiceMockRecorder) RequeueDelivery(ctx, id, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueDelivery", reflect.TypeOf((*MockService)(nil).RequeueDelivery), ctx, id, now)
+}
+
+// AddIdempotencyKey mocks base method
+func (m *MockService) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddIdempotencyKey", ctx, k)
+	ret0, _ := ret[0].(model.IdempotencyKey)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// AddIdempotencyKey indicates an expected call of AddIdempotencyKey
+func (mr *MockServiceMockRecorder) AddIdempotencyKey(ctx, k interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddIdempotencyKey", reflect.TypeOf((*MockService)(nil).AddIdempotencyKey), ctx, k)
+}
+
+// LeaseEvents mocks base method
+func (m *MockService) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaseEvents", ctx, now, timeout, limit)
+	ret0, _ := ret[0].([]model.IdempotencyKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LeaseEvents indicates an expected call of LeaseEvents
+func (mr *MockServiceMockRecorder) LeaseEvents(ctx, now, timeout, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaseEvents", reflect.TypeOf((*MockService)(nil).LeaseEvents), ctx, now, timeout, limit)
+}
+
+// MarkEventDispatched mocks base method
+func (m *MockService) MarkEventDispatched(ctx context.Context, key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkEventDispatched", ctx, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkEventDispatched indicates an expected call of MarkEventDispatched
+func (mr *MockServiceMockRecorder) MarkEventDispatched(ctx, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkEventDispatched", reflect.TypeOf((*MockService)(nil).MarkEventDispatched), ctx, key)
+}
+
+// SupportedLanguages mocks base method
+func (m *MockService) SupportedLanguages() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SupportedLanguages")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// SupportedLanguages indicates an expected call of SupportedLanguages
+func (mr *MockServiceMockRecorder) SupportedLanguages() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SupportedLanguages", reflect.TypeOf((*MockService)(nil).SupportedLanguages))
+}
+
+// SubscribeNotifications mocks base method
+func (m *MockService) SubscribeNotifications(ctx context.Context, userID int64) <-chan model.Notification {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SubscribeNotifications", ctx, userID)
+	ret0, _ := ret[0].(<-chan model.Notification)
+	return ret0
+}
+
+// SubscribeNotifications indicates an expected call of SubscribeNotifications
+func (mr *MockServiceMockRecorder) SubscribeNotifications(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SubscribeNotifications", reflect.TypeOf((*MockService)(nil).SubscribeNotifications), ctx, userID)
+}
+
+// Backup mocks base method
+func (m *MockService) Backup(ctx context.Context, w io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Backup", ctx, w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Backup indicates an expected call of Backup
+func (mr *MockServiceMockRecorder) Backup(ctx, w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Backup", reflect.TypeOf((*MockService)(nil).Backup), ctx, w)
 }
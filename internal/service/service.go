@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/text/language"
 
 	"github.com/vliubezny/gnotify/internal/model"
 	"github.com/vliubezny/gnotify/internal/storage"
@@ -14,32 +18,153 @@ import (
 var (
 	// ErrNotFound states that record was not found in storage.
 	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidCursor states that pagination cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrInvalidLanguage states that language code is malformed or not supported.
+	ErrInvalidLanguage = errors.New("invalid language")
+
+	// ErrInvalidTimeZone states that time zone is not found in tz database.
+	ErrInvalidTimeZone = errors.New("invalid time zone")
+
+	// ErrInvalidQuietHours states that quiet hours bounds are out of day or empty.
+	ErrInvalidQuietHours = errors.New("invalid quiet hours")
+
+	// ErrInvalidDevice states that device address doesn't match device type.
+	ErrInvalidDevice = errors.New("invalid device")
+
+	// ErrConflict states that record was changed since expected version.
+	ErrConflict = errors.New("conflict")
+
+	// ErrBackupNotSupported states that storage can't make online backups.
+	ErrBackupNotSupported = errors.New("backup is not supported by storage")
+)
+
+// supportedLanguages lists languages users may choose.
+var supportedLanguages = []language.Tag{
+	language.English,
+	language.MustParse("be"),
+	language.Russian,
+	language.Ukrainian,
+	language.Polish,
+	language.German,
+	language.French,
+	language.Spanish,
+	language.Portuguese,
+	language.BrazilianPortuguese,
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
 )
 
 type Service interface {
 	// GetUser returns user by ID.
 	GetUser(ctx context.Context, id int64) (model.User, error)
 
-	// GetUsers returns list of users.
-	GetUsers(ctx context.Context) ([]model.User, error)
+	// GetUsers returns page of users matching query.
+	GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error)
 
 	// UpsertUser inserts or updates user setting if record exists.
+	// Language is validated and normalized to canonical BCP 47 form.
+	// Non-zero user.Version must match stored version.
 	UpsertUser(ctx context.Context, user model.User) error
 
 	// DeleteUser deletes user by ID.
 	DeleteUser(ctx context.Context, id int64) error
 
-	// AddDevice add new device for user
-	AddDevice(ctx context.Context, userID int64, device model.Device) (model.Device, error)
+	// AddDevice add new device for user, webhook secret is generated.
+	// Non-zero version must match stored user version.
+	AddDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error)
+
+	// GetDevice returns user device by ID.
+	GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error)
+
+	// UpdateDevice updates user device, disabled device is enabled unless device is disabled.
+	// Webhook secret is kept, it is generated if device becomes webhook.
+	// Non-zero version must match stored user version.
+	UpdateDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error)
+
+	// RotateDeviceSecret replaces webhook secret with new random one.
+	// Non-zero version must match stored user version.
+	RotateDeviceSecret(ctx context.Context, userID, version int64, deviceID string) (model.Device, error)
+
+	// RemoveDevice removes device from user devices.
+	// Non-zero version must match stored user version.
+	RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error
+
+	// DisableDevice marks user device as disabled so it is skipped on delivery.
+	DisableDevice(ctx context.Context, userID int64, deviceID string) error
+
+	// AddToDigest appends event to the device digest creating digest if needed.
+	AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error
+
+	// GetDigests returns list of pending digests.
+	GetDigests(ctx context.Context) ([]model.Digest, error)
+
+	// PopDigest removes device digest and returns it.
+	PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error)
+
+	// AddNotification appends notification to user inbox.
+	AddNotification(ctx context.Context, n model.Notification) (model.Notification, error)
+
+	// GetNotifications returns page of user notifications.
+	GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error)
+
+	// MarkNotificationsRead marks user notifications as read and returns number of updated notifications.
+	MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error)
+
+	// AddDelivery enqueues pending delivery to outbox.
+	AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error)
+
+	// LeaseDeliveries leases up to limit due deliveries till now+timeout.
+	// Leased delivery is due again once its lease expires, so it is recovered if worker crashes.
+	LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error)
+
+	// UpdateDelivery saves result of delivery attempt.
+	// It returns ErrConflict if lease expired and delivery was leased again.
+	UpdateDelivery(ctx context.Context, d model.Delivery) error
+
+	// GetDeliveries returns page of deliveries from newest to oldest.
+	GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error)
+
+	// RequeueDelivery makes dead delivery pending so it is retried from scratch.
+	// It returns ErrConflict if delivery is not dead.
+	RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error)
+
+	// AddIdempotencyKey saves key with pending event unless unexpired key with the same value exists.
+	// It returns saved or existing key and reports whether key was saved.
+	AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error)
+
+	// LeaseEvents leases up to limit pending events till now+timeout.
+	// Leased event is due again once its lease expires, so it is recovered if process crashes.
+	LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error)
+
+	// MarkEventDispatched marks event accepted with the key as dispatched.
+	MarkEventDispatched(ctx context.Context, key string) error
+
+	// SupportedLanguages returns codes of languages users may choose.
+	SupportedLanguages() []string
+
+	// SubscribeNotifications returns channel of new user notifications.
+	// Channel is closed when context is done.
+	SubscribeNotifications(ctx context.Context, userID int64) <-chan model.Notification
+
+	// Backup writes storage snapshot to w.
+	Backup(ctx context.Context, w io.Writer) error
 }
 
 type service struct {
-	s storage.Storage
+	s      storage.Storage
+	broker *broker
 }
 
 func New(s storage.Storage) Service {
 	return &service{
-		s: s,
+		s:      s,
+		broker: newBroker(),
 	}
 }
 
@@ -54,16 +179,38 @@ func (s *service) GetUser(ctx context.Context, id int64) (model.User, error) {
 	return user, nil
 }
 
-func (s *service) GetUsers(ctx context.Context) ([]model.User, error) {
-	users, err := s.s.GetUsers(ctx)
+func (s *service) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
+	query.First = pageSize(query.First)
+
+	page, err := s.s.GetUsers(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get users: %w", err)
+		if err == storage.ErrInvalidCursor {
+			return model.UserPage{}, ErrInvalidCursor
+		}
+		return model.UserPage{}, fmt.Errorf("failed to get users: %w", err)
 	}
-	return users, nil
+	return page, nil
 }
 
 func (s *service) UpsertUser(ctx context.Context, user model.User) error {
+	lang, err := normalizeLanguage(user.Language)
+	if err != nil {
+		return err
+	}
+	user.Language = lang
+
+	if err := validateTimeZone(user.TimeZone); err != nil {
+		return err
+	}
+
+	if err := validateQuietHours(user.QuietHours); err != nil {
+		return err
+	}
+
 	if err := s.s.UpsertUser(ctx, user); err != nil {
+		if err == storage.ErrConflict {
+			return ErrConflict
+		}
 		return fmt.Errorf("failed to upsert user: %w", err)
 	}
 	return nil
@@ -79,13 +226,350 @@ func (s *service) DeleteUser(ctx context.Context, id int64) error {
 	return nil
 }
 
-func (s *service) AddDevice(ctx context.Context, userID int64, device model.Device) (model.Device, error) {
-	d, err := s.s.AddDevice(ctx, userID, device)
+func (s *service) AddDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return model.Device{}, err
+	}
+
+	device.Address.Secret = ""
+	if device.Type == model.DeviceWebhook {
+		secret, err := newSecret()
+		if err != nil {
+			return model.Device{}, err
+		}
+		device.Address.Secret = secret
+	}
+
+	d, err := s.s.AddDevice(ctx, userID, version, device)
 	if err != nil {
-		if err == storage.ErrNotFound {
+		switch err {
+		case storage.ErrNotFound:
 			return model.Device{}, ErrNotFound
+		case storage.ErrConflict:
+			return model.Device{}, ErrConflict
 		}
 		return model.Device{}, fmt.Errorf("failed to add device: %w", err)
 	}
 	return d, nil
 }
+
+func (s *service) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	d, err := s.s.GetDevice(ctx, userID, deviceID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return model.Device{}, ErrNotFound
+		}
+		return model.Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+	return d, nil
+}
+
+func (s *service) UpdateDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return model.Device{}, err
+	}
+
+	device.Address.Secret = ""
+	if device.Type == model.DeviceWebhook {
+		old, err := s.GetDevice(ctx, userID, device.ID)
+		if err != nil {
+			return model.Device{}, err
+		}
+
+		device.Address.Secret = old.Address.Secret
+		if old.Type != model.DeviceWebhook || old.Address.Secret == "" {
+			if device.Address.Secret, err = newSecret(); err != nil {
+				return model.Device{}, err
+			}
+		}
+	}
+
+	return s.updateDevice(ctx, userID, version, device)
+}
+
+func (s *service) RotateDeviceSecret(ctx context.Context, userID, version int64, deviceID string) (model.Device, error) {
+	device, err := s.GetDevice(ctx, userID, deviceID)
+	if err != nil {
+		return model.Device{}, err
+	}
+
+	if device.Type != model.DeviceWebhook {
+		return model.Device{}, fmt.Errorf("%w: only webhooks have secret", ErrInvalidDevice)
+	}
+
+	if device.Address.Secret, err = newSecret(); err != nil {
+		return model.Device{}, err
+	}
+
+	return s.updateDevice(ctx, userID, version, device)
+}
+
+func (s *service) updateDevice(ctx context.Context, userID, version int64, device model.Device) (model.Device, error) {
+	d, err := s.s.UpdateDevice(ctx, userID, version, device)
+	if err != nil {
+		switch err {
+		case storage.ErrNotFound:
+			return model.Device{}, ErrNotFound
+		case storage.ErrConflict:
+			return model.Device{}, ErrConflict
+		}
+		return model.Device{}, fmt.Errorf("failed to update device: %w", err)
+	}
+	return d, nil
+}
+
+func (s *service) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	if err := s.s.RemoveDevice(ctx, userID, version, deviceID); err != nil {
+		switch err {
+		case storage.ErrNotFound:
+			return ErrNotFound
+		case storage.ErrConflict:
+			return ErrConflict
+		}
+		return fmt.Errorf("failed to remove device: %w", err)
+	}
+	return nil
+}
+
+func (s *service) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	if err := s.s.DisableDevice(ctx, userID, deviceID); err != nil {
+		if err == storage.ErrNotFound {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to disable device: %w", err)
+	}
+	return nil
+}
+
+func (s *service) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	if err := s.s.AddToDigest(ctx, userID, deviceID, e); err != nil {
+		return fmt.Errorf("failed to add event to digest: %w", err)
+	}
+	return nil
+}
+
+func (s *service) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	digests, err := s.s.GetDigests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digests: %w", err)
+	}
+	return digests, nil
+}
+
+func (s *service) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	d, err := s.s.PopDigest(ctx, userID, deviceID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return model.Digest{}, ErrNotFound
+		}
+		return model.Digest{}, fmt.Errorf("failed to pop digest: %w", err)
+	}
+	return d, nil
+}
+
+func (s *service) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	n, err := s.s.AddNotification(ctx, n)
+	if err != nil {
+		return model.Notification{}, fmt.Errorf("failed to add notification: %w", err)
+	}
+
+	s.broker.publish(n)
+
+	return n, nil
+}
+
+func (s *service) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	query.First = pageSize(query.First)
+
+	page, err := s.s.GetNotifications(ctx, userID, query)
+	if err != nil {
+		if err == storage.ErrInvalidCursor {
+			return model.NotificationPage{}, ErrInvalidCursor
+		}
+		return model.NotificationPage{}, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	return page, nil
+}
+
+func (s *service) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	n, err := s.s.MarkNotificationsRead(ctx, userID, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+	return n, nil
+}
+
+func (s *service) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	d.State = model.DeliveryPending
+	d.Attempts = 0
+	d.LastError = ""
+
+	d, err := s.s.AddDelivery(ctx, d)
+	if err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to add delivery: %w", err)
+	}
+	return d, nil
+}
+
+func (s *service) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	ds, err := s.s.LeaseDeliveries(ctx, now, timeout, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease deliveries: %w", err)
+	}
+	return ds, nil
+}
+
+func (s *service) UpdateDelivery(ctx context.Context, d model.Delivery) error {
+	if err := s.s.UpdateDelivery(ctx, d); err != nil {
+		switch err {
+		case storage.ErrNotFound:
+			return ErrNotFound
+		case storage.ErrConflict:
+			return ErrConflict
+		}
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+	return nil
+}
+
+func (s *service) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	query.First = pageSize(query.First)
+
+	page, err := s.s.GetDeliveries(ctx, query)
+	if err != nil {
+		if err == storage.ErrInvalidCursor {
+			return model.DeliveryPage{}, ErrInvalidCursor
+		}
+		return model.DeliveryPage{}, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+	return page, nil
+}
+
+func (s *service) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	d, err := s.s.RequeueDelivery(ctx, id, now)
+	if err != nil {
+		switch err {
+		case storage.ErrNotFound:
+			return model.Delivery{}, ErrNotFound
+		case storage.ErrConflict:
+			return model.Delivery{}, ErrConflict
+		}
+		return model.Delivery{}, fmt.Errorf("failed to requeue delivery: %w", err)
+	}
+	return d, nil
+}
+
+func (s *service) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	k.Pending = true
+	k.NextAttemptAt = k.AcceptedAt
+
+	k, saved, err := s.s.AddIdempotencyKey(ctx, k)
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to add idempotency key: %w", err)
+	}
+	return k, saved, nil
+}
+
+func (s *service) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	ks, err := s.s.LeaseEvents(ctx, now, timeout, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease events: %w", err)
+	}
+	return ks, nil
+}
+
+func (s *service) MarkEventDispatched(ctx context.Context, key string) error {
+	if err := s.s.MarkEventDispatched(ctx, key); err != nil {
+		if err == storage.ErrNotFound {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+	return nil
+}
+
+func (s *service) SupportedLanguages() []string {
+	codes := make([]string, len(supportedLanguages))
+	for i, tag := range supportedLanguages {
+		codes[i] = tag.String()
+	}
+	return codes
+}
+
+// normalizeLanguage validates language code and returns its canonical form.
+func normalizeLanguage(code string) (string, error) {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidLanguage, code)
+	}
+
+	for _, t := range supportedLanguages {
+		if t == tag {
+			return tag.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s is not supported", ErrInvalidLanguage, tag)
+}
+
+// validateTimeZone checks that time zone is known, empty time zone stands for UTC.
+func validateTimeZone(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	// Local depends on server settings so users can't choose it
+	if name == "Local" {
+		return fmt.Errorf("%w: %s", ErrInvalidTimeZone, name)
+	}
+
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTimeZone, name)
+	}
+
+	return nil
+}
+
+// validateQuietHours checks that quiet hours are non-empty periods within a day.
+func validateQuietHours(qs []model.QuietHours) error {
+	const day = 24 * 60
+
+	for _, q := range qs {
+		if q.Start < 0 || q.Start >= day || q.End < 0 || q.End >= day || q.Start == q.End {
+			return fmt.Errorf("%w: %d-%d", ErrInvalidQuietHours, q.Start, q.End)
+		}
+	}
+
+	return nil
+}
+
+func (s *service) SubscribeNotifications(ctx context.Context, userID int64) <-chan model.Notification {
+	return s.broker.subscribe(ctx, userID)
+}
+
+func (s *service) Backup(ctx context.Context, w io.Writer) error {
+	b, ok := s.s.(storage.Backuper)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+
+	if err := b.Backup(ctx, w); err != nil {
+		return fmt.Errorf("failed to backup storage: %w", err)
+	}
+	return nil
+}
+
+// pageSize returns requested page size limited to allowed range.
+func pageSize(first int) int {
+	if first <= 0 {
+		return defaultPageSize
+	}
+	if first > maxPageSize {
+		return maxPageSize
+	}
+	return first
+}
@@ -1,13 +1,17 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/vliubezny/gnotify/internal/model"
 	"github.com/vliubezny/gnotify/internal/storage"
 	"github.com/vliubezny/gnotify/internal/storage/mock"
@@ -67,30 +71,56 @@ func TestService_GetUser(t *testing.T) {
 }
 
 func TestService_GetUsers(t *testing.T) {
-	testUsers := []model.User{
-		{ID: 1, Language: "by"},
-		{ID: 2, Language: "ru"},
+	testPage := model.UserPage{
+		Users: []model.User{
+			{ID: 1, Language: "by"},
+			{ID: 2, Language: "ru"},
+		},
+		NextCursor: "2",
 	}
 
 	testCases := []struct {
 		desc   string
-		rUsers []model.User
+		query  model.UserQuery
+		sQuery model.UserQuery
+		rPage  model.UserPage
 		rErr   error
-		users  []model.User
+		page   model.UserPage
 		err    error
 	}{
 		{
 			desc:   "success",
-			rUsers: testUsers,
-			rErr:   nil,
-			users:  testUsers,
-			err:    nil,
+			query:  model.UserQuery{First: 2, After: "0", Language: "ru", Frequency: model.Daily},
+			sQuery: model.UserQuery{First: 2, After: "0", Language: "ru", Frequency: model.Daily},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "default page size",
+			query:  model.UserQuery{},
+			sQuery: model.UserQuery{First: defaultPageSize},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "max page size",
+			query:  model.UserQuery{First: 1000},
+			sQuery: model.UserQuery{First: maxPageSize},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "ErrInvalidCursor",
+			query:  model.UserQuery{First: 10, After: "invalid"},
+			sQuery: model.UserQuery{First: 10, After: "invalid"},
+			rErr:   storage.ErrInvalidCursor,
+			err:    ErrInvalidCursor,
 		},
 		{
 			desc:   "unexpected error",
-			rUsers: nil,
+			query:  model.UserQuery{First: 10},
+			sQuery: model.UserQuery{First: 10},
 			rErr:   assert.AnError,
-			users:  nil,
 			err:    assert.AnError,
 		},
 	}
@@ -100,13 +130,13 @@ func TestService_GetUsers(t *testing.T) {
 			defer ctrl.Finish()
 
 			st := mock.NewMockStorage(ctrl)
-			st.EXPECT().GetUsers(ctx).Return(tC.rUsers, tC.rErr)
+			st.EXPECT().GetUsers(ctx, tC.sQuery).Return(tC.rPage, tC.rErr)
 
 			s := New(st)
 
-			users, err := s.GetUsers(ctx)
+			page, err := s.GetUsers(ctx, tC.query)
 			assert.True(t, errors.Is(err, tC.err), fmt.Sprintf("wanted %s got %s", tC.err, err))
-			assert.Equal(t, tC.users, users)
+			assert.Equal(t, tC.page, page)
 		})
 	}
 }
@@ -114,23 +144,72 @@ func TestService_GetUsers(t *testing.T) {
 func TestService_UpsertUser(t *testing.T) {
 	testCases := []struct {
 		desc  string
-		rUser model.User
-		rErr  error
 		user  model.User
+		sUser model.User
+		rErr  error
 		err   error
 	}{
 		{
 			desc:  "success",
-			rUser: model.User{ID: 1, Language: "en"},
-			rErr:  nil,
 			user:  model.User{ID: 1, Language: "en"},
+			sUser: model.User{ID: 1, Language: "en"},
+			rErr:  nil,
+			err:   nil,
+		},
+		{
+			desc:  "normalize language",
+			user:  model.User{ID: 1, Language: "PT-br"},
+			sUser: model.User{ID: 1, Language: "pt-BR"},
+			rErr:  nil,
 			err:   nil,
 		},
+		{
+			desc: "invalid language",
+			user: model.User{ID: 1, Language: "english"},
+			err:  ErrInvalidLanguage,
+		},
+		{
+			desc: "unsupported language",
+			user: model.User{ID: 1, Language: "ja"},
+			err:  ErrInvalidLanguage,
+		},
+		{
+			desc:  "time zone and quiet hours",
+			user:  model.User{ID: 1, Language: "en", TimeZone: "Europe/Minsk", QuietHours: []model.QuietHours{{Start: 1320, End: 420}}},
+			sUser: model.User{ID: 1, Language: "en", TimeZone: "Europe/Minsk", QuietHours: []model.QuietHours{{Start: 1320, End: 420}}},
+		},
+		{
+			desc: "unknown time zone",
+			user: model.User{ID: 1, Language: "en", TimeZone: "Mars/Olympus"},
+			err:  ErrInvalidTimeZone,
+		},
+		{
+			desc: "local time zone",
+			user: model.User{ID: 1, Language: "en", TimeZone: "Local"},
+			err:  ErrInvalidTimeZone,
+		},
+		{
+			desc: "quiet hours out of day",
+			user: model.User{ID: 1, Language: "en", QuietHours: []model.QuietHours{{Start: 1320, End: 1440}}},
+			err:  ErrInvalidQuietHours,
+		},
+		{
+			desc: "empty quiet hours",
+			user: model.User{ID: 1, Language: "en", QuietHours: []model.QuietHours{{Start: 60, End: 60}}},
+			err:  ErrInvalidQuietHours,
+		},
+		{
+			desc:  "ErrConflict",
+			user:  model.User{ID: 1, Language: "en", Version: 2},
+			sUser: model.User{ID: 1, Language: "en", Version: 2},
+			rErr:  storage.ErrConflict,
+			err:   ErrConflict,
+		},
 		{
 			desc:  "unexpected error",
-			rUser: model.User{},
-			rErr:  assert.AnError,
 			user:  model.User{ID: 1, Language: "en"},
+			sUser: model.User{ID: 1, Language: "en"},
+			rErr:  assert.AnError,
 			err:   assert.AnError,
 		},
 	}
@@ -140,7 +219,9 @@ func TestService_UpsertUser(t *testing.T) {
 			defer ctrl.Finish()
 
 			st := mock.NewMockStorage(ctrl)
-			st.EXPECT().UpsertUser(ctx, tC.user).Return(tC.rErr)
+			if tC.sUser.ID != 0 {
+				st.EXPECT().UpsertUser(ctx, tC.sUser).Return(tC.rErr)
+			}
 
 			s := New(st)
 
@@ -151,6 +232,21 @@ func TestService_UpsertUser(t *testing.T) {
 	}
 }
 
+func TestService_SupportedLanguages(t *testing.T) {
+	s := New(nil)
+
+	langs := s.SupportedLanguages()
+
+	assert.Contains(t, langs, "en")
+	assert.Contains(t, langs, "pt-BR")
+
+	for _, l := range langs {
+		n, err := normalizeLanguage(l)
+		assert.NoError(t, err)
+		assert.Equal(t, l, n, "supported languages must be canonical")
+	}
+}
+
 func TestService_DeleteUser(t *testing.T) {
 	testCases := []struct {
 		desc string
@@ -193,11 +289,12 @@ func TestService_DeleteUser(t *testing.T) {
 
 func TestService_AddDevice(t *testing.T) {
 	inputDevice := model.Device{
-		Name: "Chrome",
-		Settings: model.NotificationSettings{
-			Frequency:    model.Daily,
-			PriceChanged: true,
-		},
+		Name:    "Chrome",
+		Type:    model.DeviceEmail,
+		Address: model.Address{Email: "user@example.com"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
 	}
 
 	testCases := []struct {
@@ -221,6 +318,13 @@ func TestService_AddDevice(t *testing.T) {
 			rErr:     storage.ErrNotFound,
 			err:      ErrNotFound,
 		},
+		{
+			desc:     "ErrConflict",
+			input:    inputDevice,
+			deviceID: "12345",
+			rErr:     storage.ErrConflict,
+			err:      ErrConflict,
+		},
 		{
 			desc:     "unexpected error",
 			input:    inputDevice,
@@ -228,6 +332,11 @@ func TestService_AddDevice(t *testing.T) {
 			rErr:     assert.AnError,
 			err:      assert.AnError,
 		},
+		{
+			desc:  "ErrInvalidDevice",
+			input: model.Device{Name: "Chrome", Type: model.DeviceEmail},
+			err:   ErrInvalidDevice,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -237,15 +346,17 @@ func TestService_AddDevice(t *testing.T) {
 			id := int64(1)
 
 			st := mock.NewMockStorage(ctrl)
-			st.EXPECT().AddDevice(ctx, id, tc.input).
-				DoAndReturn(func(ctx context.Context, userID int64, d model.Device) (model.Device, error) {
-					d.ID = tc.deviceID
-					return d, tc.rErr
-				})
+			if tc.deviceID != "" {
+				st.EXPECT().AddDevice(ctx, id, int64(3), tc.input).
+					DoAndReturn(func(ctx context.Context, userID, version int64, d model.Device) (model.Device, error) {
+						d.ID = tc.deviceID
+						return d, tc.rErr
+					})
+			}
 
 			s := New(st)
 
-			d, err := s.AddDevice(ctx, id, tc.input)
+			d, err := s.AddDevice(ctx, id, 3, tc.input)
 			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
 
 			if tc.err == nil {
@@ -255,3 +366,1008 @@ func TestService_AddDevice(t *testing.T) {
 		})
 	}
 }
+
+func TestService_AddToDigest(t *testing.T) {
+	e := model.Event{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100}
+
+	testCases := []struct {
+		desc string
+		rErr error
+		err  error
+	}{
+		{
+			desc: "success",
+			rErr: nil,
+			err:  nil,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().AddToDigest(ctx, int64(1), "12345", e).Return(tc.rErr)
+
+			s := New(st)
+
+			err := s.AddToDigest(ctx, 1, "12345", e)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
+
+func TestService_GetDigests(t *testing.T) {
+	testDigests := []model.Digest{
+		{UserID: 1, DeviceID: "12345", Events: []model.Event{{Type: model.PriceChanged}}},
+	}
+
+	testCases := []struct {
+		desc     string
+		rDigests []model.Digest
+		rErr     error
+		digests  []model.Digest
+		err      error
+	}{
+		{
+			desc:     "success",
+			rDigests: testDigests,
+			rErr:     nil,
+			digests:  testDigests,
+			err:      nil,
+		},
+		{
+			desc:     "unexpected error",
+			rDigests: nil,
+			rErr:     assert.AnError,
+			digests:  nil,
+			err:      assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetDigests(ctx).Return(tc.rDigests, tc.rErr)
+
+			s := New(st)
+
+			digests, err := s.GetDigests(ctx)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.digests, digests)
+		})
+	}
+}
+
+func TestService_PopDigest(t *testing.T) {
+	testDigest := model.Digest{UserID: 1, DeviceID: "12345", Events: []model.Event{{Type: model.PriceChanged}}}
+
+	testCases := []struct {
+		desc    string
+		rDigest model.Digest
+		rErr    error
+		digest  model.Digest
+		err     error
+	}{
+		{
+			desc:    "success",
+			rDigest: testDigest,
+			rErr:    nil,
+			digest:  testDigest,
+			err:     nil,
+		},
+		{
+			desc:    "ErrNotFound",
+			rDigest: model.Digest{},
+			rErr:    storage.ErrNotFound,
+			digest:  model.Digest{},
+			err:     ErrNotFound,
+		},
+		{
+			desc:    "unexpected error",
+			rDigest: model.Digest{},
+			rErr:    assert.AnError,
+			digest:  model.Digest{},
+			err:     assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().PopDigest(ctx, int64(1), "12345").Return(tc.rDigest, tc.rErr)
+
+			s := New(st)
+
+			digest, err := s.PopDigest(ctx, 1, "12345")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.digest, digest)
+		})
+	}
+}
+
+func TestService_AddNotification(t *testing.T) {
+	input := model.Notification{UserID: 1, Type: model.PriceChanged, Title: "Price changed"}
+
+	testCases := []struct {
+		desc  string
+		rNote model.Notification
+		rErr  error
+		note  model.Notification
+		err   error
+	}{
+		{
+			desc:  "success",
+			rNote: model.Notification{ID: "12345", UserID: 1, Type: model.PriceChanged, Title: "Price changed"},
+			rErr:  nil,
+			note:  model.Notification{ID: "12345", UserID: 1, Type: model.PriceChanged, Title: "Price changed"},
+			err:   nil,
+		},
+		{
+			desc:  "unexpected error",
+			rNote: model.Notification{},
+			rErr:  assert.AnError,
+			note:  model.Notification{},
+			err:   assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().AddNotification(ctx, input).Return(tc.rNote, tc.rErr)
+
+			s := New(st)
+
+			n, err := s.AddNotification(ctx, input)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.note, n)
+		})
+	}
+}
+
+func TestService_GetNotifications(t *testing.T) {
+	testPage := model.NotificationPage{
+		Notifications: []model.Notification{{ID: "12345", UserID: 1}},
+		HasNextPage:   true,
+	}
+
+	testCases := []struct {
+		desc   string
+		query  model.NotificationQuery
+		sQuery model.NotificationQuery
+		rPage  model.NotificationPage
+		rErr   error
+		page   model.NotificationPage
+		err    error
+	}{
+		{
+			desc:   "success",
+			query:  model.NotificationQuery{First: 10, After: "1", UnreadOnly: true},
+			sQuery: model.NotificationQuery{First: 10, After: "1", UnreadOnly: true},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "default page size",
+			query:  model.NotificationQuery{},
+			sQuery: model.NotificationQuery{First: defaultPageSize},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "max page size",
+			query:  model.NotificationQuery{First: 1000},
+			sQuery: model.NotificationQuery{First: maxPageSize},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "ErrInvalidCursor",
+			query:  model.NotificationQuery{First: 10, After: "invalid"},
+			sQuery: model.NotificationQuery{First: 10, After: "invalid"},
+			rErr:   storage.ErrInvalidCursor,
+			err:    ErrInvalidCursor,
+		},
+		{
+			desc:   "unexpected error",
+			query:  model.NotificationQuery{First: 10},
+			sQuery: model.NotificationQuery{First: 10},
+			rErr:   assert.AnError,
+			err:    assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetNotifications(ctx, int64(1), tc.sQuery).Return(tc.rPage, tc.rErr)
+
+			s := New(st)
+
+			page, err := s.GetNotifications(ctx, 1, tc.query)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.page, page)
+		})
+	}
+}
+
+func TestService_MarkNotificationsRead(t *testing.T) {
+	testCases := []struct {
+		desc string
+		ids  []string
+		rN   int
+		rErr error
+		n    int
+		err  error
+	}{
+		{
+			desc: "success",
+			ids:  []string{"1", "2"},
+			rN:   2,
+			n:    2,
+		},
+		{
+			desc: "no ids",
+			ids:  nil,
+			n:    0,
+		},
+		{
+			desc: "unexpected error",
+			ids:  []string{"1"},
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			if len(tc.ids) > 0 {
+				st.EXPECT().MarkNotificationsRead(ctx, int64(1), tc.ids).Return(tc.rN, tc.rErr)
+			}
+
+			s := New(st)
+
+			n, err := s.MarkNotificationsRead(ctx, 1, tc.ids)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.n, n)
+		})
+	}
+}
+
+func TestService_SubscribeNotifications(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	n := model.Notification{ID: "12345", UserID: 1, Type: model.PriceChanged}
+
+	st := mock.NewMockStorage(ctrl)
+	st.EXPECT().AddNotification(ctx, model.Notification{UserID: 1, Type: model.PriceChanged}).Return(n, nil)
+
+	s := New(st)
+
+	c1, cancel1 := context.WithCancel(ctx)
+	defer cancel1()
+	c2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+
+	ch1 := s.SubscribeNotifications(c1, 1)
+	ch2 := s.SubscribeNotifications(c2, 2)
+
+	_, err := s.AddNotification(ctx, model.Notification{UserID: 1, Type: model.PriceChanged})
+	require.NoError(t, err)
+
+	assert.Equal(t, n, <-ch1)
+
+	cancel1()
+	cancel2()
+
+	_, ok := <-ch1
+	assert.False(t, ok, "channel must be closed")
+
+	_, ok = <-ch2
+	assert.False(t, ok, "channel must be closed without notifications")
+}
+
+func TestService_UpdateDevice(t *testing.T) {
+	inputDevice := model.Device{
+		ID:      "12345",
+		Name:    "Chrome",
+		Type:    model.DeviceSMS,
+		Address: model.Address{Phone: "+375291234567"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Weekly, Channel: model.ChannelDevice},
+		}},
+	}
+
+	testCases := []struct {
+		desc    string
+		rDevice model.Device
+		rErr    error
+		device  model.Device
+		err     error
+	}{
+		{
+			desc:    "success",
+			rDevice: inputDevice,
+			rErr:    nil,
+			device:  inputDevice,
+			err:     nil,
+		},
+		{
+			desc:    "ErrNotFound",
+			rDevice: model.Device{},
+			rErr:    storage.ErrNotFound,
+			device:  model.Device{},
+			err:     ErrNotFound,
+		},
+		{
+			desc:    "ErrConflict",
+			rDevice: model.Device{},
+			rErr:    storage.ErrConflict,
+			device:  model.Device{},
+			err:     ErrConflict,
+		},
+		{
+			desc:    "unexpected error",
+			rDevice: model.Device{},
+			rErr:    assert.AnError,
+			device:  model.Device{},
+			err:     assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().UpdateDevice(ctx, int64(1), int64(3), inputDevice).Return(tc.rDevice, tc.rErr)
+
+			s := New(st)
+
+			d, err := s.UpdateDevice(ctx, 1, 3, inputDevice)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.device, d)
+		})
+	}
+}
+
+func TestService_AddDevice_webhook(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	input := model.Device{
+		Name:    "CRM",
+		Type:    model.DeviceWebhook,
+		Address: model.Address{URL: "https://example.com/hooks/gnotify", Secret: "chosen"},
+	}
+
+	st := mock.NewMockStorage(ctrl)
+	st.EXPECT().AddDevice(ctx, int64(1), int64(0), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, userID, version int64, d model.Device) (model.Device, error) {
+			d.ID = "12345"
+			return d, nil
+		})
+
+	s := New(st)
+
+	d, err := s.AddDevice(ctx, 1, 0, input)
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://example.com/hooks/gnotify", d.Address.URL)
+	assert.Len(t, d.Address.Secret, 43, "secret must be generated")
+}
+
+func TestService_UpdateDevice_webhook(t *testing.T) {
+	input := model.Device{
+		ID:      "12345",
+		Name:    "CRM",
+		Type:    model.DeviceWebhook,
+		Address: model.Address{URL: "https://example.com/hooks/v2"},
+	}
+
+	testCases := []struct {
+		desc string
+		old  model.Device
+		rErr error
+		keep bool
+		err  error
+	}{
+		{
+			desc: "secret is kept",
+			old:  model.Device{ID: "12345", Type: model.DeviceWebhook, Address: model.Address{URL: "https://example.com/hooks/v1", Secret: "secret"}},
+			keep: true,
+		},
+		{
+			desc: "secret is generated",
+			old:  model.Device{ID: "12345", Type: model.DeviceEmail, Address: model.Address{Email: "user@example.com"}},
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetDevice(ctx, int64(1), "12345").Return(tc.old, tc.rErr)
+			if tc.err == nil {
+				st.EXPECT().UpdateDevice(ctx, int64(1), int64(3), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, userID, version int64, d model.Device) (model.Device, error) {
+						return d, nil
+					})
+			}
+
+			s := New(st)
+
+			d, err := s.UpdateDevice(ctx, 1, 3, input)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			if tc.err != nil {
+				return
+			}
+
+			assert.Equal(t, input.Address.URL, d.Address.URL)
+			if tc.keep {
+				assert.Equal(t, "secret", d.Address.Secret)
+			} else {
+				assert.Len(t, d.Address.Secret, 43)
+			}
+		})
+	}
+}
+
+func TestService_RotateDeviceSecret(t *testing.T) {
+	webhook := model.Device{
+		ID:       "12345",
+		Name:     "CRM",
+		Type:     model.DeviceWebhook,
+		Address:  model.Address{URL: "https://example.com/hooks/gnotify", Secret: "secret"},
+		Disabled: true,
+	}
+
+	testCases := []struct {
+		desc    string
+		rDevice model.Device
+		rGetErr error
+		update  bool
+		rErr    error
+		err     error
+	}{
+		{
+			desc:    "success",
+			rDevice: webhook,
+			update:  true,
+		},
+		{
+			desc:    "not webhook",
+			rDevice: model.Device{ID: "12345", Type: model.DeviceEmail, Address: model.Address{Email: "user@example.com"}},
+			err:     ErrInvalidDevice,
+		},
+		{
+			desc:    "ErrNotFound",
+			rGetErr: storage.ErrNotFound,
+			err:     ErrNotFound,
+		},
+		{
+			desc:    "ErrConflict",
+			rDevice: webhook,
+			update:  true,
+			rErr:    storage.ErrConflict,
+			err:     ErrConflict,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetDevice(ctx, int64(1), "12345").Return(tc.rDevice, tc.rGetErr)
+			if tc.update {
+				st.EXPECT().UpdateDevice(ctx, int64(1), int64(3), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, userID, version int64, d model.Device) (model.Device, error) {
+						return d, tc.rErr
+					})
+			}
+
+			s := New(st)
+
+			d, err := s.RotateDeviceSecret(ctx, 1, 3, "12345")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			if tc.err != nil {
+				return
+			}
+
+			assert.NotEqual(t, "secret", d.Address.Secret)
+			assert.Len(t, d.Address.Secret, 43)
+			assert.True(t, d.Disabled, "rotation must not enable device")
+		})
+	}
+}
+
+func TestService_RemoveDevice(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rErr error
+		err  error
+	}{
+		{
+			desc: "success",
+			rErr: nil,
+			err:  nil,
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+		{
+			desc: "ErrConflict",
+			rErr: storage.ErrConflict,
+			err:  ErrConflict,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().RemoveDevice(ctx, int64(1), int64(3), "12345").Return(tc.rErr)
+
+			s := New(st)
+
+			err := s.RemoveDevice(ctx, 1, 3, "12345")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
+
+func TestService_DisableDevice(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rErr error
+		err  error
+	}{
+		{
+			desc: "success",
+			rErr: nil,
+			err:  nil,
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().DisableDevice(ctx, int64(1), "12345").Return(tc.rErr)
+
+			s := New(st)
+
+			err := s.DisableDevice(ctx, 1, "12345")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
+
+func TestService_GetDevice(t *testing.T) {
+	device := model.Device{
+		ID:   "12345",
+		Name: "Chrome",
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
+	}
+
+	testCases := []struct {
+		desc    string
+		rDevice model.Device
+		rErr    error
+		device  model.Device
+		err     error
+	}{
+		{
+			desc:    "success",
+			rDevice: device,
+			rErr:    nil,
+			device:  device,
+			err:     nil,
+		},
+		{
+			desc:    "ErrNotFound",
+			rDevice: model.Device{},
+			rErr:    storage.ErrNotFound,
+			device:  model.Device{},
+			err:     ErrNotFound,
+		},
+		{
+			desc:    "unexpected error",
+			rDevice: model.Device{},
+			rErr:    assert.AnError,
+			device:  model.Device{},
+			err:     assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetDevice(ctx, int64(1), "12345").Return(tc.rDevice, tc.rErr)
+
+			s := New(st)
+
+			d, err := s.GetDevice(ctx, 1, "12345")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.device, d)
+		})
+	}
+}
+
+// backupStorage is storage able to make backups.
+type backupStorage struct {
+	*mock.MockStorage
+	data string
+	err  error
+}
+
+func (s backupStorage) Backup(ctx context.Context, w io.Writer) error {
+	if s.err != nil {
+		return s.err
+	}
+	_, err := io.WriteString(w, s.data)
+	return err
+}
+
+func TestService_Backup(t *testing.T) {
+	testCases := []struct {
+		desc string
+		st   storage.Storage
+		data string
+		err  error
+	}{
+		{
+			desc: "success",
+			st:   backupStorage{data: "snapshot"},
+			data: "snapshot",
+		},
+		{
+			desc: "backup error",
+			st:   backupStorage{err: assert.AnError},
+			err:  assert.AnError,
+		},
+		{
+			desc: "not supported",
+			st:   mock.NewMockStorage(gomock.NewController(t)),
+			err:  ErrBackupNotSupported,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := New(tc.st).Backup(ctx, &buf)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.data, buf.String())
+		})
+	}
+}
+
+func TestService_AddDelivery(t *testing.T) {
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	input := model.Delivery{UserID: 1, DeviceID: "1", Title: "Price changed", State: model.DeliveryDead, Attempts: 3, NextAttemptAt: now}
+	sInput := model.Delivery{UserID: 1, DeviceID: "1", Title: "Price changed", State: model.DeliveryPending, NextAttemptAt: now}
+
+	testCases := []struct {
+		desc      string
+		rDelivery model.Delivery
+		rErr      error
+		delivery  model.Delivery
+		err       error
+	}{
+		{
+			desc:      "success",
+			rDelivery: model.Delivery{ID: "12345", UserID: 1, DeviceID: "1", Title: "Price changed", State: model.DeliveryPending, NextAttemptAt: now},
+			delivery:  model.Delivery{ID: "12345", UserID: 1, DeviceID: "1", Title: "Price changed", State: model.DeliveryPending, NextAttemptAt: now},
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().AddDelivery(ctx, sInput).Return(tc.rDelivery, tc.rErr)
+
+			s := New(st)
+
+			d, err := s.AddDelivery(ctx, input)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.delivery, d)
+		})
+	}
+}
+
+func TestService_UpdateDelivery(t *testing.T) {
+	d := model.Delivery{ID: "12345", State: model.DeliverySucceeded, Attempts: 1}
+
+	testCases := []struct {
+		desc string
+		rErr error
+		err  error
+	}{
+		{
+			desc: "success",
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+		{
+			desc: "ErrConflict",
+			rErr: storage.ErrConflict,
+			err:  ErrConflict,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().UpdateDelivery(ctx, d).Return(tc.rErr)
+
+			s := New(st)
+
+			err := s.UpdateDelivery(ctx, d)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
+
+func TestService_GetDeliveries(t *testing.T) {
+	testPage := model.DeliveryPage{
+		Deliveries:  []model.Delivery{{ID: "12345", State: model.DeliveryDead}},
+		HasNextPage: true,
+	}
+
+	testCases := []struct {
+		desc   string
+		query  model.DeliveryQuery
+		sQuery model.DeliveryQuery
+		rPage  model.DeliveryPage
+		rErr   error
+		page   model.DeliveryPage
+		err    error
+	}{
+		{
+			desc:   "success",
+			query:  model.DeliveryQuery{State: model.DeliveryDead, First: 10, After: "1"},
+			sQuery: model.DeliveryQuery{State: model.DeliveryDead, First: 10, After: "1"},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "default page size",
+			query:  model.DeliveryQuery{},
+			sQuery: model.DeliveryQuery{First: defaultPageSize},
+			rPage:  testPage,
+			page:   testPage,
+		},
+		{
+			desc:   "ErrInvalidCursor",
+			query:  model.DeliveryQuery{First: 10, After: "invalid"},
+			sQuery: model.DeliveryQuery{First: 10, After: "invalid"},
+			rErr:   storage.ErrInvalidCursor,
+			err:    ErrInvalidCursor,
+		},
+		{
+			desc:   "unexpected error",
+			query:  model.DeliveryQuery{First: 10},
+			sQuery: model.DeliveryQuery{First: 10},
+			rErr:   assert.AnError,
+			err:    assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().GetDeliveries(ctx, tc.sQuery).Return(tc.rPage, tc.rErr)
+
+			s := New(st)
+
+			page, err := s.GetDeliveries(ctx, tc.query)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.page, page)
+		})
+	}
+}
+
+func TestService_RequeueDelivery(t *testing.T) {
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	testDelivery := model.Delivery{ID: "12345", State: model.DeliveryPending, NextAttemptAt: now}
+
+	testCases := []struct {
+		desc      string
+		rDelivery model.Delivery
+		rErr      error
+		delivery  model.Delivery
+		err       error
+	}{
+		{
+			desc:      "success",
+			rDelivery: testDelivery,
+			delivery:  testDelivery,
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+		{
+			desc: "ErrConflict",
+			rErr: storage.ErrConflict,
+			err:  ErrConflict,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().RequeueDelivery(ctx, "12345", now).Return(tc.rDelivery, tc.rErr)
+
+			s := New(st)
+
+			d, err := s.RequeueDelivery(ctx, "12345", now)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.delivery, d)
+		})
+	}
+}
+
+func TestService_AddIdempotencyKey(t *testing.T) {
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	k := model.IdempotencyKey{Key: "price-1-999", EventID: "1", AcceptedAt: now, ExpiresAt: now.Add(time.Hour)}
+	sKey := k
+	sKey.Pending = true
+	sKey.NextAttemptAt = now
+
+	testCases := []struct {
+		desc   string
+		rKey   model.IdempotencyKey
+		rSaved bool
+		rErr   error
+		key    model.IdempotencyKey
+		saved  bool
+		err    error
+	}{
+		{
+			desc:   "saved",
+			rKey:   sKey,
+			rSaved: true,
+			key:    sKey,
+			saved:  true,
+		},
+		{
+			desc: "duplicate",
+			rKey: model.IdempotencyKey{Key: "price-1-999", EventID: "0", AcceptedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour - time.Minute)},
+			key:  model.IdempotencyKey{Key: "price-1-999", EventID: "0", AcceptedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour - time.Minute)},
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().AddIdempotencyKey(ctx, sKey).Return(tc.rKey, tc.rSaved, tc.rErr)
+
+			s := New(st)
+
+			key, saved, err := s.AddIdempotencyKey(ctx, k)
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+			assert.Equal(t, tc.key, key)
+			assert.Equal(t, tc.saved, saved)
+		})
+	}
+}
+
+func TestService_MarkEventDispatched(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rErr error
+		err  error
+	}{
+		{
+			desc: "success",
+		},
+		{
+			desc: "ErrNotFound",
+			rErr: storage.ErrNotFound,
+			err:  ErrNotFound,
+		},
+		{
+			desc: "unexpected error",
+			rErr: assert.AnError,
+			err:  assert.AnError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			st := mock.NewMockStorage(ctrl)
+			st.EXPECT().MarkEventDispatched(ctx, "price-1-999").Return(tc.rErr)
+
+			s := New(st)
+
+			err := s.MarkEventDispatched(ctx, "price-1-999")
+			assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("wanted %s got %s", tc.err, err))
+		})
+	}
+}
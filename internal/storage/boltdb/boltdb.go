@@ -0,0 +1,929 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+)
+
+var (
+	users           = []byte("users")
+	digests         = []byte("digests")
+	digestKeys      = []byte("digest_keys")
+	notifications   = []byte("notifications")
+	deliveries      = []byte("deliveries")
+	idempotencyKeys = []byte("idempotency_keys")
+)
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// New opens or creates single file storage at path.
+func New(path string) (storage.Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createScheme(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func createScheme(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{users, digests, digestKeys, notifications, deliveries, idempotencyKeys} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return fmt.Errorf("failed to create %s bucket: %w", b, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes consistent snapshot of storage file to w.
+// Snapshot is copied to temporary file first and streamed after read transaction is closed,
+// so slow clients don't hold the transaction. Open read transaction blocks writers that need to grow the file.
+func (s *boltStorage) Backup(ctx context.Context, w io.Writer) error {
+	f, err := ioutil.TempFile("", "gnotify-backup-*.db")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind backup file: %w", err)
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+func (s *boltStorage) GetUser(ctx context.Context, id int64) (model.User, error) {
+	var u user
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getUser(tx, id, &u)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return model.User{}, err
+		}
+		return model.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return u.toModel(), nil
+}
+
+func getUser(tx *bolt.Tx, id int64, u *user) error {
+	v := tx.Bucket(users).Get(userKey(id))
+	if v == nil {
+		return storage.ErrNotFound
+	}
+	return json.Unmarshal(v, u)
+}
+
+// putUser stores user and increments its version.
+func putUser(tx *bolt.Tx, u user) error {
+	u.Version++
+
+	v, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(users).Put(userKey(u.ID), v)
+}
+
+func (s *boltStorage) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
+	var start []byte
+	if query.After != "" {
+		after, err := strconv.ParseInt(query.After, 10, 64)
+		if err != nil {
+			return model.UserPage{}, storage.ErrInvalidCursor
+		}
+		start = userKey(after)
+	}
+
+	var us []user
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(users).Cursor()
+
+		k, v := c.First()
+		if start != nil {
+			k, v = c.Seek(start)
+			if bytes.Equal(k, start) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil && len(us) <= query.First; k, v = c.Next() {
+			var u user
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			if matches(u, query) {
+				us = append(us, u)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return model.UserPage{}, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	page := model.UserPage{}
+	if len(us) > query.First {
+		us = us[:query.First]
+		page.NextCursor = strconv.FormatInt(us[len(us)-1].ID, 10)
+	}
+
+	page.Users = make([]model.User, len(us))
+	for i := range us {
+		page.Users[i] = us[i].toModel()
+	}
+
+	return page, nil
+}
+
+// matches reports whether user satisfies query filters.
+func matches(u user, query model.UserQuery) bool {
+	if query.Language != "" && u.Lang != query.Language {
+		return false
+	}
+
+	if query.EventType == "" && query.Frequency == "" {
+		return true
+	}
+
+	for _, d := range u.Devices {
+		for _, p := range d.preferences() {
+			if !p.Enabled {
+				continue
+			}
+			if query.EventType != "" && p.Type != query.EventType {
+				continue
+			}
+			if query.Frequency != "" && p.Frequency != query.Frequency {
+				continue
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *boltStorage) UpsertUser(ctx context.Context, mUser model.User) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		u := user{ID: mUser.ID}
+		if err := getUser(tx, mUser.ID, &u); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+
+		// missing user has zero version, so it can't satisfy expected one
+		if err := checkVersion(u, mUser.Version); err != nil {
+			return err
+		}
+
+		u.Lang = mUser.Language
+		u.TimeZone = mUser.TimeZone
+		u.QuietHours = newQuietHours(mUser.QuietHours)
+
+		return putUser(tx, u)
+	})
+	if err != nil {
+		if err == storage.ErrConflict {
+			return err
+		}
+		return fmt.Errorf("failed to upsert user: %w", err)
+	}
+
+	return nil
+}
+
+func (s *boltStorage) DeleteUser(ctx context.Context, id int64) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(users)
+		if b.Get(userKey(id)) == nil {
+			return storage.ErrNotFound
+		}
+		return b.Delete(userKey(id))
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return err
+		}
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+func (s *boltStorage) AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	input.ID = model.NewID()
+	d := newDevice(input)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var u user
+		if err := getUser(tx, userID, &u); err != nil {
+			return err
+		}
+
+		if err := checkVersion(u, version); err != nil {
+			return err
+		}
+
+		u.Devices = append(u.Devices, d)
+
+		return putUser(tx, u)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrConflict {
+			return model.Device{}, err
+		}
+		return model.Device{}, fmt.Errorf("failed to add device: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *boltStorage) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	var d device
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var u user
+		if err := getUser(tx, userID, &u); err != nil {
+			return err
+		}
+
+		i := findDevice(u, deviceID)
+		if i < 0 {
+			return storage.ErrNotFound
+		}
+		d = u.Devices[i]
+
+		return nil
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return model.Device{}, err
+		}
+		return model.Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *boltStorage) UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	d := newDevice(input)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var u user
+		if err := getUser(tx, userID, &u); err != nil {
+			return err
+		}
+
+		i := findDevice(u, input.ID)
+		if i < 0 {
+			return storage.ErrNotFound
+		}
+
+		if err := checkVersion(u, version); err != nil {
+			return err
+		}
+		u.Devices[i] = d
+
+		return putUser(tx, u)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrConflict {
+			return model.Device{}, err
+		}
+		return model.Device{}, fmt.Errorf("failed to update device: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *boltStorage) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var u user
+		if err := getUser(tx, userID, &u); err != nil {
+			return err
+		}
+
+		i := findDevice(u, deviceID)
+		if i < 0 {
+			return storage.ErrNotFound
+		}
+
+		if err := checkVersion(u, version); err != nil {
+			return err
+		}
+		u.Devices = append(u.Devices[:i], u.Devices[i+1:]...)
+
+		return putUser(tx, u)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrConflict {
+			return err
+		}
+		return fmt.Errorf("failed to remove device: %w", err)
+	}
+
+	return nil
+}
+
+func (s *boltStorage) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var u user
+		if err := getUser(tx, userID, &u); err != nil {
+			return err
+		}
+
+		i := findDevice(u, deviceID)
+		if i < 0 {
+			return storage.ErrNotFound
+		}
+		u.Devices[i].Disabled = true
+
+		return putUser(tx, u)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return err
+		}
+		return fmt.Errorf("failed to disable device: %w", err)
+	}
+
+	return nil
+}
+
+// findDevice returns index of user device or -1 if device is not found.
+func findDevice(u user, deviceID string) int {
+	for i, d := range u.Devices {
+		if d.ID == deviceID {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkVersion returns ErrConflict if expected version is set and differs from the stored one.
+func checkVersion(u user, version int64) error {
+	if version != 0 && u.Version != version {
+		return storage.ErrConflict
+	}
+	return nil
+}
+
+func (s *boltStorage) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, keys := tx.Bucket(digests), tx.Bucket(digestKeys)
+
+		d := digest{
+			UserID:    userID,
+			DeviceID:  deviceID,
+			CreatedAt: e.CreatedAt.UTC(),
+		}
+
+		k := keys.Get(digestKey(userID, deviceID))
+		if k != nil {
+			if err := json.Unmarshal(b.Get(k), &d); err != nil {
+				return err
+			}
+		} else {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			k = seqKey(seq)
+
+			if err := keys.Put(digestKey(userID, deviceID), k); err != nil {
+				return err
+			}
+		}
+
+		d.Events = append(d.Events, newEvent(e))
+
+		v, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add event to digest: %w", err)
+	}
+
+	return nil
+}
+
+func (s *boltStorage) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	ds := []model.Digest{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(digests).ForEach(func(k, v []byte) error {
+			var d digest
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			ds = append(ds, d.toModel())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digests: %w", err)
+	}
+
+	return ds, nil
+}
+
+func (s *boltStorage) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	var d digest
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, keys := tx.Bucket(digests), tx.Bucket(digestKeys)
+
+		k := keys.Get(digestKey(userID, deviceID))
+		if k == nil {
+			return storage.ErrNotFound
+		}
+
+		if err := json.Unmarshal(b.Get(k), &d); err != nil {
+			return err
+		}
+
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+
+		return keys.Delete(digestKey(userID, deviceID))
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return model.Digest{}, err
+		}
+		return model.Digest{}, fmt.Errorf("failed to pop digest: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *boltStorage) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	n.ID = model.NewID()
+	id, _ := model.ParseID(n.ID)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(newNotification(n))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(notifications).Put(notificationKey(n.UserID, id), v)
+	})
+	if err != nil {
+		return model.Notification{}, fmt.Errorf("failed to add notification: %w", err)
+	}
+
+	return n, nil
+}
+
+func (s *boltStorage) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	prefix := userKey(userID)
+
+	// start is the key right after the last notification to return
+	start := userKey(userID + 1)
+	if query.After != "" {
+		after, err := model.ParseID(query.After)
+		if err != nil {
+			return model.NotificationPage{}, storage.ErrInvalidCursor
+		}
+		start = notificationKey(userID, after)
+	}
+
+	page := model.NotificationPage{
+		Notifications: []model.Notification{},
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(notifications).Cursor()
+
+		k, v := c.Seek(start)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			var n notification
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+
+			if query.UnreadOnly && n.Read {
+				continue
+			}
+
+			if len(page.Notifications) == query.First {
+				page.HasNextPage = true
+				break
+			}
+			page.Notifications = append(page.Notifications, n.toModel())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return model.NotificationPage{}, fmt.Errorf("failed to get notifications: %w", err)
+	}
+
+	return page, nil
+}
+
+func (s *boltStorage) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	count := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(notifications)
+
+		for _, id := range ids {
+			oid, err := model.ParseID(id)
+			if err != nil {
+				continue
+			}
+
+			k := notificationKey(userID, oid)
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+
+			var n notification
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+
+			if n.Read {
+				continue
+			}
+			n.Read = true
+
+			if v, err = json.Marshal(n); err != nil {
+				return err
+			}
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+			count++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+
+	return count, nil
+}
+
+func (s *boltStorage) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	d.ID = model.NewID()
+	id, _ := model.ParseID(d.ID)
+	r := newDelivery(d)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putDelivery(tx, id, r)
+	})
+	if err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to add delivery: %w", err)
+	}
+
+	return r.toModel(), nil
+}
+
+func putDelivery(tx *bolt.Tx, id [12]byte, d delivery) error {
+	v, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(deliveries).Put(id[:], v)
+}
+
+func getDelivery(tx *bolt.Tx, id string, d *delivery) error {
+	k, err := model.ParseID(id)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	v := tx.Bucket(deliveries).Get(k[:])
+	if v == nil {
+		return storage.ErrNotFound
+	}
+	return json.Unmarshal(v, d)
+}
+
+func (s *boltStorage) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	var ds []delivery
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(deliveries).ForEach(func(k, v []byte) error {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.leasable(now) {
+				ds = append(ds, d)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.SliceStable(ds, func(i, j int) bool { return ds[i].NextAttemptAt.Before(ds[j].NextAttemptAt) })
+		if len(ds) > limit {
+			ds = ds[:limit]
+		}
+
+		for i := range ds {
+			ds[i].State = model.DeliveryInFlight
+			ds[i].Attempts++
+			ds[i].NextAttemptAt = now.Add(timeout).UTC()
+			ds[i].UpdatedAt = now.UTC()
+
+			id, _ := model.ParseID(ds[i].ID)
+			if err := putDelivery(tx, id, ds[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease deliveries: %w", err)
+	}
+
+	mDeliveries := make([]model.Delivery, len(ds))
+	for i := range ds {
+		mDeliveries[i] = ds[i].toModel()
+	}
+
+	return mDeliveries, nil
+}
+
+func (s *boltStorage) UpdateDelivery(ctx context.Context, input model.Delivery) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var d delivery
+		if err := getDelivery(tx, input.ID, &d); err != nil {
+			return err
+		}
+
+		if d.State != model.DeliveryInFlight || d.Attempts != input.Attempts {
+			return storage.ErrConflict
+		}
+
+		d.State = input.State
+		d.LastError = input.LastError
+		d.NextAttemptAt = input.NextAttemptAt.UTC()
+		d.UpdatedAt = input.UpdatedAt.UTC()
+
+		id, _ := model.ParseID(d.ID)
+		return putDelivery(tx, id, d)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrConflict {
+			return err
+		}
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	return nil
+}
+
+func (s *boltStorage) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	var start []byte
+	if query.After != "" {
+		after, err := model.ParseID(query.After)
+		if err != nil {
+			return model.DeliveryPage{}, storage.ErrInvalidCursor
+		}
+		start = after[:]
+	}
+
+	page := model.DeliveryPage{
+		Deliveries: []model.Delivery{},
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deliveries).Cursor()
+
+		k, v := c.Last()
+		if start != nil {
+			if k, v = c.Seek(start); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			var d delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+
+			if query.State != "" && d.State != query.State {
+				continue
+			}
+
+			if len(page.Deliveries) == query.First {
+				page.HasNextPage = true
+				break
+			}
+			page.Deliveries = append(page.Deliveries, d.toModel())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return model.DeliveryPage{}, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+
+	return page, nil
+}
+
+func (s *boltStorage) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	var d delivery
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := getDelivery(tx, id, &d); err != nil {
+			return err
+		}
+
+		if d.State != model.DeliveryDead {
+			return storage.ErrConflict
+		}
+
+		d.State = model.DeliveryPending
+		d.Attempts = 0
+		d.NextAttemptAt = now.UTC()
+		d.LastError = ""
+		d.UpdatedAt = now.UTC()
+
+		k, _ := model.ParseID(d.ID)
+		return putDelivery(tx, k, d)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound || err == storage.ErrConflict {
+			return model.Delivery{}, err
+		}
+		return model.Delivery{}, fmt.Errorf("failed to requeue delivery: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *boltStorage) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	r := newIdempotencyKey(k)
+	saved := true
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyKeys)
+
+		if v := b.Get([]byte(k.Key)); v != nil {
+			var stored idempotencyKey
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+
+			if stored.ExpiresAt.After(k.AcceptedAt) {
+				r, saved = stored, false
+				return nil
+			}
+		}
+
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(k.Key), v)
+	})
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to add idempotency key: %w", err)
+	}
+
+	return r.toModel(), saved, nil
+}
+
+func (s *boltStorage) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	var ks []idempotencyKey
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyKeys)
+
+		err := b.ForEach(func(_, v []byte) error {
+			var k idempotencyKey
+			if err := json.Unmarshal(v, &k); err != nil {
+				return err
+			}
+			if k.Pending && !k.NextAttemptAt.After(now) {
+				ks = append(ks, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// keys are iterated in key order, so events due at the same time are leased in key order
+		sort.SliceStable(ks, func(i, j int) bool { return ks[i].NextAttemptAt.Before(ks[j].NextAttemptAt) })
+		if len(ks) > limit {
+			ks = ks[:limit]
+		}
+
+		for i := range ks {
+			ks[i].NextAttemptAt = now.Add(timeout).UTC()
+
+			v, err := json.Marshal(ks[i])
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(ks[i].Key), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease events: %w", err)
+	}
+
+	mKeys := make([]model.IdempotencyKey, len(ks))
+	for i := range ks {
+		mKeys[i] = ks[i].toModel()
+	}
+
+	return mKeys, nil
+}
+
+func (s *boltStorage) MarkEventDispatched(ctx context.Context, key string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyKeys)
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			return storage.ErrNotFound
+		}
+
+		var k idempotencyKey
+		if err := json.Unmarshal(v, &k); err != nil {
+			return err
+		}
+		k.Pending = false
+
+		v, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), v)
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return err
+		}
+		return fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+
+	return nil
+}
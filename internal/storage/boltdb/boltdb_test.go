@@ -0,0 +1,98 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+	"github.com/vliubezny/gnotify/internal/storage/storagetest"
+)
+
+var ctx = context.Background()
+
+func newStorage(t *testing.T) storage.Storage {
+	s, err := New(filepath.Join(t.TempDir(), "gnotify.db"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		s.(*boltStorage).db.Close()
+	})
+
+	return s
+}
+
+func TestBoltStorage(t *testing.T) {
+	storagetest.Run(t, newStorage)
+}
+
+func TestBoltStorage_Backup(t *testing.T) {
+	s := newStorage(t)
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+
+	var buf bytes.Buffer
+	require.NoError(t, s.(storage.Backuper).Backup(ctx, &buf))
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+
+	restored, err := New(path)
+	require.NoError(t, err)
+	defer restored.(*boltStorage).db.Close()
+
+	u, err := restored.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, model.User{ID: 1, Language: "en", Version: 1}, u)
+}
+
+func TestBoltStorage_persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnotify.db")
+
+	s, err := New(path)
+	require.NoError(t, err)
+
+	d, err := func() (model.Device, error) {
+		defer s.(*boltStorage).db.Close()
+
+		require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+		return s.AddDevice(ctx, 1, 0, model.Device{Name: "Chrome"})
+	}()
+	require.NoError(t, err)
+
+	s, err = New(path)
+	require.NoError(t, err)
+	defer s.(*boltStorage).db.Close()
+
+	u, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Device{d}, u.Devices)
+}
+
+func TestBoltStorage_legacySettings(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "gnotify.db"))
+	require.NoError(t, err)
+	db := s.(*boltStorage).db
+	defer db.Close()
+
+	legacy := `{"id":1,"lang":"en","version":1,"devices":[{"id":"606d8e1b3a7c2f0001a1b2c3","name":"Chrome","priceChanged":true,"frequency":"DAILY"}]}`
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(users).Put(userKey(1), []byte(legacy))
+	}))
+
+	d, err := s.GetDevice(ctx, 1, "606d8e1b3a7c2f0001a1b2c3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]model.Preference{
+		model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+	}, d.Settings.Preferences)
+
+	page, err := s.GetUsers(ctx, model.UserQuery{First: 10, EventType: model.PriceChanged, Frequency: model.Daily})
+	require.NoError(t, err)
+	assert.Len(t, page.Users, 1)
+}
@@ -0,0 +1,397 @@
+package boltdb
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// userKey encodes user ID so that keys are sorted in ID order.
+func userKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id)^(1<<63))
+	return k
+}
+
+// notificationKey groups notifications by user and sorts them by ID.
+func notificationKey(userID int64, id [12]byte) []byte {
+	return append(userKey(userID), id[:]...)
+}
+
+// digestKey identifies device digest.
+func digestKey(userID int64, deviceID string) []byte {
+	return append(userKey(userID), deviceID...)
+}
+
+// seqKey encodes bucket sequence.
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+type user struct {
+	ID         int64        `json:"id"`
+	Lang       string       `json:"lang"`
+	TimeZone   string       `json:"timeZone,omitempty"`
+	QuietHours []quietHours `json:"quietHours,omitempty"`
+	Version    int64        `json:"version"`
+	Devices    []device     `json:"devices,omitempty"`
+}
+
+type quietHours struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func newQuietHours(qs []model.QuietHours) []quietHours {
+	if len(qs) == 0 {
+		return nil
+	}
+
+	c := make([]quietHours, len(qs))
+	for i, q := range qs {
+		c[i] = quietHours{Start: q.Start, End: q.End}
+	}
+	return c
+}
+
+func (u user) toModel() model.User {
+	mUser := model.User{
+		ID:       u.ID,
+		Language: u.Lang,
+		TimeZone: u.TimeZone,
+		Version:  u.Version,
+	}
+
+	if len(u.QuietHours) > 0 {
+		mUser.QuietHours = make([]model.QuietHours, len(u.QuietHours))
+
+		for i, q := range u.QuietHours {
+			mUser.QuietHours[i] = model.QuietHours{Start: q.Start, End: q.End}
+		}
+	}
+
+	if len(u.Devices) > 0 {
+		mUser.Devices = make([]model.Device, len(u.Devices))
+
+		for i, d := range u.Devices {
+			mUser.Devices[i] = d.toModel()
+		}
+	}
+
+	return mUser
+}
+
+type device struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Type        string       `json:"type,omitempty"`
+	Address     address      `json:"address"`
+	Disabled    bool         `json:"disabled,omitempty"`
+	Preferences []preference `json:"preferences,omitempty"`
+
+	// PriceChanged and Frequency are only set in records written before per event type preferences.
+	PriceChanged bool   `json:"priceChanged,omitempty"`
+	Frequency    string `json:"frequency,omitempty"`
+}
+
+type address struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	P256dh   string `json:"p256dh,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Token    string `json:"token,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+func newAddress(a model.Address) address {
+	return address(a)
+}
+
+func (a address) toModel() model.Address {
+	return model.Address(a)
+}
+
+type preference struct {
+	Type      string `json:"type"`
+	Enabled   bool   `json:"enabled"`
+	Frequency string `json:"frequency"`
+	Channel   string `json:"channel"`
+}
+
+func newDevice(d model.Device) device {
+	ps := make([]preference, 0, len(d.Settings.Preferences))
+	for t, p := range d.Settings.Preferences {
+		ps = append(ps, preference{
+			Type:      t,
+			Enabled:   p.Enabled,
+			Frequency: p.Frequency,
+			Channel:   p.Channel,
+		})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Type < ps[j].Type })
+
+	return device{
+		ID:          d.ID,
+		Name:        d.Name,
+		Type:        d.Type,
+		Address:     newAddress(d.Address),
+		Disabled:    d.Disabled,
+		Preferences: ps,
+	}
+}
+
+// preferences returns device preferences converting legacy settings if needed.
+func (d device) preferences() []preference {
+	if len(d.Preferences) == 0 && (d.PriceChanged || d.Frequency != "") {
+		return []preference{{
+			Type:      model.PriceChanged,
+			Enabled:   d.PriceChanged,
+			Frequency: d.Frequency,
+			Channel:   model.ChannelDevice,
+		}}
+	}
+	return d.Preferences
+}
+
+func (d device) toModel() model.Device {
+	mDevice := model.Device{
+		ID:       d.ID,
+		Name:     d.Name,
+		Type:     d.Type,
+		Address:  d.Address.toModel(),
+		Disabled: d.Disabled,
+	}
+
+	if ps := d.preferences(); len(ps) > 0 {
+		mDevice.Settings.Preferences = make(map[string]model.Preference, len(ps))
+
+		for _, p := range ps {
+			mDevice.Settings.Preferences[p.Type] = model.Preference{
+				Enabled:   p.Enabled,
+				Frequency: p.Frequency,
+				Channel:   p.Channel,
+			}
+		}
+	}
+
+	return mDevice
+}
+
+type event struct {
+	Type      string    `json:"type"`
+	UserIDs   []int64   `json:"userIds,omitempty"`
+	ProductID int64     `json:"productId,omitempty"`
+	OldPrice  int64     `json:"oldPrice,omitempty"`
+	NewPrice  int64     `json:"newPrice,omitempty"`
+	OrderID   string    `json:"orderId,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Discount  int64     `json:"discount,omitempty"`
+	Quantity  int64     `json:"quantity,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newEvent(e model.Event) event {
+	return event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt.UTC(),
+	}
+}
+
+func (e event) toModel() model.Event {
+	return model.Event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt.UTC(),
+	}
+}
+
+type digest struct {
+	UserID    int64     `json:"userId"`
+	DeviceID  string    `json:"deviceId"`
+	Events    []event   `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (d digest) toModel() model.Digest {
+	mDigest := model.Digest{
+		UserID:    d.UserID,
+		DeviceID:  d.DeviceID,
+		CreatedAt: d.CreatedAt.UTC(),
+	}
+
+	if len(d.Events) > 0 {
+		mDigest.Events = make([]model.Event, len(d.Events))
+
+		for i, e := range d.Events {
+			mDigest.Events[i] = e.toModel()
+		}
+	}
+
+	return mDigest
+}
+
+type notification struct {
+	ID        string    `json:"id"`
+	UserID    int64     `json:"userId"`
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Read      bool      `json:"read"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newNotification(n model.Notification) notification {
+	return notification{
+		ID:        n.ID,
+		UserID:    n.UserID,
+		Type:      n.Type,
+		Title:     n.Title,
+		Body:      n.Body,
+		Read:      n.Read,
+		CreatedAt: n.CreatedAt.UTC(),
+	}
+}
+
+func (n notification) toModel() model.Notification {
+	return model.Notification{
+		ID:        n.ID,
+		UserID:    n.UserID,
+		Type:      n.Type,
+		Title:     n.Title,
+		Body:      n.Body,
+		Read:      n.Read,
+		CreatedAt: n.CreatedAt.UTC(),
+	}
+}
+
+type delivery struct {
+	ID            string    `json:"id"`
+	UserID        int64     `json:"userId"`
+	DeviceID      string    `json:"deviceId"`
+	Title         string    `json:"title"`
+	Body          string    `json:"body"`
+	Events        []event   `json:"events,omitempty"`
+	State         string    `json:"state"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+func newDelivery(d model.Delivery) delivery {
+	r := delivery{
+		ID:            d.ID,
+		UserID:        d.UserID,
+		DeviceID:      d.DeviceID,
+		Title:         d.Title,
+		Body:          d.Body,
+		State:         d.State,
+		Attempts:      d.Attempts,
+		LastError:     d.LastError,
+		NextAttemptAt: d.NextAttemptAt.UTC(),
+		CreatedAt:     d.CreatedAt.UTC(),
+		UpdatedAt:     d.UpdatedAt.UTC(),
+	}
+
+	if len(d.Events) > 0 {
+		r.Events = make([]event, len(d.Events))
+
+		for i, e := range d.Events {
+			r.Events[i] = newEvent(e)
+		}
+	}
+
+	return r
+}
+
+func (d delivery) toModel() model.Delivery {
+	mDelivery := model.Delivery{
+		ID:            d.ID,
+		UserID:        d.UserID,
+		DeviceID:      d.DeviceID,
+		Title:         d.Title,
+		Body:          d.Body,
+		State:         d.State,
+		Attempts:      d.Attempts,
+		LastError:     d.LastError,
+		NextAttemptAt: d.NextAttemptAt.UTC(),
+		CreatedAt:     d.CreatedAt.UTC(),
+		UpdatedAt:     d.UpdatedAt.UTC(),
+	}
+
+	if len(d.Events) > 0 {
+		mDelivery.Events = make([]model.Event, len(d.Events))
+
+		for i, e := range d.Events {
+			mDelivery.Events[i] = e.toModel()
+		}
+	}
+
+	return mDelivery
+}
+
+// leasable reports whether delivery is due for an attempt.
+func (d delivery) leasable(now time.Time) bool {
+	switch d.State {
+	case model.DeliveryPending, model.DeliveryFailed, model.DeliveryInFlight:
+		return !d.NextAttemptAt.After(now)
+	default:
+		return false
+	}
+}
+
+type idempotencyKey struct {
+	Key           string    `json:"key"`
+	EventID       string    `json:"eventId"`
+	Event         event     `json:"event"`
+	AcceptedAt    time.Time `json:"acceptedAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	Pending       bool      `json:"pending,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+}
+
+func newIdempotencyKey(k model.IdempotencyKey) idempotencyKey {
+	return idempotencyKey{
+		Key:           k.Key,
+		EventID:       k.EventID,
+		Event:         newEvent(k.Event),
+		AcceptedAt:    k.AcceptedAt.UTC(),
+		ExpiresAt:     k.ExpiresAt.UTC(),
+		Pending:       k.Pending,
+		NextAttemptAt: k.NextAttemptAt.UTC(),
+	}
+}
+
+func (k idempotencyKey) toModel() model.IdempotencyKey {
+	return model.IdempotencyKey{
+		Key:           k.Key,
+		EventID:       k.EventID,
+		Event:         k.Event.toModel(),
+		AcceptedAt:    k.AcceptedAt.UTC(),
+		ExpiresAt:     k.ExpiresAt.UTC(),
+		Pending:       k.Pending,
+		NextAttemptAt: k.NextAttemptAt.UTC(),
+	}
+}
@@ -0,0 +1,81 @@
+package memory
+
+import "github.com/vliubezny/gnotify/internal/model"
+
+// Stored values are copied on the way in and out
+// so callers never share slices with storage state.
+
+func copyUser(u model.User) model.User {
+	u.Devices = copyDevices(u.Devices)
+	if len(u.QuietHours) == 0 {
+		u.QuietHours = nil
+	} else {
+		u.QuietHours = append([]model.QuietHours(nil), u.QuietHours...)
+	}
+	return u
+}
+
+func copyDevices(ds []model.Device) []model.Device {
+	if len(ds) == 0 {
+		return nil
+	}
+
+	c := make([]model.Device, len(ds))
+	for i, d := range ds {
+		c[i] = copyDevice(d)
+	}
+	return c
+}
+
+func copyDevice(d model.Device) model.Device {
+	d.Settings = copySettings(d.Settings)
+	return d
+}
+
+func copySettings(s model.NotificationSettings) model.NotificationSettings {
+	if len(s.Preferences) == 0 {
+		return model.NotificationSettings{}
+	}
+
+	c := make(map[string]model.Preference, len(s.Preferences))
+	for t, p := range s.Preferences {
+		c[t] = p
+	}
+	return model.NotificationSettings{Preferences: c}
+}
+
+func copyEvent(e model.Event) model.Event {
+	if len(e.UserIDs) == 0 {
+		e.UserIDs = nil
+	} else {
+		e.UserIDs = append([]int64(nil), e.UserIDs...)
+	}
+	return e
+}
+
+func copyEvents(es []model.Event) []model.Event {
+	if len(es) == 0 {
+		return nil
+	}
+
+	c := make([]model.Event, len(es))
+	for i, e := range es {
+		c[i] = copyEvent(e)
+	}
+	return c
+}
+
+func copyDigest(d model.Digest) model.Digest {
+	d.Events = copyEvents(d.Events)
+	return d
+}
+
+func copyDelivery(d model.Delivery) model.Delivery {
+	d.Events = copyEvents(d.Events)
+	return d
+}
+
+func copyIdempotencyKey(k model.IdempotencyKey) model.IdempotencyKey {
+	k.Event = copyEvent(k.Event)
+	return k
+}
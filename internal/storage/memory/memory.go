@@ -0,0 +1,599 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+)
+
+type memoryStorage struct {
+	mu            sync.RWMutex
+	users         map[int64]model.User
+	digests       []model.Digest
+	notifications []model.Notification
+	deliveries    []model.Delivery
+	keys          map[string]model.IdempotencyKey
+}
+
+// New creates in-memory storage.
+func New() storage.Storage {
+	return &memoryStorage{
+		users: make(map[int64]model.User),
+		keys:  make(map[string]model.IdempotencyKey),
+	}
+}
+
+func (s *memoryStorage) GetUser(ctx context.Context, id int64) (model.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return model.User{}, storage.ErrNotFound
+	}
+
+	return copyUser(u), nil
+}
+
+func (s *memoryStorage) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
+	var after int64
+	if query.After != "" {
+		id, err := strconv.ParseInt(query.After, 10, 64)
+		if err != nil {
+			return model.UserPage{}, storage.ErrInvalidCursor
+		}
+		after = id
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var us []model.User
+	for _, u := range s.users {
+		if query.After != "" && u.ID <= after || !matches(u, query) {
+			continue
+		}
+		us = append(us, u)
+	}
+
+	sort.Slice(us, func(i, j int) bool { return us[i].ID < us[j].ID })
+
+	page := model.UserPage{}
+	if len(us) > query.First {
+		us = us[:query.First]
+		page.NextCursor = strconv.FormatInt(us[len(us)-1].ID, 10)
+	}
+
+	page.Users = make([]model.User, len(us))
+	for i := range us {
+		page.Users[i] = copyUser(us[i])
+	}
+
+	return page, nil
+}
+
+// matches reports whether user satisfies query filters.
+func matches(u model.User, query model.UserQuery) bool {
+	if query.Language != "" && u.Language != query.Language {
+		return false
+	}
+
+	if query.EventType == "" && query.Frequency == "" {
+		return true
+	}
+
+	for _, d := range u.Devices {
+		for t, p := range d.Settings.Preferences {
+			if !p.Enabled {
+				continue
+			}
+			if query.EventType != "" && t != query.EventType {
+				continue
+			}
+			if query.Frequency != "" && p.Frequency != query.Frequency {
+				continue
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *memoryStorage) UpsertUser(ctx context.Context, user model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// missing user has zero version, so it can't satisfy expected one
+	u, ok := s.users[user.ID]
+	if err := checkVersion(u, user.Version); err != nil {
+		return err
+	}
+
+	if !ok {
+		u = model.User{ID: user.ID}
+	}
+	u.Language = user.Language
+	u.TimeZone = user.TimeZone
+	u.QuietHours = user.QuietHours
+	u.Version++
+
+	s.users[user.ID] = copyUser(u)
+
+	return nil
+}
+
+func (s *memoryStorage) DeleteUser(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return storage.ErrNotFound
+	}
+
+	delete(s.users, id)
+
+	return nil
+}
+
+func (s *memoryStorage) AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return model.Device{}, storage.ErrNotFound
+	}
+	if err := checkVersion(u, version); err != nil {
+		return model.Device{}, err
+	}
+
+	d := model.Device{
+		ID:       model.NewID(),
+		Name:     input.Name,
+		Type:     input.Type,
+		Address:  input.Address,
+		Disabled: input.Disabled,
+		Settings: copySettings(input.Settings),
+	}
+
+	u.Devices = append(copyDevices(u.Devices), d)
+	u.Version++
+	s.users[userID] = u
+
+	return copyDevice(d), nil
+}
+
+func (s *memoryStorage) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	i := findDevice(u, deviceID)
+	if i < 0 {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	return copyDevice(u.Devices[i]), nil
+}
+
+func (s *memoryStorage) UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	i := findDevice(u, input.ID)
+	if i < 0 {
+		return model.Device{}, storage.ErrNotFound
+	}
+	if err := checkVersion(u, version); err != nil {
+		return model.Device{}, err
+	}
+
+	u.Devices = copyDevices(u.Devices)
+	u.Devices[i].Name = input.Name
+	u.Devices[i].Type = input.Type
+	u.Devices[i].Address = input.Address
+	u.Devices[i].Disabled = input.Disabled
+	u.Devices[i].Settings = copySettings(input.Settings)
+	u.Version++
+	s.users[userID] = u
+
+	return copyDevice(u.Devices[i]), nil
+}
+
+func (s *memoryStorage) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+
+	i := findDevice(u, deviceID)
+	if i < 0 {
+		return storage.ErrNotFound
+	}
+	if err := checkVersion(u, version); err != nil {
+		return err
+	}
+
+	devices := make([]model.Device, 0, len(u.Devices)-1)
+	devices = append(devices, u.Devices[:i]...)
+	devices = append(devices, u.Devices[i+1:]...)
+	if len(devices) == 0 {
+		devices = nil
+	}
+
+	u.Devices = devices
+	u.Version++
+	s.users[userID] = u
+
+	return nil
+}
+
+func (s *memoryStorage) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+
+	i := findDevice(u, deviceID)
+	if i < 0 {
+		return storage.ErrNotFound
+	}
+
+	u.Devices = copyDevices(u.Devices)
+	u.Devices[i].Disabled = true
+	u.Version++
+	s.users[userID] = u
+
+	return nil
+}
+
+// findDevice returns index of the device, index is negative if device is not found.
+func findDevice(u model.User, deviceID string) int {
+	for i, d := range u.Devices {
+		if d.ID == deviceID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// checkVersion returns ErrConflict if expected version is set and differs from the stored one.
+func checkVersion(u model.User, version int64) error {
+	if version != 0 && u.Version != version {
+		return storage.ErrConflict
+	}
+	return nil
+}
+
+func (s *memoryStorage) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e = copyEvent(e)
+
+	for i, d := range s.digests {
+		if d.UserID == userID && d.DeviceID == deviceID {
+			s.digests[i].Events = append(copyEvents(d.Events), e)
+			return nil
+		}
+	}
+
+	s.digests = append(s.digests, model.Digest{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		Events:    []model.Event{e},
+		CreatedAt: e.CreatedAt,
+	})
+
+	return nil
+}
+
+func (s *memoryStorage) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ds := make([]model.Digest, len(s.digests))
+	for i, d := range s.digests {
+		ds[i] = copyDigest(d)
+	}
+
+	return ds, nil
+}
+
+func (s *memoryStorage) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, d := range s.digests {
+		if d.UserID == userID && d.DeviceID == deviceID {
+			s.digests = append(s.digests[:i:i], s.digests[i+1:]...)
+			return copyDigest(d), nil
+		}
+	}
+
+	return model.Digest{}, storage.ErrNotFound
+}
+
+func (s *memoryStorage) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n.ID = model.NewID()
+	s.notifications = append(s.notifications, n)
+
+	return n, nil
+}
+
+func (s *memoryStorage) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	if query.After != "" {
+		if _, err := model.ParseID(query.After); err != nil {
+			return model.NotificationPage{}, storage.ErrInvalidCursor
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := model.NotificationPage{
+		Notifications: []model.Notification{},
+	}
+
+	// notifications are stored in ID order, so the newest are at the end
+	for i := len(s.notifications) - 1; i >= 0; i-- {
+		n := s.notifications[i]
+
+		if n.UserID != userID || query.UnreadOnly && n.Read || query.After != "" && n.ID >= query.After {
+			continue
+		}
+
+		if len(page.Notifications) == query.First {
+			page.HasNextPage = true
+			break
+		}
+		page.Notifications = append(page.Notifications, n)
+	}
+
+	return page, nil
+}
+
+func (s *memoryStorage) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	marked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		marked[id] = true
+	}
+
+	count := 0
+	for i, n := range s.notifications {
+		if n.UserID == userID && !n.Read && marked[n.ID] {
+			s.notifications[i].Read = true
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryStorage) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.ID = model.NewID()
+	d = copyDelivery(d)
+	s.deliveries = append(s.deliveries, d)
+
+	return copyDelivery(d), nil
+}
+
+func (s *memoryStorage) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []int
+	for i, d := range s.deliveries {
+		if leasable(d, now) {
+			due = append(due, i)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return s.deliveries[due[i]].NextAttemptAt.Before(s.deliveries[due[j]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	ds := make([]model.Delivery, len(due))
+	for i, idx := range due {
+		d := &s.deliveries[idx]
+		d.State = model.DeliveryInFlight
+		d.Attempts++
+		d.NextAttemptAt = now.Add(timeout)
+		d.UpdatedAt = now
+		ds[i] = copyDelivery(*d)
+	}
+
+	return ds, nil
+}
+
+// leasable reports whether delivery is due for an attempt.
+func leasable(d model.Delivery, now time.Time) bool {
+	switch d.State {
+	case model.DeliveryPending, model.DeliveryFailed, model.DeliveryInFlight:
+		return !d.NextAttemptAt.After(now)
+	default:
+		return false
+	}
+}
+
+func (s *memoryStorage) UpdateDelivery(ctx context.Context, input model.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findDelivery(input.ID)
+	if i < 0 {
+		return storage.ErrNotFound
+	}
+
+	d := &s.deliveries[i]
+	if d.State != model.DeliveryInFlight || d.Attempts != input.Attempts {
+		return storage.ErrConflict
+	}
+
+	d.State = input.State
+	d.LastError = input.LastError
+	d.NextAttemptAt = input.NextAttemptAt
+	d.UpdatedAt = input.UpdatedAt
+
+	return nil
+}
+
+func (s *memoryStorage) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	if query.After != "" {
+		if _, err := model.ParseID(query.After); err != nil {
+			return model.DeliveryPage{}, storage.ErrInvalidCursor
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := model.DeliveryPage{
+		Deliveries: []model.Delivery{},
+	}
+
+	// deliveries are stored in ID order, so the newest are at the end
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		d := s.deliveries[i]
+
+		if query.State != "" && d.State != query.State || query.After != "" && d.ID >= query.After {
+			continue
+		}
+
+		if len(page.Deliveries) == query.First {
+			page.HasNextPage = true
+			break
+		}
+		page.Deliveries = append(page.Deliveries, copyDelivery(d))
+	}
+
+	return page, nil
+}
+
+func (s *memoryStorage) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findDelivery(id)
+	if i < 0 {
+		return model.Delivery{}, storage.ErrNotFound
+	}
+
+	d := &s.deliveries[i]
+	if d.State != model.DeliveryDead {
+		return model.Delivery{}, storage.ErrConflict
+	}
+
+	d.State = model.DeliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = now
+	d.LastError = ""
+	d.UpdatedAt = now
+
+	return copyDelivery(*d), nil
+}
+
+// findDelivery returns index of the delivery, index is negative if delivery is not found.
+func (s *memoryStorage) findDelivery(id string) int {
+	for i, d := range s.deliveries {
+		if d.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *memoryStorage) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.keys[k.Key]; ok && stored.ExpiresAt.After(k.AcceptedAt) {
+		return copyIdempotencyKey(stored), false, nil
+	}
+
+	k = copyIdempotencyKey(k)
+	s.keys[k.Key] = k
+
+	return copyIdempotencyKey(k), true, nil
+}
+
+func (s *memoryStorage) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []model.IdempotencyKey
+	for _, k := range s.keys {
+		if k.Pending && !k.NextAttemptAt.After(now) {
+			due = append(due, k)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].Key < due[j].Key
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	ks := make([]model.IdempotencyKey, len(due))
+	for i, k := range due {
+		k.NextAttemptAt = now.Add(timeout)
+		s.keys[k.Key] = k
+		ks[i] = copyIdempotencyKey(k)
+	}
+
+	return ks, nil
+}
+
+func (s *memoryStorage) MarkEventDispatched(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+
+	k.Pending = false
+	s.keys[key] = k
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+	"github.com/vliubezny/gnotify/internal/storage/storagetest"
+)
+
+var ctx = context.Background()
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return New()
+	})
+}
+
+func TestMemoryStorage_concurrentAddDevice(t *testing.T) {
+	s := New()
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.AddDevice(ctx, 1, 0, model.Device{Name: "Chrome"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	u, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, u.Devices, 50)
+}
+
+func TestMemoryStorage_returnsCopies(t *testing.T) {
+	s := New()
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+
+	pref := model.Preference{Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice}
+	d, err := s.AddDevice(ctx, 1, 0, model.Device{
+		Name:     "Chrome",
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{model.PriceChanged: pref}},
+	})
+	require.NoError(t, err)
+	d.Settings.Preferences[model.Promotion] = pref
+
+	u, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	u.Devices[0].Name = "Firefox"
+	u.Devices[0].Settings.Preferences[model.PriceChanged] = model.Preference{}
+
+	got, err := s.GetDevice(ctx, 1, d.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Chrome", got.Name)
+	assert.Equal(t, map[string]model.Preference{model.PriceChanged: pref}, got.Settings.Preferences)
+}
@@ -8,7 +8,9 @@ import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
 	model "github.com/vliubezny/gnotify/internal/model"
+	io "io"
 	reflect "reflect"
+	time "time"
 )
 
 // MockStorage is a mock of Storage interface
@@ -50,18 +52,18 @@ func (mr *MockStorageMockRecorder) GetUser(ctx, id interface{}) *gomock.Call {
 }
 
 // GetUsers mocks base method
-func (m *MockStorage) GetUsers(ctx context.Context) ([]model.User, error) {
+func (m *MockStorage) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUsers", ctx)
-	ret0, _ := ret[0].([]model.User)
+	ret := m.ctrl.Call(m, "GetUsers", ctx, query)
+	ret0, _ := ret[0].(model.UserPage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetUsers indicates an expected call of GetUsers
-func (mr *MockStorageMockRecorder) GetUsers(ctx interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetUsers(ctx, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsers", reflect.TypeOf((*MockStorage)(nil).GetUsers), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsers", reflect.TypeOf((*MockStorage)(nil).GetUsers), ctx, query)
 }
 
 // UpsertUser mocks base method
@@ -93,16 +95,319 @@ func (mr *MockStorageMockRecorder) DeleteUser(ctx, id interface{}) *gomock.Call
 }
 
 // AddDevice mocks base method
-func (m *MockStorage) AddDevice(ctx context.Context, userID int64, input model.Device) (model.Device, error) {
+func (m *MockStorage) AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddDevice", ctx, userID, input)
+	ret := m.ctrl.Call(m, "AddDevice", ctx, userID, version, input)
 	ret0, _ := ret[0].(model.Device)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // AddDevice indicates an expected call of AddDevice
-func (mr *MockStorageMockRecorder) AddDevice(ctx, userID, input interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) AddDevice(ctx, userID, version, input interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDevice", reflect.TypeOf((*MockStorage)(nil).AddDevice), ctx, userID, input)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDevice", reflect.TypeOf((*MockStorage)(nil).AddDevice), ctx, userID, version, input)
+}
+
+// GetDevice mocks base method
+func (m *MockStorage) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDevice", ctx, userID, deviceID)
+	ret0, _ := ret[0].(model.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDevice indicates an expected call of GetDevice
+func (mr *MockStorageMockRecorder) GetDevice(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDevice", reflect.TypeOf((*MockStorage)(nil).GetDevice), ctx, userID, deviceID)
+}
+
+// UpdateDevice mocks base method
+func (m *MockStorage) UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDevice", ctx, userID, version, input)
+	ret0, _ := ret[0].(model.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateDevice indicates an expected call of UpdateDevice
+func (mr *MockStorageMockRecorder) UpdateDevice(ctx, userID, version, input interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDevice", reflect.TypeOf((*MockStorage)(nil).UpdateDevice), ctx, userID, version, input)
+}
+
+// RemoveDevice mocks base method
+func (m *MockStorage) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveDevice", ctx, userID, version, deviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveDevice indicates an expected call of RemoveDevice
+func (mr *MockStorageMockRecorder) RemoveDevice(ctx, userID, version, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveDevice", reflect.TypeOf((*MockStorage)(nil).RemoveDevice), ctx, userID, version, deviceID)
+}
+
+// DisableDevice mocks base method
+func (m *MockStorage) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DisableDevice", ctx, userID, deviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DisableDevice indicates an expected call of DisableDevice
+func (mr *MockStorageMockRecorder) DisableDevice(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DisableDevice", reflect.TypeOf((*MockStorage)(nil).DisableDevice), ctx, userID, deviceID)
+}
+
+// AddToDigest mocks base method
+func (m *MockStorage) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddToDigest", ctx, userID, deviceID, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddToDigest indicates an expected call of AddToDigest
+func (mr *MockStorageMockRecorder) AddToDigest(ctx, userID, deviceID, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddToDigest", reflect.TypeOf((*MockStorage)(nil).AddToDigest), ctx, userID, deviceID, e)
+}
+
+// GetDigests mocks base method
+func (m *MockStorage) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDigests", ctx)
+	ret0, _ := ret[0].([]model.Digest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDigests indicates an expected call of GetDigests
+func (mr *MockStorageMockRecorder) GetDigests(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDigests", reflect.TypeOf((*MockStorage)(nil).GetDigests), ctx)
+}
+
+// PopDigest mocks base method
+func (m *MockStorage) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PopDigest", ctx, userID, deviceID)
+	ret0, _ := ret[0].(model.Digest)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PopDigest indicates an expected call of PopDigest
+func (mr *MockStorageMockRecorder) PopDigest(ctx, userID, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PopDigest", reflect.TypeOf((*MockStorage)(nil).PopDigest), ctx, userID, deviceID)
+}
+
+// AddNotification mocks base method
+func (m *MockStorage) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddNotification", ctx, n)
+	ret0, _ := ret[0].(model.Notification)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddNotification indicates an expected call of AddNotification
+func (mr *MockStorageMockRecorder) AddNotification(ctx, n interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddNotification", reflect.TypeOf((*MockStorage)(nil).AddNotification), ctx, n)
+}
+
+// GetNotifications mocks base method
+func (m *MockStorage) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNotifications", ctx, userID, query)
+	ret0, _ := ret[0].(model.NotificationPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNotifications indicates an expected call of GetNotifications
+func (mr *MockStorageMockRecorder) GetNotifications(ctx, userID, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNotifications", reflect.TypeOf((*MockStorage)(nil).GetNotifications), ctx, userID, query)
+}
+
+// MarkNotificationsRead mocks base method
+func (m *MockStorage) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkNotificationsRead", ctx, userID, ids)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MarkNotificationsRead indicates an expected call of MarkNotificationsRead
+func (mr *MockStorageMockRecorder) MarkNotificationsRead(ctx, userID, ids interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkNotificationsRead", reflect.TypeOf((*MockStorage)(nil).MarkNotificationsRead), ctx, userID, ids)
+}
+
+// AddDelivery mocks base method
+func (m *MockStorage) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddDelivery", ctx, d)
+	ret0, _ := ret[0].(model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddDelivery indicates an expected call of AddDelivery
+func (mr *MockStorageMockRecorder) AddDelivery(ctx, d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddDelivery", reflect.TypeOf((*MockStorage)(nil).AddDelivery), ctx, d)
+}
+
+// LeaseDeliveries mocks base method
+func (m *MockStorage) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaseDeliveries", ctx, now, timeout, limit)
+	ret0, _ := ret[0].([]model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LeaseDeliveries indicates an expected call of LeaseDeliveries
+func (mr *MockStorageMockRecorder) LeaseDeliveries(ctx, now, timeout, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaseDeliveries", reflect.TypeOf((*MockStorage)(nil).LeaseDeliveries), ctx, now, timeout, limit)
+}
+
+// UpdateDelivery mocks base method
+func (m *MockStorage) UpdateDelivery(ctx context.Context, d model.Delivery) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDelivery", ctx, d)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateDelivery indicates an expected call of UpdateDelivery
+func (mr *MockStorageMockRecorder) UpdateDelivery(ctx, d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDelivery", reflect.TypeOf((*MockStorage)(nil).UpdateDelivery), ctx, d)
+}
+
+// GetDeliveries mocks base method
+func (m *MockStorage) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeliveries", ctx, query)
+	ret0, _ := ret[0].(model.DeliveryPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeliveries indicates an expected call of GetDeliveries
+func (mr *MockStorageMockRecorder) GetDeliveries(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeliveries", reflect.TypeOf((*MockStorage)(nil).GetDeliveries), ctx, query)
+}
+
+// RequeueDelivery mocks base method
+func (m *MockStorage) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueDelivery", ctx, id, now)
+	ret0, _ := ret[0].(model.Delivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RequeueDelivery indicates an expected call of RequeueDelivery
+func (mr *MockStorageMockRecorder) RequeueDelivery(ctx, id, now interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueDelivery", reflect.TypeOf((*MockStorage)(nil).RequeueDelivery), ctx, id, now)
+}
+
+// AddIdempotencyKey mocks base method
+func (m *MockStorage) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddIdempotencyKey", ctx, k)
+	ret0, _ := ret[0].(model.IdempotencyKey)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// AddIdempotencyKey indicates an expected call of AddIdempotencyKey
+func (mr *MockStorageMockRecorder) AddIdempotencyKey(ctx, k interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).AddIdempotencyKey), ctx, k)
+}
+
+// LeaseEvents mocks base method
+func (m *MockStorage) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LeaseEvents", ctx, now, timeout, limit)
+	ret0, _ := ret[0].([]model.IdempotencyKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LeaseEvents indicates an expected call of LeaseEvents
+func (mr *MockStorageMockRecorder) LeaseEvents(ctx, now, timeout, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LeaseEvents", reflect.TypeOf((*MockStorage)(nil).LeaseEvents), ctx, now, timeout, limit)
+}
+
+// MarkEventDispatched mocks base method
+func (m *MockStorage) MarkEventDispatched(ctx context.Context, key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkEventDispatched", ctx, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkEventDispatched indicates an expected call of MarkEventDispatched
+func (mr *MockStorageMockRecorder) MarkEventDispatched(ctx, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkEventDispatched", reflect.TypeOf((*MockStorage)(nil).MarkEventDispatched), ctx, key)
+}
+
+// MockBackuper is a mock of Backuper interface
+type MockBackuper struct {
+	ctrl     *gomock.Controller
+	recorder *MockBackuperMockRecorder
+}
+
+// MockBackuperMockRecorder is the mock recorder for MockBackuper
+type MockBackuperMockRecorder struct {
+	mock *MockBackuper
+}
+
+// NewMockBackuper creates a new mock instance
+func NewMockBackuper(ctrl *gomock.Controller) *MockBackuper {
+	mock := &MockBackuper{ctrl: ctrl}
+	mock.recorder = &MockBackuperMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBackuper) EXPECT() *MockBackuperMockRecorder {
+	return m.recorder
+}
+
+// Backup mocks base method
+func (m *MockBackuper) Backup(ctx context.Context, w io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Backup", ctx, w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Backup indicates an expected call of Backup
+func (mr *MockBackuperMockRecorder) Backup(ctx, w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Backup", reflect.TypeOf((*MockBackuper)(nil).Backup), ctx, w)
 }
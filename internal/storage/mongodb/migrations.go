@@ -0,0 +1,453 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+const (
+	schemaMigrations = "schema_migrations"
+	migrationsLock   = "schema_migrations_lock"
+
+	// lockTTL limits how long crashed instance may hold migrations lock.
+	lockTTL = 5 * time.Minute
+	// lockRetryInterval is delay between attempts to acquire lock held by another instance.
+	lockRetryInterval = time.Second
+)
+
+// ErrNoMigrations states that there are no applied migrations to revert.
+var ErrNoMigrations = errors.New("no applied migrations")
+
+// migration evolves database schema. Version of migration is its index in migrations plus one.
+type migration struct {
+	description string
+	up          func(ctx context.Context, db *mongo.Database) error
+	down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations are applied in order. Never modify applied migrations, append new ones instead.
+var migrations = []migration{
+	{
+		description: "create users id index",
+		up: createIndex(users, mongo.IndexModel{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetName("id").SetUnique(true),
+		}),
+		down: dropIndex(users, "id"),
+	},
+	{
+		description: "create digests userId_deviceId index",
+		up: createIndex(digests, mongo.IndexModel{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "deviceId", Value: 1}},
+			Options: options.Index().SetName("userId_deviceId").SetUnique(true),
+		}),
+		down: dropIndex(digests, "userId_deviceId"),
+	},
+	{
+		description: "create notifications userId_id index",
+		up: createIndex(notifications, mongo.IndexModel{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("userId_id"),
+		}),
+		down: dropIndex(notifications, "userId_id"),
+	},
+	{
+		description: "create users lang_id index",
+		up: createIndex(users, mongo.IndexModel{
+			Keys:    bson.D{{Key: "lang", Value: 1}, {Key: "id", Value: 1}},
+			Options: options.Index().SetName("lang_id"),
+		}),
+		down: dropIndex(users, "lang_id"),
+	},
+	{
+		description: "create users devices_settings_id index",
+		up: createIndex(users, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "devices.priceChanged", Value: 1},
+				{Key: "devices.frequency", Value: 1},
+				{Key: "id", Value: 1},
+			},
+			Options: options.Index().SetName("devices_settings_id"),
+		}),
+		down: dropIndex(users, "devices_settings_id"),
+	},
+	{
+		description: "set initial users version",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(users).UpdateMany(ctx,
+				bson.M{"version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version": 1}})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(users).UpdateMany(ctx, bson.M{},
+				bson.M{"$unset": bson.M{"version": ""}})
+			return err
+		},
+	},
+	{
+		description: "move device settings to per event type preferences",
+		up: updateDevices(bson.M{"devices": bson.M{"$elemMatch": bson.M{"preferences": bson.M{"$exists": false}}}},
+			func(d bson.M) {
+				if _, ok := d["preferences"]; ok {
+					return
+				}
+
+				enabled, _ := d["priceChanged"].(bool)
+				frequency, _ := d["frequency"].(string)
+				d["preferences"] = bson.A{
+					bson.M{"type": model.PriceChanged, "enabled": enabled, "frequency": frequency, "channel": model.ChannelDevice},
+				}
+				delete(d, "priceChanged")
+				delete(d, "frequency")
+			}),
+		down: updateDevices(bson.M{"devices.preferences": bson.M{"$exists": true}},
+			func(d bson.M) {
+				ps, _ := d["preferences"].(bson.A)
+				for _, p := range ps {
+					p, ok := p.(bson.M)
+					if !ok || p["type"] != model.PriceChanged {
+						continue
+					}
+					d["priceChanged"] = p["enabled"]
+					d["frequency"] = p["frequency"]
+				}
+				delete(d, "preferences")
+			}),
+	},
+	{
+		description: "replace users devices_settings_id index with devices_preferences_id",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndex(users, "devices_settings_id")(ctx, db); err != nil {
+				return err
+			}
+			return createIndex(users, mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "devices.preferences.type", Value: 1},
+					{Key: "devices.preferences.frequency", Value: 1},
+					{Key: "id", Value: 1},
+				},
+				Options: options.Index().SetName("devices_preferences_id"),
+			})(ctx, db)
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndex(users, "devices_preferences_id")(ctx, db); err != nil {
+				return err
+			}
+			return createIndex(users, mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "devices.priceChanged", Value: 1},
+					{Key: "devices.frequency", Value: 1},
+					{Key: "id", Value: 1},
+				},
+				Options: options.Index().SetName("devices_settings_id"),
+			})(ctx, db)
+		},
+	},
+	{
+		description: "create deliveries state_nextAttemptAt index",
+		up: createIndex(deliveries, mongo.IndexModel{
+			Keys:    bson.D{{Key: "state", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+			Options: options.Index().SetName("state_nextAttemptAt"),
+		}),
+		down: dropIndex(deliveries, "state_nextAttemptAt"),
+	},
+	{
+		description: "create deliveries state_id index",
+		up: createIndex(deliveries, mongo.IndexModel{
+			Keys:    bson.D{{Key: "state", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("state_id"),
+		}),
+		down: dropIndex(deliveries, "state_id"),
+	},
+	{
+		description: "create idempotency_keys expiresAt TTL index",
+		up: createIndex(keys, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetName("expiresAt").SetExpireAfterSeconds(0),
+		}),
+		down: dropIndex(keys, "expiresAt"),
+	},
+	{
+		description: "create idempotency_keys pending events index",
+		up: createIndex(keys, mongo.IndexModel{
+			Keys: bson.D{{Key: "nextAttemptAt", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("pending_nextAttemptAt").
+				SetPartialFilterExpression(bson.M{"pending": true}),
+		}),
+		down: dropIndex(keys, "pending_nextAttemptAt"),
+	},
+}
+
+func createIndex(collection string, index mongo.IndexModel) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().CreateOne(ctx, index)
+		return err
+	}
+}
+
+// updateDevices rewrites devices of users matching filter with fn.
+// Devices are decoded as plain documents so fields unknown to migration are kept.
+func updateDevices(filter bson.M, fn func(d bson.M)) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		c := db.Collection(users)
+
+		cur, err := c.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+
+		for cur.Next(ctx) {
+			var u struct {
+				ID      primitive.ObjectID `bson:"_id"`
+				Devices []bson.M           `bson:"devices"`
+			}
+			if err := cur.Decode(&u); err != nil {
+				return err
+			}
+
+			for _, d := range u.Devices {
+				fn(d)
+			}
+
+			if _, err := c.UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$set": bson.M{"devices": u.Devices}}); err != nil {
+				return err
+			}
+		}
+
+		return cur.Err()
+	}
+}
+
+func dropIndex(collection, name string) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().DropOne(ctx, name)
+		return err
+	}
+}
+
+// MigrationStatus describes state of single migration.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// AppliedAt is zero for pending migrations.
+	AppliedAt time.Time
+}
+
+// Migrator manages schema migrations.
+type Migrator interface {
+	// Up applies all pending migrations.
+	Up(ctx context.Context) error
+
+	// Down reverts the last applied migration.
+	Down(ctx context.Context) error
+
+	// Status returns state of every known migration.
+	Status(ctx context.Context) ([]MigrationStatus, error)
+
+	// Close disconnects from database.
+	Close(ctx context.Context) error
+}
+
+type migrator struct {
+	db         *mongo.Database
+	migrations []migration
+	owner      string
+}
+
+// NewMigrator creates migrator of mongodb storage schema.
+func NewMigrator(uri, db string) (Migrator, error) {
+	d, err := connect(uri, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMigrator(d), nil
+}
+
+func newMigrator(db *mongo.Database) *migrator {
+	host, _ := os.Hostname()
+
+	return &migrator{
+		db:         db,
+		migrations: migrations,
+		owner:      host + ":" + strconv.Itoa(os.Getpid()),
+	}
+}
+
+func (m *migrator) Close(ctx context.Context) error {
+	return m.db.Client().Disconnect(ctx)
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+func (m *migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		current, err := m.version(ctx)
+		if err != nil {
+			return err
+		}
+
+		for v := current + 1; v <= len(m.migrations); v++ {
+			mg := m.migrations[v-1]
+			logrus.Infof("applying migration %d: %s", v, mg.description)
+
+			if err := mg.up(ctx, m.db); err != nil {
+				return fmt.Errorf("failed to apply migration %d: %w", v, err)
+			}
+
+			_, err := m.db.Collection(schemaMigrations).InsertOne(ctx, appliedMigration{
+				Version:     v,
+				Description: mg.description,
+				AppliedAt:   time.Now().UTC(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", v, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func() error {
+		current, err := m.version(ctx)
+		if err != nil {
+			return err
+		}
+
+		if current == 0 {
+			return ErrNoMigrations
+		}
+
+		if current > len(m.migrations) {
+			return fmt.Errorf("migration %d is unknown to this version", current)
+		}
+
+		mg := m.migrations[current-1]
+		logrus.Infof("reverting migration %d: %s", current, mg.description)
+
+		if err := mg.down(ctx, m.db); err != nil {
+			return fmt.Errorf("failed to revert migration %d: %w", current, err)
+		}
+
+		if _, err := m.db.Collection(schemaMigrations).DeleteOne(ctx, bson.M{"_id": current}); err != nil {
+			return fmt.Errorf("failed to unrecord migration %d: %w", current, err)
+		}
+
+		return nil
+	})
+}
+
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	cursor, err := m.db.Collection(schemaMigrations).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var applied []appliedMigration
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	ss := make([]MigrationStatus, len(m.migrations))
+	for i, mg := range m.migrations {
+		ss[i] = MigrationStatus{
+			Version:     i + 1,
+			Description: mg.description,
+			AppliedAt:   appliedAt[i+1],
+		}
+	}
+
+	return ss, nil
+}
+
+// version returns version of the last applied migration.
+func (m *migrator) version(ctx context.Context) (int, error) {
+	var last appliedMigration
+
+	err := m.db.Collection(schemaMigrations).FindOne(ctx, bson.D{},
+		options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&last)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	return last.Version, nil
+}
+
+// withLock runs fn while holding migrations lock so replicas don't migrate concurrently.
+func (m *migrator) withLock(ctx context.Context, fn func() error) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := m.unlock(); err != nil {
+			logrus.WithError(err).Error("failed to release migrations lock")
+		}
+	}()
+
+	return fn()
+}
+
+func (m *migrator) lock(ctx context.Context) error {
+	for {
+		now := time.Now().UTC()
+
+		// upsert fails with duplicate key error while unexpired lock is held by someone else
+		_, err := m.db.Collection(migrationsLock).UpdateOne(ctx,
+			bson.M{"_id": "lock", "expiresAt": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": m.owner, "expiresAt": now.Add(lockTTL)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("failed to acquire migrations lock: %w", err)
+		}
+
+		logrus.Info("waiting for migrations lock")
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to acquire migrations lock: %w", ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+func (m *migrator) unlock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.db.Collection(migrationsLock).DeleteOne(ctx, bson.M{"_id": "lock", "owner": m.owner})
+	return err
+}
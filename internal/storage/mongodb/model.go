@@ -1,20 +1,59 @@
 package mongodb
 
 import (
+	"sort"
+	"time"
+
 	"github.com/vliubezny/gnotify/internal/model"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// parseID converts model identifier into ObjectID.
+func parseID(id string) (primitive.ObjectID, error) {
+	oid, err := model.ParseID(id)
+	return primitive.ObjectID(oid), err
+}
+
 type user struct {
-	ID      int64    `bson:"id"`
-	Lang    string   `bson:"lang"`
-	Devices []device `bson:"devices,omitempty"`
+	ID         int64        `bson:"id"`
+	Lang       string       `bson:"lang"`
+	TimeZone   string       `bson:"timeZone,omitempty"`
+	QuietHours []quietHours `bson:"quietHours,omitempty"`
+	Version    int64        `bson:"version"`
+	Devices    []device     `bson:"devices,omitempty"`
+}
+
+type quietHours struct {
+	Start int `bson:"start"`
+	End   int `bson:"end"`
+}
+
+func newQuietHours(qs []model.QuietHours) []quietHours {
+	if len(qs) == 0 {
+		return nil
+	}
+
+	c := make([]quietHours, len(qs))
+	for i, q := range qs {
+		c[i] = quietHours{Start: q.Start, End: q.End}
+	}
+	return c
 }
 
 func (u user) toModel() model.User {
 	mUser := model.User{
 		ID:       u.ID,
 		Language: u.Lang,
+		TimeZone: u.TimeZone,
+		Version:  u.Version,
+	}
+
+	if len(u.QuietHours) > 0 {
+		mUser.QuietHours = make([]model.QuietHours, len(u.QuietHours))
+
+		for i, q := range u.QuietHours {
+			mUser.QuietHours[i] = model.QuietHours{Start: q.Start, End: q.End}
+		}
 	}
 
 	if len(u.Devices) > 0 {
@@ -29,19 +68,229 @@ func (u user) toModel() model.User {
 }
 
 type device struct {
-	ID           primitive.ObjectID `bson:"_id"`
-	Name         string             `bson:"name"`
-	PriceChanged bool               `bson:"priceChanged,omitempty"`
-	Frequency    string             `bson:"frequency,omitempty"`
+	ID          primitive.ObjectID `bson:"_id"`
+	Name        string             `bson:"name"`
+	Type        string             `bson:"type,omitempty"`
+	Address     address            `bson:"address"`
+	Disabled    bool               `bson:"disabled,omitempty"`
+	Preferences []preference       `bson:"preferences,omitempty"`
+}
+
+type address struct {
+	Endpoint string `bson:"endpoint,omitempty"`
+	P256dh   string `bson:"p256dh,omitempty"`
+	Auth     string `bson:"auth,omitempty"`
+	Email    string `bson:"email,omitempty"`
+	Phone    string `bson:"phone,omitempty"`
+	Token    string `bson:"token,omitempty"`
+	URL      string `bson:"url,omitempty"`
+	Secret   string `bson:"secret,omitempty"`
+}
+
+func newAddress(a model.Address) address {
+	return address(a)
+}
+
+func (a address) toModel() model.Address {
+	return model.Address(a)
+}
+
+type preference struct {
+	Type      string `bson:"type"`
+	Enabled   bool   `bson:"enabled"`
+	Frequency string `bson:"frequency"`
+	Channel   string `bson:"channel"`
+}
+
+// newPreferences converts preferences map into list ordered by event type.
+func newPreferences(s model.NotificationSettings) []preference {
+	ps := make([]preference, 0, len(s.Preferences))
+	for t, p := range s.Preferences {
+		ps = append(ps, preference{
+			Type:      t,
+			Enabled:   p.Enabled,
+			Frequency: p.Frequency,
+			Channel:   p.Channel,
+		})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Type < ps[j].Type })
+
+	return ps
 }
 
 func (d device) toModel() model.Device {
-	return model.Device{
-		ID:   d.ID.String(),
-		Name: d.Name,
-		Settings: model.NotificationSettings{
-			PriceChanged: d.PriceChanged,
-			Frequency:    d.Frequency,
-		},
+	mDevice := model.Device{
+		ID:       model.FormatID(d.ID),
+		Name:     d.Name,
+		Type:     d.Type,
+		Address:  d.Address.toModel(),
+		Disabled: d.Disabled,
+	}
+
+	if len(d.Preferences) > 0 {
+		mDevice.Settings.Preferences = make(map[string]model.Preference, len(d.Preferences))
+
+		for _, p := range d.Preferences {
+			mDevice.Settings.Preferences[p.Type] = model.Preference{
+				Enabled:   p.Enabled,
+				Frequency: p.Frequency,
+				Channel:   p.Channel,
+			}
+		}
+	}
+
+	return mDevice
+}
+
+type event struct {
+	Type      string    `bson:"type"`
+	UserIDs   []int64   `bson:"userIds,omitempty"`
+	ProductID int64     `bson:"productId,omitempty"`
+	OldPrice  int64     `bson:"oldPrice,omitempty"`
+	NewPrice  int64     `bson:"newPrice,omitempty"`
+	OrderID   string    `bson:"orderId,omitempty"`
+	Status    string    `bson:"status,omitempty"`
+	Discount  int64     `bson:"discount,omitempty"`
+	Quantity  int64     `bson:"quantity,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+func newEvent(e model.Event) event {
+	return event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+func (e event) toModel() model.Event {
+	return model.Event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+type digest struct {
+	UserID    int64     `bson:"userId"`
+	DeviceID  string    `bson:"deviceId"`
+	Events    []event   `bson:"events"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+func (d digest) toModel() model.Digest {
+	mDigest := model.Digest{
+		UserID:    d.UserID,
+		DeviceID:  d.DeviceID,
+		CreatedAt: d.CreatedAt,
+	}
+
+	if len(d.Events) > 0 {
+		mDigest.Events = make([]model.Event, len(d.Events))
+
+		for i, e := range d.Events {
+			mDigest.Events[i] = e.toModel()
+		}
+	}
+
+	return mDigest
+}
+
+type notification struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    int64              `bson:"userId"`
+	Type      string             `bson:"type"`
+	Title     string             `bson:"title"`
+	Body      string             `bson:"body"`
+	Read      bool               `bson:"read"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+func (n notification) toModel() model.Notification {
+	return model.Notification{
+		ID:        model.FormatID(n.ID),
+		UserID:    n.UserID,
+		Type:      n.Type,
+		Title:     n.Title,
+		Body:      n.Body,
+		Read:      n.Read,
+		CreatedAt: n.CreatedAt,
+	}
+}
+
+type delivery struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	UserID        int64              `bson:"userId"`
+	DeviceID      string             `bson:"deviceId"`
+	Title         string             `bson:"title"`
+	Body          string             `bson:"body"`
+	Events        []event            `bson:"events,omitempty"`
+	State         string             `bson:"state"`
+	Attempts      int                `bson:"attempts"`
+	LastError     string             `bson:"lastError,omitempty"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt"`
+	CreatedAt     time.Time          `bson:"createdAt"`
+	UpdatedAt     time.Time          `bson:"updatedAt"`
+}
+
+func (d delivery) toModel() model.Delivery {
+	mDelivery := model.Delivery{
+		ID:            model.FormatID(d.ID),
+		UserID:        d.UserID,
+		DeviceID:      d.DeviceID,
+		Title:         d.Title,
+		Body:          d.Body,
+		State:         d.State,
+		Attempts:      d.Attempts,
+		LastError:     d.LastError,
+		NextAttemptAt: d.NextAttemptAt,
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
+	}
+
+	if len(d.Events) > 0 {
+		mDelivery.Events = make([]model.Event, len(d.Events))
+
+		for i, e := range d.Events {
+			mDelivery.Events[i] = e.toModel()
+		}
+	}
+
+	return mDelivery
+}
+
+type idempotencyKey struct {
+	Key           string    `bson:"_id"`
+	EventID       string    `bson:"eventId"`
+	Event         event     `bson:"event"`
+	AcceptedAt    time.Time `bson:"acceptedAt"`
+	ExpiresAt     time.Time `bson:"expiresAt"`
+	Pending       bool      `bson:"pending"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt"`
+}
+
+func (k idempotencyKey) toModel() model.IdempotencyKey {
+	return model.IdempotencyKey{
+		Key:           k.Key,
+		EventID:       k.EventID,
+		Event:         k.Event.toModel(),
+		AcceptedAt:    k.AcceptedAt,
+		ExpiresAt:     k.ExpiresAt,
+		Pending:       k.Pending,
+		NextAttemptAt: k.NextAttemptAt,
 	}
 }
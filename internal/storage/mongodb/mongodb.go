@@ -3,6 +3,7 @@ package mongodb
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,53 +17,55 @@ import (
 )
 
 const (
-	users = "users"
+	users         = "users"
+	digests       = "digests"
+	notifications = "notifications"
+	deliveries    = "deliveries"
+	keys          = "idempotency_keys"
 )
 
 type mongoStorage struct {
 	db *mongo.Database
 }
 
-// New creates mongodb storage.
+// New creates mongodb storage and applies pending migrations.
 func New(uri, db string) (storage.Storage, error) {
-	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	d, err := connect(uri, db)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), lockTTL)
 	defer cancel()
 
-	err = client.Connect(ctx)
-	if err != nil {
+	if err := newMigrator(d).Up(ctx); err != nil {
+		d.Client().Disconnect(context.Background())
 		return nil, err
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
+	return &mongoStorage{db: d}, nil
+}
+
+func connect(uri, db string) (*mongo.Database, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
 	if err != nil {
 		return nil, err
 	}
 
-	ms := &mongoStorage{
-		db: client.Database(db),
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	if err = createScheme(ms.db); err != nil {
+	err = client.Connect(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	return ms, nil
-}
-
-func createScheme(db *mongo.Database) error {
-	ctx := context.Background()
-
-	_, err := db.Collection(users).Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.D{{Key: "id", Value: 1}},
-		Options: options.Index().SetName("id").SetUnique(true),
-	})
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	return client.Database(db), nil
 }
 
 func (s *mongoStorage) GetUser(ctx context.Context, id int64) (model.User, error) {
@@ -83,41 +86,84 @@ func (s *mongoStorage) GetUser(ctx context.Context, id int64) (model.User, error
 }
 
 func (s *mongoStorage) UpsertUser(ctx context.Context, user model.User) error {
-	_, err := s.db.Collection(users).UpdateOne(ctx, bson.M{"id": user.ID},
+	r, err := s.db.Collection(users).UpdateOne(ctx, withVersion(bson.M{"id": user.ID}, user.Version),
 		bson.M{
 			"$setOnInsert": bson.D{
 				{Key: "id", Value: user.ID},
 			},
 			"$set": bson.D{
 				{Key: "lang", Value: user.Language},
+				{Key: "timeZone", Value: user.TimeZone},
+				{Key: "quietHours", Value: newQuietHours(user.QuietHours)},
 			},
-		}, options.Update().SetUpsert(true))
+			"$inc": bson.D{
+				{Key: "version", Value: 1},
+			},
+		}, options.Update().SetUpsert(user.Version == 0))
 
 	if err != nil {
 		return fmt.Errorf("failed to upsert user: %w", err)
 	}
 
+	// only versioned update may miss
+	if r.MatchedCount == 0 && r.UpsertedCount == 0 {
+		return storage.ErrConflict
+	}
+
 	return nil
 }
 
-func (s *mongoStorage) GetUsers(ctx context.Context) ([]model.User, error) {
-	cursor, err := s.db.Collection(users).Find(ctx, bson.D{})
+func (s *mongoStorage) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
+	filter := bson.M{}
+
+	if query.Language != "" {
+		filter["lang"] = query.Language
+	}
+
+	if query.EventType != "" || query.Frequency != "" {
+		pref := bson.M{"enabled": true}
+		if query.EventType != "" {
+			pref["type"] = query.EventType
+		}
+		if query.Frequency != "" {
+			pref["frequency"] = query.Frequency
+		}
+		filter["devices.preferences"] = bson.M{"$elemMatch": pref}
+	}
+
+	if query.After != "" {
+		after, err := strconv.ParseInt(query.After, 10, 64)
+		if err != nil {
+			return model.UserPage{}, storage.ErrInvalidCursor
+		}
+		filter["id"] = bson.M{"$gt": after}
+	}
+
+	cursor, err := s.db.Collection(users).Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "id", Value: 1}}).
+		SetLimit(int64(query.First)+1))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get users: %w", err)
+		return model.UserPage{}, fmt.Errorf("failed to get users: %w", err)
 	}
 	defer cursor.Close(ctx)
 
-	var users []user
-	if err := cursor.All(ctx, &users); err != nil {
-		return nil, fmt.Errorf("failed to read users: %w", err)
+	var us []user
+	if err := cursor.All(ctx, &us); err != nil {
+		return model.UserPage{}, fmt.Errorf("failed to read users: %w", err)
+	}
+
+	page := model.UserPage{}
+	if len(us) > query.First {
+		us = us[:query.First]
+		page.NextCursor = strconv.FormatInt(us[len(us)-1].ID, 10)
 	}
 
-	mUsers := make([]model.User, len(users))
-	for i := range users {
-		mUsers[i] = users[i].toModel()
+	page.Users = make([]model.User, len(us))
+	for i := range us {
+		page.Users[i] = us[i].toModel()
 	}
 
-	return mUsers, nil
+	return page, nil
 }
 
 func (s *mongoStorage) DeleteUser(ctx context.Context, id int64) error {
@@ -133,19 +179,24 @@ func (s *mongoStorage) DeleteUser(ctx context.Context, id int64) error {
 	return nil
 }
 
-func (s *mongoStorage) AddDevice(ctx context.Context, userID int64, input model.Device) (model.Device, error) {
+func (s *mongoStorage) AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
 	d := device{
-		ID:           primitive.NewObjectID(),
-		Name:         input.Name,
-		PriceChanged: input.Settings.PriceChanged,
-		Frequency:    input.Settings.Frequency,
+		ID:          primitive.NewObjectID(),
+		Name:        input.Name,
+		Type:        input.Type,
+		Address:     newAddress(input.Address),
+		Disabled:    input.Disabled,
+		Preferences: newPreferences(input.Settings),
 	}
 
-	r := s.db.Collection(users).FindOneAndUpdate(ctx, bson.M{"id": userID},
+	r := s.db.Collection(users).FindOneAndUpdate(ctx, withVersion(bson.M{"id": userID}, version),
 		bson.M{
 			"$push": bson.D{
 				{Key: "devices", Value: d},
 			},
+			"$inc": bson.D{
+				{Key: "version", Value: 1},
+			},
 		}, options.FindOneAndUpdate().SetReturnDocument(options.After).
 			SetProjection(bson.M{
 				"devices": bson.D{
@@ -155,7 +206,7 @@ func (s *mongoStorage) AddDevice(ctx context.Context, userID int64, input model.
 
 	if r.Err() != nil {
 		if r.Err() == mongo.ErrNoDocuments {
-			return model.Device{}, storage.ErrNotFound
+			return model.Device{}, s.conflictOrNotFound(ctx, bson.M{"id": userID}, version)
 		}
 		return model.Device{}, fmt.Errorf("failed to add device: %w", r.Err())
 	}
@@ -167,3 +218,547 @@ func (s *mongoStorage) AddDevice(ctx context.Context, userID int64, input model.
 
 	return u.Devices[0].toModel(), nil
 }
+
+func (s *mongoStorage) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	id, err := parseID(deviceID)
+	if err != nil {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	r := s.db.Collection(users).FindOne(ctx, bson.M{"id": userID, "devices._id": id},
+		options.FindOne().SetProjection(bson.M{
+			"devices.$": 1,
+		}))
+
+	if r.Err() != nil {
+		if r.Err() == mongo.ErrNoDocuments {
+			return model.Device{}, storage.ErrNotFound
+		}
+		return model.Device{}, fmt.Errorf("failed to get device: %w", r.Err())
+	}
+
+	var u user
+	if err := r.Decode(&u); err != nil || len(u.Devices) == 0 {
+		return model.Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+
+	return u.Devices[0].toModel(), nil
+}
+
+func (s *mongoStorage) UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	id, err := parseID(input.ID)
+	if err != nil {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	filter := bson.M{"id": userID, "devices._id": id}
+	r := s.db.Collection(users).FindOneAndUpdate(ctx, withVersion(filter, version),
+		bson.M{
+			"$set": bson.D{
+				{Key: "devices.$.name", Value: input.Name},
+				{Key: "devices.$.type", Value: input.Type},
+				{Key: "devices.$.address", Value: newAddress(input.Address)},
+				{Key: "devices.$.disabled", Value: input.Disabled},
+				{Key: "devices.$.preferences", Value: newPreferences(input.Settings)},
+			},
+			"$inc": bson.D{
+				{Key: "version", Value: 1},
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After).
+			SetProjection(bson.M{
+				"devices.$": 1,
+			}))
+
+	if r.Err() != nil {
+		if r.Err() == mongo.ErrNoDocuments {
+			return model.Device{}, s.conflictOrNotFound(ctx, filter, version)
+		}
+		return model.Device{}, fmt.Errorf("failed to update device: %w", r.Err())
+	}
+
+	var u user
+	if err := r.Decode(&u); err != nil || len(u.Devices) == 0 {
+		return model.Device{}, fmt.Errorf("failed to update device: %w", err)
+	}
+
+	return u.Devices[0].toModel(), nil
+}
+
+func (s *mongoStorage) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	id, err := parseID(deviceID)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	filter := bson.M{"id": userID, "devices._id": id}
+	r, err := s.db.Collection(users).UpdateOne(ctx, withVersion(filter, version),
+		bson.M{
+			"$pull": bson.M{
+				"devices": bson.M{"_id": id},
+			},
+			"$inc": bson.D{
+				{Key: "version", Value: 1},
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to remove device: %w", err)
+	}
+
+	if r.MatchedCount == 0 {
+		return s.conflictOrNotFound(ctx, filter, version)
+	}
+
+	return nil
+}
+
+func (s *mongoStorage) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	id, err := parseID(deviceID)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	r, err := s.db.Collection(users).UpdateOne(ctx, bson.M{"id": userID, "devices._id": id},
+		bson.M{
+			"$set": bson.D{
+				{Key: "devices.$.disabled", Value: true},
+			},
+			"$inc": bson.D{
+				{Key: "version", Value: 1},
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to disable device: %w", err)
+	}
+
+	if r.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// withVersion returns copy of user filter which also matches expected version.
+// Zero version matches any.
+func withVersion(filter bson.M, version int64) bson.M {
+	f := bson.M{}
+	for k, v := range filter {
+		f[k] = v
+	}
+	if version != 0 {
+		f["version"] = version
+	}
+	return f
+}
+
+// conflictOrNotFound explains why versioned update matched nothing:
+// ErrConflict if document matching filter exists, ErrNotFound otherwise.
+func (s *mongoStorage) conflictOrNotFound(ctx context.Context, filter bson.M, version int64) error {
+	if version == 0 {
+		return storage.ErrNotFound
+	}
+
+	n, err := s.db.Collection(users).CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("failed to check user version: %w", err)
+	}
+
+	if n > 0 {
+		return storage.ErrConflict
+	}
+	return storage.ErrNotFound
+}
+
+func (s *mongoStorage) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	_, err := s.db.Collection(digests).UpdateOne(ctx, bson.M{"userId": userID, "deviceId": deviceID},
+		bson.M{
+			"$setOnInsert": bson.D{
+				{Key: "createdAt", Value: e.CreatedAt},
+			},
+			"$push": bson.D{
+				{Key: "events", Value: newEvent(e)},
+			},
+		}, options.Update().SetUpsert(true))
+
+	if err != nil {
+		return fmt.Errorf("failed to add event to digest: %w", err)
+	}
+
+	return nil
+}
+
+func (s *mongoStorage) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	cursor, err := s.db.Collection(digests).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digests: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var digests []digest
+	if err := cursor.All(ctx, &digests); err != nil {
+		return nil, fmt.Errorf("failed to read digests: %w", err)
+	}
+
+	mDigests := make([]model.Digest, len(digests))
+	for i := range digests {
+		mDigests[i] = digests[i].toModel()
+	}
+
+	return mDigests, nil
+}
+
+func (s *mongoStorage) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	r := s.db.Collection(digests).FindOneAndDelete(ctx, bson.M{"userId": userID, "deviceId": deviceID})
+	if r.Err() != nil {
+		if r.Err() == mongo.ErrNoDocuments {
+			return model.Digest{}, storage.ErrNotFound
+		}
+		return model.Digest{}, fmt.Errorf("failed to pop digest: %w", r.Err())
+	}
+
+	var d digest
+	if err := r.Decode(&d); err != nil {
+		return model.Digest{}, fmt.Errorf("failed to pop digest: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *mongoStorage) AddNotification(ctx context.Context, input model.Notification) (model.Notification, error) {
+	n := notification{
+		ID:        primitive.NewObjectID(),
+		UserID:    input.UserID,
+		Type:      input.Type,
+		Title:     input.Title,
+		Body:      input.Body,
+		Read:      input.Read,
+		CreatedAt: input.CreatedAt,
+	}
+
+	if _, err := s.db.Collection(notifications).InsertOne(ctx, n); err != nil {
+		return model.Notification{}, fmt.Errorf("failed to add notification: %w", err)
+	}
+
+	return n.toModel(), nil
+}
+
+func (s *mongoStorage) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	filter := bson.M{"userId": userID}
+
+	if query.UnreadOnly {
+		filter["read"] = false
+	}
+
+	if query.After != "" {
+		after, err := parseID(query.After)
+		if err != nil {
+			return model.NotificationPage{}, storage.ErrInvalidCursor
+		}
+		filter["_id"] = bson.M{"$lt": after}
+	}
+
+	cursor, err := s.db.Collection(notifications).Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(query.First)+1))
+	if err != nil {
+		return model.NotificationPage{}, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var ns []notification
+	if err := cursor.All(ctx, &ns); err != nil {
+		return model.NotificationPage{}, fmt.Errorf("failed to read notifications: %w", err)
+	}
+
+	page := model.NotificationPage{}
+	if len(ns) > query.First {
+		page.HasNextPage = true
+		ns = ns[:query.First]
+	}
+
+	page.Notifications = make([]model.Notification, len(ns))
+	for i := range ns {
+		page.Notifications[i] = ns[i].toModel()
+	}
+
+	return page, nil
+}
+
+func (s *mongoStorage) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	oids := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if oid, err := parseID(id); err == nil {
+			oids = append(oids, oid)
+		}
+	}
+
+	r, err := s.db.Collection(notifications).UpdateMany(ctx,
+		bson.M{"userId": userID, "_id": bson.M{"$in": oids}, "read": false},
+		bson.M{"$set": bson.M{"read": true}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+
+	return int(r.ModifiedCount), nil
+}
+
+func (s *mongoStorage) AddDelivery(ctx context.Context, input model.Delivery) (model.Delivery, error) {
+	d := delivery{
+		ID:            primitive.NewObjectID(),
+		UserID:        input.UserID,
+		DeviceID:      input.DeviceID,
+		Title:         input.Title,
+		Body:          input.Body,
+		State:         input.State,
+		Attempts:      input.Attempts,
+		LastError:     input.LastError,
+		NextAttemptAt: input.NextAttemptAt,
+		CreatedAt:     input.CreatedAt,
+		UpdatedAt:     input.UpdatedAt,
+	}
+
+	if len(input.Events) > 0 {
+		d.Events = make([]event, len(input.Events))
+
+		for i, e := range input.Events {
+			d.Events[i] = newEvent(e)
+		}
+	}
+
+	if _, err := s.db.Collection(deliveries).InsertOne(ctx, d); err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to add delivery: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *mongoStorage) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	filter := bson.M{
+		"state":         bson.M{"$in": bson.A{model.DeliveryPending, model.DeliveryFailed, model.DeliveryInFlight}},
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.D{
+			{Key: "state", Value: model.DeliveryInFlight},
+			{Key: "nextAttemptAt", Value: now.Add(timeout)},
+			{Key: "updatedAt", Value: now},
+		},
+		"$inc": bson.D{
+			{Key: "attempts", Value: 1},
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	// every delivery is leased atomically so concurrent workers never lease the same one
+	ds := []model.Delivery{}
+	for len(ds) < limit {
+		var d delivery
+		err := s.db.Collection(deliveries).FindOneAndUpdate(ctx, filter, update, opts).Decode(&d)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			return nil, fmt.Errorf("failed to lease deliveries: %w", err)
+		}
+		ds = append(ds, d.toModel())
+	}
+
+	return ds, nil
+}
+
+func (s *mongoStorage) UpdateDelivery(ctx context.Context, input model.Delivery) error {
+	id, err := parseID(input.ID)
+	if err != nil {
+		return storage.ErrNotFound
+	}
+
+	r, err := s.db.Collection(deliveries).UpdateOne(ctx,
+		bson.M{"_id": id, "state": model.DeliveryInFlight, "attempts": input.Attempts},
+		bson.M{
+			"$set": bson.D{
+				{Key: "state", Value: input.State},
+				{Key: "lastError", Value: input.LastError},
+				{Key: "nextAttemptAt", Value: input.NextAttemptAt},
+				{Key: "updatedAt", Value: input.UpdatedAt},
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	if r.MatchedCount == 0 {
+		return s.deliveryConflictOrNotFound(ctx, id)
+	}
+
+	return nil
+}
+
+// deliveryConflictOrNotFound explains why delivery update matched nothing:
+// ErrConflict if delivery exists, ErrNotFound otherwise.
+func (s *mongoStorage) deliveryConflictOrNotFound(ctx context.Context, id primitive.ObjectID) error {
+	n, err := s.db.Collection(deliveries).CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	if err != nil {
+		return fmt.Errorf("failed to check delivery: %w", err)
+	}
+
+	if n > 0 {
+		return storage.ErrConflict
+	}
+	return storage.ErrNotFound
+}
+
+func (s *mongoStorage) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	filter := bson.M{}
+
+	if query.State != "" {
+		filter["state"] = query.State
+	}
+
+	if query.After != "" {
+		after, err := parseID(query.After)
+		if err != nil {
+			return model.DeliveryPage{}, storage.ErrInvalidCursor
+		}
+		filter["_id"] = bson.M{"$lt": after}
+	}
+
+	cursor, err := s.db.Collection(deliveries).Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(query.First)+1))
+	if err != nil {
+		return model.DeliveryPage{}, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var ds []delivery
+	if err := cursor.All(ctx, &ds); err != nil {
+		return model.DeliveryPage{}, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	page := model.DeliveryPage{}
+	if len(ds) > query.First {
+		page.HasNextPage = true
+		ds = ds[:query.First]
+	}
+
+	page.Deliveries = make([]model.Delivery, len(ds))
+	for i := range ds {
+		page.Deliveries[i] = ds[i].toModel()
+	}
+
+	return page, nil
+}
+
+func (s *mongoStorage) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	oid, err := parseID(id)
+	if err != nil {
+		return model.Delivery{}, storage.ErrNotFound
+	}
+
+	var d delivery
+	err = s.db.Collection(deliveries).FindOneAndUpdate(ctx,
+		bson.M{"_id": oid, "state": model.DeliveryDead},
+		bson.M{
+			"$set": bson.D{
+				{Key: "state", Value: model.DeliveryPending},
+				{Key: "attempts", Value: 0},
+				{Key: "nextAttemptAt", Value: now},
+				{Key: "updatedAt", Value: now},
+			},
+			"$unset": bson.D{
+				{Key: "lastError", Value: ""},
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&d)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return model.Delivery{}, s.deliveryConflictOrNotFound(ctx, oid)
+		}
+		return model.Delivery{}, fmt.Errorf("failed to requeue delivery: %w", err)
+	}
+
+	return d.toModel(), nil
+}
+
+func (s *mongoStorage) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	c := s.db.Collection(keys)
+
+	for {
+		// upsert fails with duplicate key error while unexpired key exists
+		_, err := c.UpdateOne(ctx,
+			bson.M{"_id": k.Key, "expiresAt": bson.M{"$lte": k.AcceptedAt}},
+			bson.M{"$set": bson.D{
+				{Key: "eventId", Value: k.EventID},
+				{Key: "event", Value: newEvent(k.Event)},
+				{Key: "acceptedAt", Value: k.AcceptedAt},
+				{Key: "expiresAt", Value: k.ExpiresAt},
+				{Key: "pending", Value: k.Pending},
+				{Key: "nextAttemptAt", Value: k.NextAttemptAt},
+			}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return k, true, nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			return model.IdempotencyKey{}, false, fmt.Errorf("failed to add idempotency key: %w", err)
+		}
+
+		var stored idempotencyKey
+		if err := c.FindOne(ctx, bson.M{"_id": k.Key}).Decode(&stored); err != nil {
+			// key expired and was removed by TTL monitor in between, so try again
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			return model.IdempotencyKey{}, false, fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+
+		return stored.toModel(), false, nil
+	}
+}
+
+func (s *mongoStorage) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	filter := bson.M{
+		"pending":       true,
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.D{
+			{Key: "nextAttemptAt", Value: now.Add(timeout)},
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	// every event is leased atomically so concurrent instances never lease the same one
+	ks := []model.IdempotencyKey{}
+	for len(ks) < limit {
+		var k idempotencyKey
+		err := s.db.Collection(keys).FindOneAndUpdate(ctx, filter, update, opts).Decode(&k)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			return nil, fmt.Errorf("failed to lease events: %w", err)
+		}
+		ks = append(ks, k.toModel())
+	}
+
+	return ks, nil
+}
+
+func (s *mongoStorage) MarkEventDispatched(ctx context.Context, key string) error {
+	r, err := s.db.Collection(keys).UpdateOne(ctx,
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"pending": false}})
+	if err != nil {
+		return fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+
+	if r.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -16,7 +17,9 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 	"github.com/vliubezny/gnotify/internal/model"
 	"github.com/vliubezny/gnotify/internal/storage"
+	"github.com/vliubezny/gnotify/internal/storage/storagetest"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
@@ -80,123 +83,108 @@ func setup() func() {
 func cleanup(t *testing.T) {
 	_, err := ms.db.Collection(users).DeleteMany(ctx, bson.D{})
 	require.NoError(t, err)
-}
-
-func TestMongoStorage_GetUser(t *testing.T) {
-	defer cleanup(t)
-
-	u := model.User{
-		ID:       1,
-		Language: "en",
-	}
 
-	_, err := ms.db.Collection(users).InsertOne(ctx, bson.D{
-		{Key: "id", Value: u.ID},
-		{Key: "lang", Value: u.Language},
-	})
+	_, err = ms.db.Collection(digests).DeleteMany(ctx, bson.D{})
 	require.NoError(t, err)
 
-	user, err := ms.GetUser(ctx, u.ID)
+	_, err = ms.db.Collection(notifications).DeleteMany(ctx, bson.D{})
+	require.NoError(t, err)
 
+	_, err = ms.db.Collection(deliveries).DeleteMany(ctx, bson.D{})
 	require.NoError(t, err)
-	assert.Equal(t, u, user)
 
-	_, err = ms.GetUser(ctx, 100500)
-	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+	_, err = ms.db.Collection(keys).DeleteMany(ctx, bson.D{})
+	require.NoError(t, err)
 }
 
-func TestMongoStorage_UpsertUser(t *testing.T) {
-	defer cleanup(t)
-
-	newUser := model.User{
-		ID:       1,
-		Language: "en",
-	}
-
-	require.NoError(t, ms.UpsertUser(ctx, newUser))
-
-	user, err := ms.GetUser(ctx, newUser.ID)
-	require.NoError(t, err)
-	assert.Equal(t, newUser, user)
+func TestMongoStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Cleanup(func() { cleanup(t) })
+		return ms
+	})
+}
 
-	newUser.Language = "by"
-	require.NoError(t, ms.UpsertUser(ctx, newUser))
+func TestMigrator(t *testing.T) {
+	m := newMigrator(ms.db)
 
-	user, err = ms.GetUser(ctx, newUser.ID)
+	ss, err := m.Status(ctx)
 	require.NoError(t, err)
-	assert.Equal(t, newUser, user)
-}
+	require.Len(t, ss, len(migrations))
+	for _, s := range ss {
+		assert.False(t, s.AppliedAt.IsZero(), "migration %d must be applied by New", s.Version)
+	}
 
-func TestMongoStorage_GetUsers(t *testing.T) {
-	defer cleanup(t)
+	require.NoError(t, m.Down(ctx))
 
-	us, err := ms.GetUsers(ctx)
+	ss, err = m.Status(ctx)
 	require.NoError(t, err)
-	assert.Empty(t, us)
-
-	users := []model.User{
-		{ID: 1, Language: "en"},
-		{ID: 2, Language: "by"},
-	}
+	assert.True(t, ss[len(ss)-1].AppliedAt.IsZero(), "last migration must be reverted")
+	assert.False(t, ss[len(ss)-2].AppliedAt.IsZero())
 
-	require.NoError(t, ms.UpsertUser(ctx, users[0]))
-	require.NoError(t, ms.UpsertUser(ctx, users[1]))
+	require.NoError(t, m.Up(ctx))
 
-	us, err = ms.GetUsers(ctx)
+	ss, err = m.Status(ctx)
 	require.NoError(t, err)
-	assert.Equal(t, users, us)
+	assert.False(t, ss[len(ss)-1].AppliedAt.IsZero(), "last migration must be reapplied")
 }
 
-func TestMongoStorage_DeleteUser(t *testing.T) {
-	defer cleanup(t)
-
-	u := model.User{
-		ID:       1,
-		Language: "en",
-	}
+func TestMigrator_lock(t *testing.T) {
+	a, b := newMigrator(ms.db), newMigrator(ms.db)
+	b.owner = "another replica"
 
-	require.NoError(t, ms.UpsertUser(ctx, u))
+	require.NoError(t, a.lock(ctx))
 
-	err := ms.DeleteUser(ctx, u.ID)
-	require.NoError(t, err)
+	c, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
 
-	_, err = ms.GetUser(ctx, u.ID)
-	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+	err := b.lock(c)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), fmt.Sprintf("wanted %s got %s", context.DeadlineExceeded, err))
 
-	err = ms.DeleteUser(ctx, 100500)
-	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+	require.NoError(t, a.unlock())
+	require.NoError(t, b.lock(ctx))
+	require.NoError(t, b.unlock())
 }
 
-func TestMongoStorage_AddDevice(t *testing.T) {
-	defer cleanup(t)
+func TestMigrator_preferences(t *testing.T) {
+	t.Cleanup(func() { cleanup(t) })
 
-	newUser := model.User{
-		ID:       1,
-		Language: "en",
+	var m migration
+	for _, mg := range migrations {
+		if mg.description == "move device settings to per event type preferences" {
+			m = mg
+		}
 	}
-
-	require.NoError(t, ms.UpsertUser(ctx, newUser))
-
-	inputDevice := model.Device{
-		Name: "Chrome",
-		Settings: model.NotificationSettings{
-			Frequency:    model.Daily,
-			PriceChanged: true,
+	require.NotNil(t, m.up, "migration must exist")
+
+	oid := primitive.NewObjectID()
+	_, err := ms.db.Collection(users).InsertOne(ctx, bson.M{
+		"id":      1,
+		"lang":    "en",
+		"version": 1,
+		"devices": bson.A{
+			bson.M{"_id": oid, "name": "Chrome", "priceChanged": true, "frequency": model.Daily},
 		},
-	}
-
-	newDevice, err := ms.AddDevice(ctx, newUser.ID, inputDevice)
+	})
 	require.NoError(t, err)
 
-	assert.NotEmpty(t, newDevice.ID)
-	assert.Equal(t, inputDevice.Name, newDevice.Name)
-	assert.Equal(t, inputDevice.Settings, newDevice.Settings)
+	require.NoError(t, m.up(ctx, ms.db))
 
-	user, err := ms.GetUser(ctx, newUser.ID)
+	d, err := ms.GetDevice(ctx, 1, model.FormatID(oid))
 	require.NoError(t, err)
+	assert.Equal(t, model.Device{
+		ID:   model.FormatID(oid),
+		Name: "Chrome",
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
+	}, d)
+
+	require.NoError(t, m.down(ctx, ms.db))
 
-	if assert.NotEmpty(t, user.Devices) {
-		assert.Equal(t, inputDevice.Name, user.Devices[0].Name)
-		assert.Equal(t, inputDevice.Settings, user.Devices[0].Settings)
+	var legacy struct {
+		Devices []bson.M `bson:"devices"`
 	}
+	require.NoError(t, ms.db.Collection(users).FindOne(ctx, bson.M{"id": 1}).Decode(&legacy))
+	require.Len(t, legacy.Devices, 1)
+	assert.Equal(t, bson.M{"_id": oid, "name": "Chrome", "priceChanged": true, "frequency": model.Daily}, legacy.Devices[0])
 }
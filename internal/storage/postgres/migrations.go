@@ -0,0 +1,169 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrationsLock is advisory lock key held while migrations run so concurrent instances don't race.
+const migrationsLock = 7_246_170_339
+
+// migrations are applied in order, version of migration is its index plus one.
+// Never modify applied migrations, append new ones instead.
+var migrations = []string{
+	`
+	CREATE TABLE users (
+		id   BIGINT PRIMARY KEY,
+		lang TEXT NOT NULL
+	);
+
+	CREATE INDEX users_lang_id ON users (lang, id);
+
+	CREATE TABLE devices (
+		id            CHAR(24) PRIMARY KEY,
+		user_id       BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		name          TEXT NOT NULL,
+		price_changed BOOLEAN NOT NULL DEFAULT FALSE,
+		frequency     TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX devices_user_id_id ON devices (user_id, id);
+	CREATE INDEX devices_settings_user_id ON devices (price_changed, frequency, user_id);
+
+	CREATE TABLE digests (
+		seq        BIGSERIAL UNIQUE,
+		user_id    BIGINT NOT NULL,
+		device_id  TEXT NOT NULL,
+		events     JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (user_id, device_id)
+	);
+
+	CREATE TABLE notifications (
+		id         CHAR(24) PRIMARY KEY,
+		user_id    BIGINT NOT NULL,
+		type       TEXT NOT NULL,
+		title      TEXT NOT NULL,
+		body       TEXT NOT NULL,
+		read       BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMPTZ NOT NULL
+	);
+
+	CREATE INDEX notifications_user_id_id ON notifications (user_id, id DESC);
+	`,
+	`
+	ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+	`,
+	`
+	CREATE TABLE device_preferences (
+		device_id  CHAR(24) NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+		event_type TEXT NOT NULL,
+		enabled    BOOLEAN NOT NULL,
+		frequency  TEXT NOT NULL,
+		channel    TEXT NOT NULL,
+		PRIMARY KEY (device_id, event_type)
+	);
+
+	CREATE INDEX device_preferences_type_frequency ON device_preferences (event_type, frequency) WHERE enabled;
+
+	INSERT INTO device_preferences (device_id, event_type, enabled, frequency, channel)
+	SELECT id, 'PRICE_CHANGED', price_changed, frequency, 'DEVICE' FROM devices;
+
+	DROP INDEX devices_settings_user_id;
+	ALTER TABLE devices DROP COLUMN price_changed, DROP COLUMN frequency;
+	`,
+	`
+	ALTER TABLE users
+		ADD COLUMN time_zone TEXT NOT NULL DEFAULT '',
+		ADD COLUMN quiet_hours JSONB NOT NULL DEFAULT '[]';
+	`,
+	`
+	ALTER TABLE devices
+		ADD COLUMN type TEXT NOT NULL DEFAULT '',
+		ADD COLUMN address JSONB NOT NULL DEFAULT '{}';
+	`,
+	`
+	ALTER TABLE devices ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	`
+	CREATE TABLE deliveries (
+		id              CHAR(24) PRIMARY KEY,
+		user_id         BIGINT NOT NULL,
+		device_id       TEXT NOT NULL,
+		title           TEXT NOT NULL,
+		body            TEXT NOT NULL,
+		events          JSONB NOT NULL DEFAULT '[]',
+		state           TEXT NOT NULL,
+		attempts        INT NOT NULL DEFAULT 0,
+		last_error      TEXT NOT NULL DEFAULT '',
+		next_attempt_at TIMESTAMPTZ NOT NULL,
+		created_at      TIMESTAMPTZ NOT NULL,
+		updated_at      TIMESTAMPTZ NOT NULL
+	);
+
+	CREATE INDEX deliveries_state_next_attempt_at ON deliveries (state, next_attempt_at);
+	CREATE INDEX deliveries_state_id ON deliveries (state, id DESC);
+	`,
+	`
+	CREATE TABLE idempotency_keys (
+		key         TEXT PRIMARY KEY,
+		event_id    TEXT NOT NULL,
+		accepted_at TIMESTAMPTZ NOT NULL,
+		expires_at  TIMESTAMPTZ NOT NULL
+	);
+	`,
+	`
+	ALTER TABLE idempotency_keys
+		ADD COLUMN event           JSONB NOT NULL DEFAULT '{}',
+		ADD COLUMN pending         BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+	CREATE INDEX idempotency_keys_pending_next_attempt_at ON idempotency_keys (next_attempt_at, key) WHERE pending;
+	`,
+	`
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);
+	`,
+}
+
+// migrate applies pending migrations.
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLock); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	for v := current + 1; v <= len(migrations); v++ {
+		if _, err := tx.ExecContext(ctx, migrations[v-1]); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", v, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, v); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", v, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migrations: %w", err)
+	}
+
+	return nil
+}
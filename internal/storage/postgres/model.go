@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/vliubezny/gnotify/internal/model"
+)
+
+// event is JSON representation of digest event.
+type event struct {
+	Type      string    `json:"type"`
+	UserIDs   []int64   `json:"userIds,omitempty"`
+	ProductID int64     `json:"productId,omitempty"`
+	OldPrice  int64     `json:"oldPrice,omitempty"`
+	NewPrice  int64     `json:"newPrice,omitempty"`
+	OrderID   string    `json:"orderId,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Discount  int64     `json:"discount,omitempty"`
+	Quantity  int64     `json:"quantity,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newEvent(e model.Event) event {
+	return event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt.UTC(),
+	}
+}
+
+func (e event) toModel() model.Event {
+	return model.Event{
+		Type:      e.Type,
+		UserIDs:   e.UserIDs,
+		ProductID: e.ProductID,
+		OldPrice:  e.OldPrice,
+		NewPrice:  e.NewPrice,
+		OrderID:   e.OrderID,
+		Status:    e.Status,
+		Discount:  e.Discount,
+		Quantity:  e.Quantity,
+		CreatedAt: e.CreatedAt.UTC(),
+	}
+}
+
+// quietHours is JSON representation of user quiet hours.
+type quietHours struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func marshalQuietHours(qs []model.QuietHours) ([]byte, error) {
+	c := make([]quietHours, len(qs))
+	for i, q := range qs {
+		c[i] = quietHours{Start: q.Start, End: q.End}
+	}
+	return json.Marshal(c)
+}
+
+func unmarshalQuietHours(data []byte) ([]model.QuietHours, error) {
+	var c []quietHours
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	if len(c) == 0 {
+		return nil, nil
+	}
+
+	qs := make([]model.QuietHours, len(c))
+	for i, q := range c {
+		qs[i] = model.QuietHours{Start: q.Start, End: q.End}
+	}
+	return qs, nil
+}
+
+// address is JSON representation of device address.
+type address struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	P256dh   string `json:"p256dh,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Token    string `json:"token,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+func marshalAddress(a model.Address) ([]byte, error) {
+	return json.Marshal(address(a))
+}
+
+func unmarshalAddress(data []byte) (model.Address, error) {
+	var a address
+	if err := json.Unmarshal(data, &a); err != nil {
+		return model.Address{}, err
+	}
+	return model.Address(a), nil
+}
@@ -0,0 +1,1016 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+)
+
+// foreignKeyViolation is postgres error code of foreign key constraint violation.
+const foreignKeyViolation = "23503"
+
+// purgeInterval is how often expired idempotency keys are deleted.
+const purgeInterval = time.Minute
+
+type postgresStorage struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// purgedAt is when expired idempotency keys were deleted last time.
+	purgedAt time.Time
+}
+
+// New creates postgres storage and applies pending migrations.
+func New(dsn string) (storage.Storage, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &postgresStorage{db: db}, nil
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *postgresStorage) GetUser(ctx context.Context, id int64) (model.User, error) {
+	u := model.User{ID: id}
+
+	var qh []byte
+	err := s.db.QueryRowContext(ctx, `SELECT lang, time_zone, quiet_hours, version FROM users WHERE id = $1`, id).
+		Scan(&u.Language, &u.TimeZone, &qh, &u.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.User{}, storage.ErrNotFound
+		}
+		return model.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if u.QuietHours, err = unmarshalQuietHours(qh); err != nil {
+		return model.User{}, fmt.Errorf("failed to read quiet hours: %w", err)
+	}
+
+	devices, err := getDevices(ctx, s.db, []int64{id})
+	if err != nil {
+		return model.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	u.Devices = devices[id]
+
+	return u, nil
+}
+
+func (s *postgresStorage) GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if query.After != "" {
+		after, err := strconv.ParseInt(query.After, 10, 64)
+		if err != nil {
+			return model.UserPage{}, storage.ErrInvalidCursor
+		}
+		where = append(where, "u.id > "+arg(after))
+	}
+
+	if query.Language != "" {
+		where = append(where, "u.lang = "+arg(query.Language))
+	}
+
+	if query.EventType != "" || query.Frequency != "" {
+		pref := []string{"d.user_id = u.id", "p.enabled"}
+		if query.EventType != "" {
+			pref = append(pref, "p.event_type = "+arg(query.EventType))
+		}
+		if query.Frequency != "" {
+			pref = append(pref, "p.frequency = "+arg(query.Frequency))
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM devices d JOIN device_preferences p ON p.device_id = d.id WHERE "+
+			strings.Join(pref, " AND ")+")")
+	}
+
+	q := `SELECT u.id, u.lang, u.time_zone, u.quiet_hours, u.version FROM users u`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY u.id LIMIT " + arg(query.First+1)
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return model.UserPage{}, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []model.User{}
+	for rows.Next() {
+		var (
+			u   model.User
+			qh  []byte
+			err error
+		)
+		if err = rows.Scan(&u.ID, &u.Language, &u.TimeZone, &qh, &u.Version); err != nil {
+			return model.UserPage{}, fmt.Errorf("failed to read users: %w", err)
+		}
+		if u.QuietHours, err = unmarshalQuietHours(qh); err != nil {
+			return model.UserPage{}, fmt.Errorf("failed to read quiet hours: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return model.UserPage{}, fmt.Errorf("failed to read users: %w", err)
+	}
+
+	page := model.UserPage{}
+	if len(users) > query.First {
+		users = users[:query.First]
+		page.NextCursor = strconv.FormatInt(users[len(users)-1].ID, 10)
+	}
+
+	ids := make([]int64, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+
+	devices, err := getDevices(ctx, s.db, ids)
+	if err != nil {
+		return model.UserPage{}, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	for i := range users {
+		users[i].Devices = devices[users[i].ID]
+	}
+	page.Users = users
+
+	return page, nil
+}
+
+// getDevices returns devices of users grouped by user ID.
+func getDevices(ctx context.Context, q querier, userIDs []int64) (map[int64][]model.Device, error) {
+	devices := make(map[int64][]model.Device, len(userIDs))
+	if len(userIDs) == 0 {
+		return devices, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT user_id, id, name, type, address, disabled
+		FROM devices
+		WHERE user_id = ANY($1)
+		ORDER BY id`, pq.Array(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var (
+			userID int64
+			d      model.Device
+			addr   []byte
+			err    error
+		)
+		if err = rows.Scan(&userID, &d.ID, &d.Name, &d.Type, &addr, &d.Disabled); err != nil {
+			return nil, fmt.Errorf("failed to read devices: %w", err)
+		}
+		if d.Address, err = unmarshalAddress(addr); err != nil {
+			return nil, fmt.Errorf("failed to read device address: %w", err)
+		}
+		devices[userID] = append(devices[userID], d)
+		ids = append(ids, d.ID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read devices: %w", err)
+	}
+
+	prefs, err := getPreferences(ctx, q, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ds := range devices {
+		for i := range ds {
+			ds[i].Settings.Preferences = prefs[ds[i].ID]
+		}
+	}
+
+	return devices, nil
+}
+
+// getPreferences returns preferences of devices grouped by device ID.
+func getPreferences(ctx context.Context, q querier, deviceIDs []string) (map[string]map[string]model.Preference, error) {
+	prefs := make(map[string]map[string]model.Preference, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return prefs, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT device_id, event_type, enabled, frequency, channel
+		FROM device_preferences
+		WHERE device_id = ANY($1)`, pq.Array(deviceIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device preferences: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			deviceID, eventType string
+			p                   model.Preference
+		)
+		if err := rows.Scan(&deviceID, &eventType, &p.Enabled, &p.Frequency, &p.Channel); err != nil {
+			return nil, fmt.Errorf("failed to read device preferences: %w", err)
+		}
+		if prefs[deviceID] == nil {
+			prefs[deviceID] = make(map[string]model.Preference)
+		}
+		prefs[deviceID][eventType] = p
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device preferences: %w", err)
+	}
+
+	return prefs, nil
+}
+
+// putPreferences replaces device preferences.
+func putPreferences(ctx context.Context, tx *sql.Tx, deviceID string, s model.NotificationSettings) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM device_preferences WHERE device_id = $1`, deviceID); err != nil {
+		return fmt.Errorf("failed to delete device preferences: %w", err)
+	}
+
+	for t, p := range s.Preferences {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO device_preferences (device_id, event_type, enabled, frequency, channel)
+			VALUES ($1, $2, $3, $4, $5)`,
+			deviceID, t, p.Enabled, p.Frequency, p.Channel)
+		if err != nil {
+			return fmt.Errorf("failed to add device preference: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *postgresStorage) UpsertUser(ctx context.Context, user model.User) error {
+	qh, err := marshalQuietHours(user.QuietHours)
+	if err != nil {
+		return fmt.Errorf("failed to marshal quiet hours: %w", err)
+	}
+
+	if user.Version == 0 {
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO users (id, lang, time_zone, quiet_hours) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (id) DO UPDATE SET lang = EXCLUDED.lang, time_zone = EXCLUDED.time_zone,
+				quiet_hours = EXCLUDED.quiet_hours, version = users.version + 1`,
+			user.ID, user.Language, user.TimeZone, string(qh))
+		if err != nil {
+			return fmt.Errorf("failed to upsert user: %w", err)
+		}
+
+		return nil
+	}
+
+	r, err := s.db.ExecContext(ctx, `
+		UPDATE users SET lang = $2, time_zone = $3, quiet_hours = $4, version = version + 1
+		WHERE id = $1 AND version = $5`, user.ID, user.Language, user.TimeZone, string(qh), user.Version)
+	if err != nil {
+		return fmt.Errorf("failed to upsert user: %w", err)
+	}
+
+	if err := requireAffected(r); err != nil {
+		return storage.ErrConflict
+	}
+
+	return nil
+}
+
+func (s *postgresStorage) DeleteUser(ctx context.Context, id int64) error {
+	r, err := s.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return requireAffected(r)
+}
+
+func (s *postgresStorage) AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	d := model.Device{
+		ID:       model.NewID(),
+		Name:     input.Name,
+		Type:     input.Type,
+		Address:  input.Address,
+		Disabled: input.Disabled,
+		Settings: input.Settings,
+	}
+
+	addr, err := marshalAddress(d.Address)
+	if err != nil {
+		return model.Device{}, fmt.Errorf("failed to marshal device address: %w", err)
+	}
+
+	err = s.updateUser(ctx, userID, version, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO devices (id, user_id, name, type, address, disabled) VALUES ($1, $2, $3, $4, $5, $6)`,
+			d.ID, userID, d.Name, d.Type, string(addr), d.Disabled)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+				return storage.ErrNotFound
+			}
+			return fmt.Errorf("failed to add device: %w", err)
+		}
+		return putPreferences(ctx, tx, d.ID, d.Settings)
+	})
+	if err != nil {
+		return model.Device{}, err
+	}
+
+	return d, nil
+}
+
+func (s *postgresStorage) GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error) {
+	if _, err := model.ParseID(deviceID); err != nil {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	d := model.Device{ID: deviceID}
+
+	var addr []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT name, type, address, disabled FROM devices WHERE user_id = $1 AND id = $2`, userID, deviceID).
+		Scan(&d.Name, &d.Type, &addr, &d.Disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Device{}, storage.ErrNotFound
+		}
+		return model.Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+
+	if d.Address, err = unmarshalAddress(addr); err != nil {
+		return model.Device{}, fmt.Errorf("failed to read device address: %w", err)
+	}
+
+	prefs, err := getPreferences(ctx, s.db, []string{deviceID})
+	if err != nil {
+		return model.Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+	d.Settings.Preferences = prefs[deviceID]
+
+	return d, nil
+}
+
+func (s *postgresStorage) UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error) {
+	if _, err := model.ParseID(input.ID); err != nil {
+		return model.Device{}, storage.ErrNotFound
+	}
+
+	d := model.Device{ID: input.ID}
+
+	addr, err := marshalAddress(input.Address)
+	if err != nil {
+		return model.Device{}, fmt.Errorf("failed to marshal device address: %w", err)
+	}
+
+	err = s.updateUser(ctx, userID, version, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			UPDATE devices SET name = $3, type = $4, address = $5, disabled = $6
+			WHERE user_id = $1 AND id = $2
+			RETURNING name`,
+			userID, input.ID, input.Name, input.Type, string(addr), input.Disabled).
+			Scan(&d.Name)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return storage.ErrNotFound
+			}
+			return fmt.Errorf("failed to update device: %w", err)
+		}
+		return putPreferences(ctx, tx, d.ID, input.Settings)
+	})
+	if err != nil {
+		return model.Device{}, err
+	}
+
+	d.Type = input.Type
+	d.Address = input.Address
+	d.Disabled = input.Disabled
+	d.Settings = input.Settings
+
+	return d, nil
+}
+
+func (s *postgresStorage) RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error {
+	if _, err := model.ParseID(deviceID); err != nil {
+		return storage.ErrNotFound
+	}
+
+	return s.updateUser(ctx, userID, version, func(tx *sql.Tx) error {
+		r, err := tx.ExecContext(ctx, `DELETE FROM devices WHERE user_id = $1 AND id = $2`, userID, deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to remove device: %w", err)
+		}
+		return requireAffected(r)
+	})
+}
+
+func (s *postgresStorage) DisableDevice(ctx context.Context, userID int64, deviceID string) error {
+	if _, err := model.ParseID(deviceID); err != nil {
+		return storage.ErrNotFound
+	}
+
+	return s.updateUser(ctx, userID, 0, func(tx *sql.Tx) error {
+		r, err := tx.ExecContext(ctx, `UPDATE devices SET disabled = TRUE WHERE user_id = $1 AND id = $2`, userID, deviceID)
+		if err != nil {
+			return fmt.Errorf("failed to disable device: %w", err)
+		}
+		return requireAffected(r)
+	})
+}
+
+// updateUser runs fn in transaction and increments user version afterwards.
+// Changes made by fn are rolled back with storage.ErrConflict if stored version differs from expected one.
+func (s *postgresStorage) updateUser(ctx context.Context, userID, version int64, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	r, err := tx.ExecContext(ctx, `
+		UPDATE users SET version = version + 1
+		WHERE id = $1 AND ($2 = 0 OR version = $2)`, userID, version)
+	if err != nil {
+		return fmt.Errorf("failed to update user version: %w", err)
+	}
+
+	if err := requireAffected(r); err != nil {
+		return storage.ErrConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *postgresStorage) AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error {
+	events, err := json.Marshal([]event{newEvent(e)})
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO digests (user_id, device_id, events, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET events = digests.events || EXCLUDED.events`,
+		userID, deviceID, events, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add event to digest: %w", err)
+	}
+
+	return nil
+}
+
+func (s *postgresStorage) GetDigests(ctx context.Context) ([]model.Digest, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, device_id, events, created_at
+		FROM digests
+		ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digests: %w", err)
+	}
+	defer rows.Close()
+
+	ds := []model.Digest{}
+	for rows.Next() {
+		d, err := scanDigest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read digests: %w", err)
+		}
+		ds = append(ds, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read digests: %w", err)
+	}
+
+	return ds, nil
+}
+
+func (s *postgresStorage) PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error) {
+	row := s.db.QueryRowContext(ctx, `
+		DELETE FROM digests
+		WHERE user_id = $1 AND device_id = $2
+		RETURNING user_id, device_id, events, created_at`, userID, deviceID)
+
+	d, err := scanDigest(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Digest{}, storage.ErrNotFound
+		}
+		return model.Digest{}, fmt.Errorf("failed to pop digest: %w", err)
+	}
+
+	return d, nil
+}
+
+// scanDigest reads digest selected as user_id, device_id, events, created_at.
+func scanDigest(row interface{ Scan(...interface{}) error }) (model.Digest, error) {
+	var (
+		d      model.Digest
+		events []byte
+	)
+
+	if err := row.Scan(&d.UserID, &d.DeviceID, &events, &d.CreatedAt); err != nil {
+		return model.Digest{}, err
+	}
+	d.CreatedAt = d.CreatedAt.UTC()
+
+	var es []event
+	if err := json.Unmarshal(events, &es); err != nil {
+		return model.Digest{}, fmt.Errorf("failed to decode events: %w", err)
+	}
+
+	if len(es) > 0 {
+		d.Events = make([]model.Event, len(es))
+		for i, e := range es {
+			d.Events[i] = e.toModel()
+		}
+	}
+
+	return d, nil
+}
+
+func (s *postgresStorage) AddNotification(ctx context.Context, n model.Notification) (model.Notification, error) {
+	n.ID = model.NewID()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notifications (id, user_id, type, title, body, read, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		n.ID, n.UserID, n.Type, n.Title, n.Body, n.Read, n.CreatedAt)
+	if err != nil {
+		return model.Notification{}, fmt.Errorf("failed to add notification: %w", err)
+	}
+
+	return n, nil
+}
+
+func (s *postgresStorage) GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error) {
+	q := `SELECT id, user_id, type, title, body, read, created_at FROM notifications WHERE user_id = $1`
+	args := []interface{}{userID}
+
+	if query.UnreadOnly {
+		q += ` AND NOT read`
+	}
+
+	if query.After != "" {
+		if _, err := model.ParseID(query.After); err != nil {
+			return model.NotificationPage{}, storage.ErrInvalidCursor
+		}
+		args = append(args, query.After)
+		q += ` AND id < $` + strconv.Itoa(len(args))
+	}
+
+	args = append(args, query.First+1)
+	q += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return model.NotificationPage{}, fmt.Errorf("failed to get notifications: %w", err)
+	}
+	defer rows.Close()
+
+	ns := []model.Notification{}
+	for rows.Next() {
+		var n model.Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.Title, &n.Body, &n.Read, &n.CreatedAt); err != nil {
+			return model.NotificationPage{}, fmt.Errorf("failed to read notifications: %w", err)
+		}
+		n.CreatedAt = n.CreatedAt.UTC()
+		ns = append(ns, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return model.NotificationPage{}, fmt.Errorf("failed to read notifications: %w", err)
+	}
+
+	page := model.NotificationPage{Notifications: ns}
+	if len(ns) > query.First {
+		page.HasNextPage = true
+		page.Notifications = ns[:query.First]
+	}
+
+	return page, nil
+}
+
+func (s *postgresStorage) MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error) {
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, err := model.ParseID(id); err == nil {
+			valid = append(valid, id)
+		}
+	}
+
+	r, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET read = TRUE
+		WHERE user_id = $1 AND id = ANY($2) AND NOT read`, userID, pq.Array(valid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark notifications read: %w", err)
+	}
+
+	return int(n), nil
+}
+
+// requireAffected returns storage.ErrNotFound if statement changed no rows.
+func requireAffected(r sql.Result) error {
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// deliveryColumns are selected by scanDelivery.
+const deliveryColumns = `id, user_id, device_id, title, body, events, state, attempts, last_error, next_attempt_at, created_at, updated_at`
+
+func (s *postgresStorage) AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error) {
+	d.ID = model.NewID()
+
+	es := make([]event, len(d.Events))
+	for i, e := range d.Events {
+		es[i] = newEvent(e)
+	}
+
+	events, err := json.Marshal(es)
+	if err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to encode events: %w", err)
+	}
+
+	row := s.db.QueryRowContext(ctx, `
+		INSERT INTO deliveries (`+deliveryColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING `+deliveryColumns,
+		d.ID, d.UserID, d.DeviceID, d.Title, d.Body, string(events), d.State, d.Attempts, d.LastError,
+		d.NextAttemptAt, d.CreatedAt, d.UpdatedAt)
+
+	d, err = scanDelivery(row)
+	if err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to add delivery: %w", err)
+	}
+
+	return d, nil
+}
+
+func (s *postgresStorage) LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error) {
+	// SKIP LOCKED lets concurrent workers lease different deliveries instead of waiting for each other
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE deliveries SET state = $1, attempts = attempts + 1, next_attempt_at = $2, updated_at = $3
+		WHERE id IN (
+			SELECT id FROM deliveries
+			WHERE state = ANY($4) AND next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $5
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+deliveryColumns,
+		model.DeliveryInFlight, now.Add(timeout), now,
+		pq.Array([]string{model.DeliveryPending, model.DeliveryFailed, model.DeliveryInFlight}), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	ds := []model.Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deliveries: %w", err)
+		}
+		ds = append(ds, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	// leased deliveries share next attempt time, so order them by creation
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID < ds[j].ID })
+
+	return ds, nil
+}
+
+func (s *postgresStorage) UpdateDelivery(ctx context.Context, d model.Delivery) error {
+	r, err := s.db.ExecContext(ctx, `
+		UPDATE deliveries SET state = $1, last_error = $2, next_attempt_at = $3, updated_at = $4
+		WHERE id = $5 AND state = $6 AND attempts = $7`,
+		d.State, d.LastError, d.NextAttemptAt, d.UpdatedAt, d.ID, model.DeliveryInFlight, d.Attempts)
+	if err != nil {
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	if err := requireAffected(r); err != nil {
+		if err == storage.ErrNotFound {
+			return s.deliveryConflictOrNotFound(ctx, d.ID)
+		}
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	return nil
+}
+
+// deliveryConflictOrNotFound explains why delivery update matched nothing:
+// ErrConflict if delivery exists, ErrNotFound otherwise.
+func (s *postgresStorage) deliveryConflictOrNotFound(ctx context.Context, id string) error {
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM deliveries WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check delivery: %w", err)
+	}
+
+	if exists {
+		return storage.ErrConflict
+	}
+	return storage.ErrNotFound
+}
+
+func (s *postgresStorage) GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error) {
+	q := `SELECT ` + deliveryColumns + ` FROM deliveries WHERE TRUE`
+	args := []interface{}{}
+
+	if query.State != "" {
+		args = append(args, query.State)
+		q += ` AND state = $` + strconv.Itoa(len(args))
+	}
+
+	if query.After != "" {
+		if _, err := model.ParseID(query.After); err != nil {
+			return model.DeliveryPage{}, storage.ErrInvalidCursor
+		}
+		args = append(args, query.After)
+		q += ` AND id < $` + strconv.Itoa(len(args))
+	}
+
+	args = append(args, query.First+1)
+	q += ` ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args))
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return model.DeliveryPage{}, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	ds := []model.Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return model.DeliveryPage{}, fmt.Errorf("failed to read deliveries: %w", err)
+		}
+		ds = append(ds, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return model.DeliveryPage{}, fmt.Errorf("failed to read deliveries: %w", err)
+	}
+
+	page := model.DeliveryPage{Deliveries: ds}
+	if len(ds) > query.First {
+		page.HasNextPage = true
+		page.Deliveries = ds[:query.First]
+	}
+
+	return page, nil
+}
+
+func (s *postgresStorage) RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error) {
+	if _, err := model.ParseID(id); err != nil {
+		return model.Delivery{}, storage.ErrNotFound
+	}
+
+	row := s.db.QueryRowContext(ctx, `
+		UPDATE deliveries SET state = $1, attempts = 0, last_error = '', next_attempt_at = $2, updated_at = $2
+		WHERE id = $3 AND state = $4
+		RETURNING `+deliveryColumns,
+		model.DeliveryPending, now, id, model.DeliveryDead)
+
+	d, err := scanDelivery(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return model.Delivery{}, s.deliveryConflictOrNotFound(ctx, id)
+		}
+		return model.Delivery{}, fmt.Errorf("failed to requeue delivery: %w", err)
+	}
+
+	return d, nil
+}
+
+// scanDelivery reads delivery selected as deliveryColumns.
+func scanDelivery(row interface{ Scan(...interface{}) error }) (model.Delivery, error) {
+	var (
+		d      model.Delivery
+		events []byte
+	)
+
+	err := row.Scan(&d.ID, &d.UserID, &d.DeviceID, &d.Title, &d.Body, &events, &d.State, &d.Attempts, &d.LastError,
+		&d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return model.Delivery{}, err
+	}
+	d.NextAttemptAt = d.NextAttemptAt.UTC()
+	d.CreatedAt = d.CreatedAt.UTC()
+	d.UpdatedAt = d.UpdatedAt.UTC()
+
+	var es []event
+	if err := json.Unmarshal(events, &es); err != nil {
+		return model.Delivery{}, fmt.Errorf("failed to decode events: %w", err)
+	}
+
+	if len(es) > 0 {
+		d.Events = make([]model.Event, len(es))
+		for i, e := range es {
+			d.Events[i] = e.toModel()
+		}
+	}
+
+	return d, nil
+}
+
+// keyColumns are selected by scanKey.
+const keyColumns = `key, event_id, event, accepted_at, expires_at, pending, next_attempt_at`
+
+func (s *postgresStorage) AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error) {
+	e, err := json.Marshal(newEvent(k.Event))
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if err := s.purgeIdempotencyKeys(ctx, k.AcceptedAt); err != nil {
+		return model.IdempotencyKey{}, false, err
+	}
+
+	// conflicting insert waits for concurrent one, so only one of them saves the key
+	r, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (`+keyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (key) DO UPDATE
+		SET event_id = EXCLUDED.event_id, event = EXCLUDED.event, accepted_at = EXCLUDED.accepted_at,
+			expires_at = EXCLUDED.expires_at, pending = EXCLUDED.pending, next_attempt_at = EXCLUDED.next_attempt_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.accepted_at`,
+		k.Key, k.EventID, e, k.AcceptedAt, k.ExpiresAt, k.Pending, k.NextAttemptAt)
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to add idempotency key: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to add idempotency key: %w", err)
+	}
+
+	if n > 0 {
+		return k, true, nil
+	}
+
+	stored, err := scanKey(s.db.QueryRowContext(ctx, `SELECT `+keyColumns+` FROM idempotency_keys WHERE key = $1`, k.Key))
+	if err != nil {
+		return model.IdempotencyKey{}, false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	return stored, false, nil
+}
+
+// purgeIdempotencyKeys deletes keys expired by now at most once per purgeInterval.
+// Keys of events waiting for dispatch are kept.
+func (s *postgresStorage) purgeIdempotencyKeys(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.purgedAt) < purgeInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.purgedAt = now
+	s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1 AND NOT pending`, now); err != nil {
+		return fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+
+	return nil
+}
+
+func (s *postgresStorage) LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error) {
+	// SKIP LOCKED lets concurrent instances lease different events instead of waiting for each other
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE idempotency_keys SET next_attempt_at = $1
+		WHERE key IN (
+			SELECT key FROM idempotency_keys
+			WHERE pending AND next_attempt_at <= $2
+			ORDER BY next_attempt_at, key
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+keyColumns,
+		now.Add(timeout), now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease events: %w", err)
+	}
+	defer rows.Close()
+
+	ks := []model.IdempotencyKey{}
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read events: %w", err)
+		}
+		ks = append(ks, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+
+	// leased events share next attempt time, so order them by key
+	sort.Slice(ks, func(i, j int) bool { return ks[i].Key < ks[j].Key })
+
+	return ks, nil
+}
+
+func (s *postgresStorage) MarkEventDispatched(ctx context.Context, key string) error {
+	r, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET pending = FALSE WHERE key = $1`, key)
+	if err != nil {
+		return fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+
+	if err := requireAffected(r); err != nil {
+		if err == storage.ErrNotFound {
+			return err
+		}
+		return fmt.Errorf("failed to mark event dispatched: %w", err)
+	}
+
+	return nil
+}
+
+// scanKey reads idempotency key selected as keyColumns.
+func scanKey(row interface{ Scan(...interface{}) error }) (model.IdempotencyKey, error) {
+	var (
+		k model.IdempotencyKey
+		e []byte
+	)
+
+	if err := row.Scan(&k.Key, &k.EventID, &e, &k.AcceptedAt, &k.ExpiresAt, &k.Pending, &k.NextAttemptAt); err != nil {
+		return model.IdempotencyKey{}, err
+	}
+	k.AcceptedAt = k.AcceptedAt.UTC()
+	k.ExpiresAt = k.ExpiresAt.UTC()
+	k.NextAttemptAt = k.NextAttemptAt.UTC()
+
+	var ev event
+	if err := json.Unmarshal(e, &ev); err != nil {
+		return model.IdempotencyKey{}, fmt.Errorf("failed to decode event: %w", err)
+	}
+	k.Event = ev.toModel()
+
+	return k, nil
+}
@@ -0,0 +1,143 @@
+//+build integration
+
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+	"github.com/vliubezny/gnotify/internal/storage/storagetest"
+)
+
+var (
+	ctx = context.Background()
+	ps  *postgresStorage
+)
+
+func TestMain(m *testing.M) {
+	shutdown := setup()
+
+	code := m.Run()
+
+	shutdown()
+	os.Exit(code)
+}
+
+func setup() func() {
+	req := testcontainers.ContainerRequest{
+		Image:        "postgres:13",
+		ExposedPorts: []string{"5432/tcp"},
+		Env: map[string]string{
+			"POSTGRES_USER":     "gnotify",
+			"POSTGRES_PASSWORD": "gnotify",
+			"POSTGRES_DB":       "gnotify",
+		},
+		WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+	}
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatalf("failed to create container")
+	}
+
+	if err := c.Start(ctx); err != nil {
+		logrus.WithError(err).Fatal("failed to start container")
+	}
+
+	host, err := c.Host(ctx)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to get host")
+	}
+
+	port, err := c.MappedPort(ctx, "5432")
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to map port")
+	}
+
+	dsn := fmt.Sprintf("postgres://gnotify:gnotify@%s:%s/gnotify?sslmode=disable", host, port.Port())
+
+	s, err := New(dsn)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to setup postgres storage")
+	}
+	ps = s.(*postgresStorage)
+
+	shutdownFn := func() {
+		if c != nil {
+			c.Terminate(ctx)
+		}
+	}
+
+	return shutdownFn
+}
+
+func cleanup(t *testing.T) {
+	_, err := ps.db.ExecContext(ctx, `TRUNCATE users, devices, device_preferences, digests, notifications, deliveries, idempotency_keys`)
+	require.NoError(t, err)
+}
+
+func TestPostgresStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Cleanup(func() { cleanup(t) })
+		return ps
+	})
+}
+
+func TestPostgresStorage_migrate(t *testing.T) {
+	require.NoError(t, migrate(ctx, ps.db), "migrations must be idempotent")
+
+	var version int
+	require.NoError(t, ps.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+}
+
+func TestPostgresStorage_purgeIdempotencyKeys(t *testing.T) {
+	t.Cleanup(func() { cleanup(t) })
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	// keys are purged at most once per interval
+	ps.purgedAt = now
+
+	keys := []model.IdempotencyKey{
+		{Key: "expired", EventID: "1", AcceptedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		{Key: "pending", EventID: "2", AcceptedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour), Pending: true},
+		{Key: "active", EventID: "3", AcceptedAt: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	for _, k := range keys {
+		_, saved, err := ps.AddIdempotencyKey(ctx, k)
+		require.NoError(t, err)
+		require.True(t, saved)
+	}
+
+	stored := func() []string {
+		rows, err := ps.db.QueryContext(ctx, `SELECT key FROM idempotency_keys ORDER BY key`)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var keys []string
+		for rows.Next() {
+			var k string
+			require.NoError(t, rows.Scan(&k))
+			keys = append(keys, k)
+		}
+		require.NoError(t, rows.Err())
+		return keys
+	}
+
+	require.NoError(t, ps.purgeIdempotencyKeys(ctx, now.Add(time.Second)))
+	assert.Equal(t, []string{"active", "expired", "pending"}, stored())
+
+	require.NoError(t, ps.purgeIdempotencyKeys(ctx, now.Add(purgeInterval)))
+	assert.Equal(t, []string{"active", "pending"}, stored())
+}
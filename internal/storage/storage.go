@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"errors"
+	"io"
+	"time"
 
 	"github.com/vliubezny/gnotify/internal/model"
 )
@@ -12,22 +14,99 @@ import (
 var (
 	// ErrNotFound states that record was not found in storage.
 	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidCursor states that pagination cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrConflict states that record was changed since expected version.
+	ErrConflict = errors.New("conflict")
 )
 
 // Storage saves and loads user notification settings.
+//
+// Methods changing user or its devices take expected user version and return ErrConflict
+// if stored version differs. Zero version skips the check.
 type Storage interface {
 	// GetUser returns user by ID.
 	GetUser(ctx context.Context, id int64) (model.User, error)
 
-	// GetUsers returns list of users.
-	GetUsers(ctx context.Context) ([]model.User, error)
+	// GetUsers returns page of users matching query.
+	GetUsers(ctx context.Context, query model.UserQuery) (model.UserPage, error)
 
 	// UpsertUser inserts or updates user setting if record exists.
+	// Existing user is updated only if its version equals user.Version.
 	UpsertUser(ctx context.Context, user model.User) error
 
 	// DeleteUser deletes user by ID.
 	DeleteUser(ctx context.Context, id int64) error
 
 	// AddDevice add new device for user
-	AddDevice(ctx context.Context, userID int64, input model.Device) (model.Device, error)
+	AddDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error)
+
+	// GetDevice returns user device by ID.
+	GetDevice(ctx context.Context, userID int64, deviceID string) (model.Device, error)
+
+	// UpdateDevice updates user device, device is disabled only if input is.
+	UpdateDevice(ctx context.Context, userID, version int64, input model.Device) (model.Device, error)
+
+	// RemoveDevice removes device from user devices.
+	RemoveDevice(ctx context.Context, userID, version int64, deviceID string) error
+
+	// DisableDevice marks user device as disabled.
+	DisableDevice(ctx context.Context, userID int64, deviceID string) error
+
+	// AddToDigest appends event to the device digest creating digest if needed.
+	AddToDigest(ctx context.Context, userID int64, deviceID string, e model.Event) error
+
+	// GetDigests returns list of pending digests.
+	GetDigests(ctx context.Context) ([]model.Digest, error)
+
+	// PopDigest removes device digest and returns it.
+	PopDigest(ctx context.Context, userID int64, deviceID string) (model.Digest, error)
+
+	// AddNotification appends notification to user inbox.
+	AddNotification(ctx context.Context, n model.Notification) (model.Notification, error)
+
+	// GetNotifications returns page of user notifications.
+	GetNotifications(ctx context.Context, userID int64, query model.NotificationQuery) (model.NotificationPage, error)
+
+	// MarkNotificationsRead marks user notifications as read and returns number of updated notifications.
+	MarkNotificationsRead(ctx context.Context, userID int64, ids []string) (int, error)
+
+	// AddDelivery appends delivery to outbox.
+	AddDelivery(ctx context.Context, d model.Delivery) (model.Delivery, error)
+
+	// LeaseDeliveries marks up to limit deliveries which are due at now as in-flight till now+timeout
+	// and returns them with incremented attempts. Pending, failed and in-flight deliveries
+	// with expired lease are due, the earliest are leased first.
+	LeaseDeliveries(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.Delivery, error)
+
+	// UpdateDelivery saves state, last error and next attempt time of in-flight delivery.
+	// It returns ErrConflict if delivery was leased again since d.Attempts.
+	UpdateDelivery(ctx context.Context, d model.Delivery) error
+
+	// GetDeliveries returns page of deliveries.
+	GetDeliveries(ctx context.Context, query model.DeliveryQuery) (model.DeliveryPage, error)
+
+	// RequeueDelivery makes dead delivery pending with no attempts and clears its last error.
+	// It returns ErrConflict if delivery is not dead.
+	RequeueDelivery(ctx context.Context, id string, now time.Time) (model.Delivery, error)
+
+	// AddIdempotencyKey saves key unless the same key which is unexpired at k.AcceptedAt exists.
+	// It returns saved or existing key and reports whether key was saved.
+	// Storages without TTL support keep expired keys till they are reused.
+	AddIdempotencyKey(ctx context.Context, k model.IdempotencyKey) (model.IdempotencyKey, bool, error)
+
+	// LeaseEvents marks up to limit pending events which are due at now as leased till now+timeout
+	// and returns their keys. Events are due at their next attempt time, the earliest are leased first.
+	LeaseEvents(ctx context.Context, now time.Time, timeout time.Duration, limit int) ([]model.IdempotencyKey, error)
+
+	// MarkEventDispatched clears pending flag of event accepted with the key.
+	MarkEventDispatched(ctx context.Context, key string) error
+}
+
+// Backuper is implemented by storages able to make online backups.
+type Backuper interface {
+	// Backup writes consistent snapshot of storage to w.
+	Backup(ctx context.Context, w io.Writer) error
 }
@@ -0,0 +1,818 @@
+// Package storagetest provides conformance tests shared by storage implementations.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vliubezny/gnotify/internal/model"
+	"github.com/vliubezny/gnotify/internal/storage"
+)
+
+var ctx = context.Background()
+
+// Factory returns empty storage for a single test.
+type Factory func(t *testing.T) storage.Storage
+
+// Run checks that storage created by newStorage behaves as storage.Storage requires.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage)
+	}{
+		{"GetUser", testGetUser},
+		{"UpsertUser", testUpsertUser},
+		{"GetUsers", testGetUsers},
+		{"GetUsersDeviceFilter", testGetUsersDeviceFilter},
+		{"DeleteUser", testDeleteUser},
+		{"AddDevice", testAddDevice},
+		{"GetDevice", testGetDevice},
+		{"Digests", testDigests},
+		{"Notifications", testNotifications},
+		{"Deliveries", testDeliveries},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"IdempotencyKeysConcurrency", testIdempotencyKeysConcurrency},
+		{"Events", testEvents},
+		{"UpdateDevice", testUpdateDevice},
+		{"RemoveDevice", testRemoveDevice},
+		{"DisableDevice", testDisableDevice},
+		{"Version", testVersion},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStorage(t))
+		})
+	}
+}
+
+// settings returns settings with single enabled preference delivered to device.
+func settings(eventType, frequency string) model.NotificationSettings {
+	return model.NotificationSettings{Preferences: map[string]model.Preference{
+		eventType: {Enabled: true, Frequency: frequency, Channel: model.ChannelDevice},
+	}}
+}
+
+func testGetUser(t *testing.T, s storage.Storage) {
+	u := model.User{
+		ID:       1,
+		Language: "en",
+	}
+
+	require.NoError(t, s.UpsertUser(ctx, u))
+
+	user, err := s.GetUser(ctx, u.ID)
+
+	require.NoError(t, err)
+	u.Version = 1
+	assert.Equal(t, u, user)
+
+	_, err = s.GetUser(ctx, 100500)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+}
+
+func testUpsertUser(t *testing.T, s storage.Storage) {
+	newUser := model.User{
+		ID:       1,
+		Language: "en",
+	}
+
+	require.NoError(t, s.UpsertUser(ctx, newUser))
+
+	user, err := s.GetUser(ctx, newUser.ID)
+	require.NoError(t, err)
+	newUser.Version = 1
+	assert.Equal(t, newUser, user)
+
+	newUser.Language = "by"
+	newUser.TimeZone = "Europe/Minsk"
+	newUser.QuietHours = []model.QuietHours{{Start: 1320, End: 420}, {Start: 780, End: 840}}
+	require.NoError(t, s.UpsertUser(ctx, newUser))
+
+	user, err = s.GetUser(ctx, newUser.ID)
+	require.NoError(t, err)
+	newUser.Version = 2
+	assert.Equal(t, newUser, user)
+
+	stale := newUser
+	stale.Version = 1
+	stale.Language = "ru"
+	err = s.UpsertUser(ctx, stale)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	user, err = s.GetUser(ctx, newUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, newUser, user)
+
+	err = s.UpsertUser(ctx, model.User{ID: 100500, Language: "en", Version: 1})
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	_, err = s.GetUser(ctx, 100500)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	newUser.TimeZone = ""
+	newUser.QuietHours = nil
+	require.NoError(t, s.UpsertUser(ctx, newUser))
+
+	user, err = s.GetUser(ctx, newUser.ID)
+	require.NoError(t, err)
+	newUser.Version = 3
+	assert.Equal(t, newUser, user)
+}
+
+func testGetUsers(t *testing.T, s storage.Storage) {
+	page, err := s.GetUsers(ctx, model.UserQuery{First: 10})
+	require.NoError(t, err)
+	assert.Empty(t, page.Users)
+	assert.Empty(t, page.NextCursor)
+
+	users := []model.User{
+		{ID: 1, Language: "en"},
+		{ID: 2, Language: "by"},
+		{ID: 3, Language: "en"},
+	}
+
+	for i := range users {
+		require.NoError(t, s.UpsertUser(ctx, users[i]))
+		users[i].Version = 1
+	}
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 2})
+	require.NoError(t, err)
+	assert.Equal(t, users[:2], page.Users)
+	assert.Equal(t, "2", page.NextCursor)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 2, After: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, users[2:], page.Users)
+	assert.Empty(t, page.NextCursor)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 10, Language: "en"})
+	require.NoError(t, err)
+	assert.Equal(t, []model.User{users[0], users[2]}, page.Users)
+
+	_, err = s.GetUsers(ctx, model.UserQuery{First: 10, After: "invalid"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), fmt.Sprintf("wanted %s got %s", storage.ErrInvalidCursor, err))
+}
+
+func testGetUsersDeviceFilter(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 2, Language: "en"}))
+
+	_, err := s.AddDevice(ctx, 1, 0, model.Device{
+		Name: "Chrome",
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: false, Frequency: model.Daily, Channel: model.ChannelDevice},
+			model.Promotion:    {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+		}},
+	})
+	require.NoError(t, err)
+	_, err = s.AddDevice(ctx, 1, 0, model.Device{
+		Name:     "Firefox",
+		Settings: settings(model.PriceChanged, model.Hourly),
+	})
+	require.NoError(t, err)
+	_, err = s.AddDevice(ctx, 2, 0, model.Device{
+		Name:     "Safari",
+		Settings: settings(model.PriceChanged, model.Daily),
+	})
+	require.NoError(t, err)
+
+	page, err := s.GetUsers(ctx, model.UserQuery{First: 10, EventType: model.PriceChanged})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 2)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 10, EventType: model.PriceChanged, Frequency: model.Daily})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, int64(2), page.Users[0].ID)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 10, EventType: model.Promotion})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, int64(1), page.Users[0].ID)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 10, Frequency: model.Daily})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 2)
+
+	page, err = s.GetUsers(ctx, model.UserQuery{First: 10, EventType: model.Wishlist})
+	require.NoError(t, err)
+	assert.Empty(t, page.Users)
+}
+
+func testDeleteUser(t *testing.T, s storage.Storage) {
+	u := model.User{
+		ID:       1,
+		Language: "en",
+	}
+
+	require.NoError(t, s.UpsertUser(ctx, u))
+
+	err := s.DeleteUser(ctx, u.ID)
+	require.NoError(t, err)
+
+	_, err = s.GetUser(ctx, u.ID)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	err = s.DeleteUser(ctx, 100500)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testAddDevice(t *testing.T, s storage.Storage) {
+	newUser := model.User{
+		ID:       1,
+		Language: "en",
+	}
+
+	require.NoError(t, s.UpsertUser(ctx, newUser))
+
+	inputDevice := model.Device{
+		Name: "Chrome",
+		Type: model.DeviceWebPush,
+		Address: model.Address{
+			Endpoint: "https://fcm.googleapis.com/fcm/send/abc",
+			P256dh:   "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM",
+			Auth:     "tBHItJI5svbpez7KI4CCXg",
+		},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: true, Frequency: model.Daily, Channel: model.ChannelDevice},
+			model.Wishlist:     {Enabled: true, Frequency: model.Weekly, Channel: model.ChannelInbox},
+		}},
+	}
+
+	newDevice, err := s.AddDevice(ctx, newUser.ID, 0, inputDevice)
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, newDevice.ID)
+	assert.Equal(t, inputDevice.Name, newDevice.Name)
+	assert.Equal(t, inputDevice.Type, newDevice.Type)
+	assert.Equal(t, inputDevice.Address, newDevice.Address)
+	assert.Equal(t, inputDevice.Settings, newDevice.Settings)
+
+	user, err := s.GetUser(ctx, newUser.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), user.Version)
+
+	if assert.NotEmpty(t, user.Devices) {
+		assert.Equal(t, newDevice, user.Devices[0])
+	}
+
+	_, err = model.ParseID(newDevice.ID)
+	assert.NoError(t, err, "device ID must be parsable")
+}
+
+func testGetDevice(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 2, Language: "en"}))
+
+	var devices []model.Device
+	for _, name := range []string{"Chrome", "Firefox"} {
+		d, err := s.AddDevice(ctx, 1, 0, model.Device{
+			Name:     name,
+			Settings: settings(model.PriceChanged, model.Daily),
+		})
+		require.NoError(t, err)
+		devices = append(devices, d)
+	}
+
+	d, err := s.GetDevice(ctx, 1, devices[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, devices[1], d)
+
+	_, err = s.GetDevice(ctx, 2, devices[1].ID)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	_, err = s.GetDevice(ctx, 1, "invalid")
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testDigests(t *testing.T, s storage.Storage) {
+	ds, err := s.GetDigests(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ds)
+
+	createdAt := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	events := []model.Event{
+		{Type: model.PriceChanged, ProductID: 1, OldPrice: 200, NewPrice: 100, CreatedAt: createdAt},
+		{Type: model.PriceChanged, UserIDs: []int64{1}, ProductID: 2, OldPrice: 300, NewPrice: 250, CreatedAt: createdAt.Add(time.Minute)},
+		{Type: model.OrderStatus, UserIDs: []int64{1}, OrderID: "A-1001", Status: model.OrderShipped, CreatedAt: createdAt.Add(2 * time.Minute)},
+		{Type: model.Promotion, ProductID: 3, Discount: 15, CreatedAt: createdAt.Add(3 * time.Minute)},
+		{Type: model.Wishlist, UserIDs: []int64{1}, ProductID: 4, Quantity: 2, CreatedAt: createdAt.Add(4 * time.Minute)},
+	}
+
+	for _, e := range events {
+		require.NoError(t, s.AddToDigest(ctx, 1, "device", e))
+	}
+
+	digest := model.Digest{
+		UserID:    1,
+		DeviceID:  "device",
+		Events:    events,
+		CreatedAt: createdAt,
+	}
+
+	ds, err = s.GetDigests(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Digest{digest}, ds)
+
+	d, err := s.PopDigest(ctx, 1, "device")
+	require.NoError(t, err)
+	assert.Equal(t, digest, d)
+
+	_, err = s.PopDigest(ctx, 1, "device")
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testNotifications(t *testing.T, s storage.Storage) {
+	createdAt := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+
+	var added []model.Notification
+	for i := 0; i < 3; i++ {
+		n, err := s.AddNotification(ctx, model.Notification{
+			UserID:    1,
+			Type:      model.PriceChanged,
+			Title:     "Price changed",
+			Body:      fmt.Sprintf("Product %d price changed from 2.00 to 1.00", i),
+			CreatedAt: createdAt.Add(time.Duration(i) * time.Minute),
+		})
+		require.NoError(t, err)
+		assert.NotEmpty(t, n.ID)
+		added = append(added, n)
+	}
+
+	_, err := s.AddNotification(ctx, model.Notification{UserID: 2, Type: model.PriceChanged, CreatedAt: createdAt})
+	require.NoError(t, err)
+
+	page, err := s.GetNotifications(ctx, 1, model.NotificationQuery{First: 2})
+	require.NoError(t, err)
+	assert.Equal(t, model.NotificationPage{
+		Notifications: []model.Notification{added[2], added[1]},
+		HasNextPage:   true,
+	}, page)
+
+	page, err = s.GetNotifications(ctx, 1, model.NotificationQuery{First: 2, After: added[1].ID})
+	require.NoError(t, err)
+	assert.Equal(t, model.NotificationPage{
+		Notifications: []model.Notification{added[0]},
+	}, page)
+
+	n, err := s.MarkNotificationsRead(ctx, 1, []string{added[0].ID, added[2].ID, "invalid"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = s.MarkNotificationsRead(ctx, 2, []string{added[1].ID})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	page, err = s.GetNotifications(ctx, 1, model.NotificationQuery{First: 10, UnreadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, model.NotificationPage{
+		Notifications: []model.Notification{added[1]},
+	}, page)
+
+	_, err = s.GetNotifications(ctx, 1, model.NotificationQuery{First: 10, After: "invalid"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), fmt.Sprintf("wanted %s got %s", storage.ErrInvalidCursor, err))
+}
+
+func testUpdateDevice(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 2, Language: "en"}))
+
+	var ids []string
+	for _, name := range []string{"Chrome", "Firefox"} {
+		d, err := s.AddDevice(ctx, 1, 0, model.Device{
+			Name:     name,
+			Settings: settings(model.PriceChanged, model.Daily),
+		})
+		require.NoError(t, err)
+		ids = append(ids, d.ID)
+	}
+
+	input := model.Device{
+		ID:      ids[1],
+		Name:    "Firefox Nightly",
+		Type:    model.DeviceWebhook,
+		Address: model.Address{URL: "https://example.com/hooks/gnotify", Secret: "c2VjcmV0"},
+		Settings: model.NotificationSettings{Preferences: map[string]model.Preference{
+			model.PriceChanged: {Enabled: false, Frequency: model.Weekly, Channel: model.ChannelDevice},
+			model.BackInStock:  {Enabled: true, Frequency: model.Hourly, Channel: model.ChannelInbox},
+		}},
+	}
+
+	d, err := s.UpdateDevice(ctx, 1, 0, input)
+	require.NoError(t, err)
+	assert.Equal(t, input, d)
+
+	user, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, user.Devices, 2)
+	assert.Equal(t, "Chrome", user.Devices[0].Name)
+	assert.Equal(t, input, user.Devices[1])
+
+	_, err = s.UpdateDevice(ctx, 2, 0, input)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	input.ID = "invalid"
+	_, err = s.UpdateDevice(ctx, 1, 0, input)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testRemoveDevice(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 2, Language: "en"}))
+
+	var ids []string
+	for _, name := range []string{"Chrome", "Firefox"} {
+		d, err := s.AddDevice(ctx, 1, 0, model.Device{
+			Name:     name,
+			Settings: settings(model.PriceChanged, model.Daily),
+		})
+		require.NoError(t, err)
+		ids = append(ids, d.ID)
+	}
+
+	err := s.RemoveDevice(ctx, 2, 0, ids[0])
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	require.NoError(t, s.RemoveDevice(ctx, 1, 0, ids[0]))
+
+	user, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, user.Devices, 1)
+	assert.Equal(t, "Firefox", user.Devices[0].Name)
+
+	err = s.RemoveDevice(ctx, 1, 0, ids[0])
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	err = s.RemoveDevice(ctx, 1, 0, "invalid")
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testDisableDevice(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 2, Language: "en"}))
+
+	var ids []string
+	for _, name := range []string{"Chrome", "Firefox"} {
+		d, err := s.AddDevice(ctx, 1, 0, model.Device{
+			Name:     name,
+			Settings: settings(model.PriceChanged, model.Daily),
+		})
+		require.NoError(t, err)
+		ids = append(ids, d.ID)
+	}
+
+	err := s.DisableDevice(ctx, 2, ids[0])
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	require.NoError(t, s.DisableDevice(ctx, 1, ids[0]))
+
+	user, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, user.Devices, 2)
+	assert.True(t, user.Devices[0].Disabled)
+	assert.False(t, user.Devices[1].Disabled)
+	assert.Equal(t, int64(4), user.Version)
+
+	d, err := s.GetDevice(ctx, 1, ids[0])
+	require.NoError(t, err)
+	assert.True(t, d.Disabled)
+
+	// update enables device unless input is disabled
+	d.Disabled = false
+	_, err = s.UpdateDevice(ctx, 1, 0, d)
+	require.NoError(t, err)
+
+	d, err = s.GetDevice(ctx, 1, ids[0])
+	require.NoError(t, err)
+	assert.False(t, d.Disabled)
+
+	err = s.DisableDevice(ctx, 1, "invalid")
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testVersion(t *testing.T, s storage.Storage) {
+	require.NoError(t, s.UpsertUser(ctx, model.User{ID: 1, Language: "en"}))
+
+	input := model.Device{
+		Name:     "Chrome",
+		Settings: settings(model.PriceChanged, model.Daily),
+	}
+
+	d, err := s.AddDevice(ctx, 1, 1, input)
+	require.NoError(t, err)
+
+	_, err = s.AddDevice(ctx, 1, 1, input)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	_, err = s.AddDevice(ctx, 100500, 1, input)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	d.Name = "Chrome Beta"
+	_, err = s.UpdateDevice(ctx, 1, 1, d)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	err = s.RemoveDevice(ctx, 1, 1, d.ID)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	user, err := s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), user.Version)
+	require.Len(t, user.Devices, 1, "rejected changes must not be applied")
+	assert.Equal(t, "Chrome", user.Devices[0].Name)
+
+	_, err = s.UpdateDevice(ctx, 1, 2, d)
+	require.NoError(t, err)
+
+	require.NoError(t, s.RemoveDevice(ctx, 1, 3, d.ID))
+
+	user, err = s.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, model.User{ID: 1, Language: "en", Version: 4}, user)
+}
+
+func testDeliveries(t *testing.T, s storage.Storage) {
+	now := time.Date(2021, time.April, 7, 10, 30, 0, 0, time.UTC)
+	timeout := time.Minute
+
+	var added []model.Delivery
+	for i := 0; i < 3; i++ {
+		d, err := s.AddDelivery(ctx, model.Delivery{
+			UserID:   1,
+			DeviceID: "1",
+			Title:    "Price changed",
+			Body:     fmt.Sprintf("Product %d price changed from 2.00 to 1.00", i),
+			Events: []model.Event{
+				{Type: model.PriceChanged, ProductID: int64(i), OldPrice: 200, NewPrice: 100, CreatedAt: now},
+			},
+			State:         model.DeliveryPending,
+			NextAttemptAt: now.Add(time.Duration(i) * time.Second),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+		require.NoError(t, err)
+		assert.NotEmpty(t, d.ID)
+		added = append(added, d)
+	}
+
+	// the last delivery isn't due yet
+	leased, err := s.LeaseDeliveries(ctx, now.Add(time.Second), timeout, 10)
+	require.NoError(t, err)
+	require.Len(t, leased, 2)
+
+	for i, d := range leased {
+		want := added[i]
+		want.State = model.DeliveryInFlight
+		want.Attempts = 1
+		want.NextAttemptAt = now.Add(time.Second + timeout)
+		want.UpdatedAt = now.Add(time.Second)
+		assert.Equal(t, want, d)
+	}
+
+	leased, err = s.LeaseDeliveries(ctx, now.Add(2*time.Second), timeout, 10)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, added[2].ID, leased[0].ID)
+
+	// the first delivery fails and waits for retry
+	d := added[0]
+	d.Attempts = 1
+	d.State = model.DeliveryFailed
+	d.LastError = "unavailable"
+	d.NextAttemptAt = now.Add(time.Hour)
+	d.UpdatedAt = now.Add(3 * time.Second)
+	require.NoError(t, s.UpdateDelivery(ctx, d))
+
+	err = s.UpdateDelivery(ctx, d)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	// lease of the second delivery expires and it's leased again
+	leased, err = s.LeaseDeliveries(ctx, now.Add(time.Second+timeout), timeout, 10)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, added[1].ID, leased[0].ID)
+	assert.Equal(t, 2, leased[0].Attempts)
+
+	// worker which lost the lease can't update delivery
+	stale := leased[0]
+	stale.Attempts = 1
+	stale.State = model.DeliverySucceeded
+	err = s.UpdateDelivery(ctx, stale)
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	dead := leased[0]
+	dead.State = model.DeliveryDead
+	dead.LastError = "gone"
+	require.NoError(t, s.UpdateDelivery(ctx, dead))
+
+	leased, err = s.LeaseDeliveries(ctx, now.Add(2*timeout), timeout, 10)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, added[2].ID, leased[0].ID)
+
+	page, err := s.GetDeliveries(ctx, model.DeliveryQuery{First: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Deliveries, 2)
+	assert.True(t, page.HasNextPage)
+	assert.Equal(t, added[2].ID, page.Deliveries[0].ID)
+	assert.Equal(t, added[1].ID, page.Deliveries[1].ID)
+
+	page, err = s.GetDeliveries(ctx, model.DeliveryQuery{First: 2, After: added[1].ID})
+	require.NoError(t, err)
+	require.Len(t, page.Deliveries, 1)
+	assert.False(t, page.HasNextPage)
+	assert.Equal(t, added[0].ID, page.Deliveries[0].ID)
+
+	page, err = s.GetDeliveries(ctx, model.DeliveryQuery{State: model.DeliveryDead, First: 10})
+	require.NoError(t, err)
+	require.Len(t, page.Deliveries, 1)
+	assert.Equal(t, model.DeliveryDead, page.Deliveries[0].State)
+	assert.Equal(t, "gone", page.Deliveries[0].LastError)
+
+	_, err = s.GetDeliveries(ctx, model.DeliveryQuery{First: 10, After: "invalid"})
+	assert.True(t, errors.Is(err, storage.ErrInvalidCursor), fmt.Sprintf("wanted %s got %s", storage.ErrInvalidCursor, err))
+
+	requeued, err := s.RequeueDelivery(ctx, added[1].ID, now.Add(time.Hour))
+	require.NoError(t, err)
+	want := added[1]
+	want.NextAttemptAt = now.Add(time.Hour)
+	want.UpdatedAt = now.Add(time.Hour)
+	assert.Equal(t, want, requeued)
+
+	_, err = s.RequeueDelivery(ctx, added[1].ID, now.Add(time.Hour))
+	assert.True(t, errors.Is(err, storage.ErrConflict), fmt.Sprintf("wanted %s got %s", storage.ErrConflict, err))
+
+	_, err = s.RequeueDelivery(ctx, model.NewID(), now)
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+
+	// lease of the third delivery expired before the others became due
+	leased, err = s.LeaseDeliveries(ctx, now.Add(time.Hour), timeout, 1)
+	require.NoError(t, err)
+	require.Len(t, leased, 1)
+	assert.Equal(t, added[2].ID, leased[0].ID, "the earliest due delivery must be leased first")
+}
+
+// keysNow returns current time, idempotency keys must not expire during tests,
+// otherwise storages with TTL indexes may delete them.
+func keysNow() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func testIdempotencyKeys(t *testing.T, s storage.Storage) {
+	now := keysNow()
+	// keys are unique, so tests don't depend on keys left by other tests
+	prefix := model.NewID()
+
+	k := model.IdempotencyKey{
+		Key:           prefix + "-price-1-999",
+		EventID:       "1",
+		Event:         model.Event{Type: model.PriceChanged, UserIDs: []int64{1}, ProductID: 1, OldPrice: 1099, NewPrice: 999, CreatedAt: now},
+		AcceptedAt:    now,
+		ExpiresAt:     now.Add(time.Hour),
+		Pending:       true,
+		NextAttemptAt: now,
+	}
+
+	stored, saved, err := s.AddIdempotencyKey(ctx, k)
+	require.NoError(t, err)
+	assert.True(t, saved)
+	assert.Equal(t, k, stored)
+
+	// duplicate gets the original key
+	dup := k
+	dup.EventID, dup.AcceptedAt, dup.ExpiresAt = "2", now.Add(time.Minute), now.Add(time.Hour+time.Minute)
+	stored, saved, err = s.AddIdempotencyKey(ctx, dup)
+	require.NoError(t, err)
+	assert.False(t, saved)
+	assert.Equal(t, k, stored)
+
+	other := k
+	other.Key, other.EventID = prefix+"-price-2-999", "3"
+	_, saved, err = s.AddIdempotencyKey(ctx, other)
+	require.NoError(t, err)
+	assert.True(t, saved)
+
+	// expired key is reused
+	reused := k
+	reused.EventID, reused.AcceptedAt, reused.ExpiresAt, reused.NextAttemptAt = "4", now.Add(time.Hour), now.Add(2*time.Hour), now.Add(time.Hour)
+	stored, saved, err = s.AddIdempotencyKey(ctx, reused)
+	require.NoError(t, err)
+	assert.True(t, saved)
+	assert.Equal(t, reused, stored)
+}
+
+func testEvents(t *testing.T, s storage.Storage) {
+	now := keysNow()
+	prefix := model.NewID()
+
+	keys := make([]model.IdempotencyKey, 3)
+	for i := range keys {
+		keys[i] = model.IdempotencyKey{
+			Key:           fmt.Sprintf("%s-%d", prefix, i),
+			EventID:       fmt.Sprint(i),
+			Event:         model.Event{Type: model.PriceChanged, UserIDs: []int64{1, 2}, ProductID: int64(i + 1), OldPrice: 200, NewPrice: 100, CreatedAt: now},
+			AcceptedAt:    now,
+			ExpiresAt:     now.Add(time.Hour),
+			Pending:       true,
+			NextAttemptAt: now.Add(time.Duration(i) * time.Second),
+		}
+
+		_, saved, err := s.AddIdempotencyKey(ctx, keys[i])
+		require.NoError(t, err)
+		require.True(t, saved)
+	}
+
+	// lease is the next attempt time of leased event
+	lease := func(k model.IdempotencyKey, until time.Time) model.IdempotencyKey {
+		k.NextAttemptAt = until
+		return k
+	}
+
+	leased, err := s.LeaseEvents(ctx, now.Add(time.Second), time.Minute, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []model.IdempotencyKey{
+		lease(keys[0], now.Add(time.Minute+time.Second)),
+		lease(keys[1], now.Add(time.Minute+time.Second)),
+	}, leased)
+
+	// leased events are not due till lease expires
+	leased, err = s.LeaseEvents(ctx, now.Add(2*time.Second), time.Minute, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []model.IdempotencyKey{lease(keys[2], now.Add(time.Minute+2*time.Second))}, leased)
+
+	require.NoError(t, s.MarkEventDispatched(ctx, keys[0].Key))
+
+	// dispatched event is never leased again, expired lease is leased again
+	leased, err = s.LeaseEvents(ctx, now.Add(time.Hour), time.Minute, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []model.IdempotencyKey{lease(keys[1], now.Add(time.Hour+time.Minute))}, leased)
+
+	// duplicate of dispatched event gets it as dispatched
+	dup := keys[0]
+	dup.EventID = "3"
+	stored, saved, err := s.AddIdempotencyKey(ctx, dup)
+	require.NoError(t, err)
+	assert.False(t, saved)
+	keys[0].Pending = false
+	keys[0].NextAttemptAt = now.Add(time.Minute + time.Second)
+	assert.Equal(t, keys[0], stored)
+
+	err = s.MarkEventDispatched(ctx, "missing")
+	assert.True(t, errors.Is(err, storage.ErrNotFound), fmt.Sprintf("wanted %s got %s", storage.ErrNotFound, err))
+}
+
+func testIdempotencyKeysConcurrency(t *testing.T, s storage.Storage) {
+	const goroutines = 20
+
+	now := keysNow()
+	key := model.NewID() + "-price-1-999"
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		saved  []string
+		stored = map[string]bool{}
+	)
+
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			k, ok, err := s.AddIdempotencyKey(ctx, model.IdempotencyKey{
+				Key:        key,
+				EventID:    fmt.Sprint(i),
+				AcceptedAt: now,
+				ExpiresAt:  now.Add(time.Hour),
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if ok {
+				saved = append(saved, k.EventID)
+			}
+			stored[k.EventID] = true
+		}(i)
+	}
+
+	close(start)
+	wg.Wait()
+
+	require.Len(t, saved, 1, "key must be saved exactly once")
+	assert.Equal(t, map[string]bool{saved[0]: true}, stored, "duplicates must get the saved key")
+}